@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/TBPixel/tww-rando-twitch-bot/internal/app"
 	"github.com/TBPixel/tww-rando-twitch-bot/internal/cli"
@@ -14,7 +17,10 @@ func main() {
 		log.Fatalln(err)
 	}
 
-	err = cli.NewApp(*application).Run(os.Args)
+	// commands which run until stopped shut down cleanly once interrupted
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err = cli.NewApp(*application).RunContext(ctx, os.Args)
+	stop()
 	if err != nil {
 		log.Fatalln(err)
 	}
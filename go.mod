@@ -6,6 +6,8 @@ require (
 	github.com/dgraph-io/badger v1.6.0
 	github.com/gempir/go-twitch-irc/v2 v2.6.0
 	github.com/joho/godotenv v1.3.0
+	github.com/lib/pq v1.10.9
+	github.com/mattn/go-sqlite3 v1.14.16
 	github.com/timshannon/badgerhold v1.0.0
 	github.com/urfave/cli/v2 v2.3.0
 )
@@ -20,7 +22,7 @@ require (
 	github.com/google/uuid v1.3.0
 	github.com/gorilla/websocket v1.4.2
 	github.com/nirasan/go-oauth-pkce-code-verifier v0.0.0-20170819232839-0fbfe93532da // indirect
-	github.com/pkg/errors v0.9.1 // indirect
+	github.com/pkg/errors v0.9.1
 	github.com/russross/blackfriday/v2 v2.0.1 // indirect
 	github.com/shurcooL/sanitized_anchor_name v1.0.0 // indirect
 	github.com/skratchdot/open-golang v0.0.0-20200116055534-eef842397966
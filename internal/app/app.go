@@ -9,8 +9,10 @@ import (
 
 type App struct {
 	TwitchClient *twitch.ApiClient
-	DB           *storage.DB
+	DB           storage.Store
 	Bot          *twitch.Bot
+	EventSub     *twitch.EventSub
+	UserTokens   *twitch.UserTokens
 	Config       config.App
 }
 
@@ -25,16 +27,27 @@ func New() (*App, error) {
 		return nil, err
 	}
 
-	bot := twitch.NewBot(conf.Twitch, db, conf.Racetime.URL)
 	ttvClient, err := twitch.NewApiClient(conf.Twitch)
 	if err != nil {
 		return nil, err
 	}
+	bot := twitch.NewBot(conf.Twitch, db, ttvClient, conf.Racetime.URL)
+
+	// eventsub is optional, as it needs a publicly reachable callback
+	var eventSub *twitch.EventSub
+	if conf.Twitch.EventSub.Enabled() {
+		eventSub, err = twitch.NewEventSub(conf.Twitch.EventSub.Secret)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	return &App{
 		TwitchClient: ttvClient,
 		DB:           db,
 		Bot:          bot,
+		EventSub:     eventSub,
+		UserTokens:   twitch.NewUserTokens(conf.Twitch, db),
 		Config:       conf,
 	}, nil
 }
@@ -3,11 +3,12 @@ package cli
 import (
 	"fmt"
 	"log"
-	"strings"
+	"time"
 
 	"github.com/TBPixel/tww-rando-twitch-bot/internal/app"
 	"github.com/TBPixel/tww-rando-twitch-bot/internal/races"
 	"github.com/TBPixel/tww-rando-twitch-bot/internal/storage"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/twitch"
 	"github.com/urfave/cli/v2"
 )
 
@@ -23,21 +24,100 @@ func twwrBot(app app.App) cli.ActionFunc {
 		log.Printf("racetime monitor watching all races in %s", category)
 		go monitor.Listen(ctx.Context)
 
-		users, err := app.DB.FindUsers(storage.UserQuery{
-			Field: storage.FieldActiveInChannel,
-			Value: true,
-		})
-		if err != nil {
-			return err
+		var events chan twitch.StreamEvent
+		if app.EventSub != nil {
+			go func() {
+				err := serveEventSub(ctx.Context, app)
+				if err != nil {
+					log.Printf("eventsub: %s", err)
+				}
+			}()
+
+			err := subscribeFollowedChannels(app)
+			if err != nil {
+				log.Printf("eventsub: %s", err)
+			}
+
+			events = app.EventSub.AddListener()
+			defer app.EventSub.RemoveListener(events)
+			log.Printf("bot joining followed twitch channels as eventsub reports them live")
+		} else {
+			log.Printf("bot joining followed twitch channels as polling finds them live")
+		}
+
+		if app.Config.DB.BackupDir != "" {
+			if db, ok := app.DB.(*storage.BadgerStore); ok {
+				go db.RunBackups(ctx.Context, app.Config.DB.BackupDir, app.Config.DB.BackupInterval, app.Config.DB.BackupKeep)
+				log.Printf("backing up the database to %s every %s", app.Config.DB.BackupDir, app.Config.DB.BackupInterval)
+			} else {
+				log.Printf("DB_BACKUP_DIR is only supported by the %s driver, skipping backups", storage.DriverBadger)
+			}
+		}
+
+		history := races.NewHistory(app.Config.Racetime, app.DB)
+		historyListener := monitor.AddListener()
+		defer monitor.RemoveListener(historyListener)
+		go history.Run(ctx.Context, historyListener)
+
+		presence := twitch.NewPresence(app.Config.Twitch, app.Bot, app.TwitchClient, app.DB)
+		go presence.Run(ctx.Context, events)
+
+		markers := twitch.NewMarkers(app.TwitchClient, app.UserTokens, app.DB)
+		markersListener := monitor.AddListener()
+		defer monitor.RemoveListener(markersListener)
+		go markers.Run(ctx.Context, markersListener)
+
+		titles := twitch.NewTitles(app.TwitchClient, app.UserTokens, app.DB)
+		titlesListener := monitor.AddListener()
+		defer monitor.RemoveListener(titlesListener)
+		go titles.Run(ctx.Context, titlesListener)
+
+		predictions := twitch.NewPredictions(app.Config.Twitch, app.TwitchClient, app.UserTokens, app.DB)
+		predictionsListener := monitor.AddListener()
+		defer monitor.RemoveListener(predictionsListener)
+		go predictions.Run(ctx.Context, predictionsListener)
+
+		// clip links can only be shared in race rooms this process has joined
+		var rooms twitch.RaceRooms
+		if ctx.Bool("racetime-rooms") {
+			manager, err := newRoomManager(app, ctx.Int("max-rooms"))
+			if err != nil {
+				return err
+			}
+			roomsListener := monitor.AddListener()
+			defer monitor.RemoveListener(roomsListener)
+			// rooms are only closed cleanly if the manager is waited on
+			done := make(chan struct{})
+			defer func() {
+				<-done
+			}()
+			go func() {
+				defer close(done)
+				manager.Run(ctx.Context, roomsListener)
+			}()
+			rooms = manager
+			log.Printf("racetime bot joining races for category %s", category)
 		}
-		var channels []string
-		for _, u := range users {
-			channels = append(channels, u.TwitchName)
+
+		clips := twitch.NewClips(app.Config.Twitch, app.TwitchClient, app.UserTokens, app.DB, app.Bot, rooms)
+		clipsListener := monitor.AddListener()
+		defer monitor.RemoveListener(clipsListener)
+		go clips.Run(ctx.Context, clipsListener)
+
+		shoutouts := twitch.NewShoutouts(app.TwitchClient, app.UserTokens, app.DB, app.Bot)
+		shoutoutsListener := monitor.AddListener()
+		defer monitor.RemoveListener(shoutoutsListener)
+		go shoutouts.Run(ctx.Context, shoutoutsListener)
+
+		if retention := app.Config.Twitch.CommandLogRetention; retention > 0 {
+			go twitch.PruneCommandLogs(ctx.Context, app.DB, retention, time.Hour)
 		}
 
-		app.Bot.Join(channels...)
+		announcements := twitch.NewAnnouncements(app.DB, app.Bot, app.Config.Racetime.URL)
+		announcementsListener := monitor.AddListener()
+		defer monitor.RemoveListener(announcementsListener)
+		go announcements.Run(ctx.Context, announcementsListener)
 
-		log.Printf("bot listening to all active twitch channels: %s", strings.Join(channels, ", "))
 		app.Bot.Listen(ctx.Context, listener)
 
 		return nil
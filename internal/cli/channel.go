@@ -0,0 +1,67 @@
+package cli
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/app"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/storage"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/twitch"
+	"github.com/urfave/cli/v2"
+)
+
+func channelConfig(app app.App) cli.ActionFunc {
+	return func(ctx *cli.Context) error {
+		idStr := ctx.Args().First()
+		if idStr == "" {
+			return fmt.Errorf("missing required argument: account_id")
+		}
+
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			return fmt.Errorf("account_id must be an unsigned integer")
+		}
+
+		user, err := app.DB.FindUser(storage.Where(storage.FieldID).Eq(uint64(id)))
+		if err != nil {
+			return err
+		}
+
+		settings, err := twitch.ChannelSettingsFor(app.DB, *user)
+		if err != nil {
+			return err
+		}
+
+		if ctx.NArg() == 1 {
+			for _, s := range twitch.Settings {
+				fmt.Printf("%-26s %-14s %s\n", s.Key, s.Get(settings), s.Description)
+			}
+
+			return nil
+		}
+
+		setting, ok := twitch.FindSetting(ctx.Args().Get(1))
+		if !ok {
+			return fmt.Errorf("unknown setting %s, settings are: %s", ctx.Args().Get(1), strings.Join(twitch.SettingKeys(), ", "))
+		}
+		if ctx.NArg() == 2 {
+			fmt.Println(setting.Get(settings))
+			return nil
+		}
+
+		err = setting.Set(&settings, strings.Join(ctx.Args().Slice()[2:], " "))
+		if err != nil {
+			return err
+		}
+		_, err = app.DB.SaveChannelSettings(settings)
+		if err != nil {
+			return err
+		}
+
+		log.Printf("%s set to %s for channel %s", setting.Key, setting.Get(settings), user.TwitchName)
+
+		return nil
+	}
+}
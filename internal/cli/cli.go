@@ -1,6 +1,8 @@
 package cli
 
 import (
+	"time"
+
 	"github.com/TBPixel/tww-rando-twitch-bot/internal/app"
 	"github.com/urfave/cli/v2"
 )
@@ -34,6 +36,150 @@ func NewApp(app app.App) *cli.App {
 						},
 						Action: twitchFollow(app),
 					},
+					{
+						Name:        "title",
+						Description: "Opt a channel into stream titles and category set from its races",
+						ArgsUsage:   "account_id",
+						Flags: []cli.Flag{
+							&cli.BoolFlag{
+								Name:    "disable",
+								Aliases: []string{"d"},
+								Usage:   "stop setting the stream title of the channel",
+							},
+							&cli.StringFlag{
+								Name:  "template",
+								Usage: "title template using {preset}, {goal}, {race} and {opponents}",
+							},
+						},
+						Action: twitchTitle(app),
+					},
+					{
+						Name:        "predictions",
+						Description: "channel predictions run on a channel's races",
+						Subcommands: []*cli.Command{
+							{
+								Name:        "set",
+								Description: "Opt a channel into predictions opened when its races start",
+								ArgsUsage:   "account_id",
+								Flags: []cli.Flag{
+									&cli.BoolFlag{
+										Name:    "disable",
+										Aliases: []string{"d"},
+										Usage:   "stop running predictions on the channel's races",
+									},
+									&cli.IntFlag{
+										Name:  "top",
+										Usage: "predict whether the streamer finishes within this place",
+									},
+									&cli.DurationFlag{
+										Name:  "target",
+										Usage: "predict whether the streamer beats this time instead, such as 1h30m",
+									},
+								},
+								Action: twitchPredictionsSet(app),
+							},
+							{
+								Name:        "history",
+								Description: "list the predictions run on a channel's races",
+								ArgsUsage:   "account_id",
+								Action:      twitchPredictionsHistory(app),
+							},
+						},
+					},
+					{
+						Name:        "clips",
+						Description: "clips of a channel finishing races",
+						Subcommands: []*cli.Command{
+							{
+								Name:        "set",
+								Description: "Opt a channel into clips created when it finishes a race",
+								ArgsUsage:   "account_id",
+								Flags: []cli.Flag{
+									&cli.BoolFlag{
+										Name:    "disable",
+										Aliases: []string{"d"},
+										Usage:   "stop clipping the channel",
+									},
+									&cli.BoolFlag{
+										Name:  "chat",
+										Usage: "post clip links in twitch chat",
+									},
+									&cli.BoolFlag{
+										Name:  "racetime",
+										Usage: "post clip links in the racetime room",
+									},
+								},
+								Action: twitchClipsSet(app),
+							},
+							{
+								Name:        "list",
+								Description: "list the clips created of a channel",
+								ArgsUsage:   "account_id",
+								Action:      twitchClipsList(app),
+							},
+						},
+					},
+					{
+						Name:        "shoutouts",
+						Description: "Opt a channel into shoutouts of its live opponents once a race finishes",
+						ArgsUsage:   "account_id",
+						Flags: []cli.Flag{
+							&cli.BoolFlag{
+								Name:    "disable",
+								Aliases: []string{"d"},
+								Usage:   "stop shouting out the channel's opponents",
+							},
+						},
+						Action: twitchShoutouts(app),
+					},
+					{
+						Name:        "unlink",
+						Description: "Revoke the twitch token a channel has granted the bot",
+						ArgsUsage:   "account_id",
+						Action:      twitchUnlink(app),
+					},
+					{
+						Name:        "scopes",
+						Description: "list the twitch scopes each channel has granted the bot",
+						Action:      twitchScopes(app),
+					},
+					{
+						Name:        "channels",
+						Description: "list the live and joined state of followed channels",
+						Action:      twitchChannels(app),
+					},
+					{
+						Name:        "multi",
+						Description: "Choose how !twwr multi builds links for a channel",
+						ArgsUsage:   "account_id",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "provider",
+								Usage: "multistream site to link to (multitwitch, kadgar or twitchtheater)",
+							},
+							&cli.BoolFlag{
+								Name:  "hide-finished",
+								Usage: "leave racers who have finished or forfeited out of the link",
+							},
+						},
+						Action: twitchMulti(app),
+					},
+					{
+						Name:        "eventsub",
+						Description: "twitch eventsub webhook commands",
+						Subcommands: []*cli.Command{
+							{
+								Name:        "subscribe",
+								Description: "subscribe to stream online and offline events of every followed channel",
+								Action:      twitchEventSubSubscribe(app),
+							},
+							{
+								Name:        "list",
+								Description: "list the eventsub subscriptions of the bot",
+								Action:      twitchEventSubList(app),
+							},
+						},
+					},
 				},
 			},
 			{
@@ -104,13 +250,142 @@ func NewApp(app app.App) *cli.App {
 							},
 						},
 					},
+					{
+						Name:        "history",
+						Description: "list the races recorded while the bot was running",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "racer",
+								Usage: "only list the races of this racetime user id",
+							},
+						},
+						Action: racetimeHistory(app),
+					},
+					{
+						Name:        "bot",
+						Description: "racetime.gg race room bot commands",
+						Subcommands: []*cli.Command{
+							{
+								Name:        "run",
+								Description: "join every open race room of a category and report the connection status",
+								ArgsUsage:   "category",
+								Flags: []cli.Flag{
+									&cli.IntFlag{
+										Name:  "max-rooms",
+										Usage: "maximum number of race rooms to join at once",
+										Value: app.Config.Racetime.MaxRooms,
+									},
+								},
+								Action: racetimeBotRun(app),
+							},
+						},
+					},
+				},
+			},
+			{
+				Name:        "db",
+				Description: "database export, import, backup, restore and key rotation commands",
+				Subcommands: []*cli.Command{
+					{
+						Name:        "export",
+						Description: "Write every record of the database as JSON Lines, to stdout when the file is -",
+						ArgsUsage:   "file",
+						Action:      dbExport(app),
+					},
+					{
+						Name:        "import",
+						Description: "Read an export into an empty database, validating all of it before anything is written",
+						ArgsUsage:   "file",
+						Action:      dbImport(app),
+					},
+					{
+						Name:        "backup",
+						Description: "Back up the badger database while the bot keeps running",
+						ArgsUsage:   "file",
+						Action:      dbBackup(app),
+					},
+					{
+						Name:        "restore",
+						Description: "Replace the badger database with a backup once it has been validated",
+						ArgsUsage:   "file",
+						Action:      dbRestore(app),
+					},
+					{
+						Name:        "rotate-key",
+						Description: "Rewrap every stored token with the key in a key file, while the bot is stopped",
+						ArgsUsage:   "key_file",
+						Flags: []cli.Flag{
+							&cli.BoolFlag{
+								Name:  "generate",
+								Usage: "generate a new key into the key file, which must not exist yet",
+							},
+						},
+						Action: dbRotateKey(app),
+					},
+				},
+			},
+			{
+				Name:        "channel",
+				Description: "commands for administering the bot's behaviour in a channel",
+				Subcommands: []*cli.Command{
+					{
+						Name:        "config",
+						Description: "List a channel's settings, show one setting, or set one to a value",
+						ArgsUsage:   "account_id [setting] [value]",
+						Action:      channelConfig(app),
+					},
+				},
+			},
+			{
+				Name:        "stats",
+				Description: "usage statistics of the bot",
+				Subcommands: []*cli.Command{
+					{
+						Name:        "commands",
+						Description: "Report chat command usage by channel and by command over a time window",
+						Flags: []cli.Flag{
+							&cli.DurationFlag{
+								Name:  "since",
+								Value: time.Hour * 24 * 7,
+								Usage: "how far back to report, such as 24h",
+							},
+							&cli.StringFlag{
+								Name:  "channel",
+								Usage: "only report the commands of this twitch channel",
+							},
+						},
+						Action: statsCommands(app),
+					},
+				},
+			},
+			{
+				Name:        "users",
+				Description: "commands for administering users",
+				Subcommands: []*cli.Command{
+					{
+						Name:        "merge",
+						Description: "Consolidate a duplicate user into another, moving its linked accounts, channel state, predictions and clips",
+						ArgsUsage:   "keep_id duplicate_id",
+						Action:      usersMerge(app),
+					},
 				},
 			},
 			{
 				Name:      "bot",
 				Usage:     "Run the Wind Waker Randomizer Twitch bot from the command line",
 				ArgsUsage: "category",
-				Action:    twwrBot(app),
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "racetime-rooms",
+						Usage: "also join race rooms as the racetime bot, so clip links can be posted in them",
+					},
+					&cli.IntFlag{
+						Name:  "max-rooms",
+						Usage: "maximum number of race rooms to join at once",
+						Value: app.Config.Racetime.MaxRooms,
+					},
+				},
+				Action: twwrBot(app),
 			},
 		},
 	}
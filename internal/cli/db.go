@@ -0,0 +1,176 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/app"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/storage"
+	"github.com/urfave/cli/v2"
+)
+
+func dbExport(app app.App) cli.ActionFunc {
+	return func(ctx *cli.Context) error {
+		path := ctx.Args().First()
+		if path == "" {
+			return fmt.Errorf("missing required argument: file")
+		}
+
+		var w io.Writer = os.Stdout
+		if path != "-" {
+			// exports carry sealed tokens, so they are kept from other users like the database is
+			f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+
+		stats, err := storage.Export(app.DB, w)
+		if err != nil {
+			return err
+		}
+		logStats("exported", stats)
+
+		return nil
+	}
+}
+
+func dbImport(app app.App) cli.ActionFunc {
+	return func(ctx *cli.Context) error {
+		path := ctx.Args().First()
+		if path == "" {
+			return fmt.Errorf("missing required argument: file")
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		stats, err := storage.Import(app.DB, f)
+		logStats("imported", stats)
+		if err != nil {
+			return err
+		}
+
+		return nil
+	}
+}
+
+func dbBackup(app app.App) cli.ActionFunc {
+	return func(ctx *cli.Context) error {
+		path := ctx.Args().First()
+		if path == "" {
+			return fmt.Errorf("missing required argument: file")
+		}
+
+		db, ok := app.DB.(*storage.BadgerStore)
+		if !ok {
+			return fmt.Errorf("backups are only supported by the %s driver, use db export or your database's own tools instead", storage.DriverBadger)
+		}
+
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		err = db.Backup(f)
+		if err != nil {
+			return err
+		}
+		log.Printf("database backed up to %s", path)
+
+		return nil
+	}
+}
+
+func dbRestore(app app.App) cli.ActionFunc {
+	return func(ctx *cli.Context) error {
+		path := ctx.Args().First()
+		if path == "" {
+			return fmt.Errorf("missing required argument: file")
+		}
+
+		db, ok := app.DB.(*storage.BadgerStore)
+		if !ok {
+			return fmt.Errorf("restores are only supported by the %s driver, use db import or your database's own tools instead", storage.DriverBadger)
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		err = db.Restore(f)
+		if err != nil {
+			return err
+		}
+		log.Printf("database restored from %s", path)
+
+		return nil
+	}
+}
+
+func dbRotateKey(app app.App) cli.ActionFunc {
+	return func(ctx *cli.Context) error {
+		path := ctx.Args().First()
+		if path == "" {
+			return fmt.Errorf("missing required argument: key_file")
+		}
+
+		if ctx.Bool("generate") {
+			key, err := storage.GenerateKey()
+			if err != nil {
+				return err
+			}
+
+			// never overwrite a key file, as secrets may still be sealed with its key
+			f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintln(f, key)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return err
+			}
+			log.Printf("generated a new database encryption key in %s", path)
+		}
+
+		key, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		n, err := app.DB.RotateEncryptionKey(string(key))
+		if err != nil {
+			return err
+		}
+		log.Printf("rewrapped %d secrets, set DB_ENCRYPTION_KEY_FILE=%s in place of the old key before starting the bot", n, path)
+
+		return nil
+	}
+}
+
+func logStats(action string, stats storage.ExportStats) {
+	var types []string
+	for t := range stats {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+
+	for _, t := range types {
+		log.Printf("%s %d %s records", action, stats[t], t)
+	}
+}
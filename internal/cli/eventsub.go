@@ -0,0 +1,94 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/app"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/storage"
+	"github.com/urfave/cli/v2"
+)
+
+var errEventSubDisabled = fmt.Errorf("eventsub is not configured, set TWITCH_EVENTSUB_SECRET and TWITCH_EVENTSUB_CALLBACK_URL")
+
+func twitchEventSubSubscribe(app app.App) cli.ActionFunc {
+	return func(ctx *cli.Context) error {
+		if app.EventSub == nil {
+			return errEventSubDisabled
+		}
+
+		return subscribeFollowedChannels(app)
+	}
+}
+
+func twitchEventSubList(app app.App) cli.ActionFunc {
+	return func(ctx *cli.Context) error {
+		subscriptions, err := app.TwitchClient.GetEventSubSubscriptions()
+		if err != nil {
+			return err
+		}
+
+		for _, s := range subscriptions {
+			log.Printf("%s %s for %s (%s) -> %s", s.ID, s.Type, s.Condition.BroadcasterUserID, s.Status, s.Transport.Callback)
+		}
+
+		return nil
+	}
+}
+
+// subscribeFollowedChannels subscribes to the stream events of every followed channel
+func subscribeFollowedChannels(app app.App) error {
+	users, err := app.DB.FindUsers(storage.ActiveChannels())
+	if err != nil {
+		return err
+	}
+
+	var ids []string
+	for _, u := range users {
+		ids = append(ids, u.TwitchID)
+	}
+
+	conf := app.Config.Twitch.EventSub
+	err = app.TwitchClient.SubscribeStreamEvents(ids, conf.CallbackURL, conf.Secret)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("eventsub subscribed to stream events of %d channels", len(ids))
+	return nil
+}
+
+// serveEventSub receives eventsub webhooks until the context ends
+func serveEventSub(ctx context.Context, app app.App) error {
+	callback, err := url.Parse(app.Config.Twitch.EventSub.CallbackURL)
+	if err != nil {
+		return err
+	}
+
+	path := callback.Path
+	if path == "" {
+		path = "/"
+	}
+	mux := http.NewServeMux()
+	mux.Handle(path, app.EventSub)
+
+	server := &http.Server{
+		Addr:    app.Config.Twitch.EventSub.Addr,
+		Handler: mux,
+	}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	log.Printf("eventsub listening on %s%s", server.Addr, path)
+	err = server.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		return err
+	}
+
+	return nil
+}
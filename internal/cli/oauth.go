@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"html"
 	"io"
 	"log"
 	"net"
@@ -13,6 +14,7 @@ import (
 	"strings"
 
 	"github.com/TBPixel/tww-rando-twitch-bot/internal/config"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/twitch"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/skratchdot/open-golang/open"
@@ -21,6 +23,11 @@ import (
 
 type tokenParserFunc func(config config.App, reader io.ReadCloser) (interface{}, error)
 
+// scopedToken is implemented by parsed tokens which know the scopes they were granted
+type scopedToken interface {
+	GrantedScopes() []string
+}
+
 // authorizeUser implements the OAuth2 flow.
 func authorizeUser(ctx *cli.Context, config config.App, authUrl, tokenUrl, clientID, clientSecret, redirectURL string, scopes []string, parserFunc tokenParserFunc) {
 
@@ -72,14 +79,24 @@ func authorizeUser(ctx *cli.Context, config config.App, authUrl, tokenUrl, clien
 		}
 		ctx.Context = context.WithValue(ctx.Context, "token", contents)
 
+		var granted string
+		if scoped, ok := contents.(scopedToken); ok {
+			granted = "<p>Granted scopes:</p><ul>"
+			for _, s := range scoped.GrantedScopes() {
+				granted += fmt.Sprintf("<li>%s</li>", html.EscapeString(s))
+			}
+			granted += "</ul>"
+		}
+
 		// return an indication of success to the caller
-		io.WriteString(w, `
+		io.WriteString(w, fmt.Sprintf(`
 		<html>
 			<body>
 				<h1>Login successful!</h1>
 				<h2>You can close this window and return to the twwr CLI.</h2>
+				%s
 			</body>
-		</html>`)
+		</html>`, granted))
 
 		fmt.Println("Successfully logged into twitch API.")
 
@@ -118,6 +135,11 @@ type TwitchAccessTokenContents struct {
 	UserID            string  `json:"user_id"`
 	ExpiresAt         float64 `json:"expires_in"`
 	PreferredUsername string  `json:"preferred_username"`
+	Grant             twitch.TokenGrant
+}
+
+func (t TwitchAccessTokenContents) GrantedScopes() []string {
+	return t.Grant.Scope
 }
 
 type RacetimeAccessTokenContents struct {
@@ -162,29 +184,28 @@ func cleanup(server *http.Server) {
 
 func twitchTokenParserFunc(_ config.App, reader io.ReadCloser) (interface{}, error) {
 	defer reader.Close()
-	var responseBody map[string]interface{}
+	var grant twitch.TokenGrant
 
-	// unmarshal the json into a string map
-	err := json.NewDecoder(reader).Decode(&responseBody)
+	err := json.NewDecoder(reader).Decode(&grant)
 	if err != nil {
 		fmt.Printf("twitch: JSON error: %s", err)
 		return nil, err
 	}
 
-	tkn, _, err := new(jwt.Parser).ParseUnverified(responseBody["id_token"].(string), jwt.MapClaims{})
+	tkn, _, err := new(jwt.Parser).ParseUnverified(grant.IDToken, jwt.MapClaims{})
 	if err != nil {
 		return nil, err
 	}
 
-	var contents TwitchAccessTokenContents
+	contents := TwitchAccessTokenContents{
+		Grant: grant,
+	}
 	if claims, ok := tkn.Claims.(jwt.MapClaims); ok {
-		contents = TwitchAccessTokenContents{
-			PreferredUsername: claims["preferred_username"].(string),
-			UserID:            claims["sub"].(string),
-			ExpiresAt:         claims["exp"].(float64),
-		}
+		contents.PreferredUsername = claims["preferred_username"].(string)
+		contents.UserID = claims["sub"].(string)
+		contents.ExpiresAt = claims["exp"].(float64)
 	} else {
-		log.Printf("failed to parse claims from token: %s", responseBody["access_token"])
+		log.Printf("failed to parse claims from id token of user")
 	}
 
 	// retrieve the access token out of the map, and return to caller
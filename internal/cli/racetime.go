@@ -1,6 +1,7 @@
 package cli
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"strconv"
@@ -12,6 +13,7 @@ import (
 
 	"github.com/TBPixel/tww-rando-twitch-bot/internal/app"
 	"github.com/TBPixel/tww-rando-twitch-bot/internal/racetime"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/twitch"
 	"github.com/urfave/cli/v2"
 )
 
@@ -29,10 +31,7 @@ func racetimeConnect(app app.App) cli.ActionFunc {
 			return err
 		}
 
-		user, err := app.DB.FindUser(storage.UserQuery{
-			Field: storage.FieldID,
-			Value: uint64(id),
-		})
+		user, err := app.DB.FindUser(storage.Where(storage.FieldID).Eq(uint64(id)))
 		if err != nil {
 			return err
 		}
@@ -56,6 +55,15 @@ func racetimeConnect(app app.App) cli.ActionFunc {
 		user, err = app.DB.UpdateUser(user.ID, storage.UserUpdate{
 			RacetimeID: &tkn.ID,
 		})
+		if err != nil {
+			var conflict *storage.ConflictError
+			if errors.As(err, &conflict) {
+				return fmt.Errorf("racetime account %s is already linked to user %d, merge the users with `twwr users merge %d %d` if they are the same streamer",
+					tkn.ID, conflict.UserID, id, conflict.UserID)
+			}
+
+			return err
+		}
 
 		log.Printf("%+v\n", user)
 
@@ -180,3 +188,89 @@ func racetimeCategoryMonitor(app app.App) cli.ActionFunc {
 		}
 	}
 }
+
+func racetimeHistory(app app.App) cli.ActionFunc {
+	return func(ctx *cli.Context) error {
+		var history []*storage.Race
+		var err error
+		if racer := ctx.String("racer"); racer != "" {
+			history, err = app.DB.FindEntrantRaces(racer)
+		} else {
+			history, err = app.DB.FindRaces(storage.All().SortBy(storage.FieldOpenedAt).Reverse())
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, r := range history {
+			log.Printf("%s/%s %s %s (%s) opened %s, %d entrants", r.Category, r.Slug, r.Status, r.Goal, r.Preset,
+				r.OpenedAt.Format(time.RFC3339), len(r.Entrants))
+			for _, e := range r.Entrants {
+				if e.Place > 0 {
+					log.Printf("  %d. %s %s (%+d)", e.Place, e.Name, e.FinishTime, e.ScoreChange)
+				} else {
+					log.Printf("  %s %s", e.Name, e.Status)
+				}
+			}
+		}
+
+		return nil
+	}
+}
+
+// newRoomManager creates a manager joining race rooms as the racetime bot
+func newRoomManager(app app.App, maxRooms int) (*races.RoomManager, error) {
+	bot, err := racetime.NewBot(app.Config.Racetime, racetime.Options{})
+	if err != nil {
+		return nil, err
+	}
+
+	commands := twitch.NewRoomCommands(app.DB)
+	return races.NewRoomManager(bot, maxRooms, func(race racetime.RaceData) racetime.Handler {
+		return racetime.Handlers{
+			racetime.NewCommandHandler(app.Config.Racetime.CommandCooldown, commands),
+			races.NewRoomInfoHandler(),
+		}
+	}), nil
+}
+
+func racetimeBotRun(app app.App) cli.ActionFunc {
+	return func(ctx *cli.Context) error {
+		category := ctx.Args().First()
+		if category == "" {
+			return fmt.Errorf("missing required argument: category")
+		}
+
+		manager, err := newRoomManager(app, ctx.Int("max-rooms"))
+		if err != nil {
+			return err
+		}
+
+		monitor := races.NewMonitor(app.Config.Racetime, category)
+		listener := monitor.AddListener()
+		defer monitor.RemoveListener(listener)
+
+		go monitor.Listen(ctx.Context)
+		// rooms are only closed cleanly if the manager is waited on
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			manager.Run(ctx.Context, listener)
+		}()
+
+		log.Printf("racetime bot joining races for category %s", category)
+		for {
+			select {
+			case <-time.After(app.Config.Racetime.RaceRefreshInterval):
+				rooms := manager.Rooms()
+				log.Printf("racetime bot connected to %d race rooms", len(rooms))
+				for _, r := range rooms {
+					log.Printf("  %s", r)
+				}
+			case <-ctx.Context.Done():
+				<-done
+				return nil
+			}
+		}
+	}
+}
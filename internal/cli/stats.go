@@ -0,0 +1,65 @@
+package cli
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/app"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/storage"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/twitch"
+	"github.com/urfave/cli/v2"
+)
+
+func statsCommands(app app.App) cli.ActionFunc {
+	return func(ctx *cli.Context) error {
+		since := time.Now().Add(-ctx.Duration("since"))
+		query := storage.Where(storage.FieldCreatedAt).Ge(since)
+		if channel := strings.ToLower(ctx.String("channel")); channel != "" {
+			query = query.And(storage.FieldChannel).Eq(channel)
+		}
+
+		logs, err := app.DB.FindCommandLogs(query.SortBy(storage.FieldCreatedAt))
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%d commands since %s\n", len(logs), since.Format(time.RFC3339))
+		printCommandUsage("channel", twitch.SummarizeCommands(logs, func(l *storage.CommandLog) string {
+			return l.Channel
+		}))
+		printCommandUsage("command", twitch.SummarizeCommands(logs, func(l *storage.CommandLog) string {
+			return l.Command
+		}))
+
+		return nil
+	}
+}
+
+var commandOutcomes = []string{
+	storage.CommandAnswered,
+	storage.CommandCooldown,
+	storage.CommandPermission,
+	storage.CommandNotInRace,
+	storage.CommandDisabled,
+}
+
+func printCommandUsage(by string, usage []twitch.CommandUsage) {
+	if len(usage) == 0 {
+		return
+	}
+
+	fmt.Printf("\n%-20s %7s", by, "total")
+	for _, o := range commandOutcomes {
+		fmt.Printf(" %11s", o)
+	}
+	fmt.Printf(" %10s\n", "latency")
+
+	for _, u := range usage {
+		fmt.Printf("%-20s %7d", u.Key, u.Total)
+		for _, o := range commandOutcomes {
+			fmt.Printf(" %11d", u.Outcomes[o])
+		}
+		fmt.Printf(" %10s\n", u.AverageLatency.Round(time.Millisecond))
+	}
+}
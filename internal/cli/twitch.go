@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"log"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/TBPixel/tww-rando-twitch-bot/internal/storage"
 
@@ -16,15 +18,20 @@ import (
 
 func twitchLogin(app app.App) cli.ActionFunc {
 	return func(ctx *cli.Context) error {
+		// the granted token is stored encrypted, so fail before the user goes through the oauth flow for nothing
+		if app.Config.DB.EncryptionKey == "" && app.Config.DB.EncryptionKeyFile == "" {
+			return fmt.Errorf("twitch login stores the granted token encrypted, set DB_ENCRYPTION_KEY or DB_ENCRYPTION_KEY_FILE first: %w", storage.ErrNoEncryptionKey)
+		}
+
 		authorizeUser(
 			ctx,
 			app.Config,
 			twitch.AuthURL,
-			twitch.TokenURL,
+			app.Config.Twitch.TokenURL,
 			app.Config.Twitch.ClientID,
 			app.Config.Twitch.ClientSecret,
 			app.Config.Twitch.RedirectURL,
-			[]string{"openid"},
+			twitch.LoginScopes(app.Config.Twitch),
 			twitchTokenParserFunc)
 		token, ok := ctx.Context.Value("token").(TwitchAccessTokenContents)
 		if !ok {
@@ -35,10 +42,7 @@ func twitchLogin(app app.App) cli.ActionFunc {
 			return err
 		}
 
-		user, err := app.DB.FindUser(storage.UserQuery{
-			Field: storage.FieldTwitchID,
-			Value: ttvUser.ID,
-		})
+		user, err := app.DB.FindUser(storage.Where(storage.FieldTwitchID).Eq(ttvUser.ID))
 		if err != nil {
 			if err != storage.ErrNotFound {
 				return err
@@ -51,6 +55,12 @@ func twitchLogin(app app.App) cli.ActionFunc {
 			log.Printf("new user created with id %d for ttv %s", user.ID, user.TwitchName)
 		}
 
+		user, err = app.DB.SaveTwitchToken(user.ID, *token.Grant.Token())
+		if err != nil {
+			return err
+		}
+		log.Printf("ttv %s granted scopes: %s", user.TwitchName, strings.Join(user.TwitchScopes, " "))
+
 		log.Printf("%+v\n", user)
 
 		return nil
@@ -79,6 +89,338 @@ func twitchFollow(app app.App) cli.ActionFunc {
 
 		log.Printf("twitch bot follow mode set to %v for channel %s", enabled, user.TwitchName)
 
+		if enabled && app.EventSub != nil {
+			conf := app.Config.Twitch.EventSub
+			err = app.TwitchClient.SubscribeStreamEvents([]string{user.TwitchID}, conf.CallbackURL, conf.Secret)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
+
+func twitchMulti(app app.App) cli.ActionFunc {
+	return func(ctx *cli.Context) error {
+		idStr := ctx.Args().First()
+		if idStr == "" {
+			return fmt.Errorf("missing required argument: id")
+		}
+
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			return fmt.Errorf("id must be an unsigned integer")
+		}
+
+		user, err := app.DB.FindUser(storage.Where(storage.FieldID).Eq(uint64(id)))
+		if err != nil {
+			return err
+		}
+
+		settings, err := twitch.ChannelSettingsFor(app.DB, *user)
+		if err != nil {
+			return err
+		}
+		if ctx.IsSet("provider") {
+			provider, _ := twitch.FindSetting("multistream.provider")
+			err = provider.Set(&settings, ctx.String("provider"))
+			if err != nil {
+				return err
+			}
+		}
+		if ctx.IsSet("hide-finished") {
+			settings.MultiHideFinished = ctx.Bool("hide-finished")
+		}
+
+		_, err = app.DB.SaveChannelSettings(settings)
+		if err != nil {
+			return err
+		}
+
+		provider := settings.MultistreamProvider
+		if provider == "" {
+			provider = twitch.MultiTwitch
+		}
+		log.Printf("!twwr multi for channel %s links to %s, hiding finished racers: %v", user.TwitchName, provider, settings.MultiHideFinished)
+
+		return nil
+	}
+}
+
+func twitchTitle(app app.App) cli.ActionFunc {
+	return func(ctx *cli.Context) error {
+		enabled := !ctx.Bool("disable")
+		idStr := ctx.Args().First()
+		if idStr == "" {
+			return fmt.Errorf("missing required argument: id")
+		}
+
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			return fmt.Errorf("id must be an unsigned integer")
+		}
+
+		update := storage.UserUpdate{
+			AutoTitle: &enabled,
+		}
+		if ctx.IsSet("template") {
+			template := ctx.String("template")
+			update.TitleTemplate = &template
+		}
+
+		user, err := app.DB.UpdateUser(uint64(id), update)
+		if err != nil {
+			return err
+		}
+
+		template := user.TitleTemplate
+		if template == "" {
+			template = twitch.DefaultTitleTemplate
+		}
+		log.Printf("stream titles set to %v for channel %s using %q", enabled, user.TwitchName, template)
+
+		if enabled && !app.UserTokens.HasScopes(*user, twitch.ScopeManageBroadcast) {
+			log.Printf("%s has not granted %s, they must log in again before titles can be set", user.TwitchName, twitch.ScopeManageBroadcast)
+		}
+
+		return nil
+	}
+}
+
+func twitchPredictionsSet(app app.App) cli.ActionFunc {
+	return func(ctx *cli.Context) error {
+		enabled := !ctx.Bool("disable")
+		idStr := ctx.Args().First()
+		if idStr == "" {
+			return fmt.Errorf("missing required argument: id")
+		}
+
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			return fmt.Errorf("id must be an unsigned integer")
+		}
+
+		update := storage.UserUpdate{
+			Predictions: &enabled,
+		}
+		if ctx.IsSet("top") {
+			top := ctx.Int("top")
+			if top <= 0 {
+				return fmt.Errorf("top must be a positive place")
+			}
+			update.PredictionTopN = &top
+		}
+		if ctx.IsSet("target") {
+			target := ctx.Duration("target")
+			update.PredictionTarget = &target
+		}
+
+		user, err := app.DB.UpdateUser(uint64(id), update)
+		if err != nil {
+			return err
+		}
+
+		log.Printf("predictions set to %v for channel %s asking %q", enabled, user.TwitchName, twitch.PredictionTitle(*user))
+
+		if enabled && !app.UserTokens.HasScopes(*user, twitch.ScopeManagePredictions) {
+			log.Printf("%s has not granted %s, they must log in again before predictions can run", user.TwitchName, twitch.ScopeManagePredictions)
+		}
+
+		return nil
+	}
+}
+
+func twitchPredictionsHistory(app app.App) cli.ActionFunc {
+	return func(ctx *cli.Context) error {
+		idStr := ctx.Args().First()
+		if idStr == "" {
+			return fmt.Errorf("missing required argument: id")
+		}
+
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			return fmt.Errorf("id must be an unsigned integer")
+		}
+
+		predictions, err := app.DB.FindPredictions(storage.Where(storage.FieldUserID).Eq(uint64(id)).
+			SortBy(storage.FieldCreatedAt).Reverse())
+		if err != nil {
+			return err
+		}
+
+		for _, p := range predictions {
+			switch p.Status {
+			case storage.PredictionResolved:
+				log.Printf("%s %s %q won: %v (place %d, %s)", p.CreatedAt.Format(time.RFC3339), p.RaceSlug, p.Title, p.Won, p.Place, p.FinishTime)
+			default:
+				log.Printf("%s %s %q %s", p.CreatedAt.Format(time.RFC3339), p.RaceSlug, p.Title, p.Status)
+			}
+		}
+
+		return nil
+	}
+}
+
+func twitchClipsSet(app app.App) cli.ActionFunc {
+	return func(ctx *cli.Context) error {
+		enabled := !ctx.Bool("disable")
+		idStr := ctx.Args().First()
+		if idStr == "" {
+			return fmt.Errorf("missing required argument: id")
+		}
+
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			return fmt.Errorf("id must be an unsigned integer")
+		}
+
+		update := storage.UserUpdate{
+			AutoClip: &enabled,
+		}
+		if ctx.IsSet("chat") {
+			chat := ctx.Bool("chat")
+			update.ClipToChat = &chat
+		}
+		if ctx.IsSet("racetime") {
+			rt := ctx.Bool("racetime")
+			update.ClipToRacetime = &rt
+		}
+
+		user, err := app.DB.UpdateUser(uint64(id), update)
+		if err != nil {
+			return err
+		}
+
+		log.Printf("clips set to %v for channel %s, posting to chat: %v, racetime: %v", enabled, user.TwitchName, user.ClipToChat, user.ClipToRacetime)
+
+		if enabled && !app.UserTokens.HasScopes(*user, twitch.ScopeEditClips) {
+			log.Printf("%s has not granted %s, they must log in again before clips can be created", user.TwitchName, twitch.ScopeEditClips)
+		}
+
+		return nil
+	}
+}
+
+func twitchClipsList(app app.App) cli.ActionFunc {
+	return func(ctx *cli.Context) error {
+		idStr := ctx.Args().First()
+		if idStr == "" {
+			return fmt.Errorf("missing required argument: id")
+		}
+
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			return fmt.Errorf("id must be an unsigned integer")
+		}
+
+		clips, err := app.DB.FindClips(storage.Where(storage.FieldUserID).Eq(uint64(id)).
+			SortBy(storage.FieldCreatedAt).Reverse())
+		if err != nil {
+			return err
+		}
+
+		for _, c := range clips {
+			log.Printf("%s %s %s %s", c.CreatedAt.Format(time.RFC3339), c.RaceSlug, c.Status, c.URL)
+		}
+
+		return nil
+	}
+}
+
+func twitchShoutouts(app app.App) cli.ActionFunc {
+	return func(ctx *cli.Context) error {
+		enabled := !ctx.Bool("disable")
+		idStr := ctx.Args().First()
+		if idStr == "" {
+			return fmt.Errorf("missing required argument: id")
+		}
+
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			return fmt.Errorf("id must be an unsigned integer")
+		}
+
+		user, err := app.DB.UpdateUser(uint64(id), storage.UserUpdate{
+			Shoutouts: &enabled,
+		})
+		if err != nil {
+			return err
+		}
+
+		log.Printf("shoutouts set to %v for channel %s", enabled, user.TwitchName)
+
+		if enabled && !app.UserTokens.HasScopes(*user, twitch.ScopeManageShoutouts) {
+			log.Printf("%s has not granted %s, shoutouts will be sent as chat messages until they log in again", user.TwitchName, twitch.ScopeManageShoutouts)
+		}
+
+		return nil
+	}
+}
+
+func twitchUnlink(app app.App) cli.ActionFunc {
+	return func(ctx *cli.Context) error {
+		idStr := ctx.Args().First()
+		if idStr == "" {
+			return fmt.Errorf("missing required argument: id")
+		}
+
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			return fmt.Errorf("id must be an unsigned integer")
+		}
+
+		err = app.UserTokens.Revoke(uint64(id))
+		if err != nil {
+			if err == storage.ErrNotFound {
+				return fmt.Errorf("user %v has not granted the bot a twitch token", id)
+			}
+
+			return err
+		}
+
+		log.Printf("twitch token of user %v revoked", id)
+
+		return nil
+	}
+}
+
+func twitchScopes(app app.App) cli.ActionFunc {
+	return func(ctx *cli.Context) error {
+		users, err := app.DB.FindUsers(nil)
+		if err != nil {
+			return err
+		}
+
+		for _, u := range users {
+			if len(u.TwitchScopes) == 0 {
+				log.Printf("%d %s has not granted any scopes", u.ID, u.TwitchName)
+				continue
+			}
+
+			log.Printf("%d %s granted scopes: %s", u.ID, u.TwitchName, strings.Join(u.TwitchScopes, " "))
+		}
+
+		return nil
+	}
+}
+
+func twitchChannels(app app.App) cli.ActionFunc {
+	return func(ctx *cli.Context) error {
+		states, err := app.DB.FindChannelStates()
+		if err != nil {
+			return err
+		}
+
+		for _, s := range states {
+			user, err := app.DB.FindUser(storage.Where(storage.FieldID).Eq(s.UserID))
+			if err != nil {
+				return err
+			}
+
+			log.Printf("%s live: %v (since %s), joined: %v", user.TwitchName, s.Live, s.LiveSince, s.Joined)
+		}
+
 		return nil
 	}
 }
@@ -0,0 +1,37 @@
+package cli
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/app"
+	"github.com/urfave/cli/v2"
+)
+
+func usersMerge(app app.App) cli.ActionFunc {
+	return func(ctx *cli.Context) error {
+		if ctx.NArg() < 2 {
+			return fmt.Errorf("missing required arguments: keep_id duplicate_id")
+		}
+
+		keepID, err := strconv.Atoi(ctx.Args().Get(0))
+		if err != nil {
+			return fmt.Errorf("keep_id must be an unsigned integer")
+		}
+		duplicateID, err := strconv.Atoi(ctx.Args().Get(1))
+		if err != nil {
+			return fmt.Errorf("duplicate_id must be an unsigned integer")
+		}
+
+		user, err := app.DB.MergeUsers(uint64(keepID), uint64(duplicateID))
+		if err != nil {
+			return err
+		}
+
+		log.Printf("user %d merged into %d", duplicateID, keepID)
+		log.Printf("%+v\n", user)
+
+		return nil
+	}
+}
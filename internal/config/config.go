@@ -2,6 +2,7 @@ package config
 
 import (
 	"os"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -11,15 +12,38 @@ func Open() App {
 	return App{
 		Host: os.Getenv("APP_HOST"),
 		DB: DB{
-			Path:          os.Getenv("DB_PATH"),
-			EnableLogging: false,
+			Driver:            os.Getenv("DB_DRIVER"),
+			DSN:               os.Getenv("DB_DSN"),
+			Path:              os.Getenv("DB_PATH"),
+			EncryptionKey:     os.Getenv("DB_ENCRYPTION_KEY"),
+			EncryptionKeyFile: os.Getenv("DB_ENCRYPTION_KEY_FILE"),
+			BackupDir:         os.Getenv("DB_BACKUP_DIR"),
+			BackupInterval:    envDuration("DB_BACKUP_INTERVAL", time.Hour*24),
+			BackupKeep:        envInt("DB_BACKUP_KEEP", 7),
+			EnableLogging:     false,
 		},
 		Twitch: Twitch{
-			IRCOAuth:     os.Getenv("TWITCH_IRC_OAUTH"),
-			Username:     os.Getenv("TWITCH_USERNAME"),
-			ClientID:     os.Getenv("TWITCH_CLIENT_ID"),
-			ClientSecret: os.Getenv("TWITCH_CLIENT_SECRET"),
-			RedirectURL:  os.Getenv("TWITCH_REDIRECT_URL"),
+			IRCOAuth:            os.Getenv("TWITCH_IRC_OAUTH"),
+			Username:            os.Getenv("TWITCH_USERNAME"),
+			ClientID:            os.Getenv("TWITCH_CLIENT_ID"),
+			ClientSecret:        os.Getenv("TWITCH_CLIENT_SECRET"),
+			RedirectURL:         os.Getenv("TWITCH_REDIRECT_URL"),
+			APIURL:              envString("TWITCH_API_URL", "https://api.twitch.tv/helix"),
+			TokenURL:            envString("TWITCH_TOKEN_URL", "https://id.twitch.tv/oauth2/token"),
+			RevokeURL:           envString("TWITCH_REVOKE_URL", "https://id.twitch.tv/oauth2/revoke"),
+			Scopes:              strings.Fields(envString("TWITCH_SCOPES", "openid channel:manage:broadcast channel:manage:predictions clips:edit moderator:manage:shoutouts")),
+			LiveGracePeriod:     envDuration("TWITCH_LIVE_GRACE_PERIOD", time.Minute*10),
+			LivePollInterval:    envDuration("TWITCH_LIVE_POLL_INTERVAL", time.Minute),
+			LiveCheckInterval:   envDuration("TWITCH_LIVE_CHECK_INTERVAL", time.Second*15),
+			PredictionWindow:    envDuration("TWITCH_PREDICTION_WINDOW", time.Minute*2),
+			ClipPollInterval:    envDuration("TWITCH_CLIP_POLL_INTERVAL", time.Second*3),
+			ClipTimeout:         envDuration("TWITCH_CLIP_TIMEOUT", time.Second*15),
+			CommandLogRetention: envDuration("TWITCH_COMMAND_LOG_RETENTION", time.Hour*24*30),
+			EventSub: EventSub{
+				Secret:      os.Getenv("TWITCH_EVENTSUB_SECRET"),
+				CallbackURL: os.Getenv("TWITCH_EVENTSUB_CALLBACK_URL"),
+				Addr:        os.Getenv("TWITCH_EVENTSUB_ADDR"),
+			},
 		},
 		Racetime: newRacetime(),
 	}
@@ -35,7 +59,22 @@ type App struct {
 
 // DB
 type DB struct {
-	Path          string
+	// Driver is badger, sqlite, postgres or memory
+	Driver string
+	// DSN is the data source name of the sqlite and postgres drivers
+	DSN string
+	// Path is where the badger driver keeps its files
+	Path string
+	// EncryptionKey is the base64 encoded 32 byte master key secrets are stored with
+	EncryptionKey string
+	// EncryptionKeyFile is a file holding the master key, instead of EncryptionKey
+	EncryptionKeyFile string
+	// BackupDir is where the bot writes badger backups every BackupInterval while
+	// it runs, with backups disabled when it is empty
+	BackupDir      string
+	BackupInterval time.Duration
+	// BackupKeep is how many of the latest backups are kept, all of them when 0
+	BackupKeep    int
 	EnableLogging bool
 }
 
@@ -46,6 +85,42 @@ type Twitch struct {
 	ClientID     string
 	ClientSecret string
 	RedirectURL  string
+	// APIURL and TokenURL point the helix client at twitch, or at a stand-in
+	APIURL    string
+	TokenURL  string
+	RevokeURL string
+	// Scopes are requested from streamers when they log in
+	Scopes []string
+	// LiveGracePeriod is how long the bot stays in chat after a stream goes offline
+	LiveGracePeriod time.Duration
+	// LivePollInterval is how often streams are polled, which catches up on
+	// anything eventsub missed when it is configured
+	LivePollInterval time.Duration
+	// LiveCheckInterval is how often channels past their grace period or no longer followed are parted
+	LiveCheckInterval time.Duration
+	// PredictionWindow is how long predictions stay open before they lock
+	PredictionWindow time.Duration
+	// ClipPollInterval is how often a clip is looked up while twitch processes it
+	ClipPollInterval time.Duration
+	// ClipTimeout is how long twitch may take to process a clip before it is
+	// assumed to have failed
+	ClipTimeout time.Duration
+	// CommandLogRetention is how long chat commands stay in the command log,
+	// with logs kept forever when it is 0
+	CommandLogRetention time.Duration
+	EventSub            EventSub
+}
+
+// EventSub configures the webhook which receives Twitch EventSub notifications
+type EventSub struct {
+	Secret      string
+	CallbackURL string
+	Addr        string
+}
+
+// Enabled reports whether EventSub has been configured
+func (e EventSub) Enabled() bool {
+	return e.Secret != "" && e.CallbackURL != ""
 }
 
 type Racetime struct {
@@ -56,6 +131,8 @@ type Racetime struct {
 	ClientSecret        string
 	RedirectURL         string
 	RaceRefreshInterval time.Duration
+	MaxRooms            int
+	CommandCooldown     time.Duration
 }
 
 func newRacetime() Racetime {
@@ -71,5 +148,39 @@ func newRacetime() Racetime {
 		ClientSecret:        os.Getenv("RACETIME_CLIENT_SECRET"),
 		RedirectURL:         os.Getenv("RACETIME_REDIRECT_URL"),
 		RaceRefreshInterval: time.Second * 30,
+		MaxRooms:            envInt("RACETIME_MAX_ROOMS", 10),
+		CommandCooldown:     envDuration("RACETIME_COMMAND_COOLDOWN", time.Second*10),
+	}
+}
+
+// envString reads an environment variable, falling back to def when it is unset
+func envString(key, def string) string {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+
+	return v
+}
+
+// envDuration reads a duration environment variable such as "10s",
+// falling back to def when it is unset or malformed
+func envDuration(key string, def time.Duration) time.Duration {
+	v, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+
+	return v
+}
+
+// envInt reads an integer environment variable, falling back to def
+// when it is unset or malformed
+func envInt(key string, def int) int {
+	v, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return def
 	}
+
+	return v
 }
@@ -0,0 +1,129 @@
+package races
+
+import (
+	"context"
+
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/racetime"
+)
+
+// ChangeType describes what happened to a race between two race lists
+type ChangeType string
+
+const (
+	RaceStarted ChangeType = "started"
+	// EntrantJoined, EntrantLeft, EntrantFinished and EntrantForfeited changes carry the entrant
+	EntrantJoined   ChangeType = "joined"
+	EntrantLeft     ChangeType = "left"
+	EntrantFinished ChangeType = "finished"
+	// EntrantForfeited entrants have forfeited or been disqualified
+	EntrantForfeited ChangeType = "forfeited"
+	// RaceEnded races have finished, been cancelled or left the race list mid-race
+	RaceEnded ChangeType = "ended"
+)
+
+// Change is something that happened to a race between two race lists
+type Change struct {
+	Type    ChangeType
+	Race    racetime.RaceData
+	Entrant *racetime.Entrant
+}
+
+// Diff compares two race lists from the monitor, returning races which have
+// started or ended and entrants who have joined, left, finished or forfeited in
+// between them. Entrants of a race which leaves the list before starting have left it.
+func Diff(prev, next []racetime.RaceData) []Change {
+	before := map[string]racetime.RaceData{}
+	for _, r := range prev {
+		before[r.Name] = r
+	}
+
+	var changes []Change
+	seen := map[string]bool{}
+	for _, r := range next {
+		seen[r.Name] = true
+		old, existed := before[r.Name]
+
+		if r.Status.Value == racetime.StatusInProgress && (!existed || old.Status.Value != racetime.StatusInProgress) {
+			changes = append(changes, Change{Type: RaceStarted, Race: r})
+		}
+
+		entered := map[string]bool{}
+		finished := map[string]bool{}
+		forfeited := map[string]bool{}
+		for _, e := range old.Entrants {
+			entered[e.User.ID] = true
+			if e.Status.Value == racetime.EntrantDone {
+				finished[e.User.ID] = true
+			}
+			if forfeit(e) {
+				forfeited[e.User.ID] = true
+			}
+		}
+		current := map[string]bool{}
+		for i, e := range r.Entrants {
+			current[e.User.ID] = true
+			if !entered[e.User.ID] {
+				changes = append(changes, Change{Type: EntrantJoined, Race: r, Entrant: &r.Entrants[i]})
+			}
+			if e.Status.Value == racetime.EntrantDone && !finished[e.User.ID] {
+				changes = append(changes, Change{Type: EntrantFinished, Race: r, Entrant: &r.Entrants[i]})
+			}
+			if forfeit(e) && !forfeited[e.User.ID] {
+				changes = append(changes, Change{Type: EntrantForfeited, Race: r, Entrant: &r.Entrants[i]})
+			}
+		}
+		for i, e := range old.Entrants {
+			if !current[e.User.ID] {
+				changes = append(changes, Change{Type: EntrantLeft, Race: r, Entrant: &old.Entrants[i]})
+			}
+		}
+
+		if r.Ended() && existed && !old.Ended() {
+			changes = append(changes, Change{Type: RaceEnded, Race: r})
+		}
+	}
+
+	for _, r := range prev {
+		if seen[r.Name] || r.Ended() {
+			continue
+		}
+
+		if r.Status.Value == racetime.StatusInProgress {
+			changes = append(changes, Change{Type: RaceEnded, Race: r})
+			continue
+		}
+
+		// races which leave the race list before starting were cancelled, and everyone in them has left
+		for i := range r.Entrants {
+			changes = append(changes, Change{Type: EntrantLeft, Race: r, Entrant: &r.Entrants[i]})
+		}
+	}
+
+	return changes
+}
+
+func forfeit(e racetime.Entrant) bool {
+	return e.Status.Value == racetime.EntrantForfeit || e.Status.Value == racetime.EntrantDisqualified
+}
+
+// WatchChanges calls handle with every change between the race lists received
+// from the listener until the context ends. The first race list is only
+// remembered, as what changed before it is unknown.
+func WatchChanges(ctx context.Context, listener <-chan []racetime.RaceData, handle func(Change)) {
+	var prev []racetime.RaceData
+	first := true
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case racesData := <-listener:
+			if !first {
+				for _, c := range Diff(prev, racesData) {
+					handle(c)
+				}
+			}
+			prev = racesData
+			first = false
+		}
+	}
+}
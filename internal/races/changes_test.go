@@ -0,0 +1,97 @@
+package races_test
+
+import (
+	"testing"
+
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/races"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/racetime"
+)
+
+func race(name, status string, entrants ...racetime.Entrant) racetime.RaceData {
+	r := racetime.RaceData{
+		Name:     "twwr/" + name,
+		Slug:     name,
+		Entrants: entrants,
+	}
+	r.Status.Value = status
+
+	return r
+}
+
+func racer(id, status string) racetime.Entrant {
+	var e racetime.Entrant
+	e.User.ID = id
+	e.Status.Value = status
+
+	return e
+}
+
+func TestDiff(t *testing.T) {
+	t.Run("should report races which have started", func(t *testing.T) {
+		changes := races.Diff(
+			[]racetime.RaceData{race("clever-link-1234", racetime.StatusPending)},
+			[]racetime.RaceData{race("clever-link-1234", racetime.StatusInProgress)},
+		)
+		if len(changes) != 1 || changes[0].Type != races.RaceStarted {
+			t.Errorf("got %+v, want one %v change", changes, races.RaceStarted)
+		}
+	})
+
+	t.Run("should report each entrant who finished once", func(t *testing.T) {
+		prev := []racetime.RaceData{race("clever-link-1234", racetime.StatusInProgress,
+			racer("a", racetime.EntrantDone), racer("b", racetime.EntrantInProgress))}
+		next := []racetime.RaceData{race("clever-link-1234", racetime.StatusInProgress,
+			racer("a", racetime.EntrantDone), racer("b", racetime.EntrantDone))}
+
+		changes := races.Diff(prev, next)
+		if len(changes) != 1 || changes[0].Type != races.EntrantFinished || changes[0].Entrant.User.ID != "b" {
+			t.Errorf("got %+v, want b to have finished", changes)
+		}
+	})
+
+	t.Run("should report entrants who joined or left", func(t *testing.T) {
+		changes := races.Diff(
+			[]racetime.RaceData{race("clever-link-1234", racetime.StatusOpen, racer("a", racetime.EntrantNotReady))},
+			[]racetime.RaceData{race("clever-link-1234", racetime.StatusOpen, racer("b", racetime.EntrantNotReady))},
+		)
+		if len(changes) != 2 || changes[0].Type != races.EntrantJoined || changes[0].Entrant.User.ID != "b" ||
+			changes[1].Type != races.EntrantLeft || changes[1].Entrant.User.ID != "a" {
+			t.Errorf("got %+v, want b to have joined and a to have left", changes)
+		}
+	})
+
+	t.Run("should report races which have ended or left the race list mid-race", func(t *testing.T) {
+		changes := races.Diff(
+			[]racetime.RaceData{
+				race("clever-link-1234", racetime.StatusInProgress),
+				race("wild-tetra-5678", racetime.StatusInProgress),
+				race("done-zelda-9012", racetime.StatusFinished),
+			},
+			[]racetime.RaceData{race("clever-link-1234", racetime.StatusFinished)},
+		)
+		if len(changes) != 2 || changes[0].Type != races.RaceEnded || changes[1].Type != races.RaceEnded {
+			t.Errorf("got %+v, want two %v changes", changes, races.RaceEnded)
+		}
+	})
+
+	t.Run("should report entrants of races which left the race list before starting as leaving", func(t *testing.T) {
+		changes := races.Diff(
+			[]racetime.RaceData{race("clever-link-1234", racetime.StatusOpen, racer("a", racetime.EntrantReady), racer("b", racetime.EntrantNotReady))},
+			nil,
+		)
+		if len(changes) != 2 || changes[0].Type != races.EntrantLeft || changes[1].Type != races.EntrantLeft {
+			t.Fatalf("got %+v, want two %v changes", changes, races.EntrantLeft)
+		}
+		if changes[0].Entrant.User.ID != "a" || changes[1].Entrant.User.ID != "b" {
+			t.Errorf("got %v and %v, want a and b", changes[0].Entrant.User.ID, changes[1].Entrant.User.ID)
+		}
+	})
+
+	t.Run("should report nothing when races are unchanged", func(t *testing.T) {
+		list := []racetime.RaceData{race("clever-link-1234", racetime.StatusInProgress, racer("a", racetime.EntrantDone))}
+		changes := races.Diff(list, list)
+		if len(changes) != 0 {
+			t.Errorf("got %+v, want no changes", changes)
+		}
+	})
+}
@@ -0,0 +1,147 @@
+package races
+
+import (
+	"context"
+	"log"
+	"reflect"
+	"strings"
+
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/config"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/racetime"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/storage"
+)
+
+// History records every race the monitor sees, updating
+// each record as the race progresses
+type History struct {
+	conf config.Racetime
+	db   storage.Store
+	// recorded holds the last record saved of each current race,
+	// so races are only written when they change
+	recorded map[string]storage.Race
+}
+
+// NewHistory creates a recorder of race history
+func NewHistory(conf config.Racetime, db storage.Store) *History {
+	return &History{
+		conf:     conf,
+		db:       db,
+		recorded: map[string]storage.Race{},
+	}
+}
+
+// Run records the race lists received from the listener until the context ends
+func (h *History) Run(ctx context.Context, listener <-chan []racetime.RaceData) {
+	var prev []racetime.RaceData
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case racesData := <-listener:
+			h.record(prev, racesData)
+			prev = racesData
+		}
+	}
+}
+
+func (h *History) record(prev, next []racetime.RaceData) {
+	current := map[string]bool{}
+	for _, r := range next {
+		current[r.Slug] = true
+		h.save(r)
+	}
+
+	for _, r := range prev {
+		if current[r.Slug] {
+			continue
+		}
+
+		// races can leave the list before the monitor sees them end,
+		// so their result is fetched one last time
+		if !r.Ended() {
+			category, name := splitRaceName(r.Name)
+			final, err := racetime.RaceDetail(h.conf, category, name)
+			if err != nil {
+				log.Printf("history: error fetching result of %s: %s", r.Name, err)
+			} else {
+				h.save(*final)
+			}
+		}
+
+		delete(h.recorded, r.Slug)
+	}
+}
+
+func (h *History) save(r racetime.RaceData) {
+	race := Record(r)
+	if last, ok := h.recorded[race.Slug]; ok && reflect.DeepEqual(last, race) {
+		return
+	}
+
+	_, err := h.db.SaveRace(race)
+	if err != nil {
+		log.Printf("history: %s", err)
+		return
+	}
+
+	h.recorded[race.Slug] = race
+}
+
+// Record converts racetime's race data into the race history record
+func Record(r racetime.RaceData) storage.Race {
+	category, _ := splitRaceName(r.Name)
+	info := ParseInfo(r.Info)
+	preset := info.Preset
+	if preset == "" {
+		preset = ExtractPreset(r)
+	}
+
+	race := storage.Race{
+		Slug:      r.Slug,
+		Category:  category,
+		Status:    r.Status.Value,
+		Goal:      r.Goal.Name,
+		Info:      r.Info,
+		Preset:    preset,
+		Permalink: info.Permalink,
+		SeedHash:  info.SeedHash,
+		OpenedAt:  r.OpenedAt,
+		StartedAt: r.StartedAt,
+		EndedAt:   r.EndedAt,
+	}
+	if r.Status.Value == racetime.StatusCancelled {
+		race.EndedAt = r.CancelledAt
+	}
+
+	for _, e := range r.Entrants {
+		entrant := storage.RaceEntrant{
+			RacetimeID:  e.User.ID,
+			Name:        e.User.Name,
+			TwitchName:  e.User.TwitchName,
+			Status:      e.Status.Value,
+			Place:       e.Place,
+			ScoreChange: e.ScoreChange,
+		}
+		if e.FinishTime != "" {
+			finishTime, err := racetime.ParseDuration(e.FinishTime)
+			if err != nil {
+				log.Printf("history: %s", err)
+			}
+			entrant.FinishTime = finishTime
+		}
+
+		race.Entrants = append(race.Entrants, entrant)
+	}
+
+	return race
+}
+
+// splitRaceName splits a race name such as twwr/clever-moblin-1234 into its category and slug
+func splitRaceName(name string) (string, string) {
+	i := strings.Index(name, "/")
+	if i == -1 {
+		return "", name
+	}
+
+	return name[:i], name[i+1:]
+}
@@ -0,0 +1,118 @@
+package races_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/config"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/races"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/racetime"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/storage"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/storage/storagetest"
+)
+
+func finisher(id string, place int, finishTime string) racetime.Entrant {
+	e := racer(id, racetime.EntrantDone)
+	e.Place = place
+	e.FinishTime = finishTime
+	e.ScoreChange = 10
+
+	return e
+}
+
+func TestRecord(t *testing.T) {
+	t.Run("should parse the preset, permalink and entrant results", func(t *testing.T) {
+		r := race("clever-link-1234", racetime.StatusFinished,
+			finisher("a", 1, "P0DT01H23M45.500000S"), racer("b", racetime.EntrantForfeit))
+		r.Info = "s4 | MS45LjAAQQAFCyIAD3DAAgAAAAAAAQAA | Seed Hash: Ganon Bokoblin Moblin"
+		r.EndedAt = time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+
+		got := races.Record(r)
+		if got.Slug != "clever-link-1234" || got.Category != "twwr" || got.Preset != "s4" ||
+			got.Permalink != "MS45LjAAQQAFCyIAD3DAAgAAAAAAAQAA" || got.SeedHash != "Ganon Bokoblin Moblin" ||
+			!got.EndedAt.Equal(r.EndedAt) {
+			t.Errorf("got %+v, want the race info parsed", got)
+		}
+
+		want := time.Hour + time.Minute*23 + time.Second*45 + time.Millisecond*500
+		if len(got.Entrants) != 2 || got.Entrants[0].Place != 1 || got.Entrants[0].FinishTime != want ||
+			got.Entrants[0].ScoreChange != 10 || got.Entrants[1].Status != racetime.EntrantForfeit {
+			t.Errorf("got %+v, want a finished and a forfeited entrant", got.Entrants)
+		}
+	})
+
+	t.Run("should end cancelled races when they were cancelled", func(t *testing.T) {
+		r := race("clever-link-1234", racetime.StatusCancelled)
+		r.CancelledAt = time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+
+		got := races.Record(r)
+		if !got.EndedAt.Equal(r.CancelledAt) {
+			t.Errorf("got %v, want %v", got.EndedAt, r.CancelledAt)
+		}
+	})
+}
+
+func TestHistory(t *testing.T) {
+	final := race("clever-link-1234", racetime.StatusFinished, finisher("a", 1, "P0DT01H00M00S"), finisher("b", 2, "P0DT01H10M00S"))
+	fetched := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/twwr/clever-link-1234/data" {
+			http.NotFound(w, r)
+			return
+		}
+
+		fetched++
+		json.NewEncoder(w).Encode(final)
+	}))
+	defer server.Close()
+
+	db, err := storage.Open(config.DB{
+		Driver:        storage.DriverMemory,
+		EncryptionKey: storagetest.EncryptionKey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	listener := make(chan []racetime.RaceData)
+	history := races.NewHistory(config.Racetime{URL: server.URL}, db)
+	go history.Run(ctx, listener)
+
+	t.Run("should record races as they progress", func(t *testing.T) {
+		listener <- []racetime.RaceData{race("clever-link-1234", racetime.StatusInProgress,
+			racer("a", racetime.EntrantInProgress), racer("b", racetime.EntrantInProgress))}
+		listener <- []racetime.RaceData{race("clever-link-1234", racetime.StatusInProgress,
+			finisher("a", 1, "P0DT01H00M00S"), racer("b", racetime.EntrantInProgress))}
+		// the next list is only received once the last has been recorded
+		listener <- []racetime.RaceData{race("clever-link-1234", racetime.StatusInProgress,
+			finisher("a", 1, "P0DT01H00M00S"), racer("b", racetime.EntrantInProgress))}
+
+		got, err := db.FindRace("clever-link-1234")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Status != racetime.StatusInProgress || len(got.Entrants) != 2 || got.Entrants[0].FinishTime != time.Hour {
+			t.Errorf("got %+v, want a to have finished", got)
+		}
+	})
+
+	t.Run("should fetch the result of races which leave the list mid-race", func(t *testing.T) {
+		listener <- []racetime.RaceData{}
+		listener <- []racetime.RaceData{}
+
+		got, err := db.FindRace("clever-link-1234")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fetched != 1 || got.Status != racetime.StatusFinished || got.Entrants[1].Place != 2 {
+			t.Errorf("got %+v after %v fetches, want the final result fetched once", got, fetched)
+		}
+	})
+}
@@ -0,0 +1,97 @@
+package races
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/racetime"
+)
+
+const (
+	SeedHashPrefix = "Seed Hash:"
+	InfoDelimiter  = " | "
+)
+
+// Info is the standard layout of a race's info,
+// "preset | permalink | Seed Hash: ..."
+type Info struct {
+	Preset    string
+	Permalink string
+	SeedHash  string
+}
+
+// ParseInfo reads the preset, permalink and seed hash from race info.
+// Fields which cannot be found are left empty.
+func ParseInfo(info string) Info {
+	parts := strings.Split(info, InfoDelimiter)
+
+	hashIndex := -1
+	for i, p := range parts {
+		if strings.HasPrefix(strings.TrimSpace(p), SeedHashPrefix) {
+			hashIndex = i
+			break
+		}
+	}
+
+	var parsed Info
+	if hashIndex == -1 {
+		parsed.Preset = findPreset(info)
+		return parsed
+	}
+
+	parsed.SeedHash = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(parts[hashIndex]), SeedHashPrefix))
+	if hashIndex > 0 {
+		parsed.Permalink = parts[hashIndex-1]
+	}
+	if hashIndex > 1 {
+		parsed.Preset = findPreset(parts[hashIndex-2])
+	}
+
+	return parsed
+}
+
+// String formats the info in the standard layout, leaving out empty fields
+func (i Info) String() string {
+	var parts []string
+	if i.Preset != "" {
+		parts = append(parts, i.Preset)
+	}
+	if i.Permalink != "" {
+		parts = append(parts, i.Permalink)
+	}
+	if i.SeedHash != "" {
+		parts = append(parts, SeedHashPrefix+" "+i.SeedHash)
+	}
+
+	return strings.Join(parts, InfoDelimiter)
+}
+
+// ExtractPreset finds a recognized preset in a race's goal or info
+func ExtractPreset(race racetime.RaceData) string {
+	for _, text := range []string{race.Goal.Name, race.InfoUser, race.Info} {
+		preset := findPreset(text)
+		if preset != "" {
+			return preset
+		}
+	}
+
+	return ""
+}
+
+// findPreset matches whole words only, as permalinks such as
+// "MS45LjAA..." would otherwise match presets like "s4"
+func findPreset(text string) string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r) && r != '-'
+	})
+
+	for _, p := range Presets() {
+		for _, w := range words {
+			if w == strings.ToLower(p) {
+				return p
+			}
+		}
+	}
+
+	return ""
+}
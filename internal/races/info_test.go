@@ -0,0 +1,63 @@
+package races_test
+
+import (
+	"testing"
+
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/races"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/racetime"
+)
+
+func TestParseInfo(t *testing.T) {
+	t.Run("should read every field of the standard layout", func(t *testing.T) {
+		want := races.Info{
+			Preset:    "s4",
+			Permalink: "MS45LjAAQQAFCyIAD3DAAgAAAAAAAQAA",
+			SeedHash:  "Ganon Bokoblin Moblin",
+		}
+
+		got := races.ParseInfo("s4 | MS45LjAAQQAFCyIAD3DAAgAAAAAAAQAA | Seed Hash: Ganon Bokoblin Moblin")
+		if got != want {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	})
+
+	t.Run("should round trip through String", func(t *testing.T) {
+		want := races.Info{
+			Preset:    "preset-a",
+			Permalink: "MS45LjAAQQA3AyYCD1DAAgAAAAAAAAAA",
+			SeedHash:  "Link Zelda Tetra",
+		}
+
+		got := races.ParseInfo(want.String())
+		if got != want {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	})
+
+	t.Run("should leave the permalink empty without a seed hash", func(t *testing.T) {
+		got := races.ParseInfo("s1 | MS45LjAAQQAXAwYCDxDAAgAAAAAAAQAA")
+		if got.Permalink != "" || got.Preset != "s1" {
+			t.Errorf("got %+v, want only the preset", got)
+		}
+	})
+}
+
+func TestExtractPreset(t *testing.T) {
+	t.Run("should find a preset in the goal", func(t *testing.T) {
+		var race racetime.RaceData
+		race.Goal.Name = "S4"
+
+		if got := races.ExtractPreset(race); got != "s4" {
+			t.Errorf("got %v, want %v", got, "s4")
+		}
+	})
+
+	t.Run("should not match presets inside a permalink", func(t *testing.T) {
+		var race racetime.RaceData
+		race.Info = "preset-a | MS45LjAAQQA3AyYCD1DAAgAAAAAAAAAA"
+
+		if got := races.ExtractPreset(race); got != "preset-a" {
+			t.Errorf("got %v, want %v", got, "preset-a")
+		}
+	})
+}
@@ -33,11 +33,14 @@ func NewMonitor(config config.Racetime, category string) *Monitor {
 	}
 }
 
+// AddListener returns a channel the latest race list is sent on. A
+// listener which hasn't received the previous list has it replaced,
+// so slow listeners skip to the latest list rather than holding up others.
 func (m *Monitor) AddListener() chan []racetime.RaceData {
 	m.listenerMutex.Lock()
 	defer m.listenerMutex.Unlock()
 
-	listener := make(chan []racetime.RaceData)
+	listener := make(chan []racetime.RaceData, 1)
 	m.listeners = append(m.listeners, listener)
 
 	return listener
@@ -95,11 +98,19 @@ func (m *Monitor) Races() []racetime.RaceData {
 	return m.races
 }
 
+// emit shares a race list with every listener without waiting on them,
+// replacing any list a listener has yet to receive
 func (m *Monitor) emit(races []racetime.RaceData) {
 	m.listenerMutex.Lock()
 	defer m.listenerMutex.Unlock()
 
 	for _, l := range m.listeners {
+		select {
+		case <-l:
+		default:
+		}
+
+		// emit is the only sender, so once drained there is room
 		l <- races
 	}
 }
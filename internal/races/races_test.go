@@ -0,0 +1,74 @@
+package races_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/config"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/races"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/racetime"
+)
+
+func TestMonitor(t *testing.T) {
+	var mut sync.Mutex
+	status := racetime.StatusOpen
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/twwr/data":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"current_races": []map[string]string{{"name": "twwr/a-race"}},
+			})
+		case "/twwr/a-race/data":
+			mut.Lock()
+			defer mut.Unlock()
+			json.NewEncoder(w).Encode(race("a-race", status))
+		}
+	}))
+	defer srv.Close()
+
+	monitor := races.NewMonitor(config.Racetime{URL: srv.URL, RaceRefreshInterval: time.Millisecond * 5}, "twwr")
+	slow := monitor.AddListener()
+	fast := monitor.AddListener()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go monitor.Listen(ctx)
+
+	t.Run("should not hold up listeners behind one which isn't receiving", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			select {
+			case <-fast:
+			case <-time.After(time.Second * 2):
+				t.Fatalf("got %v race lists, want %v", i, 3)
+			}
+		}
+	})
+
+	t.Run("should replace race lists a listener has yet to receive with the latest", func(t *testing.T) {
+		mut.Lock()
+		status = racetime.StatusInProgress
+		mut.Unlock()
+
+		deadline := time.Now().Add(time.Second * 2)
+		for {
+			// the race list waiting on the slow listener is replaced once the change is polled
+			var got []racetime.RaceData
+			select {
+			case got = <-slow:
+			case <-time.After(time.Second * 2):
+				t.Fatal("timed out waiting for a race list")
+			}
+			if len(got) == 1 && got[0].Status.Value == racetime.StatusInProgress {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("got %+v, want a-race %v", got, racetime.StatusInProgress)
+			}
+		}
+	})
+}
@@ -0,0 +1,71 @@
+package races
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/racetime"
+)
+
+// RoomInfoHandler sets a race room's info when a recognized preset
+// is chosen, pinning the preset's description and posting its
+// example permalink so race monitors can rely on the info format
+type RoomInfoHandler struct {
+	racetime.BaseHandler
+	applied string
+}
+
+// NewRoomInfoHandler creates a handler for a single race room
+func NewRoomInfoHandler() *RoomInfoHandler {
+	return &RoomInfoHandler{}
+}
+
+func (h *RoomInfoHandler) RaceData(r *racetime.Room, e racetime.RaceDataEvent) {
+	race := e.Race
+	if race.Ended() {
+		return
+	}
+
+	preset := ExtractPreset(race)
+	if preset == "" || preset == h.applied {
+		return
+	}
+
+	ex := ExamplePermaByPreset(preset)
+	if ex == nil {
+		return
+	}
+
+	// keep a permalink and seed hash someone has already shared
+	current := ParseInfo(race.Info)
+	info := Info{
+		Preset:    ex.Preset,
+		Permalink: current.Permalink,
+		SeedHash:  current.SeedHash,
+	}
+	if info.Permalink == "" {
+		info.Permalink = ex.Perma
+	}
+
+	ctx := context.Background()
+	if race.InfoBot != info.String() {
+		err := r.SetInfo(ctx, info.String(), "")
+		if err != nil {
+			log.Printf("racetime: set info in race room %s: %s", r.Name(), err)
+			return
+		}
+	}
+	// only once the info is set, so a failure is retried on the next update
+	h.applied = preset
+
+	err := r.SendMessage(ctx, fmt.Sprintf("%s: %s", ex.Preset, ex.Description), racetime.MessageOptions{Pinned: true})
+	if err != nil {
+		log.Printf("racetime: pin preset in race room %s: %s", r.Name(), err)
+	}
+
+	err = r.SendMessage(ctx, fmt.Sprintf("example permalink: %s", ex.Perma), racetime.MessageOptions{})
+	if err != nil {
+		log.Printf("racetime: post example permalink in race room %s: %s", r.Name(), err)
+	}
+}
@@ -0,0 +1,92 @@
+package races_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/config"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/races"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/racetime"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/racetime/racetimetest"
+	"github.com/gorilla/websocket"
+)
+
+// received collects the actions sent to a race room until none arrive for a while
+func received(actions <-chan racetimetest.Action) []string {
+	var got []string
+	for {
+		select {
+		case a := <-actions:
+			got = append(got, a.Action)
+		case <-time.After(time.Millisecond * 100):
+			return got
+		}
+	}
+}
+
+func TestRoomInfoHandler(t *testing.T) {
+	sent := make(chan racetimetest.Action, 10)
+	srv := racetimetest.NewServer(t, func(_ int, _ *websocket.Conn, actions <-chan racetimetest.Action) {
+		for a := range actions {
+			if a.Action != racetime.ActionGetHistory {
+				sent <- a
+			}
+		}
+	})
+	defer srv.Close()
+
+	bot, err := racetime.NewBot(config.Racetime{URL: srv.URL, WSSchema: "ws"}, racetime.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	room, err := bot.Join(ctx, "clever-link-1234", racetime.BaseHandler{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := race("clever-link-1234", racetime.StatusOpen)
+	r.Goal.Name = "s4"
+	e := racetime.RaceDataEvent{Race: r}
+	want := []string{racetime.ActionSetInfo, racetime.ActionMessage, racetime.ActionMessage}
+
+	h := races.NewRoomInfoHandler()
+	t.Run("should set the info and post the preset once chosen", func(t *testing.T) {
+		h.RaceData(room, e)
+
+		got := received(sent)
+		if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("should not apply the same preset again", func(t *testing.T) {
+		h.RaceData(room, e)
+
+		if got := received(sent); len(got) != 0 {
+			t.Errorf("got %v, want no actions", got)
+		}
+	})
+
+	t.Run("should retry once setting the info failed", func(t *testing.T) {
+		closed, err := bot.Join(ctx, "clever-link-1234", racetime.BaseHandler{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		closed.Close()
+		received(sent)
+
+		h := races.NewRoomInfoHandler()
+		h.RaceData(closed, e)
+		h.RaceData(room, e)
+
+		got := received(sent)
+		if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+}
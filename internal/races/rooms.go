@@ -0,0 +1,242 @@
+package races
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/racetime"
+)
+
+// RoomState describes the connection state of a single race room
+type RoomState string
+
+const (
+	RoomConnecting RoomState = "connecting"
+	RoomConnected  RoomState = "connected"
+	// RoomReconnecting rooms lost their connection and are retrying with backoff
+	RoomReconnecting RoomState = "reconnecting"
+	RoomClosed       RoomState = "closed"
+)
+
+// RoomStatus is a snapshot of a race room tracked by the RoomManager
+type RoomStatus struct {
+	Slug       string
+	Goal       string
+	RaceStatus string
+	State      RoomState
+	JoinedAt   time.Time
+	Err        error
+}
+
+// room holds the per-room state of a connected race room
+type room struct {
+	status RoomStatus
+	conn   *racetime.Room
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// RoomManager connects the racetime bot to every race the
+// monitor reports, up to a maximum number of concurrent rooms
+type RoomManager struct {
+	bot        *racetime.Bot
+	maxRooms   int
+	newHandler func(race racetime.RaceData) racetime.Handler
+	mut        sync.Mutex
+	rooms      map[string]*room
+}
+
+// NewRoomManager creates a manager which will join at most maxRooms race rooms at once,
+// handling the events of each room with the handler returned by newHandler
+func NewRoomManager(bot *racetime.Bot, maxRooms int, newHandler func(race racetime.RaceData) racetime.Handler) *RoomManager {
+	return &RoomManager{
+		bot:        bot,
+		maxRooms:   maxRooms,
+		newHandler: newHandler,
+		mut:        sync.Mutex{},
+		rooms:      map[string]*room{},
+	}
+}
+
+// Run joins and leaves race rooms as race lists are received from
+// the listener, disconnecting from all rooms when the context ends
+func (m *RoomManager) Run(ctx context.Context, listener <-chan []racetime.RaceData) {
+	for {
+		select {
+		case racesData := <-listener:
+			m.sync(ctx, racesData)
+		case <-ctx.Done():
+			m.closeAll()
+			return
+		}
+	}
+}
+
+// Rooms returns the status of every tracked race room, ordered by slug
+func (m *RoomManager) Rooms() []RoomStatus {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	var statuses []RoomStatus
+	for _, r := range m.rooms {
+		status := r.status
+		if status.State == RoomConnected {
+			// race data pushed to the room is fresher than the monitor's
+			if race, ok := r.conn.Race(); ok {
+				status.RaceStatus = race.Status.Value
+				status.Goal = race.Goal.Name
+			}
+			if !r.conn.Connected() {
+				status.State = RoomReconnecting
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Slug < statuses[j].Slug
+	})
+
+	return statuses
+}
+
+func (m *RoomManager) sync(ctx context.Context, racesData []racetime.RaceData) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	current := map[string]racetime.RaceData{}
+	for _, race := range racesData {
+		current[race.Slug] = race
+	}
+
+	// leave rooms whose race has ended or is no longer listed
+	for slug, r := range m.rooms {
+		race, ok := current[slug]
+		if ok && !race.Ended() {
+			r.status.RaceStatus = race.Status.Value
+			r.status.Goal = race.Goal.Name
+			continue
+		}
+
+		r.cancel()
+		delete(m.rooms, slug)
+		log.Printf("racetime: leaving race room %s", slug)
+	}
+
+	for _, race := range racesData {
+		if race.Ended() {
+			continue
+		}
+
+		r, ok := m.rooms[race.Slug]
+		if ok && r.status.State != RoomClosed {
+			continue
+		}
+
+		if m.active() >= m.maxRooms {
+			log.Printf("racetime: not joining race room %s, already in %d rooms", race.Slug, m.maxRooms)
+			continue
+		}
+
+		m.join(ctx, race)
+	}
+}
+
+// join connects to a race room in the background. Callers must hold the mutex.
+func (m *RoomManager) join(ctx context.Context, race racetime.RaceData) {
+	roomCtx, cancel := context.WithCancel(ctx)
+	r := &room{
+		status: RoomStatus{
+			Slug:       race.Slug,
+			Goal:       race.Goal.Name,
+			RaceStatus: race.Status.Value,
+			State:      RoomConnecting,
+			JoinedAt:   time.Now(),
+		},
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	m.rooms[race.Slug] = r
+
+	log.Printf("racetime: joining race room %s", race.Slug)
+	go func() {
+		defer close(r.done)
+
+		conn, err := m.bot.Join(roomCtx, race.Slug, m.newHandler(race))
+		if err == nil {
+			m.mut.Lock()
+			r.conn = conn
+			r.status.State = RoomConnected
+			m.mut.Unlock()
+
+			// ask for the race so handlers can act on its current state
+			err := conn.GetRace(roomCtx)
+			if err != nil {
+				log.Printf("racetime: get race %s: %s", race.Slug, err)
+			}
+
+			<-conn.Done()
+		}
+
+		m.mut.Lock()
+		defer m.mut.Unlock()
+		r.status.State = RoomClosed
+		r.status.Err = err
+		if err != nil {
+			log.Printf("racetime: race room %s closed: %s", race.Slug, err)
+		}
+	}()
+}
+
+// Room returns the connection to a race room by slug, if it is connected
+func (m *RoomManager) Room(slug string) (*racetime.Room, bool) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	r, ok := m.rooms[slug]
+	if !ok || r.status.State != RoomConnected {
+		return nil, false
+	}
+
+	return r.conn, true
+}
+
+// active counts the rooms which have not closed. Callers must hold the mutex.
+func (m *RoomManager) active() int {
+	var n int
+	for _, r := range m.rooms {
+		if r.status.State != RoomClosed {
+			n++
+		}
+	}
+
+	return n
+}
+
+func (m *RoomManager) closeAll() {
+	m.mut.Lock()
+	var pending []*room
+	for slug, r := range m.rooms {
+		r.cancel()
+		pending = append(pending, r)
+		delete(m.rooms, slug)
+	}
+	m.mut.Unlock()
+
+	for _, r := range pending {
+		<-r.done
+	}
+}
+
+// String formats a room status for display
+func (s RoomStatus) String() string {
+	status := fmt.Sprintf("%s [%s] %s (%s)", s.Slug, s.RaceStatus, s.State, s.Goal)
+	if s.Err != nil {
+		status = fmt.Sprintf("%s: %s", status, s.Err)
+	}
+
+	return status
+}
@@ -0,0 +1,164 @@
+package races_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/config"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/races"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/racetime"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/racetime/racetimetest"
+	"github.com/gorilla/websocket"
+)
+
+// runManager runs a room manager against srv until the test ends, returning it
+// along with its cancel func, the listener race lists are sent on and a
+// channel closed once Run returns
+func runManager(t *testing.T, srv string, maxRooms int) (*races.RoomManager, context.CancelFunc, chan []racetime.RaceData, <-chan struct{}) {
+	// rooms which lose their connection stay reconnecting for the whole test
+	bot, err := racetime.NewBot(config.Racetime{URL: srv, WSSchema: "ws"}, racetime.Options{MinReconnectBackoff: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manager := races.NewRoomManager(bot, maxRooms, func(racetime.RaceData) racetime.Handler {
+		return racetime.BaseHandler{}
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	listener := make(chan []racetime.RaceData)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		manager.Run(ctx, listener)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	return manager, cancel, listener, done
+}
+
+// waitRooms waits for the manager's rooms to satisfy ok, returning them either way
+func waitRooms(m *races.RoomManager, ok func([]races.RoomStatus) bool) []races.RoomStatus {
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		rooms := m.Rooms()
+		if ok(rooms) || time.Now().After(deadline) {
+			return rooms
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+}
+
+func connected(n int) func([]races.RoomStatus) bool {
+	return func(rooms []races.RoomStatus) bool {
+		if len(rooms) != n {
+			return false
+		}
+		for _, r := range rooms {
+			if r.State != races.RoomConnected {
+				return false
+			}
+		}
+
+		return true
+	}
+}
+
+func TestRoomManager(t *testing.T) {
+	srv := racetimetest.NewServer(t, func(_ int, _ *websocket.Conn, actions <-chan racetimetest.Action) {
+		for range actions {
+		}
+	})
+	defer srv.Close()
+
+	t.Run("should join races which have not ended up to the maximum rooms", func(t *testing.T) {
+		manager, _, listener, _ := runManager(t, srv.URL, 2)
+		listener <- []racetime.RaceData{
+			race("a-race", racetime.StatusOpen),
+			race("b-race", racetime.StatusFinished),
+			race("c-race", racetime.StatusInProgress),
+			race("d-race", racetime.StatusOpen),
+		}
+
+		rooms := waitRooms(manager, connected(2))
+		if len(rooms) != 2 || rooms[0].Slug != "a-race" || rooms[1].Slug != "c-race" {
+			t.Errorf("got %v, want a-race and c-race connected", rooms)
+		}
+	})
+
+	t.Run("should leave races which ended or left the race list", func(t *testing.T) {
+		manager, _, listener, _ := runManager(t, srv.URL, 2)
+		listener <- []racetime.RaceData{race("a-race", racetime.StatusOpen), race("b-race", racetime.StatusOpen)}
+		waitRooms(manager, connected(2))
+
+		listener <- []racetime.RaceData{race("a-race", racetime.StatusCancelled)}
+		rooms := waitRooms(manager, func(rooms []races.RoomStatus) bool {
+			return len(rooms) == 0
+		})
+		if len(rooms) != 0 {
+			t.Errorf("got %v, want no rooms", rooms)
+		}
+	})
+
+	t.Run("should close every room before returning once the context ends", func(t *testing.T) {
+		var mut sync.Mutex
+		var closed int
+		counting := racetimetest.NewServer(t, func(_ int, _ *websocket.Conn, actions <-chan racetimetest.Action) {
+			for range actions {
+			}
+
+			mut.Lock()
+			closed++
+			mut.Unlock()
+		})
+		defer counting.Close()
+
+		manager, cancel, listener, done := runManager(t, counting.URL, 2)
+		listener <- []racetime.RaceData{race("a-race", racetime.StatusOpen), race("b-race", racetime.StatusOpen)}
+		waitRooms(manager, connected(2))
+
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(time.Second * 5):
+			t.Fatal("Run did not return")
+		}
+		if rooms := manager.Rooms(); len(rooms) != 0 {
+			t.Errorf("got %v, want no rooms", rooms)
+		}
+
+		// the server notices the close after the client sent it
+		deadline := time.Now().Add(time.Second * 5)
+		for {
+			mut.Lock()
+			n := closed
+			mut.Unlock()
+			if n == 2 || time.Now().After(deadline) {
+				if n != 2 {
+					t.Errorf("got %v connections closed, want %v", n, 2)
+				}
+				break
+			}
+			time.Sleep(time.Millisecond * 5)
+		}
+	})
+
+	t.Run("should report rooms which lost their connection as reconnecting", func(t *testing.T) {
+		dropping := racetimetest.NewServer(t, func(int, *websocket.Conn, <-chan racetimetest.Action) {})
+		defer dropping.Close()
+
+		manager, _, listener, _ := runManager(t, dropping.URL, 1)
+		listener <- []racetime.RaceData{race("a-race", racetime.StatusOpen)}
+
+		rooms := waitRooms(manager, func(rooms []races.RoomStatus) bool {
+			return len(rooms) == 1 && rooms[0].State == races.RoomReconnecting
+		})
+		if len(rooms) != 1 || rooms[0].State != races.RoomReconnecting {
+			t.Errorf("got %v, want a-race %v", rooms, races.RoomReconnecting)
+		}
+	})
+}
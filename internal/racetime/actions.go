@@ -0,0 +1,184 @@
+package racetime
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+// Actions supported by the racetime.gg bot protocol
+const (
+	ActionMessage          = "message"
+	ActionPinMessage       = "pin_message"
+	ActionUnpinMessage     = "unpin_message"
+	ActionSetInfo          = "setinfo"
+	ActionSetGoal          = "set_goal"
+	ActionMakeOpen         = "make_open"
+	ActionMakeInvitational = "make_invitational"
+	ActionBegin            = "begin"
+	ActionCancelRace       = "cancel_race"
+	ActionInvite           = "invite"
+	ActionAcceptRequest    = "accept_request"
+	ActionForceUnready     = "force_unready"
+	ActionRemoveEntrant    = "remove_entrant"
+	ActionAddMonitor       = "add_monitor"
+	ActionRemoveMonitor    = "remove_monitor"
+	ActionOverrideStream   = "override_stream"
+	ActionGetRace          = "getrace"
+	ActionGetHistory       = "gethistory"
+)
+
+// MessageOptions alter how a chat message is posted
+type MessageOptions struct {
+	Pinned   bool
+	DirectTo string
+}
+
+// Do sends an action to the race room, returning once it has been written.
+// The racetime.gg bot protocol does not acknowledge actions, so those the
+// server rejects are passed to the room's handler as an ErrorEvent.
+func (r *Room) Do(ctx context.Context, action string, data map[string]interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	err := r.write(send{
+		Action: action,
+		Data:   data,
+	})
+	if err != nil {
+		return fmt.Errorf("error sending %s: %w", action, err)
+	}
+
+	return nil
+}
+
+// SendMessage posts a chat message to the race room
+func (r *Room) SendMessage(ctx context.Context, message string, opts MessageOptions) error {
+	s := messageAction(message, opts)
+	return r.Do(ctx, s.Action, s.Data)
+}
+
+// PinMessage pins a chat message by id
+func (r *Room) PinMessage(ctx context.Context, messageID string) error {
+	return r.Do(ctx, ActionPinMessage, map[string]interface{}{
+		"message": messageID,
+	})
+}
+
+// UnpinMessage unpins a chat message by id
+func (r *Room) UnpinMessage(ctx context.Context, messageID string) error {
+	return r.Do(ctx, ActionUnpinMessage, map[string]interface{}{
+		"message": messageID,
+	})
+}
+
+// SetInfo updates the race info set by the bot and, optionally, the info set by users.
+// An empty infoUser leaves the user set info unchanged.
+func (r *Room) SetInfo(ctx context.Context, infoBot, infoUser string) error {
+	data := map[string]interface{}{
+		"info_bot": infoBot,
+	}
+	if infoUser != "" {
+		data["info_user"] = infoUser
+	}
+
+	return r.Do(ctx, ActionSetInfo, data)
+}
+
+// SetGoal changes the goal of the race
+func (r *Room) SetGoal(ctx context.Context, goal string) error {
+	return r.Do(ctx, ActionSetGoal, map[string]interface{}{
+		"goal": goal,
+	})
+}
+
+// MakeOpen allows anyone to join the race
+func (r *Room) MakeOpen(ctx context.Context) error {
+	return r.Do(ctx, ActionMakeOpen, nil)
+}
+
+// MakeInvitational restricts the race to invited entrants
+func (r *Room) MakeInvitational(ctx context.Context) error {
+	return r.Do(ctx, ActionMakeInvitational, nil)
+}
+
+// Begin starts the race countdown
+func (r *Room) Begin(ctx context.Context) error {
+	return r.Do(ctx, ActionBegin, nil)
+}
+
+// CancelRace cancels the race
+func (r *Room) CancelRace(ctx context.Context) error {
+	return r.Do(ctx, ActionCancelRace, nil)
+}
+
+// Invite a user to the race by racetime user id
+func (r *Room) Invite(ctx context.Context, userID string) error {
+	return r.userAction(ctx, ActionInvite, userID)
+}
+
+// AcceptRequest accepts a user's request to join the race
+func (r *Room) AcceptRequest(ctx context.Context, userID string) error {
+	return r.userAction(ctx, ActionAcceptRequest, userID)
+}
+
+// ForceUnready marks an entrant as not ready
+func (r *Room) ForceUnready(ctx context.Context, userID string) error {
+	return r.userAction(ctx, ActionForceUnready, userID)
+}
+
+// RemoveEntrant removes an entrant from the race
+func (r *Room) RemoveEntrant(ctx context.Context, userID string) error {
+	return r.userAction(ctx, ActionRemoveEntrant, userID)
+}
+
+// AddMonitor promotes a user to race monitor
+func (r *Room) AddMonitor(ctx context.Context, userID string) error {
+	return r.userAction(ctx, ActionAddMonitor, userID)
+}
+
+// RemoveMonitor demotes a race monitor
+func (r *Room) RemoveMonitor(ctx context.Context, userID string) error {
+	return r.userAction(ctx, ActionRemoveMonitor, userID)
+}
+
+// OverrideStream lets an entrant ready up without a live stream
+func (r *Room) OverrideStream(ctx context.Context, userID string) error {
+	return r.userAction(ctx, ActionOverrideStream, userID)
+}
+
+// GetRace asks the server to push the latest race data
+func (r *Room) GetRace(ctx context.Context) error {
+	return r.Do(ctx, ActionGetRace, nil)
+}
+
+// GetHistory asks the server to push the race room's chat history
+func (r *Room) GetHistory(ctx context.Context) error {
+	return r.Do(ctx, ActionGetHistory, nil)
+}
+
+func (r *Room) userAction(ctx context.Context, action, userID string) error {
+	return r.Do(ctx, action, map[string]interface{}{
+		"user": userID,
+	})
+}
+
+func messageAction(message string, opts MessageOptions) send {
+	data := map[string]interface{}{
+		"message": message,
+		"guid":    uuid.New().String(),
+	}
+	if opts.Pinned {
+		data["pinned"] = true
+	}
+	if opts.DirectTo != "" {
+		data["direct_to"] = opts.DirectTo
+	}
+
+	return send{
+		Action: ActionMessage,
+		Data:   data,
+	}
+}
@@ -11,6 +11,29 @@ import (
 	"github.com/TBPixel/tww-rando-twitch-bot/internal/config"
 )
 
+// Race status values as reported by racetime.gg
+const (
+	StatusOpen         = "open"
+	StatusInvitational = "invitational"
+	StatusPending      = "pending"
+	StatusInProgress   = "in_progress"
+	StatusFinished     = "finished"
+	StatusCancelled    = "cancelled"
+)
+
+// Entrant status values as reported by racetime.gg
+const (
+	EntrantRequested    = "requested"
+	EntrantInvited      = "invited"
+	EntrantDeclined     = "declined"
+	EntrantReady        = "ready"
+	EntrantNotReady     = "not_ready"
+	EntrantInProgress   = "in_progress"
+	EntrantDone         = "done"
+	EntrantForfeit      = "dnf"
+	EntrantDisqualified = "dq"
+)
+
 type PaginatedRaces struct {
 	Count    uint       `json:"count"`
 	NumPages uint       `json:"num_pages"`
@@ -52,12 +75,16 @@ type RaceData struct {
 		Custom bool   `json:"custom"`
 	} `json:"goal"`
 	Info                  string    `json:"info"`
+	InfoBot               string    `json:"info_bot"`
+	InfoUser              string    `json:"info_user"`
 	Entrants              []Entrant `json:"entrants"`
 	EntrantsCount         int       `json:"entrants_count"`
 	EntrantsCountFinished int       `json:"entrants_count_finished"`
 	EntrantsCountInactive int       `json:"entrants_count_inactive"`
 	OpenedAt              time.Time `json:"opened_at"`
 	StartedAt             time.Time `json:"started_at"`
+	EndedAt               time.Time `json:"ended_at"`
+	CancelledAt           time.Time `json:"cancelled_at"`
 	TimeLimit             string    `json:"time_limit"`
 	Category              *struct {
 		Name      string `json:"name"`
@@ -69,6 +96,11 @@ type RaceData struct {
 	} `json:"category,omitempty"`
 }
 
+// Ended reports whether the race has finished or been cancelled
+func (r RaceData) Ended() bool {
+	return r.Status.Value == StatusFinished || r.Status.Value == StatusCancelled
+}
+
 type UserDataResponse struct {
 	Results []UserData `json:"results"`
 }
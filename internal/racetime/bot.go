@@ -1,35 +1,136 @@
 package racetime
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/url"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/TBPixel/tww-rando-twitch-bot/internal/config"
 )
 
+// tokenRefreshMargin renews the bot's token this long before it expires
+const tokenRefreshMargin = time.Minute * 5
+
+// Options tune the race room connections of a bot. Zero fields take the
+// values of DefaultOptions.
+type Options struct {
+	// PingInterval is how often a ping is sent to keep race room connections alive
+	PingInterval time.Duration
+	// PongTimeout is how long past a ping the connection may stay silent before it is considered dead
+	PongTimeout time.Duration
+	// MinReconnectBackoff is the initial wait before reconnecting to a race room
+	MinReconnectBackoff time.Duration
+	// MaxReconnectBackoff caps the wait between reconnection attempts
+	MaxReconnectBackoff time.Duration
+}
+
+// DefaultOptions are the options racetime.gg expects bots to connect with
+func DefaultOptions() Options {
+	return Options{
+		PingInterval:        time.Second * 20,
+		PongTimeout:         time.Second * 10,
+		MinReconnectBackoff: time.Second,
+		MaxReconnectBackoff: time.Minute,
+	}
+}
+
+func (o Options) withDefaults() Options {
+	d := DefaultOptions()
+	if o.PingInterval == 0 {
+		o.PingInterval = d.PingInterval
+	}
+	if o.PongTimeout == 0 {
+		o.PongTimeout = d.PongTimeout
+	}
+	if o.MinReconnectBackoff == 0 {
+		o.MinReconnectBackoff = d.MinReconnectBackoff
+	}
+	if o.MaxReconnectBackoff == 0 {
+		o.MaxReconnectBackoff = d.MaxReconnectBackoff
+	}
+
+	return o
+}
+
 type Bot struct {
-	token  TokenSet
-	config config.Racetime
+	config    config.Racetime
+	options   Options
+	mut       sync.Mutex
+	token     TokenSet
+	expiresAt time.Time
 }
 
-func NewBot(c config.Racetime) (*Bot, error) {
-	resp, err := http.PostForm(fmt.Sprintf("%s/o/token", c.URL), url.Values{
-		"client_id":     []string{c.ClientID},
-		"client_secret": []string{c.ClientSecret},
-		"grant_type":    []string{"client_credentials"},
-	})
+func NewBot(c config.Racetime, opts Options) (*Bot, error) {
+	b := &Bot{
+		config:  c,
+		options: opts.withDefaults(),
+	}
+
+	err := b.refreshToken(context.Background())
 	if err != nil {
 		return nil, err
 	}
+
+	return b, nil
+}
+
+// AccessToken returns the bot's client credentials token,
+// renewing it first if it is about to expire
+func (b *Bot) AccessToken(ctx context.Context) (string, error) {
+	b.mut.Lock()
+	expired := time.Now().Add(tokenRefreshMargin).After(b.expiresAt)
+	b.mut.Unlock()
+
+	if expired {
+		err := b.refreshToken(ctx)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	b.mut.Lock()
+	defer b.mut.Unlock()
+
+	return b.token.AccessToken, nil
+}
+
+func (b *Bot) refreshToken(ctx context.Context) error {
+	form := url.Values{
+		"client_id":     []string{b.config.ClientID},
+		"client_secret": []string{b.config.ClientSecret},
+		"grant_type":    []string{"client_credentials"},
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s/%s", b.config.URL, TokenURL), strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := fetch(req)
+	if err != nil {
+		return err
+	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("status code %v while requesting racetime bot token", resp.StatusCode)
+	}
+
 	var token TokenSet
 	err = json.NewDecoder(resp.Body).Decode(&token)
+	if err != nil {
+		return fmt.Errorf("error decoding racetime bot token: %w", err)
+	}
+
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	b.token = token
+	b.expiresAt = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
 
-	return &Bot{
-		token:  token,
-		config: c,
-	}, nil
+	return nil
 }
@@ -0,0 +1,154 @@
+package racetime
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cooldowns rate limits each user's use of a command, remembering
+// the chat message which triggered each use so it can be forgotten
+// if the message is deleted or purged
+type Cooldowns struct {
+	duration time.Duration
+	mut      sync.Mutex
+	uses     map[string]commandUse
+}
+
+type commandUse struct {
+	userID  string
+	command string
+	at      time.Time
+}
+
+// NewCooldowns creates a cooldown tracker which allows a user to
+// use a command once per duration
+func NewCooldowns(duration time.Duration) *Cooldowns {
+	return &Cooldowns{
+		duration: duration,
+		mut:      sync.Mutex{},
+		uses:     map[string]commandUse{},
+	}
+}
+
+// Allow reports whether the user may use the command at the given time,
+// recording the message as a use when they may
+func (c *Cooldowns) Allow(messageID, userID, command string, at time.Time) bool {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	for id, use := range c.uses {
+		if at.Sub(use.at) >= c.duration {
+			delete(c.uses, id)
+			continue
+		}
+
+		if use.userID == userID && use.command == command {
+			return false
+		}
+	}
+
+	c.uses[messageID] = commandUse{
+		userID:  userID,
+		command: command,
+		at:      at,
+	}
+
+	return true
+}
+
+// Forget drops the use recorded for a chat message
+func (c *Cooldowns) Forget(messageID string) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	delete(c.uses, messageID)
+}
+
+// ForgetUser drops every use recorded for a user
+func (c *Cooldowns) ForgetUser(userID string) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	for id, use := range c.uses {
+		if use.userID == userID {
+			delete(c.uses, id)
+		}
+	}
+}
+
+// CommandResolver finds the command a chat message in a race room
+// invokes, returning it with its arguments but without its prefix
+type CommandResolver interface {
+	ResolveCommand(race RaceData, message string) (string, bool)
+}
+
+// DefaultCommand resolves commands which start with the default prefix
+func DefaultCommand(message string) (string, bool) {
+	fields := strings.Fields(message)
+	if len(fields) < 2 || !strings.EqualFold(fields[0], DefaultPrefix) {
+		return "", false
+	}
+
+	return strings.Join(fields[1:], " "), true
+}
+
+// CommandHandler answers bot commands posted in a race room's chat
+type CommandHandler struct {
+	BaseHandler
+	cooldowns *Cooldowns
+	commands  CommandResolver
+}
+
+// NewCommandHandler creates a handler which allows each user to use a command once per cooldown.
+// Commands are resolved by commands, or only from the default prefix when it is nil.
+func NewCommandHandler(cooldown time.Duration, commands CommandResolver) *CommandHandler {
+	return &CommandHandler{
+		cooldowns: NewCooldowns(cooldown),
+		commands:  commands,
+	}
+}
+
+func (h *CommandHandler) resolve(r *Room, message string) (string, bool) {
+	if h.commands == nil {
+		return DefaultCommand(message)
+	}
+
+	race, _ := r.Race()
+	return h.commands.ResolveCommand(race, message)
+}
+
+func (h *CommandHandler) ChatMessage(r *Room, e ChatMessageEvent) {
+	m := e.Message
+	if m.IsBot || m.IsSystem {
+		return
+	}
+
+	command, ok := h.resolve(r, m.MessagePlain)
+	if !ok {
+		return
+	}
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return
+	}
+
+	if !h.cooldowns.Allow(m.ID, m.User.ID, strings.ToLower(fields[0]), m.PostedAt) {
+		return
+	}
+
+	err := r.SendMessage(context.Background(), command, MessageOptions{})
+	if err != nil {
+		log.Printf("racetime: reply in race room %s: %s", r.Name(), err)
+	}
+}
+
+func (h *CommandHandler) ChatDelete(_ *Room, e ChatDeleteEvent) {
+	h.cooldowns.Forget(e.Delete.ID)
+}
+
+func (h *CommandHandler) ChatPurge(_ *Room, e ChatPurgeEvent) {
+	h.cooldowns.ForgetUser(e.Purge.User.ID)
+}
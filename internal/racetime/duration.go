@@ -0,0 +1,43 @@
+package racetime
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// isoDuration matches the ISO 8601 durations racetime.gg reports times in,
+// such as P0DT01H23M45.678901S
+var isoDuration = regexp.MustCompile(`^P(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+(?:\.\d+)?)S)?)?$`)
+
+// ParseDuration reads a racetime.gg duration such as an entrant's finish time
+func ParseDuration(s string) (time.Duration, error) {
+	m := isoDuration.FindStringSubmatch(s)
+	if m == nil || s == "P" {
+		return 0, fmt.Errorf("invalid racetime duration %q", s)
+	}
+
+	var d time.Duration
+	for i, unit := range []time.Duration{time.Hour * 24, time.Hour, time.Minute} {
+		if m[i+1] == "" {
+			continue
+		}
+
+		n, err := strconv.Atoi(m[i+1])
+		if err != nil {
+			return 0, err
+		}
+		d += time.Duration(n) * unit
+	}
+
+	if m[4] != "" {
+		seconds, err := strconv.ParseFloat(m[4], 64)
+		if err != nil {
+			return 0, err
+		}
+		d += time.Duration(seconds * float64(time.Second))
+	}
+
+	return d, nil
+}
@@ -0,0 +1,27 @@
+package racetime_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/racetime"
+)
+
+func TestParseDuration(t *testing.T) {
+	t.Run("should read racetime finish times", func(t *testing.T) {
+		got, err := racetime.ParseDuration("P0DT01H23M45.5S")
+		want := time.Hour + time.Minute*23 + time.Second*45 + time.Millisecond*500
+		if err != nil || got != want {
+			t.Errorf("got %v %v, want %v", got, err, want)
+		}
+	})
+
+	t.Run("should reject anything else", func(t *testing.T) {
+		for _, s := range []string{"", "P", "01:23:45"} {
+			_, err := racetime.ParseDuration(s)
+			if err == nil {
+				t.Errorf("got %v for %q, want an error", err, s)
+			}
+		}
+	})
+}
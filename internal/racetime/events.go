@@ -0,0 +1,231 @@
+package racetime
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Event is a decoded message received from a race room
+type Event interface {
+	EventType() string
+}
+
+// ChatMessage is a single message posted in a race room's chat
+type ChatMessage struct {
+	Bot          interface{} `json:"bot"`
+	Delay        int         `json:"delay"`
+	Highlight    bool        `json:"highlight"`
+	ID           string      `json:"id"`
+	IsBot        bool        `json:"is_bot"`
+	IsMonitor    bool        `json:"is_monitor"`
+	IsSystem     bool        `json:"is_system"`
+	Message      string      `json:"message"`
+	MessagePlain string      `json:"message_plain"`
+	PostedAt     time.Time   `json:"posted_at"`
+	User         UserData    `json:"user"`
+}
+
+type ChatHistoryEvent struct {
+	Date     time.Time     `json:"date"`
+	Messages []ChatMessage `json:"messages"`
+}
+
+type ChatMessageEvent struct {
+	Date    time.Time   `json:"date"`
+	Message ChatMessage `json:"message"`
+}
+
+type ChatDeleteEvent struct {
+	Date   time.Time `json:"date"`
+	Delete struct {
+		ID        string      `json:"id"`
+		User      UserData    `json:"user"`
+		Bot       interface{} `json:"bot"`
+		IsBot     bool        `json:"is_bot"`
+		DeletedBy UserData    `json:"deleted_by"`
+	} `json:"delete"`
+}
+
+type ChatPurgeEvent struct {
+	Date  time.Time `json:"date"`
+	Purge struct {
+		User     UserData `json:"user"`
+		PurgedBy UserData `json:"purged_by"`
+	} `json:"purge"`
+}
+
+// ErrorEvent is sent by racetime.gg when it rejects an action. Action
+// is the name of the action which was sent last, as the server does
+// not say which action an error belongs to.
+type ErrorEvent struct {
+	Date   time.Time `json:"date"`
+	Errors []string  `json:"errors"`
+	Action string    `json:"-"`
+}
+
+type PongEvent struct {
+	Date time.Time `json:"date"`
+}
+
+type RaceDataEvent struct {
+	Date time.Time `json:"date"`
+	Race RaceData  `json:"race"`
+}
+
+func (ChatHistoryEvent) EventType() string { return msgChatHistory }
+func (ChatMessageEvent) EventType() string { return msgChatMessage }
+func (ChatDeleteEvent) EventType() string  { return msgChatDelete }
+func (ChatPurgeEvent) EventType() string   { return msgChatPurge }
+func (ErrorEvent) EventType() string       { return msgError }
+func (PongEvent) EventType() string        { return msgPong }
+func (RaceDataEvent) EventType() string    { return msgRaceData }
+
+// UnknownEvent is returned for message types the decoder does not recognize
+type UnknownEvent struct {
+	Type string
+	Raw  json.RawMessage
+}
+
+func (e UnknownEvent) EventType() string { return e.Type }
+
+// DecodeEvent decodes a race room websocket message into its typed event
+func DecodeEvent(msg []byte) (Event, error) {
+	var message recv
+	err := json.Unmarshal(msg, &message)
+	if err != nil {
+		return nil, err
+	}
+
+	var event Event
+	switch message.Type {
+	case msgChatHistory:
+		var e ChatHistoryEvent
+		err = json.Unmarshal(msg, &e)
+		event = e
+	case msgChatMessage:
+		var e ChatMessageEvent
+		err = json.Unmarshal(msg, &e)
+		event = e
+	case msgChatDelete:
+		var e ChatDeleteEvent
+		err = json.Unmarshal(msg, &e)
+		event = e
+	case msgChatPurge:
+		var e ChatPurgeEvent
+		err = json.Unmarshal(msg, &e)
+		event = e
+	case msgError:
+		var e ErrorEvent
+		err = json.Unmarshal(msg, &e)
+		event = e
+	case msgPong:
+		var e PongEvent
+		err = json.Unmarshal(msg, &e)
+		event = e
+	case msgRaceData:
+		var e RaceDataEvent
+		err = json.Unmarshal(msg, &e)
+		event = e
+	default:
+		return UnknownEvent{Type: message.Type, Raw: msg}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error decoding %s message: %w", message.Type, err)
+	}
+
+	return event, nil
+}
+
+// Handler receives the events of a race room. Handlers are called one
+// at a time, off the connection's read loop, so they may send actions.
+//
+// Chat history is passed to ChatHistory as received. Messages in it
+// which the room has not seen before are also passed to ChatMessage,
+// so each chat message is handled once across reconnects.
+type Handler interface {
+	ChatHistory(r *Room, e ChatHistoryEvent)
+	ChatMessage(r *Room, e ChatMessageEvent)
+	ChatDelete(r *Room, e ChatDeleteEvent)
+	ChatPurge(r *Room, e ChatPurgeEvent)
+	Error(r *Room, e ErrorEvent)
+	Pong(r *Room, e PongEvent)
+	RaceData(r *Room, e RaceDataEvent)
+}
+
+// BaseHandler implements every Handler method as a no-op,
+// for embedding in handlers which only need some events
+type BaseHandler struct{}
+
+func (BaseHandler) ChatHistory(*Room, ChatHistoryEvent) {}
+func (BaseHandler) ChatMessage(*Room, ChatMessageEvent) {}
+func (BaseHandler) ChatDelete(*Room, ChatDeleteEvent)   {}
+func (BaseHandler) ChatPurge(*Room, ChatPurgeEvent)     {}
+func (BaseHandler) Error(*Room, ErrorEvent)             {}
+func (BaseHandler) Pong(*Room, PongEvent)               {}
+func (BaseHandler) RaceData(*Room, RaceDataEvent)       {}
+
+// Handlers fans every event out to each handler in order
+type Handlers []Handler
+
+func (hs Handlers) ChatHistory(r *Room, e ChatHistoryEvent) {
+	for _, h := range hs {
+		h.ChatHistory(r, e)
+	}
+}
+
+func (hs Handlers) ChatMessage(r *Room, e ChatMessageEvent) {
+	for _, h := range hs {
+		h.ChatMessage(r, e)
+	}
+}
+
+func (hs Handlers) ChatDelete(r *Room, e ChatDeleteEvent) {
+	for _, h := range hs {
+		h.ChatDelete(r, e)
+	}
+}
+
+func (hs Handlers) ChatPurge(r *Room, e ChatPurgeEvent) {
+	for _, h := range hs {
+		h.ChatPurge(r, e)
+	}
+}
+
+func (hs Handlers) Error(r *Room, e ErrorEvent) {
+	for _, h := range hs {
+		h.Error(r, e)
+	}
+}
+
+func (hs Handlers) Pong(r *Room, e PongEvent) {
+	for _, h := range hs {
+		h.Pong(r, e)
+	}
+}
+
+func (hs Handlers) RaceData(r *Room, e RaceDataEvent) {
+	for _, h := range hs {
+		h.RaceData(r, e)
+	}
+}
+
+// dispatch calls the handler method matching the event's type
+func dispatch(h Handler, r *Room, event Event) {
+	switch e := event.(type) {
+	case ChatHistoryEvent:
+		h.ChatHistory(r, e)
+	case ChatMessageEvent:
+		h.ChatMessage(r, e)
+	case ChatDeleteEvent:
+		h.ChatDelete(r, e)
+	case ChatPurgeEvent:
+		h.ChatPurge(r, e)
+	case ErrorEvent:
+		h.Error(r, e)
+	case PongEvent:
+		h.Pong(r, e)
+	case RaceDataEvent:
+		h.RaceData(r, e)
+	}
+}
@@ -0,0 +1,66 @@
+// Package racetimetest provides a fake of racetime.gg for tests
+package racetimetest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/racetime"
+	"github.com/gorilla/websocket"
+)
+
+// Action is an action the bot sent over a race room connection
+type Action struct {
+	Action string                 `json:"action"`
+	Data   map[string]interface{} `json:"data"`
+}
+
+// NewServer serves the token endpoint and a bot websocket, handing each
+// connection, numbered from 1, and the actions received on it to serve.
+// The connection is closed once serve returns.
+func NewServer(t *testing.T, serve func(conn int, c *websocket.Conn, actions <-chan Action)) *httptest.Server {
+	upgrader := websocket.Upgrader{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/o/token", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(racetime.TokenSet{
+			AccessToken: "token",
+			ExpiresIn:   36000,
+		})
+	})
+
+	var mut sync.Mutex
+	var conns int
+	mux.HandleFunc("/ws/o/bot/", func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade: %s", err)
+			return
+		}
+		defer c.Close()
+
+		mut.Lock()
+		conns++
+		conn := conns
+		mut.Unlock()
+
+		actions := make(chan Action)
+		go func() {
+			defer close(actions)
+			for {
+				var a Action
+				err := c.ReadJSON(&a)
+				if err != nil {
+					return
+				}
+				actions <- a
+			}
+		}()
+
+		serve(conn, c, actions)
+	})
+
+	return httptest.NewServer(mux)
+}
@@ -3,18 +3,22 @@ package racetime
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 )
 
+// DefaultPrefix starts bot commands, in race rooms and in
+// the twitch chats of channels which haven't chosen their own
+const DefaultPrefix = "!twwr"
+
 const (
-	botPrefix      = "!twwr"
 	msgChatHistory = "chat.history"
 	msgChatMessage = "chat.message"
 	msgChatDelete  = "chat.delete"
@@ -22,139 +26,363 @@ const (
 	msgError       = "error"
 	msgPong        = "pong"
 	msgRaceData    = "race.data"
+
+	actionPing = "ping"
+
+	// seenMessages bounds how many chat message ids are remembered for deduplication
+	seenMessages = 500
+	// eventQueue bounds how many events may wait on the room's handler
+	eventQueue = 100
 )
 
+var ErrDisconnected = errors.New("race room is not connected")
+
 type recv struct {
 	Type string    `json:"type"`
 	Date time.Time `json:"date"`
 }
 
-type chatMsg struct {
-	recv
-	Message struct {
-		Bot          interface{} `json:"bot"`
-		Delay        int         `json:"delay"`
-		Highlight    bool        `json:"highlight"`
-		ID           string      `json:"id"`
-		IsBot        bool        `json:"is_bot"`
-		IsMonitor    bool        `json:"is_monitor"`
-		IsSystem     bool        `json:"is_system"`
-		Message      string      `json:"message"`
-		MessagePlain string      `json:"message_plain"`
-		PostedAt     time.Time   `json:"posted_at"`
-		User         UserData    `json:"user"`
-	} `json:"message"`
+type send struct {
+	Action string                 `json:"action"`
+	Data   map[string]interface{} `json:"data,omitempty"`
 }
 
-type send struct {
-	Action string            `json:"action"`
-	Data   map[string]string `json:"data"`
+// Room is a bot connection to a single race room. The connection
+// is re-established automatically until the room is closed.
+type Room struct {
+	bot        *Bot
+	name       string
+	handler    Handler
+	events     chan Event
+	cancel     context.CancelFunc
+	connMut    sync.Mutex
+	conn       *websocket.Conn
+	writeMut   sync.Mutex
+	errMut     sync.Mutex
+	lastAction string
+	raceMut    sync.Mutex
+	race       *RaceData
+	seenMut    sync.Mutex
+	seen       map[string]bool
+	seenOrder  []string
+	synced     bool
+	done       chan struct{}
 }
 
-// Connect to a raceroom's chat via name
-func (b Bot) Connect(ctx context.Context, name string) error {
-	u, err := url.Parse(b.config.URL)
+// Connect to a raceroom's chat via name, blocking until the context ends
+func (b *Bot) Connect(ctx context.Context, name string, handler Handler) error {
+	room, err := b.Join(ctx, name, handler)
 	if err != nil {
 		return err
 	}
+
+	<-room.Done()
+	return nil
+}
+
+// Join a raceroom's chat via name, returning once the connection is open.
+// Events received from the room are passed to the handler. The room
+// reconnects when the connection drops and is closed when the context ends.
+func (b *Bot) Join(ctx context.Context, name string, handler Handler) (*Room, error) {
+	c, err := b.dial(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	r := &Room{
+		bot:     b,
+		name:    name,
+		handler: handler,
+		events:  make(chan Event, eventQueue),
+		cancel:  cancel,
+		conn:    c,
+		seen:    map[string]bool{},
+		done:    make(chan struct{}),
+	}
+	go r.handle()
+	go r.run(ctx, c)
+
+	return r, nil
+}
+
+func (b *Bot) dial(ctx context.Context, name string) (*websocket.Conn, error) {
+	token, err := b.AccessToken(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error renewing racetime bot token: %w", err)
+	}
+
+	u, err := url.Parse(b.config.URL)
+	if err != nil {
+		return nil, err
+	}
 	u.Scheme = b.config.WSSchema
 	u.Path = fmt.Sprintf("/ws/o/bot/%s", name)
 	q := u.Query()
-	q.Set("token", b.token.AccessToken)
+	q.Set("token", token)
 	u.RawQuery = q.Encode()
 
-	log.Printf("connecting to ws: %s", u.String())
-	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	log.Printf("connecting to ws: %s/%s", b.config.URL, name)
+	c, _, err := websocket.DefaultDialer.DialContext(ctx, u.String(), nil)
 	if err != nil {
-		return fmt.Errorf("dial: %s", err)
+		return nil, fmt.Errorf("dial: %s", err)
+	}
+
+	return c, nil
+}
+
+// Name of the race room
+func (r *Room) Name() string {
+	return r.name
+}
+
+// Done is closed once the room has been closed
+func (r *Room) Done() <-chan struct{} {
+	return r.done
+}
+
+// Connected reports whether the room currently has an open connection
+func (r *Room) Connected() bool {
+	r.connMut.Lock()
+	defer r.connMut.Unlock()
+
+	return r.conn != nil
+}
+
+// Race returns the latest race data pushed to the room, if any has been received
+func (r *Room) Race() (RaceData, bool) {
+	r.raceMut.Lock()
+	defer r.raceMut.Unlock()
+
+	if r.race == nil {
+		return RaceData{}, false
 	}
-	defer c.Close()
 
-	done := make(chan struct{})
-	go func() {
-		defer close(done)
+	return *r.race, true
+}
+
+// Close the room, waiting for the connection to shut down
+func (r *Room) Close() error {
+	r.cancel()
+	<-r.done
+
+	return nil
+}
+
+// run serves the connection, reconnecting with backoff whenever it drops
+func (r *Room) run(ctx context.Context, c *websocket.Conn) {
+	defer close(r.done)
+	defer close(r.events)
+
+	opts := r.bot.options
+	backoff := opts.MinReconnectBackoff
+	for {
+		connectedAt := time.Now()
+		err := r.serve(ctx, c)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("racetime: lost connection to race room %s: %s", r.name, err)
+
+		// a connection that stayed up for a while starts backing off afresh
+		if time.Since(connectedAt) > opts.MaxReconnectBackoff {
+			backoff = opts.MinReconnectBackoff
+		}
+
 		for {
-			_, message, err := c.ReadMessage()
-			if err != nil {
-				log.Println("read:", err)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
 				return
 			}
-			err = processChatMessage(c, message)
-			if err != nil {
-				log.Println("process: ", err)
-				return
+
+			backoff *= 2
+			if backoff > opts.MaxReconnectBackoff {
+				backoff = opts.MaxReconnectBackoff
+			}
+
+			c, err = r.bot.dial(ctx, r.name)
+			if err == nil {
+				break
 			}
+			log.Printf("racetime: reconnecting to race room %s: %s", r.name, err)
 		}
+	}
+}
+
+// serve reads from a single connection until it fails or the context ends
+func (r *Room) serve(ctx context.Context, c *websocket.Conn) error {
+	r.connMut.Lock()
+	r.conn = c
+	r.connMut.Unlock()
+
+	stop := make(chan struct{})
+	defer func() {
+		close(stop)
+		r.connMut.Lock()
+		r.conn = nil
+		r.connMut.Unlock()
+		c.Close()
 	}()
 
+	go r.keepalive(ctx, c, stop)
+
+	// resynchronize chat so commands missed while disconnected are
+	// handled, and those already handled are not handled again
+	err := r.writeTo(c, send{Action: ActionGetHistory})
+	if err != nil {
+		return err
+	}
+
+	for {
+		c.SetReadDeadline(time.Now().Add(r.bot.options.PingInterval + r.bot.options.PongTimeout))
+		_, message, err := c.ReadMessage()
+		if err != nil {
+			return err
+		}
+
+		err = r.process(message)
+		if err != nil {
+			log.Println("process: ", err)
+		}
+	}
+}
+
+// keepalive pings the connection until it stops, and cleanly closes
+// the connection by sending a close message when the context ends
+func (r *Room) keepalive(ctx context.Context, c *websocket.Conn, stop <-chan struct{}) {
+	ticker := time.NewTicker(r.bot.options.PingInterval)
+	defer ticker.Stop()
+
 	for {
 		select {
-		case <-done:
-			return nil
+		case <-ticker.C:
+			err := r.writeTo(c, send{Action: actionPing})
+			if err != nil {
+				log.Printf("racetime: ping race room %s: %s", r.name, err)
+			}
 		case <-ctx.Done():
-			log.Println("interrupt")
-
-			// Cleanly close the connection by sending a close message and then
-			// waiting (with timeout) for the server to close the connection.
+			r.writeMut.Lock()
 			err := c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			r.writeMut.Unlock()
 			if err != nil {
-				return fmt.Errorf("write close: %s", err)
+				log.Printf("write close: %s", err)
 			}
+
+			// wait (with timeout) for the server to close the connection
 			select {
-			case <-done:
+			case <-stop:
 			case <-time.After(time.Second):
+				c.Close()
 			}
-			return nil
+			return
+		case <-stop:
+			return
 		}
 	}
 }
 
-func processChatMessage(c *websocket.Conn, msg []byte) error {
-	var message recv
-	err := json.Unmarshal(msg, &message)
+// handle passes queued events to the room's handler
+func (r *Room) handle() {
+	for event := range r.events {
+		dispatch(r.handler, r, event)
+	}
+}
+
+func (r *Room) process(msg []byte) error {
+	event, err := DecodeEvent(msg)
 	if err != nil {
 		return err
 	}
 
-	if message.Type != msgChatMessage {
+	switch e := event.(type) {
+	case ErrorEvent:
+		r.errMut.Lock()
+		e.Action = r.lastAction
+		r.errMut.Unlock()
+		log.Printf("racetime: race room %s rejected %s: %s", r.name, e.Action, strings.Join(e.Errors, ", "))
+		event = e
+	case RaceDataEvent:
+		r.raceMut.Lock()
+		r.race = &e.Race
+		r.raceMut.Unlock()
+	case ChatMessageEvent:
+		if !r.markSeen(e.Message.ID) {
+			return nil
+		}
+	case ChatHistoryEvent:
+		// the first history received is what was said before the bot
+		// joined, so it is only remembered rather than handled
+		r.seenMut.Lock()
+		synced := r.synced
+		r.synced = true
+		r.seenMut.Unlock()
+
+		r.events <- e
+		for _, m := range e.Messages {
+			if !r.markSeen(m.ID) || !synced {
+				continue
+			}
+
+			r.events <- ChatMessageEvent{
+				Date:    e.Date,
+				Message: m,
+			}
+		}
+		return nil
+	case UnknownEvent:
 		return nil
 	}
 
-	var cm chatMsg
-	err = json.Unmarshal(msg, &cm)
-	if err != nil {
-		return err
-	}
+	r.events <- event
+	return nil
+}
 
-	if cm.Message.IsBot {
-		return nil
+// markSeen records a chat message id, returning false if it was already seen
+func (r *Room) markSeen(id string) bool {
+	r.seenMut.Lock()
+	defer r.seenMut.Unlock()
+
+	if r.seen[id] {
+		return false
 	}
 
-	if !strings.HasPrefix(cm.Message.MessagePlain, botPrefix) || len(cm.Message.MessagePlain) <= len(botPrefix) {
-		return nil
+	r.seen[id] = true
+	r.seenOrder = append(r.seenOrder, id)
+	if len(r.seenOrder) > seenMessages {
+		delete(r.seen, r.seenOrder[0])
+		r.seenOrder = r.seenOrder[1:]
 	}
 
-	command := strings.TrimSpace(cm.Message.MessagePlain[len(botPrefix)+1:])
-	return parseCommand(c, command)
+	return true
 }
 
-func parseCommand(c *websocket.Conn, command string) error {
-	return sendMsg(c, command)
-}
+func (r *Room) write(s send) error {
+	r.connMut.Lock()
+	c := r.conn
+	r.connMut.Unlock()
 
-func sendMsg(c *websocket.Conn, message string) error {
-	m := send{
-		Action: "message",
-		Data: map[string]string{
-			"message": message,
-			"guid":    uuid.New().String(),
-		},
+	if c == nil {
+		return ErrDisconnected
 	}
 
-	d, err := json.Marshal(m)
+	// errors are attributed to the last action sent on the bot's behalf,
+	// rather than to the pings and resyncs the room sends itself
+	r.errMut.Lock()
+	r.lastAction = s.Action
+	r.errMut.Unlock()
+
+	return r.writeTo(c, s)
+}
+
+func (r *Room) writeTo(c *websocket.Conn, s send) error {
+	d, err := json.Marshal(s)
 	if err != nil {
 		return err
 	}
 
+	r.writeMut.Lock()
+	defer r.writeMut.Unlock()
+
 	return c.WriteMessage(websocket.TextMessage, d)
 }
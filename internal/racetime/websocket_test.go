@@ -0,0 +1,277 @@
+package racetime_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/config"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/racetime"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/racetime/racetimetest"
+	"github.com/gorilla/websocket"
+)
+
+func chatMessage(id, message string) map[string]interface{} {
+	return map[string]interface{}{
+		"id":            id,
+		"message":       message,
+		"message_plain": message,
+		"posted_at":     time.Now(),
+	}
+}
+
+func TestRoomActions(t *testing.T) {
+	srv := racetimetest.NewServer(t, func(_ int, c *websocket.Conn, actions <-chan racetimetest.Action) {
+		for a := range actions {
+			if a.Action != racetime.ActionSetInfo {
+				continue
+			}
+
+			c.WriteJSON(map[string]interface{}{
+				"type":   "error",
+				"errors": []string{"You do not have permission to do that."},
+			})
+		}
+	})
+	defer srv.Close()
+
+	bot, err := racetime.NewBot(config.Racetime{URL: srv.URL, WSSchema: "ws"}, racetime.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	handler := recordingHandler{events: make(chan racetime.Event, 10)}
+	room, err := bot.Join(ctx, "clever-link-1234", handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("should succeed when the server does not respond with an error", func(t *testing.T) {
+		err := room.SendMessage(ctx, "hello", racetime.MessageOptions{Pinned: true})
+		if err != nil {
+			t.Errorf("got %v, want nil", err)
+		}
+	})
+
+	t.Run("should return without waiting and pass rejections to the handler", func(t *testing.T) {
+		err := room.SetInfo(ctx, "s4", "")
+		if err != nil {
+			t.Fatalf("got %v, want nil", err)
+		}
+
+		select {
+		case e := <-handler.events:
+			if e, ok := e.(racetime.ErrorEvent); !ok || e.Action != racetime.ActionSetInfo {
+				t.Errorf("got %+v, want an error for %v", e, racetime.ActionSetInfo)
+			}
+		case <-time.After(time.Second * 2):
+			t.Errorf("timed out waiting for the error")
+		}
+	})
+
+	t.Run("should fail once the context has ended", func(t *testing.T) {
+		ended, cancel := context.WithCancel(ctx)
+		cancel()
+
+		err := room.SendMessage(ended, "hello", racetime.MessageOptions{})
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("got %v, want %v", err, context.Canceled)
+		}
+	})
+
+	t.Run("should close when the context ends", func(t *testing.T) {
+		cancel()
+
+		select {
+		case <-room.Done():
+		case <-time.After(time.Second * 2):
+			t.Errorf("room did not close")
+		}
+	})
+}
+
+func TestRoomReconnect(t *testing.T) {
+	replies := make(chan string, 10)
+	srv := racetimetest.NewServer(t, func(conn int, c *websocket.Conn, actions <-chan racetimetest.Action) {
+		for a := range actions {
+			switch a.Action {
+			case racetime.ActionGetHistory:
+				history := []interface{}{chatMessage("1", "!twwr before")}
+				if conn > 1 {
+					history = append(history, chatMessage("2", "!twwr during"), chatMessage("3", "!twwr missed"))
+				}
+				c.WriteJSON(map[string]interface{}{
+					"type":     "chat.history",
+					"messages": history,
+				})
+
+				if conn == 1 {
+					c.WriteJSON(map[string]interface{}{
+						"type":    "chat.message",
+						"message": chatMessage("2", "!twwr during"),
+					})
+				}
+			case racetime.ActionMessage:
+				replies <- a.Data["message"].(string)
+
+				// drop the first connection once the bot has replied
+				if conn == 1 {
+					return
+				}
+			}
+		}
+	})
+	defer srv.Close()
+
+	bot, err := racetime.NewBot(config.Racetime{URL: srv.URL, WSSchema: "ws"}, racetime.Options{MinReconnectBackoff: time.Millisecond * 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, err = bot.Join(ctx, "clever-link-1234", racetime.NewCommandHandler(0, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("should handle each command once across reconnects", func(t *testing.T) {
+		for _, want := range []string{"during", "missed"} {
+			select {
+			case got := <-replies:
+				if got != want {
+					t.Errorf("got %v, want %v", got, want)
+				}
+			case <-time.After(time.Second * 2):
+				t.Fatalf("timed out waiting for reply %v", want)
+			}
+		}
+
+		select {
+		case got := <-replies:
+			t.Errorf("got unexpected reply %v", got)
+		case <-time.After(time.Millisecond * 100):
+		}
+	})
+}
+
+// recordingHandler forwards the events it receives to a channel
+type recordingHandler struct {
+	racetime.BaseHandler
+	events chan racetime.Event
+}
+
+func (h recordingHandler) Error(_ *racetime.Room, e racetime.ErrorEvent) {
+	h.events <- e
+}
+
+func (h recordingHandler) RaceData(_ *racetime.Room, e racetime.RaceDataEvent) {
+	h.events <- e
+}
+
+func TestRoomEvents(t *testing.T) {
+	srv := racetimetest.NewServer(t, func(_ int, c *websocket.Conn, actions <-chan racetimetest.Action) {
+		for a := range actions {
+			switch a.Action {
+			case racetime.ActionGetRace:
+				c.WriteJSON(map[string]interface{}{
+					"type": "race.data",
+					"race": map[string]interface{}{
+						"slug":   "clever-link-1234",
+						"status": map[string]string{"value": racetime.StatusInProgress},
+					},
+				})
+			case racetime.ActionBegin:
+				c.WriteJSON(map[string]interface{}{
+					"type":   "error",
+					"errors": []string{"The race has already started."},
+				})
+			}
+		}
+	})
+	defer srv.Close()
+
+	bot, err := racetime.NewBot(config.Racetime{URL: srv.URL, WSSchema: "ws"}, racetime.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	handler := recordingHandler{events: make(chan racetime.Event, 10)}
+	room, err := bot.Join(ctx, "clever-link-1234", handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("should update the room's race from race.data", func(t *testing.T) {
+		room.GetRace(ctx)
+
+		e := (<-handler.events).(racetime.RaceDataEvent)
+		if e.Race.Status.Value != racetime.StatusInProgress {
+			t.Errorf("got %v, want %v", e.Race.Status.Value, racetime.StatusInProgress)
+		}
+
+		race, ok := room.Race()
+		if !ok || race.Slug != "clever-link-1234" {
+			t.Errorf("got %+v, want the pushed race", race)
+		}
+	})
+
+	t.Run("should pass errors to the handler with the action that caused them", func(t *testing.T) {
+		room.Begin(ctx)
+
+		e := (<-handler.events).(racetime.ErrorEvent)
+		if e.Action != racetime.ActionBegin {
+			t.Errorf("got %v, want %v", e.Action, racetime.ActionBegin)
+		}
+	})
+}
+
+func TestCooldowns(t *testing.T) {
+	now := time.Now()
+
+	t.Run("should block a user from repeating a command within the cooldown", func(t *testing.T) {
+		c := racetime.NewCooldowns(time.Minute)
+
+		if !c.Allow("1", "user", "race", now) {
+			t.Errorf("got false, want first use allowed")
+		}
+		if c.Allow("2", "user", "race", now.Add(time.Second)) {
+			t.Errorf("got true, want repeat blocked")
+		}
+		if !c.Allow("3", "other", "race", now.Add(time.Second)) {
+			t.Errorf("got false, want other users allowed")
+		}
+		if !c.Allow("4", "user", "race", now.Add(time.Minute)) {
+			t.Errorf("got false, want use allowed after the cooldown")
+		}
+	})
+
+	t.Run("should drop deleted messages from the cooldown", func(t *testing.T) {
+		c := racetime.NewCooldowns(time.Minute)
+		c.Allow("1", "user", "race", now)
+		c.Forget("1")
+
+		if !c.Allow("2", "user", "race", now) {
+			t.Errorf("got false, want use allowed after delete")
+		}
+	})
+
+	t.Run("should drop purged users from the cooldown", func(t *testing.T) {
+		c := racetime.NewCooldowns(time.Minute)
+		c.Allow("1", "user", "race", now)
+		c.Allow("2", "user", "vs", now)
+		c.ForgetUser("user")
+
+		if !c.Allow("3", "user", "race", now) || !c.Allow("4", "user", "vs", now) {
+			t.Errorf("got false, want uses allowed after purge")
+		}
+	})
+}
@@ -0,0 +1,70 @@
+package storage_test
+
+import (
+	"testing"
+
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/config"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/storage"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/storage/storagetest"
+	"github.com/timshannon/badgerhold"
+)
+
+func TestBadgerStore(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Store {
+		db, err := storage.Open(config.DB{
+			Driver:        storage.DriverBadger,
+			Path:          t.TempDir(),
+			EncryptionKey: storagetest.EncryptionKey,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return db
+	})
+}
+
+// legacyUser is a user saved while multistream settings were kept on users
+type legacyUser struct {
+	ID                  uint64
+	TwitchID            string
+	MultistreamProvider string
+	MultiHideFinished   bool
+}
+
+func (legacyUser) Type() string                         { return "User" }
+func (legacyUser) Indexes() map[string]badgerhold.Index { return nil }
+
+func TestBadgerMigrations(t *testing.T) {
+	t.Run("should move the multistream settings kept on users to their channel settings", func(t *testing.T) {
+		dir := t.TempDir()
+		options := badgerhold.DefaultOptions
+		options.Dir = dir
+		options.ValueDir = dir
+		options.Logger = nil
+		store, err := badgerhold.Open(options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = store.Insert(uint64(1), legacyUser{ID: 1, TwitchID: "1", MultistreamProvider: "kadgar", MultiHideFinished: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		store.Close()
+
+		db, err := storage.OpenBadger(config.DB{Path: dir, EncryptionKey: storagetest.EncryptionKey})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		settings, err := db.FindChannelSettings(1)
+		if err != nil || settings.MultistreamProvider != "kadgar" || !settings.MultiHideFinished || settings.Prefix != "!twwr" {
+			t.Errorf("got %+v (%v), want the user's multistream settings", settings, err)
+		}
+		user, err := db.FindUser(storage.Where(storage.FieldID).Eq(uint64(1)))
+		if err != nil || user.TwitchID != "1" {
+			t.Errorf("got %+v (%v), want the user", user, err)
+		}
+	})
+}
@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/timshannon/badgerhold"
+)
+
+// ChannelState tracks whether a followed channel is live
+// and whether the bot has joined its chat
+type ChannelState struct {
+	UserID       uint64 `badgerhold:"key"`
+	TwitchID     string
+	Live         bool
+	Joined       bool
+	LiveSince    time.Time
+	OfflineSince time.Time
+	// TitleRace is the slug of the race the stream title was set for,
+	// with OriginalTitle and OriginalGameID to restore when it ends
+	TitleRace      string
+	OriginalTitle  string
+	OriginalGameID string
+	UpdatedAt      time.Time
+}
+
+// FindChannelState looks up the state of a user's channel
+func (db *BadgerStore) FindChannelState(userID uint64) (*ChannelState, error) {
+	var state ChannelState
+	err := db.store.Get(userID, &state)
+	if err != nil {
+		if err == badgerhold.ErrNotFound {
+			return nil, ErrNotFound
+		}
+
+		return nil, fmt.Errorf("error while looking up channel state for user %v: %w", userID, err)
+	}
+
+	return &state, nil
+}
+
+// FindChannelStates lists the state of every channel
+func (db *BadgerStore) FindChannelStates() ([]*ChannelState, error) {
+	var states []*ChannelState
+	err := db.store.Find(&states, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error while looking up channel states: %w", err)
+	}
+
+	return states, nil
+}
+
+// SaveChannelState inserts or replaces the state of a user's channel
+func (db *BadgerStore) SaveChannelState(state ChannelState) (*ChannelState, error) {
+	state.UpdatedAt = time.Now()
+
+	err := db.store.Upsert(state.UserID, &state)
+	if err != nil {
+		return nil, fmt.Errorf("error saving channel state for user %v: %w", state.UserID, err)
+	}
+
+	return &state, nil
+}
@@ -0,0 +1,57 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+)
+
+// Clip status values
+const (
+	ClipPending = "pending"
+	ClipReady   = "ready"
+	ClipFailed  = "failed"
+)
+
+// Clip is a twitch clip the bot created of a streamer finishing a race
+type Clip struct {
+	ID       string `badgerhold:"key"`
+	UserID   uint64 `badgerhold:"index"`
+	RaceSlug string `badgerhold:"index"`
+	EditURL  string
+	// URL is only known once twitch has finished processing the clip
+	URL       string
+	Status    string
+	CreatedAt time.Time
+}
+
+// FindClips lists the clips matching a query
+func (db *BadgerStore) FindClips(query *Query) ([]*Clip, error) {
+	var clips []*Clip
+	err := db.find(clipSchema, &clips, query)
+	if err != nil {
+		return nil, fmt.Errorf("error while looking up clips: %w", err)
+	}
+
+	return clips, nil
+}
+
+// CountClips counts the clips matching a query
+func (db *BadgerStore) CountClips(query *Query) (int, error) {
+	var clips []*Clip
+	n, err := db.count(clipSchema, &clips, query)
+	if err != nil {
+		return 0, fmt.Errorf("error while counting clips: %w", err)
+	}
+
+	return n, nil
+}
+
+// SaveClip inserts or replaces a clip
+func (db *BadgerStore) SaveClip(clip Clip) (*Clip, error) {
+	err := db.store.Upsert(clip.ID, &clip)
+	if err != nil {
+		return nil, fmt.Errorf("error saving clip %s: %w", clip.ID, err)
+	}
+
+	return &clip, nil
+}
@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/timshannon/badgerhold"
+)
+
+// Outcomes of the chat commands the bot handles
+const (
+	CommandAnswered   = "answered"
+	CommandCooldown   = "cooldown"
+	CommandPermission = "permission"
+	CommandNotInRace  = "not_in_race"
+	// CommandDisabled commands were turned off in the channel they were used in
+	CommandDisabled = "disabled"
+)
+
+// CommandLog records a chat command the bot handled in a streamer's channel
+type CommandLog struct {
+	ID uint64 `badgerhold:"key"`
+	// UserID is the streamer whose channel the command was used in
+	UserID  uint64
+	Channel string
+	Chatter string
+	Command string
+	Args    string
+	// Latency is how long the bot took to handle the command
+	Latency   time.Duration
+	Outcome   string
+	CreatedAt time.Time `badgerholdIndex:"CreatedAt"`
+}
+
+// SaveCommandLog records a handled command
+func (db *BadgerStore) SaveCommandLog(entry CommandLog) (*CommandLog, error) {
+	err := db.store.Insert(badgerhold.NextSequence(), &entry)
+	if err != nil {
+		return nil, fmt.Errorf("error saving command log: %w", err)
+	}
+
+	return &entry, nil
+}
+
+// FindCommandLogs lists the handled commands matching a query
+func (db *BadgerStore) FindCommandLogs(query *Query) ([]*CommandLog, error) {
+	var logs []*CommandLog
+	err := db.find(commandLogSchema, &logs, query)
+	if err != nil {
+		return nil, fmt.Errorf("error while looking up command logs: %w", err)
+	}
+
+	return logs, nil
+}
+
+// CountCommandLogs counts the handled commands matching a query
+func (db *BadgerStore) CountCommandLogs(query *Query) (int, error) {
+	var logs []*CommandLog
+	n, err := db.count(commandLogSchema, &logs, query)
+	if err != nil {
+		return 0, fmt.Errorf("error while counting command logs: %w", err)
+	}
+
+	return n, nil
+}
+
+// DeleteCommandLogs deletes the commands handled before a time, returning how many were deleted
+func (db *BadgerStore) DeleteCommandLogs(before time.Time) (int, error) {
+	var logs []*CommandLog
+	query := badgerhold.Where("CreatedAt").Lt(before).Index("CreatedAt")
+	err := db.store.Find(&logs, query)
+	if err != nil {
+		return 0, fmt.Errorf("error while looking up command logs: %w", err)
+	}
+	if len(logs) == 0 {
+		return 0, nil
+	}
+
+	err = db.store.DeleteMatching(&CommandLog{}, query)
+	if err != nil {
+		return 0, fmt.Errorf("error deleting command logs: %w", err)
+	}
+
+	return len(logs), nil
+}
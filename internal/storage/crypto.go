@@ -0,0 +1,374 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/config"
+)
+
+// ErrNoEncryptionKey is returned when storing a secret without a configured key
+var ErrNoEncryptionKey = errors.New("no database encryption key has been configured")
+
+// ErrUnknownEncryptionKey is returned when opening a secret sealed with a key the store doesn't have
+var ErrUnknownEncryptionKey = errors.New("secret was sealed with an unknown database encryption key")
+
+// envelopeHeader starts every secret sealed in an envelope, telling
+// them apart from secrets sealed directly with the master key. Secrets in
+// an envelope are bound to what they were sealed for, while those in a
+// legacyEnvelopeHeader envelope are not and are only ever opened.
+var (
+	envelopeHeader       = []byte("twe2")
+	legacyEnvelopeHeader = []byte("twe1")
+)
+
+const (
+	keySize   = 32
+	keyIDSize = 8
+)
+
+// GenerateKey creates a random base64 encoded 32 byte database encryption key
+func GenerateKey() (string, error) {
+	k := make([]byte, keySize)
+	_, err := io.ReadFull(rand.Reader, k)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(k), nil
+}
+
+// masterKey wraps the data key of every secret sealed with it
+type masterKey struct {
+	// id tells which master key wrapped a data key, without revealing the key
+	id   []byte
+	aead cipher.AEAD
+}
+
+// parseKey reads a base64 encoded 32 byte master key
+func parseKey(key string) (*masterKey, error) {
+	k, err := base64.StdEncoding.DecodeString(strings.TrimSpace(key))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding database encryption key: %w", err)
+	}
+	if len(k) != keySize {
+		return nil, fmt.Errorf("database encryption key must be %v bytes, got %v", keySize, len(k))
+	}
+
+	aead, err := newAEAD(k)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(k)
+
+	return &masterKey{id: sum[:keyIDSize], aead: aead}, nil
+}
+
+// newAEAD creates an AES-GCM cipher from a 32 byte key
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// newSecrets loads the configured master key, either given directly or read
+// from a key file, leaving secrets without a key when neither is set
+func newSecrets(conf config.DB) (secrets, error) {
+	key := conf.EncryptionKey
+	if conf.EncryptionKeyFile != "" {
+		if key != "" {
+			return secrets{}, errors.New("set either DB_ENCRYPTION_KEY or DB_ENCRYPTION_KEY_FILE, not both")
+		}
+
+		b, err := ioutil.ReadFile(conf.EncryptionKeyFile)
+		if err != nil {
+			return secrets{}, fmt.Errorf("error reading database encryption key file: %w", err)
+		}
+		key = string(b)
+	}
+	if key == "" {
+		return secrets{}, nil
+	}
+
+	k, err := parseKey(key)
+	if err != nil {
+		return secrets{}, err
+	}
+
+	return secrets{key: k}, nil
+}
+
+// secrets encrypts secrets such as user tokens before they are stored. Each
+// secret is sealed with a random data key of its own, kept alongside it
+// wrapped by the master key, so the master key never touches the secrets
+// themselves and rotating it only rewraps data keys.
+type secrets struct {
+	// key seals secrets, and is nil when no key is configured
+	key *masterKey
+	// previous are the keys secrets sealed before a rotation may still be wrapped with
+	previous []*masterKey
+}
+
+// encrypt seals plaintext in an envelope of the key id, the wrapped data key
+// and the plaintext sealed with the data key. The sealed plaintext is bound to
+// aad, such as the record and field it is stored in, so it only opens with it.
+func (s secrets) encrypt(plaintext, aad []byte) ([]byte, error) {
+	if s.key == nil {
+		return nil, ErrNoEncryptionKey
+	}
+
+	dataKey := make([]byte, keySize)
+	_, err := io.ReadFull(rand.Reader, dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.key.seal(dataKey, plaintext, aad)
+}
+
+// seal seals plaintext with a data key, then wraps the data key with the master key
+func (k *masterKey) seal(dataKey, plaintext, aad []byte) ([]byte, error) {
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := seal(aead, plaintext, aad)
+	if err != nil {
+		return nil, err
+	}
+
+	return k.wrap(dataKey, sealed)
+}
+
+// wrap puts a secret sealed with a data key in an envelope, along with the
+// data key wrapped by the master key
+func (k *masterKey) wrap(dataKey, sealed []byte) ([]byte, error) {
+	wrapped, err := seal(k.aead, dataKey, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	envelope := append([]byte(nil), envelopeHeader...)
+	envelope = append(envelope, k.id...)
+	envelope = append(envelope, wrapped...)
+
+	return append(envelope, sealed...), nil
+}
+
+// decrypt opens ciphertext created by encrypt with the same aad, along with
+// secrets sealed before they were bound to anything
+func (s secrets) decrypt(ciphertext, aad []byte) ([]byte, error) {
+	dataKey, sealed, err := s.unwrap(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	if dataKey == nil {
+		return s.decryptLegacy(ciphertext)
+	}
+	if bytes.HasPrefix(ciphertext, legacyEnvelopeHeader) {
+		aad = nil
+	}
+
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return open(aead, sealed, aad)
+}
+
+// unwrap opens the data key of an envelope, returning it along with the
+// sealed secret. Ciphertext which isn't an envelope has no data key.
+func (s secrets) unwrap(ciphertext []byte) (dataKey, sealed []byte, err error) {
+	if s.key == nil && len(s.previous) == 0 {
+		return nil, nil, ErrNoEncryptionKey
+	}
+	if !bytes.HasPrefix(ciphertext, envelopeHeader) && !bytes.HasPrefix(ciphertext, legacyEnvelopeHeader) {
+		return nil, nil, nil
+	}
+
+	// both envelopes have headers of the same size
+	rest := ciphertext[len(envelopeHeader):]
+	if len(rest) < keyIDSize {
+		return nil, nil, errors.New("ciphertext is too short")
+	}
+	id, rest := rest[:keyIDSize], rest[keyIDSize:]
+
+	key := s.find(id)
+	if key == nil {
+		return nil, nil, ErrUnknownEncryptionKey
+	}
+
+	size := key.aead.NonceSize() + keySize + key.aead.Overhead()
+	if len(rest) < size {
+		return nil, nil, errors.New("ciphertext is too short")
+	}
+	dataKey, err = open(key.aead, rest[:size], nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return dataKey, rest[size:], nil
+}
+
+// decryptLegacy opens secrets sealed directly with a master key, as they
+// were before envelope encryption
+func (s secrets) decryptLegacy(ciphertext []byte) ([]byte, error) {
+	err := errors.New("no keys to decrypt with")
+	for _, k := range s.keys() {
+		var plaintext []byte
+		plaintext, err = open(k.aead, ciphertext, nil)
+		if err == nil {
+			return plaintext, nil
+		}
+	}
+
+	return nil, err
+}
+
+// rewrap wraps the data key of a sealed secret with the current key, sealing
+// secrets from before they were bound to aad in a new envelope bound to it.
+// It reports whether the secret changed, as secrets already wrapped with the
+// current key are left be.
+func (s secrets) rewrap(ciphertext, aad []byte) ([]byte, bool, error) {
+	if s.key == nil {
+		return nil, false, ErrNoEncryptionKey
+	}
+	if bytes.HasPrefix(ciphertext, envelopeHeader) && len(ciphertext) >= len(envelopeHeader)+keyIDSize &&
+		bytes.Equal(ciphertext[len(envelopeHeader):len(envelopeHeader)+keyIDSize], s.key.id) {
+		return ciphertext, false, nil
+	}
+
+	if !bytes.HasPrefix(ciphertext, envelopeHeader) {
+		plaintext, err := s.decrypt(ciphertext, aad)
+		if err != nil {
+			return nil, false, err
+		}
+
+		envelope, err := s.encrypt(plaintext, aad)
+		return envelope, err == nil, err
+	}
+
+	dataKey, sealed, err := s.unwrap(ciphertext)
+	if err != nil {
+		return nil, false, err
+	}
+
+	envelope, err := s.key.wrap(dataKey, sealed)
+	return envelope, err == nil, err
+}
+
+// rotate makes a base64 encoded key the one secrets are sealed with, keeping
+// the current keys to open secrets not yet rewrapped
+func (s secrets) rotate(key string) (secrets, error) {
+	k, err := parseKey(key)
+	if err != nil {
+		return secrets{}, err
+	}
+
+	var previous []*masterKey
+	for _, p := range s.keys() {
+		if !bytes.Equal(p.id, k.id) {
+			previous = append(previous, p)
+		}
+	}
+
+	return secrets{key: k, previous: previous}, nil
+}
+
+// keys lists the current key followed by the previous keys
+func (s secrets) keys() []*masterKey {
+	var keys []*masterKey
+	if s.key != nil {
+		keys = append(keys, s.key)
+	}
+
+	return append(keys, s.previous...)
+}
+
+// find looks up a key by id
+func (s secrets) find(id []byte) *masterKey {
+	for _, k := range s.keys() {
+		if bytes.Equal(k.id, id) {
+			return k
+		}
+	}
+
+	return nil
+}
+
+// seal encrypts plaintext bound to aad, prefixing the result with its nonce
+func seal(aead cipher.AEAD, plaintext, aad []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+// open decrypts ciphertext created by seal with the same aad
+func open(aead cipher.AEAD, ciphertext, aad []byte) ([]byte, error) {
+	size := aead.NonceSize()
+	if len(ciphertext) < size {
+		return nil, errors.New("ciphertext is too short")
+	}
+
+	return aead.Open(nil, ciphertext[:size], ciphertext[size:], aad)
+}
+
+// tokenAAD binds a twitch token to the user it is stored on, so a token
+// copied onto another user's record doesn't open
+func tokenAAD(userID uint64) []byte {
+	return []byte(fmt.Sprintf("users/%d/twitch_token", userID))
+}
+
+// sealToken encrypts a token for storage on a user record
+func (s secrets) sealToken(userID uint64, token OAuthToken) ([]byte, error) {
+	plaintext, err := json.Marshal(token)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.encrypt(plaintext, tokenAAD(userID))
+}
+
+// openToken decrypts a token sealed by sealToken for the same user
+func (s secrets) openToken(userID uint64, ciphertext []byte) (*OAuthToken, error) {
+	plaintext, err := s.decrypt(ciphertext, tokenAAD(userID))
+	if err != nil {
+		return nil, err
+	}
+
+	var token OAuthToken
+	err = json.Unmarshal(plaintext, &token)
+	if err != nil {
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+// moveToken reseals a token sealed for one user for another
+func (s secrets) moveToken(ciphertext []byte, from, to uint64) ([]byte, error) {
+	plaintext, err := s.decrypt(ciphertext, tokenAAD(from))
+	if err != nil {
+		return nil, err
+	}
+
+	return s.encrypt(plaintext, tokenAAD(to))
+}
@@ -0,0 +1,215 @@
+package storage_test
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/config"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/storage"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/storage/storagetest"
+)
+
+func TestEncryptionKeys(t *testing.T) {
+	t.Run("should read the key from a key file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "key")
+		err := ioutil.WriteFile(path, []byte(storagetest.EncryptionKey+"\n"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		db, err := storage.OpenMemory(config.DB{EncryptionKeyFile: path})
+		if err != nil {
+			t.Fatal(err)
+		}
+		user, err := db.CreateUser("1", "streamer", "Streamer", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.SaveTwitchToken(user.ID, storage.OAuthToken{AccessToken: "access"})
+		if err != nil {
+			t.Errorf("got %v, want nil", err)
+		}
+	})
+
+	t.Run("should not take both a key and a key file", func(t *testing.T) {
+		_, err := storage.OpenMemory(config.DB{
+			EncryptionKey:     storagetest.EncryptionKey,
+			EncryptionKeyFile: filepath.Join(t.TempDir(), "key"),
+		})
+		if err == nil {
+			t.Error("got nil, want an error")
+		}
+	})
+
+	t.Run("should not open tokens sealed with another key", func(t *testing.T) {
+		path := t.TempDir()
+		db, err := storage.OpenBadger(config.DB{Path: path, EncryptionKey: storagetest.EncryptionKey})
+		if err != nil {
+			t.Fatal(err)
+		}
+		user, err := db.CreateUser("1", "streamer", "Streamer", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.SaveTwitchToken(user.ID, storage.OAuthToken{AccessToken: "access"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+
+		key, err := storage.GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		db, err = storage.OpenBadger(config.DB{Path: path, EncryptionKey: key})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		_, err = db.FindTwitchToken(user.ID)
+		if !errors.Is(err, storage.ErrUnknownEncryptionKey) {
+			t.Errorf("got %v, want %v", err, storage.ErrUnknownEncryptionKey)
+		}
+	})
+
+	t.Run("should not leak tokens in backups", func(t *testing.T) {
+		db := openBadger(t)
+		user, err := db.CreateUser("1", "streamer", "Streamer", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.SaveTwitchToken(user.ID, storage.OAuthToken{
+			AccessToken:  "plaintext-access-token",
+			RefreshToken: "plaintext-refresh-token",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var backup bytes.Buffer
+		err = db.Backup(&backup)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(backup.Bytes(), []byte("plaintext-")) {
+			t.Error("got a backup containing a plaintext token, want only sealed tokens")
+		}
+	})
+
+	t.Run("should not open tokens moved onto another user", func(t *testing.T) {
+		dsn := filepath.Join(t.TempDir(), "twwr.db")
+		db := openSQLiteAt(t, dsn)
+		for _, id := range []string{"1", "2"} {
+			user, err := db.CreateUser(id, "streamer"+id, "Streamer"+id, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = db.SaveTwitchToken(user.ID, storage.OAuthToken{AccessToken: "access-" + id})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		conn, err := sql.Open("sqlite3", dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		_, err = conn.Exec("UPDATE users SET twitch_token = (SELECT twitch_token FROM users WHERE id = 1) WHERE id = 2")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		token, err := db.FindTwitchToken(2)
+		if err == nil {
+			t.Errorf("got %+v, want an error", token)
+		}
+	})
+
+	t.Run("should open and upgrade tokens sealed before they were bound to their user", func(t *testing.T) {
+		dsn := filepath.Join(t.TempDir(), "twwr.db")
+		db := openSQLiteAt(t, dsn)
+		user, err := db.CreateUser("1", "streamer", "Streamer", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn, err := sql.Open("sqlite3", dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		_, err = conn.Exec("UPDATE users SET twitch_token = ? WHERE id = ?", unboundEnvelope(t, storagetest.EncryptionKey, storage.OAuthToken{AccessToken: "access"}), user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		token, err := db.FindTwitchToken(user.ID)
+		if err != nil || token.AccessToken != "access" {
+			t.Fatalf("got %+v (%v), want the token", token, err)
+		}
+
+		key, err := storage.GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := db.RotateEncryptionKey(key)
+		if err != nil || n != 1 {
+			t.Fatalf("got %v rewrapped (%v), want %v", n, err, 1)
+		}
+		var ciphertext []byte
+		err = conn.QueryRow("SELECT twitch_token FROM users WHERE id = ?", user.ID).Scan(&ciphertext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(ciphertext, []byte("twe2")) {
+			t.Errorf("got %q, want the token in a bound envelope", ciphertext[:4])
+		}
+	})
+}
+
+// unboundEnvelope seals a token as envelopes were before they were bound to their user
+func unboundEnvelope(t *testing.T, key string, token storage.OAuthToken) []byte {
+	seal := func(key, plaintext []byte) []byte {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nonce := make([]byte, aead.NonceSize())
+		rand.Read(nonce)
+
+		return aead.Seal(nonce, nonce, plaintext, nil)
+	}
+
+	master, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := json.Marshal(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataKey := make([]byte, 32)
+	rand.Read(dataKey)
+	id := sha256.Sum256(master)
+
+	envelope := append([]byte("twe1"), id[:8]...)
+	envelope = append(envelope, seal(master, dataKey)...)
+
+	return append(envelope, seal(dataKey, plaintext)...)
+}
@@ -1,23 +1,40 @@
 package storage
 
 import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"time"
+
 	"github.com/TBPixel/tww-rando-twitch-bot/internal/config"
 	"github.com/dgraph-io/badger"
 	"github.com/timshannon/badgerhold"
 )
 
-// DB
-type DB struct {
+// BadgerStore keeps everything in an embedded badger database
+type BadgerStore struct {
+	secrets
 	store *badgerhold.Store
 }
 
-// Open
-func Open(conf config.DB) (*DB, error) {
+// OpenBadger opens the badger database at the configured path
+func OpenBadger(conf config.DB) (*BadgerStore, error) {
 	options := badger.DefaultOptions(conf.Path)
 	if conf.EnableLogging == false {
 		options.Logger = nil
 	}
 
+	keys, err := newSecrets(conf)
+	if err != nil {
+		return nil, err
+	}
+
 	store, err := badgerhold.Open(badgerhold.Options{
 		Options:          options,
 		Encoder:          badgerhold.DefaultEncode,
@@ -28,12 +45,301 @@ func Open(conf config.DB) (*DB, error) {
 		return nil, err
 	}
 
-	return &DB{
-		store,
-	}, nil
+	db := &BadgerStore{
+		secrets: keys,
+		store:   store,
+	}
+	err = db.migrateMultistreamSettings()
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+
+	return db, nil
 }
 
 // Close
-func (db *DB) Close() error {
+func (db *BadgerStore) Close() error {
 	return db.store.Close()
 }
+
+// clear removes every record
+func (db *BadgerStore) clear() error {
+	return db.store.Badger().DropAll()
+}
+
+// find looks up the records of a schema matching a query into result, a
+// pointer to a slice. Badger filters them, then they are sorted and paged as
+// every store does, since badger keeps keys out of the records it sorts.
+func (db *BadgerStore) find(s schema, result interface{}, query *Query) error {
+	q, err := badgerQuery(s, query)
+	if err != nil {
+		return err
+	}
+
+	err = db.store.Find(result, q)
+	if err != nil {
+		return err
+	}
+
+	records := reflect.ValueOf(result).Elem()
+	from, to, err := query.arrange(s, records.Interface())
+	if err != nil {
+		return err
+	}
+	records.Set(records.Slice(from, to))
+
+	return nil
+}
+
+// count counts the records of a schema matching a query's conditions,
+// reading them into result, a pointer to a slice
+func (db *BadgerStore) count(s schema, result interface{}, query *Query) (int, error) {
+	q, err := badgerQuery(s, query)
+	if err != nil {
+		return 0, err
+	}
+
+	err = db.store.Find(result, q)
+	if err != nil {
+		return 0, err
+	}
+
+	return reflect.ValueOf(result).Elem().Len(), nil
+}
+
+// badgerQuery turns the conditions of a query into a badgerhold query,
+// using the schema's index on a field when one is queried
+func badgerQuery(s schema, query *Query) (*badgerhold.Query, error) {
+	err := query.validate(s)
+	if err != nil {
+		return nil, err
+	}
+	if query == nil || len(query.criteria) == 0 {
+		// a nil query matches every record
+		return nil, nil
+	}
+
+	var q *badgerhold.Query
+	index := ""
+	for _, c := range query.criteria {
+		field := string(c.field)
+		if c.field == s.key {
+			field = badgerhold.Key
+		}
+		if index == "" && s.indexes[c.field] {
+			index = field
+		}
+
+		var criterion *badgerhold.Criterion
+		if q == nil {
+			criterion = badgerhold.Where(field)
+		} else {
+			criterion = q.And(field)
+		}
+
+		switch c.op {
+		case opEq:
+			q = criterion.Eq(c.value)
+		case opNe:
+			q = criterion.Ne(c.value)
+		case opGt:
+			q = criterion.Gt(c.value)
+		case opGe:
+			q = criterion.Ge(c.value)
+		case opLt:
+			q = criterion.Lt(c.value)
+		case opLe:
+			q = criterion.Le(c.value)
+		}
+	}
+	if index != "" {
+		q = q.Index(index)
+	}
+
+	return q, nil
+}
+
+// Backup streams an online backup of the whole database to w
+func (db *BadgerStore) Backup(w io.Writer) error {
+	_, err := db.store.Badger().Backup(w, 0)
+	return err
+}
+
+// Restore replaces every record with those of a backup. The backup is first
+// loaded into a scratch database and read back, so one which is corrupt or
+// isn't of this bot leaves the existing data as it was.
+func (db *BadgerStore) Restore(backup io.ReadSeeker) error {
+	err := validateBackup(backup)
+	if err != nil {
+		return fmt.Errorf("invalid backup: %w", err)
+	}
+
+	_, err = backup.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	err = db.store.Badger().DropAll()
+	if err != nil {
+		return fmt.Errorf("error clearing database: %w", err)
+	}
+
+	return db.store.Badger().Load(backup, maxPendingRestoreWrites)
+}
+
+// maxPendingRestoreWrites bounds the memory a restore uses
+const maxPendingRestoreWrites = 256
+
+func validateBackup(backup io.Reader) error {
+	dir, err := ioutil.TempDir("", "twwr-restore")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	options := badger.DefaultOptions(dir)
+	options.Logger = nil
+	scratch, err := badgerhold.Open(badgerhold.Options{
+		Options: options,
+		Encoder: badgerhold.DefaultEncode,
+		Decoder: badgerhold.DefaultDecode,
+	})
+	if err != nil {
+		return err
+	}
+	defer scratch.Close()
+
+	err = load(scratch.Badger(), backup)
+	if err != nil {
+		return err
+	}
+
+	// every record must decode, as it would once restored
+	var users []*User
+	err = scratch.Find(&users, nil)
+	if err != nil {
+		return err
+	}
+	var states []*ChannelState
+	err = scratch.Find(&states, nil)
+	if err != nil {
+		return err
+	}
+	var settings []*ChannelSettings
+	err = scratch.Find(&settings, nil)
+	if err != nil {
+		return err
+	}
+	var predictions []*Prediction
+	err = scratch.Find(&predictions, nil)
+	if err != nil {
+		return err
+	}
+	var clips []*Clip
+	err = scratch.Find(&clips, nil)
+	if err != nil {
+		return err
+	}
+	var races []*Race
+	err = scratch.Find(&races, nil)
+	if err != nil {
+		return err
+	}
+	var logs []*CommandLog
+	return scratch.Find(&logs, nil)
+}
+
+// load reads a backup into a database, returning an error rather than
+// panicking as badger does when a backup is corrupt
+func load(db *badger.DB, backup io.Reader) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("corrupt backup: %v", r)
+		}
+	}()
+
+	return db.Load(backup, maxPendingRestoreWrites)
+}
+
+// RunBackups writes a backup to dir every interval until the context ends,
+// naming each after when it was taken and keeping only the latest keep
+// backups, or every backup when keep is 0
+func (db *BadgerStore) RunBackups(ctx context.Context, dir string, interval time.Duration, keep int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			path, err := db.backupTo(dir)
+			if err != nil {
+				log.Printf("backup: %s", err)
+				continue
+			}
+			log.Printf("backup: database backed up to %s", path)
+
+			err = pruneBackups(dir, keep)
+			if err != nil {
+				log.Printf("backup: %s", err)
+			}
+		}
+	}
+}
+
+// pruneBackups removes all but the latest keep backups in dir, which sort
+// by when they were taken as they are named after it
+func pruneBackups(dir string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+
+	backups, err := filepath.Glob(filepath.Join(dir, "twwr-*.bak"))
+	if err != nil {
+		return err
+	}
+	if len(backups) <= keep {
+		return nil
+	}
+
+	sort.Strings(backups)
+	for _, path := range backups[:len(backups)-keep] {
+		err = os.Remove(path)
+		if err != nil {
+			return err
+		}
+		log.Printf("backup: removed old backup %s", path)
+	}
+
+	return nil
+}
+
+// backupTo writes a backup into dir, only giving it its final
+// name once complete so partial backups are never mistaken for one
+func (db *BadgerStore) backupTo(dir string) (string, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := ioutil.TempFile(dir, ".twwr-backup-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+
+	err = db.Backup(f)
+	if err != nil {
+		f.Close()
+		return "", err
+	}
+	err = f.Close()
+	if err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, fmt.Sprintf("twwr-%s.bak", time.Now().UTC().Format("20060102T150405Z")))
+	return path, os.Rename(f.Name(), path)
+}
@@ -0,0 +1,436 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// ExportFormat names exports in their header, with ExportVersion
+// bumped whenever the records of an export change incompatibly.
+// Version 1 kept multistream settings on users.
+const (
+	ExportFormat  = "twwr-export"
+	ExportVersion = 2
+)
+
+// Record types of an export
+const (
+	RecordUser            = "user"
+	RecordChannelState    = "channel_state"
+	RecordChannelSettings = "channel_settings"
+	RecordPrediction      = "prediction"
+	RecordClip            = "clip"
+	RecordRace            = "race"
+	RecordCommandLog      = "command_log"
+)
+
+// exportHeader is the first line of an export
+type exportHeader struct {
+	Format     string    `json:"format"`
+	Version    int       `json:"version"`
+	ExportedAt time.Time `json:"exported_at"`
+}
+
+// exportRecord is every line after the header, one entity each
+type exportRecord struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+// ExportStats counts the records of each type exported or imported
+type ExportStats map[string]int
+
+// Export writes every entity of a store as JSON Lines. Twitch tokens stay
+// encrypted, so an export can only be imported with the same DB_ENCRYPTION_KEY.
+func Export(db Store, w io.Writer) (ExportStats, error) {
+	enc := json.NewEncoder(w)
+	err := enc.Encode(exportHeader{
+		Format:     ExportFormat,
+		Version:    ExportVersion,
+		ExportedAt: time.Now(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	stats := ExportStats{}
+	write := func(recordType string, data interface{}) error {
+		raw, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+
+		stats[recordType]++
+		return enc.Encode(exportRecord{Type: recordType, Data: raw})
+	}
+
+	users, err := db.FindUsers(nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range users {
+		err = write(RecordUser, u)
+		if err != nil {
+			return nil, err
+		}
+
+		predictions, err := db.FindPredictions(Where(FieldUserID).Eq(u.ID).SortBy(FieldCreatedAt).Reverse())
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range predictions {
+			err = write(RecordPrediction, p)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		clips, err := db.FindClips(Where(FieldUserID).Eq(u.ID).SortBy(FieldCreatedAt).Reverse())
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range clips {
+			err = write(RecordClip, c)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	states, err := db.FindChannelStates()
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range states {
+		err = write(RecordChannelState, s)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	settings, err := db.FindAllChannelSettings()
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range settings {
+		err = write(RecordChannelSettings, s)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	races, err := db.FindRaces(All().SortBy(FieldOpenedAt).Reverse())
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range races {
+		err = write(RecordRace, r)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	logs, err := db.FindCommandLogs(All().SortBy(FieldCreatedAt))
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range logs {
+		err = write(RecordCommandLog, l)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return stats, nil
+}
+
+// export is every entity read from an export
+type export struct {
+	users         []User
+	channelStates []ChannelState
+	settings      []ChannelSettings
+	predictions   []Prediction
+	clips         []Clip
+	races         []Race
+	commandLogs   []CommandLog
+}
+
+// readExport reads and validates a whole export, so nothing is
+// imported from one which is corrupt or from an unknown version
+func readExport(r io.Reader) (*export, error) {
+	scanner := bufio.NewScanner(r)
+	// races with many entrants make for long lines
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	if !scanner.Scan() {
+		if scanner.Err() != nil {
+			return nil, scanner.Err()
+		}
+
+		return nil, fmt.Errorf("export is empty")
+	}
+	var header exportHeader
+	err := json.Unmarshal(scanner.Bytes(), &header)
+	if err != nil || header.Format != ExportFormat {
+		return nil, fmt.Errorf("input is not a %s file", ExportFormat)
+	}
+	if header.Version < 1 || header.Version > ExportVersion {
+		return nil, fmt.Errorf("unsupported export version %d, expected %d or older", header.Version, ExportVersion)
+	}
+
+	var e export
+	var legacy []legacyUser
+	line := 1
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var record exportRecord
+		err = json.Unmarshal(scanner.Bytes(), &record)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		switch record.Type {
+		case RecordUser:
+			var u User
+			err = json.Unmarshal(record.Data, &u)
+			e.users = append(e.users, u)
+			if err == nil && header.Version < 2 {
+				var l legacyUser
+				err = json.Unmarshal(record.Data, &l)
+				legacy = append(legacy, l)
+			}
+		case RecordChannelState:
+			var s ChannelState
+			err = json.Unmarshal(record.Data, &s)
+			e.channelStates = append(e.channelStates, s)
+		case RecordChannelSettings:
+			var s ChannelSettings
+			err = json.Unmarshal(record.Data, &s)
+			e.settings = append(e.settings, s)
+		case RecordPrediction:
+			var p Prediction
+			err = json.Unmarshal(record.Data, &p)
+			e.predictions = append(e.predictions, p)
+		case RecordClip:
+			var c Clip
+			err = json.Unmarshal(record.Data, &c)
+			e.clips = append(e.clips, c)
+		case RecordRace:
+			var race Race
+			err = json.Unmarshal(record.Data, &race)
+			e.races = append(e.races, race)
+		case RecordCommandLog:
+			var l CommandLog
+			err = json.Unmarshal(record.Data, &l)
+			e.commandLogs = append(e.commandLogs, l)
+		default:
+			err = fmt.Errorf("unknown record type %q", record.Type)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+	if scanner.Err() != nil {
+		return nil, scanner.Err()
+	}
+
+	// channels without settings keep the multistream settings of older exports
+	configured := map[uint64]bool{}
+	for _, s := range e.settings {
+		configured[s.UserID] = true
+	}
+	for _, l := range legacy {
+		settings, ok := l.settings()
+		if ok && !configured[l.ID] {
+			e.settings = append(e.settings, settings)
+		}
+	}
+
+	users := map[uint64]bool{}
+	// accounts finds users sharing an account, which databases from before
+	// accounts were kept unique can hold and no store will restore
+	accounts := map[Field]map[string]uint64{FieldTwitchID: {}, FieldRacetimeID: {}}
+	for _, u := range e.users {
+		if users[u.ID] {
+			return nil, fmt.Errorf("user %d is exported more than once", u.ID)
+		}
+		users[u.ID] = true
+
+		for _, a := range []struct {
+			field Field
+			value string
+		}{{FieldTwitchID, u.TwitchID}, {FieldRacetimeID, u.RacetimeID}} {
+			if a.value == "" {
+				continue
+			}
+			if other, ok := accounts[a.field][a.value]; ok {
+				return nil, fmt.Errorf("users %d and %d share %s %s, merge them with twwr users merge before exporting", other, u.ID, a.field, a.value)
+			}
+			accounts[a.field][a.value] = u.ID
+		}
+	}
+	for _, s := range e.channelStates {
+		if !users[s.UserID] {
+			return nil, fmt.Errorf("channel state of user %d has no user", s.UserID)
+		}
+	}
+	for _, s := range e.settings {
+		if !users[s.UserID] {
+			return nil, fmt.Errorf("channel settings of user %d have no user", s.UserID)
+		}
+	}
+	for _, p := range e.predictions {
+		if !users[p.UserID] {
+			return nil, fmt.Errorf("prediction %s of user %d has no user", p.ID, p.UserID)
+		}
+	}
+	for _, c := range e.clips {
+		if !users[c.UserID] {
+			return nil, fmt.Errorf("clip %s of user %d has no user", c.ID, c.UserID)
+		}
+	}
+
+	for _, l := range e.commandLogs {
+		if !users[l.UserID] {
+			return nil, fmt.Errorf("command log %d of user %d has no user", l.ID, l.UserID)
+		}
+	}
+
+	return &e, nil
+}
+
+// clearer is a store which can remove every record it keeps
+type clearer interface {
+	clear() error
+}
+
+// Import reads an export into an empty store, keeping the ids of its users.
+// The whole export is validated before anything is written, and the store is
+// emptied again should writing it fail partway.
+func Import(db Store, r io.Reader) (ExportStats, error) {
+	e, err := readExport(r)
+	if err != nil {
+		return nil, fmt.Errorf("invalid export: %w", err)
+	}
+
+	err = checkEmpty(db)
+	if err != nil {
+		return nil, err
+	}
+
+	stats, err := importExport(db, e)
+	if err != nil {
+		if c, ok := db.(clearer); ok {
+			cerr := c.clear()
+			if cerr != nil {
+				return stats, fmt.Errorf("%w, and the partial import could not be cleared: %s", err, cerr)
+			}
+			stats = ExportStats{}
+		}
+
+		return stats, err
+	}
+
+	return stats, nil
+}
+
+// checkEmpty makes sure a store holds nothing, as it is cleared should an import fail
+func checkEmpty(db Store) error {
+	counts := []struct {
+		name  string
+		count func(*Query) (int, error)
+	}{
+		{"users", db.CountUsers},
+		{"predictions", db.CountPredictions},
+		{"clips", db.CountClips},
+		{"races", db.CountRaces},
+		{"command logs", db.CountCommandLogs},
+	}
+	for _, c := range counts {
+		n, err := c.count(nil)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			return fmt.Errorf("can only import into an empty database, found %d %s", n, c.name)
+		}
+	}
+
+	states, err := db.FindChannelStates()
+	if err != nil {
+		return err
+	}
+	settings, err := db.FindAllChannelSettings()
+	if err != nil {
+		return err
+	}
+	if len(states) > 0 || len(settings) > 0 {
+		return fmt.Errorf("can only import into an empty database, found channel states or settings")
+	}
+
+	return nil
+}
+
+// importExport writes every entity of an export, stopping at the first failure
+func importExport(db Store, e *export) (ExportStats, error) {
+	var err error
+	stats := ExportStats{}
+	for _, u := range e.users {
+		err = db.RestoreUser(u)
+		if err != nil {
+			return stats, err
+		}
+		stats[RecordUser]++
+	}
+	for _, s := range e.channelStates {
+		_, err = db.SaveChannelState(s)
+		if err != nil {
+			return stats, err
+		}
+		stats[RecordChannelState]++
+	}
+	for _, s := range e.settings {
+		_, err = db.SaveChannelSettings(s)
+		if err != nil {
+			return stats, err
+		}
+		stats[RecordChannelSettings]++
+	}
+	for _, p := range e.predictions {
+		_, err = db.SavePrediction(p)
+		if err != nil {
+			return stats, err
+		}
+		stats[RecordPrediction]++
+	}
+	for _, c := range e.clips {
+		_, err = db.SaveClip(c)
+		if err != nil {
+			return stats, err
+		}
+		stats[RecordClip]++
+	}
+	for _, race := range e.races {
+		_, err = db.SaveRace(race)
+		if err != nil {
+			return stats, err
+		}
+		stats[RecordRace]++
+	}
+	for _, l := range e.commandLogs {
+		_, err = db.SaveCommandLog(l)
+		if err != nil {
+			return stats, err
+		}
+		stats[RecordCommandLog]++
+	}
+
+	return stats, nil
+}
@@ -0,0 +1,396 @@
+package storage_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/config"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/storage"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/storage/storagetest"
+)
+
+func openBadger(t *testing.T) *storage.BadgerStore {
+	db, err := storage.OpenBadger(config.DB{
+		Path:          t.TempDir(),
+		EncryptionKey: storagetest.EncryptionKey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+	})
+
+	return db
+}
+
+func openSQLite(t *testing.T) *storage.SQLStore {
+	return openSQLiteAt(t, filepath.Join(t.TempDir(), "twwr.db"))
+}
+
+func openSQLiteAt(t *testing.T, dsn string) *storage.SQLStore {
+	db, err := storage.OpenSQL(config.DB{
+		Driver:        storage.DriverSQLite,
+		DSN:           dsn,
+		EncryptionKey: storagetest.EncryptionKey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+	})
+
+	return db
+}
+
+// seed fills a store with one of each entity, returning the user created
+func seed(t *testing.T, db storage.Store) *storage.User {
+	// badger hands out id 0 first, which exports must keep
+	user, err := db.CreateUser("1234", "tanjo3", "Tanjo3", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	racetimeID := "racetime-1"
+	_, err = db.UpdateUser(user.ID, storage.UserUpdate{RacetimeID: &racetimeID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err = db.SaveTwitchToken(user.ID, storage.OAuthToken{AccessToken: "access", Scopes: []string{"clips:edit"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.SaveChannelState(storage.ChannelState{UserID: user.ID, TwitchID: "1234", Live: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.SavePrediction(storage.Prediction{ID: "prediction", UserID: user.ID, RaceSlug: "clever-link-1234", Status: storage.PredictionResolved, CreatedAt: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.SaveClip(storage.Clip{ID: "clip", UserID: user.ID, RaceSlug: "clever-link-1234", Status: storage.ClipReady, CreatedAt: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.SaveChannelSettings(storage.ChannelSettings{UserID: user.ID, Prefix: "!tww"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.SaveCommandLog(storage.CommandLog{UserID: user.ID, Channel: "tanjo3", Command: "race", Outcome: storage.CommandAnswered, CreatedAt: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.SaveRace(storage.Race{
+		Slug:     "clever-link-1234",
+		Category: "twwr",
+		Status:   "finished",
+		Entrants: []storage.RaceEntrant{{RacetimeID: racetimeID, Name: "Tanjo3", Place: 1, FinishTime: time.Hour}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return user
+}
+
+func TestExport(t *testing.T) {
+	t.Run("should move every entity between drivers", func(t *testing.T) {
+		from := openBadger(t)
+		user := seed(t, from)
+
+		var export bytes.Buffer
+		stats, err := storage.Export(from, &export)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, recordType := range []string{storage.RecordUser, storage.RecordChannelState, storage.RecordChannelSettings,
+			storage.RecordPrediction, storage.RecordClip, storage.RecordRace, storage.RecordCommandLog} {
+			if stats[recordType] != 1 {
+				t.Errorf("got %v %s records, want %v", stats[recordType], recordType, 1)
+			}
+		}
+
+		to := openSQLite(t)
+		_, err = storage.Import(to, &export)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := to.FindUser(storage.Where(storage.FieldRacetimeID).Eq("racetime-1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.ID != user.ID || got.TwitchName != "tanjo3" {
+			t.Errorf("got %+v, want %+v", got, user)
+		}
+		token, err := to.FindTwitchToken(user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token.AccessToken != "access" {
+			t.Errorf("got %v, want %v", token.AccessToken, "access")
+		}
+		state, err := to.FindChannelState(user.ID)
+		if err != nil || !state.Live {
+			t.Errorf("got %+v (%v), want the live channel state", state, err)
+		}
+		clips, err := to.FindClips(storage.Where(storage.FieldUserID).Eq(user.ID))
+		if err != nil || len(clips) != 1 {
+			t.Errorf("got %v clips (%v), want %v", len(clips), err, 1)
+		}
+		race, err := to.FindRace("clever-link-1234")
+		if err != nil || len(race.Entrants) != 1 || race.Entrants[0].FinishTime != time.Hour {
+			t.Errorf("got %+v (%v), want the race and its entrant", race, err)
+		}
+
+		// new users must not take the ids of imported ones
+		other, err := to.CreateUser("5678", "other", "Other", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if other.ID == user.ID {
+			t.Errorf("got id %v for both users, want distinct ids", other.ID)
+		}
+	})
+
+	t.Run("should keep new badger users off the ids of imported ones", func(t *testing.T) {
+		from := openSQLite(t)
+		for _, id := range []string{"1", "2", "3"} {
+			_, err := from.CreateUser(id, "user"+id, "User"+id, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var export bytes.Buffer
+		_, err := storage.Export(from, &export)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		to := openBadger(t)
+		_, err = storage.Import(to, &export)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = to.CreateUser("4", "user4", "User4", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		users, err := to.FindUsers(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(users) != 4 {
+			t.Errorf("got %v users, want %v", len(users), 4)
+		}
+	})
+}
+
+func TestImport(t *testing.T) {
+	header := `{"format":"twwr-export","version":1}` + "\n"
+	user := `{"type":"user","data":{"ID":1,"TwitchID":"1234"}}` + "\n"
+
+	tests := map[string]string{
+		"should reject input which isn't an export": "hello\n",
+		"should reject unknown versions":            `{"format":"twwr-export","version":99}` + "\n",
+		"should reject unknown record types":        header + `{"type":"unknown","data":{}}` + "\n",
+		"should reject malformed records":           header + user + `{"type":"clip","data":` + "\n",
+		"should reject records without their user":  header + user + `{"type":"clip","data":{"ID":"clip","UserID":2}}` + "\n",
+		"should reject users exported twice":        header + user + user,
+		"should reject users sharing a twitch account": header + user +
+			`{"type":"user","data":{"ID":2,"TwitchID":"1234"}}` + "\n",
+		"should reject users sharing a racetime account": header +
+			`{"type":"user","data":{"ID":1,"TwitchID":"1","RacetimeID":"abc"}}` + "\n" +
+			`{"type":"user","data":{"ID":2,"TwitchID":"2","RacetimeID":"abc"}}` + "\n",
+	}
+	for name, input := range tests {
+		input := input
+		t.Run(name, func(t *testing.T) {
+			db := openBadger(t)
+			_, err := storage.Import(db, strings.NewReader(input))
+			if err == nil {
+				t.Fatal("got nil, want an error")
+			}
+
+			users, err := db.FindUsers(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(users) != 0 {
+				t.Errorf("got %v users, want nothing imported", len(users))
+			}
+		})
+	}
+
+	t.Run("should move the multistream settings of version 1 users to their channel settings", func(t *testing.T) {
+		db := openBadger(t)
+		_, err := storage.Import(db, strings.NewReader(header+
+			`{"type":"user","data":{"ID":1,"TwitchID":"1","MultistreamProvider":"kadgar","MultiHideFinished":true}}`+"\n"+
+			`{"type":"user","data":{"ID":2,"TwitchID":"2","MultistreamProvider":"kadgar"}}`+"\n"+
+			`{"type":"channel_settings","data":{"UserID":2,"Prefix":"!race","MultistreamProvider":"multitwitch"}}`+"\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		settings, err := db.FindChannelSettings(1)
+		if err != nil || settings.MultistreamProvider != "kadgar" || !settings.MultiHideFinished || settings.Prefix != "!twwr" {
+			t.Errorf("got %+v (%v), want the user's multistream settings", settings, err)
+		}
+		settings, err = db.FindChannelSettings(2)
+		if err != nil || settings.MultistreamProvider != "multitwitch" || settings.Prefix != "!race" {
+			t.Errorf("got %+v (%v), want the exported channel settings", settings, err)
+		}
+	})
+
+	t.Run("should only import into an empty database", func(t *testing.T) {
+		db := openBadger(t)
+		seed(t, db)
+
+		_, err := storage.Import(db, strings.NewReader(header+`{"type":"user","data":{"ID":7,"TwitchID":"7"}}`+"\n"))
+		if err == nil {
+			t.Fatal("got nil, want an error")
+		}
+	})
+
+	t.Run("should not import into a database holding only races", func(t *testing.T) {
+		db := openBadger(t)
+		_, err := db.SaveRace(storage.Race{Slug: "clever-link-1234"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = storage.Import(db, strings.NewReader(header+user))
+		if err == nil {
+			t.Fatal("got nil, want an error")
+		}
+	})
+
+	t.Run("should leave the database empty when writing the export fails", func(t *testing.T) {
+		db := openSQLite(t)
+		// the database rejects a race listing an entrant twice, which only shows once it is written
+		_, err := storage.Import(db, strings.NewReader(header+user+
+			`{"type":"channel_settings","data":{"UserID":1,"Prefix":"!race"}}`+"\n"+
+			`{"type":"race","data":{"Slug":"clever-link-1234","Entrants":[{"RacetimeID":"a"},{"RacetimeID":"a"}]}}`+"\n"))
+		if err == nil {
+			t.Fatal("got nil, want an error")
+		}
+
+		users, err := db.FindUsers(nil)
+		if err != nil || len(users) != 0 {
+			t.Errorf("got %v users (%v), want nothing imported", len(users), err)
+		}
+		settings, err := db.FindAllChannelSettings()
+		if err != nil || len(settings) != 0 {
+			t.Errorf("got %v channel settings (%v), want nothing imported", len(settings), err)
+		}
+
+		// the cleared database takes the export once it is fixed
+		_, err = storage.Import(db, strings.NewReader(header+user))
+		if err != nil {
+			t.Errorf("got %v, want nil", err)
+		}
+	})
+}
+
+func TestBackup(t *testing.T) {
+	t.Run("should keep only the latest backups", func(t *testing.T) {
+		db := openBadger(t)
+		dir := t.TempDir()
+		old := []string{"twwr-20200101T000000Z.bak", "twwr-20200102T000000Z.bak", "twwr-20200103T000000Z.bak"}
+		for _, name := range old {
+			err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			db.RunBackups(ctx, dir, time.Millisecond*10, 2)
+		}()
+
+		// the oldest backups go once a new one has been written
+		deadline := time.Now().Add(time.Second * 5)
+		for {
+			if _, err := os.Stat(filepath.Join(dir, old[1])); os.IsNotExist(err) || time.Now().After(deadline) {
+				break
+			}
+			time.Sleep(time.Millisecond * 5)
+		}
+		cancel()
+		<-done
+
+		backups, _ := filepath.Glob(filepath.Join(dir, "twwr-*.bak"))
+		if len(backups) != 2 {
+			t.Errorf("got %v, want the latest %v backups", backups, 2)
+		}
+		for _, name := range old[:2] {
+			if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+				t.Errorf("got %v kept, want it removed", name)
+			}
+		}
+	})
+
+	t.Run("should restore a backup over existing data", func(t *testing.T) {
+		from := openBadger(t)
+		user := seed(t, from)
+
+		var backup bytes.Buffer
+		err := from.Backup(&backup)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		to := openBadger(t)
+		_, err = to.CreateUser("5678", "replaced", "Replaced", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = to.Restore(bytes.NewReader(backup.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		users, err := to.FindUsers(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(users) != 1 || users[0].ID != user.ID || users[0].TwitchName != "tanjo3" {
+			t.Errorf("got %+v, want only the restored user", users)
+		}
+		race, err := to.FindRace("clever-link-1234")
+		if err != nil || len(race.Entrants) != 1 {
+			t.Errorf("got %+v (%v), want the restored race", race, err)
+		}
+	})
+
+	t.Run("should leave data as it was when a backup is invalid", func(t *testing.T) {
+		db := openBadger(t)
+		seed(t, db)
+
+		err := db.Restore(strings.NewReader("not a backup"))
+		if err == nil {
+			t.Fatal("got nil, want an error")
+		}
+
+		users, err := db.FindUsers(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(users) != 1 {
+			t.Errorf("got %v users, want the existing user kept", len(users))
+		}
+	})
+}
@@ -0,0 +1,780 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/config"
+)
+
+// MemoryStore keeps everything in memory, for tests and runs which don't
+// need to keep anything. It behaves as BadgerStore does, handing out copies
+// so records only change when saved.
+type MemoryStore struct {
+	secrets
+	mut         sync.Mutex
+	nextUserID  uint64
+	nextLogID   uint64
+	users       map[uint64]User
+	states      map[uint64]ChannelState
+	settings    map[uint64]ChannelSettings
+	predictions map[string]Prediction
+	clips       map[string]Clip
+	races       map[string]Race
+	logs        map[uint64]CommandLog
+}
+
+// OpenMemory creates an empty in-memory store
+func OpenMemory(conf config.DB) (*MemoryStore, error) {
+	keys, err := newSecrets(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MemoryStore{
+		secrets:     keys,
+		users:       map[uint64]User{},
+		states:      map[uint64]ChannelState{},
+		settings:    map[uint64]ChannelSettings{},
+		predictions: map[string]Prediction{},
+		clips:       map[string]Clip{},
+		races:       map[string]Race{},
+		logs:        map[uint64]CommandLog{},
+	}, nil
+}
+
+// Close
+func (db *MemoryStore) Close() error {
+	return nil
+}
+
+// clear removes every record
+func (db *MemoryStore) clear() error {
+	db.mut.Lock()
+	defer db.mut.Unlock()
+
+	db.users = map[uint64]User{}
+	db.states = map[uint64]ChannelState{}
+	db.settings = map[uint64]ChannelSettings{}
+	db.predictions = map[string]Prediction{}
+	db.clips = map[string]Clip{}
+	db.races = map[string]Race{}
+	db.logs = map[uint64]CommandLog{}
+
+	return nil
+}
+
+// FindUsers
+func (db *MemoryStore) FindUsers(query *Query) ([]*User, error) {
+	db.mut.Lock()
+	defer db.mut.Unlock()
+
+	return db.findUsers(query)
+}
+
+func (db *MemoryStore) findUsers(query *Query) ([]*User, error) {
+	err := query.validate(userSchema)
+	if err != nil {
+		return nil, fmt.Errorf("error while looking up users: %w", err)
+	}
+
+	var users []*User
+	for _, u := range db.users {
+		match, err := query.matches(u)
+		if err != nil {
+			return nil, fmt.Errorf("error while looking up users: %w", err)
+		}
+		if match {
+			u := copyUser(u)
+			users = append(users, &u)
+		}
+	}
+
+	from, to, err := query.arrange(userSchema, users)
+	if err != nil {
+		return nil, fmt.Errorf("error while looking up users: %w", err)
+	}
+
+	return users[from:to], nil
+}
+
+// CountUsers
+func (db *MemoryStore) CountUsers(query *Query) (int, error) {
+	// the order and paging a count ignores must still be valid
+	err := query.validate(userSchema)
+	if err != nil {
+		return 0, fmt.Errorf("error while counting users: %w", err)
+	}
+
+	users, err := db.FindUsers(countable(query))
+	if err != nil {
+		return 0, fmt.Errorf("error while counting users: %w", err)
+	}
+
+	return len(users), nil
+}
+
+// FindUser
+func (db *MemoryStore) FindUser(query *Query) (*User, error) {
+	users, err := db.FindUsers(query)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(users) == 0 {
+		return nil, ErrNotFound
+	}
+
+	return users[0], nil
+}
+
+// CreateUser inserts a new user into the store
+func (db *MemoryStore) CreateUser(twitchID, twitchName, twitchDisplayName, profileImageURL string) (*User, error) {
+	db.mut.Lock()
+	defer db.mut.Unlock()
+
+	user := User{
+		TwitchID:          twitchID,
+		TwitchName:        twitchName,
+		TwitchDisplayName: twitchDisplayName,
+		ProfileImageURL:   profileImageURL,
+		ActiveInChannel:   false,
+		JoinedAt:          time.Now(),
+	}
+	err := checkUnique(db.findUsers, user, true)
+	if err != nil {
+		return nil, err
+	}
+
+	// restored users keep their ids, which the sequence may hand out again
+	for {
+		user.ID = db.nextUserID
+		db.nextUserID++
+		if _, ok := db.users[user.ID]; !ok {
+			break
+		}
+	}
+	db.users[user.ID] = copyUser(user)
+
+	return &user, nil
+}
+
+// UpdateUser
+func (db *MemoryStore) UpdateUser(id uint64, update UserUpdate) (*User, error) {
+	db.mut.Lock()
+	defer db.mut.Unlock()
+
+	u, ok := db.users[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	u = copyUser(u)
+	update.apply(&u)
+
+	err := checkUnique(db.findUsers, u, false)
+	if err != nil {
+		return nil, err
+	}
+	db.users[id] = copyUser(u)
+
+	return &u, nil
+}
+
+// RestoreUser inserts a user exactly as given, keeping its id
+func (db *MemoryStore) RestoreUser(user User) error {
+	db.mut.Lock()
+	defer db.mut.Unlock()
+
+	err := checkUnique(db.findUsers, user, true)
+	if err != nil {
+		return err
+	}
+	if _, ok := db.users[user.ID]; ok {
+		return &ConflictError{Field: FieldID, Value: fmt.Sprint(user.ID), UserID: user.ID}
+	}
+	db.users[user.ID] = copyUser(user)
+
+	return nil
+}
+
+// MergeUsers consolidates a duplicate user into the user kept, moving its
+// accounts, channel state and settings, predictions, clips and command logs before deleting it
+func (db *MemoryStore) MergeUsers(keepID, duplicateID uint64) (*User, error) {
+	if keepID == duplicateID {
+		return nil, fmt.Errorf("cannot merge user %v into itself", keepID)
+	}
+
+	db.mut.Lock()
+	defer db.mut.Unlock()
+
+	keep, ok := db.users[keepID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	duplicate, ok := db.users[duplicateID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	merged, err := db.mergeUser(copyUser(keep), copyUser(duplicate))
+	if err != nil {
+		return nil, err
+	}
+	delete(db.users, duplicateID)
+	db.users[keepID] = copyUser(merged)
+
+	for id, p := range db.predictions {
+		if p.UserID == duplicateID {
+			p.UserID = keepID
+			db.predictions[id] = p
+		}
+	}
+	for id, c := range db.clips {
+		if c.UserID == duplicateID {
+			c.UserID = keepID
+			db.clips[id] = c
+		}
+	}
+	for id, l := range db.logs {
+		if l.UserID == duplicateID {
+			l.UserID = keepID
+			db.logs[id] = l
+		}
+	}
+
+	// the duplicate's channel state and settings are only kept when the user kept has none
+	if state, ok := db.states[duplicateID]; ok {
+		delete(db.states, duplicateID)
+		if _, ok := db.states[keepID]; !ok {
+			state.UserID = keepID
+			db.states[keepID] = state
+		}
+	}
+	if settings, ok := db.settings[duplicateID]; ok {
+		delete(db.settings, duplicateID)
+		if _, ok := db.settings[keepID]; !ok {
+			settings.UserID = keepID
+			db.settings[keepID] = settings
+		}
+	}
+
+	return &merged, nil
+}
+
+// DeleteUser
+func (db *MemoryStore) DeleteUser(id uint64) error {
+	db.mut.Lock()
+	defer db.mut.Unlock()
+
+	if _, ok := db.users[id]; !ok {
+		return fmt.Errorf("error deleting user with id %v: %w", id, ErrNotFound)
+	}
+	delete(db.users, id)
+
+	return nil
+}
+
+// SaveTwitchToken encrypts a user's twitch token onto their user record
+func (db *MemoryStore) SaveTwitchToken(id uint64, token OAuthToken) (*User, error) {
+	db.mut.Lock()
+	defer db.mut.Unlock()
+
+	user, ok := db.users[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	user = copyUser(user)
+
+	var err error
+	user.TwitchToken, err = db.sealToken(id, token)
+	if err != nil {
+		return nil, fmt.Errorf("error encrypting twitch token for user %v: %w", id, err)
+	}
+	user.TwitchScopes = append([]string(nil), token.Scopes...)
+	db.users[id] = copyUser(user)
+
+	return &user, nil
+}
+
+// FindTwitchToken decrypts the twitch token a user has granted, if any
+func (db *MemoryStore) FindTwitchToken(id uint64) (*OAuthToken, error) {
+	db.mut.Lock()
+	defer db.mut.Unlock()
+
+	user, ok := db.users[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if len(user.TwitchToken) == 0 {
+		return nil, ErrNotFound
+	}
+
+	token, err := db.openToken(id, user.TwitchToken)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting twitch token for user %v: %w", id, err)
+	}
+
+	return token, nil
+}
+
+// DeleteTwitchToken removes a user's twitch token and granted scopes
+func (db *MemoryStore) DeleteTwitchToken(id uint64) error {
+	db.mut.Lock()
+	defer db.mut.Unlock()
+
+	user, ok := db.users[id]
+	if !ok {
+		return ErrNotFound
+	}
+	user.TwitchToken = nil
+	user.TwitchScopes = nil
+	db.users[id] = user
+
+	return nil
+}
+
+// RotateEncryptionKey rewraps every user's twitch token with a new master key
+func (db *MemoryStore) RotateEncryptionKey(key string) (int, error) {
+	db.mut.Lock()
+	defer db.mut.Unlock()
+
+	rotated, err := db.rotate(key)
+	if err != nil {
+		return 0, err
+	}
+
+	// tokens are rewrapped before any is saved, so a failure leaves every user as they were
+	tokens := map[uint64][]byte{}
+	for id, user := range db.users {
+		if len(user.TwitchToken) == 0 {
+			continue
+		}
+
+		token, changed, err := rotated.rewrap(user.TwitchToken, tokenAAD(id))
+		if err != nil {
+			return 0, fmt.Errorf("error rewrapping twitch token for user %v: %w", id, err)
+		}
+		if changed {
+			tokens[id] = token
+		}
+	}
+	for id, token := range tokens {
+		user := db.users[id]
+		user.TwitchToken = token
+		db.users[id] = user
+	}
+	db.secrets = rotated
+
+	return len(tokens), nil
+}
+
+// FindChannelState looks up the state of a user's channel
+func (db *MemoryStore) FindChannelState(userID uint64) (*ChannelState, error) {
+	db.mut.Lock()
+	defer db.mut.Unlock()
+
+	state, ok := db.states[userID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return &state, nil
+}
+
+// FindChannelStates lists the state of every channel
+func (db *MemoryStore) FindChannelStates() ([]*ChannelState, error) {
+	db.mut.Lock()
+	defer db.mut.Unlock()
+
+	var states []*ChannelState
+	for _, s := range db.states {
+		s := s
+		states = append(states, &s)
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].UserID < states[j].UserID
+	})
+
+	return states, nil
+}
+
+// SaveChannelState inserts or replaces the state of a user's channel
+func (db *MemoryStore) SaveChannelState(state ChannelState) (*ChannelState, error) {
+	db.mut.Lock()
+	defer db.mut.Unlock()
+
+	state.UpdatedAt = time.Now()
+	db.states[state.UserID] = state
+
+	return &state, nil
+}
+
+// FindChannelSettings looks up the settings saved for a user's channel
+func (db *MemoryStore) FindChannelSettings(userID uint64) (*ChannelSettings, error) {
+	db.mut.Lock()
+	defer db.mut.Unlock()
+
+	settings, ok := db.settings[userID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	settings = copySettings(settings)
+
+	return &settings, nil
+}
+
+// FindAllChannelSettings lists the settings saved for every channel
+func (db *MemoryStore) FindAllChannelSettings() ([]*ChannelSettings, error) {
+	db.mut.Lock()
+	defer db.mut.Unlock()
+
+	var all []*ChannelSettings
+	for _, s := range db.settings {
+		s := copySettings(s)
+		all = append(all, &s)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].UserID < all[j].UserID
+	})
+
+	return all, nil
+}
+
+// SaveChannelSettings inserts or replaces the settings of a user's channel
+func (db *MemoryStore) SaveChannelSettings(settings ChannelSettings) (*ChannelSettings, error) {
+	db.mut.Lock()
+	defer db.mut.Unlock()
+
+	settings.UpdatedAt = time.Now()
+	db.settings[settings.UserID] = copySettings(settings)
+
+	return &settings, nil
+}
+
+// SaveCommandLog records a handled command
+func (db *MemoryStore) SaveCommandLog(entry CommandLog) (*CommandLog, error) {
+	db.mut.Lock()
+	defer db.mut.Unlock()
+
+	entry.ID = db.nextLogID
+	db.nextLogID++
+	db.logs[entry.ID] = entry
+
+	return &entry, nil
+}
+
+// FindCommandLogs lists the handled commands matching a query
+func (db *MemoryStore) FindCommandLogs(query *Query) ([]*CommandLog, error) {
+	db.mut.Lock()
+	defer db.mut.Unlock()
+
+	err := query.validate(commandLogSchema)
+	if err != nil {
+		return nil, fmt.Errorf("error while looking up command logs: %w", err)
+	}
+
+	var logs []*CommandLog
+	for _, l := range db.logs {
+		match, err := query.matches(l)
+		if err != nil {
+			return nil, fmt.Errorf("error while looking up command logs: %w", err)
+		}
+		if match {
+			l := l
+			logs = append(logs, &l)
+		}
+	}
+
+	from, to, err := query.arrange(commandLogSchema, logs)
+	if err != nil {
+		return nil, fmt.Errorf("error while looking up command logs: %w", err)
+	}
+
+	return logs[from:to], nil
+}
+
+// CountCommandLogs counts the handled commands matching a query
+func (db *MemoryStore) CountCommandLogs(query *Query) (int, error) {
+	// the order and paging a count ignores must still be valid
+	err := query.validate(commandLogSchema)
+	if err != nil {
+		return 0, fmt.Errorf("error while counting command logs: %w", err)
+	}
+
+	logs, err := db.FindCommandLogs(countable(query))
+	if err != nil {
+		return 0, fmt.Errorf("error while counting command logs: %w", err)
+	}
+
+	return len(logs), nil
+}
+
+// DeleteCommandLogs deletes the commands handled before a time, returning how many were deleted
+func (db *MemoryStore) DeleteCommandLogs(before time.Time) (int, error) {
+	db.mut.Lock()
+	defer db.mut.Unlock()
+
+	n := 0
+	for id, l := range db.logs {
+		if l.CreatedAt.Before(before) {
+			delete(db.logs, id)
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+// FindPredictions lists the predictions matching a query
+func (db *MemoryStore) FindPredictions(query *Query) ([]*Prediction, error) {
+	db.mut.Lock()
+	defer db.mut.Unlock()
+
+	err := query.validate(predictionSchema)
+	if err != nil {
+		return nil, fmt.Errorf("error while looking up predictions: %w", err)
+	}
+
+	var predictions []*Prediction
+	for _, p := range db.predictions {
+		match, err := query.matches(p)
+		if err != nil {
+			return nil, fmt.Errorf("error while looking up predictions: %w", err)
+		}
+		if match {
+			p := p
+			predictions = append(predictions, &p)
+		}
+	}
+
+	from, to, err := query.arrange(predictionSchema, predictions)
+	if err != nil {
+		return nil, fmt.Errorf("error while looking up predictions: %w", err)
+	}
+
+	return predictions[from:to], nil
+}
+
+// CountPredictions counts the predictions matching a query
+func (db *MemoryStore) CountPredictions(query *Query) (int, error) {
+	// the order and paging a count ignores must still be valid
+	err := query.validate(predictionSchema)
+	if err != nil {
+		return 0, fmt.Errorf("error while counting predictions: %w", err)
+	}
+
+	predictions, err := db.FindPredictions(countable(query))
+	if err != nil {
+		return 0, fmt.Errorf("error while counting predictions: %w", err)
+	}
+
+	return len(predictions), nil
+}
+
+// FindActivePrediction looks up the prediction still open for a user's race
+func (db *MemoryStore) FindActivePrediction(userID uint64, raceSlug string) (*Prediction, error) {
+	db.mut.Lock()
+	defer db.mut.Unlock()
+
+	for _, p := range db.predictions {
+		if p.UserID == userID && p.RaceSlug == raceSlug && p.Status == PredictionActive {
+			return &p, nil
+		}
+	}
+
+	return nil, ErrNotFound
+}
+
+// SavePrediction inserts or replaces a prediction
+func (db *MemoryStore) SavePrediction(prediction Prediction) (*Prediction, error) {
+	db.mut.Lock()
+	defer db.mut.Unlock()
+
+	db.predictions[prediction.ID] = prediction
+
+	return &prediction, nil
+}
+
+// FindClips lists the clips matching a query
+func (db *MemoryStore) FindClips(query *Query) ([]*Clip, error) {
+	db.mut.Lock()
+	defer db.mut.Unlock()
+
+	err := query.validate(clipSchema)
+	if err != nil {
+		return nil, fmt.Errorf("error while looking up clips: %w", err)
+	}
+
+	var clips []*Clip
+	for _, c := range db.clips {
+		match, err := query.matches(c)
+		if err != nil {
+			return nil, fmt.Errorf("error while looking up clips: %w", err)
+		}
+		if match {
+			c := c
+			clips = append(clips, &c)
+		}
+	}
+
+	from, to, err := query.arrange(clipSchema, clips)
+	if err != nil {
+		return nil, fmt.Errorf("error while looking up clips: %w", err)
+	}
+
+	return clips[from:to], nil
+}
+
+// CountClips counts the clips matching a query
+func (db *MemoryStore) CountClips(query *Query) (int, error) {
+	// the order and paging a count ignores must still be valid
+	err := query.validate(clipSchema)
+	if err != nil {
+		return 0, fmt.Errorf("error while counting clips: %w", err)
+	}
+
+	clips, err := db.FindClips(countable(query))
+	if err != nil {
+		return 0, fmt.Errorf("error while counting clips: %w", err)
+	}
+
+	return len(clips), nil
+}
+
+// SaveClip inserts or replaces a clip
+func (db *MemoryStore) SaveClip(clip Clip) (*Clip, error) {
+	db.mut.Lock()
+	defer db.mut.Unlock()
+
+	db.clips[clip.ID] = clip
+
+	return &clip, nil
+}
+
+// FindRace looks up the race with a slug
+func (db *MemoryStore) FindRace(slug string) (*Race, error) {
+	db.mut.Lock()
+	defer db.mut.Unlock()
+
+	race, ok := db.races[slug]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	race = copyRace(race)
+
+	return &race, nil
+}
+
+// FindRaces lists the races matching a query
+func (db *MemoryStore) FindRaces(query *Query) ([]*Race, error) {
+	err := query.validate(raceSchema)
+	if err != nil {
+		return nil, fmt.Errorf("error while looking up races: %w", err)
+	}
+
+	return db.findRaces(query, func(r Race) (bool, error) {
+		return query.matches(r)
+	})
+}
+
+// CountRaces counts the races matching a query
+func (db *MemoryStore) CountRaces(query *Query) (int, error) {
+	// the order and paging a count ignores must still be valid
+	err := query.validate(raceSchema)
+	if err != nil {
+		return 0, fmt.Errorf("error while counting races: %w", err)
+	}
+
+	races, err := db.FindRaces(countable(query))
+	if err != nil {
+		return 0, fmt.Errorf("error while counting races: %w", err)
+	}
+
+	return len(races), nil
+}
+
+// FindEntrantRaces lists the races a racetime user entered, most recently opened first
+func (db *MemoryStore) FindEntrantRaces(racetimeID string) ([]*Race, error) {
+	return db.findRaces(All().SortBy(FieldOpenedAt).Reverse(), func(r Race) (bool, error) {
+		for _, e := range r.Entrants {
+			if e.RacetimeID == racetimeID {
+				return true, nil
+			}
+		}
+
+		return false, nil
+	})
+}
+
+func (db *MemoryStore) findRaces(query *Query, match func(r Race) (bool, error)) ([]*Race, error) {
+	db.mut.Lock()
+	defer db.mut.Unlock()
+
+	var races []*Race
+	for _, r := range db.races {
+		ok, err := match(r)
+		if err != nil {
+			return nil, fmt.Errorf("error while looking up races: %w", err)
+		}
+		if ok {
+			r := copyRace(r)
+			races = append(races, &r)
+		}
+	}
+
+	from, to, err := query.arrange(raceSchema, races)
+	if err != nil {
+		return nil, fmt.Errorf("error while looking up races: %w", err)
+	}
+
+	return races[from:to], nil
+}
+
+// SaveRace inserts or replaces a race and its entrants
+func (db *MemoryStore) SaveRace(race Race) (*Race, error) {
+	db.mut.Lock()
+	defer db.mut.Unlock()
+
+	race.UpdatedAt = time.Now()
+	db.races[race.Slug] = copyRace(race)
+
+	return &race, nil
+}
+
+// copyUser copies a user along with its token and scopes, so
+// changes to one of them don't reach the other
+func copyUser(u User) User {
+	if u.TwitchToken != nil {
+		u.TwitchToken = append([]byte(nil), u.TwitchToken...)
+	}
+	if u.TwitchScopes != nil {
+		u.TwitchScopes = append([]string(nil), u.TwitchScopes...)
+	}
+
+	return u
+}
+
+func copySettings(s ChannelSettings) ChannelSettings {
+	if s.Commands != nil {
+		s.Commands = append([]string(nil), s.Commands...)
+	}
+	if s.Aliases != nil {
+		aliases := make(map[string]string, len(s.Aliases))
+		for alias, command := range s.Aliases {
+			aliases[alias] = command
+		}
+		s.Aliases = aliases
+	}
+
+	return s
+}
+
+func copyRace(r Race) Race {
+	if r.Entrants != nil {
+		r.Entrants = append([]RaceEntrant(nil), r.Entrants...)
+	}
+
+	return r
+}
@@ -0,0 +1,23 @@
+package storage_test
+
+import (
+	"testing"
+
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/config"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/storage"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/storage/storagetest"
+)
+
+func TestMemoryStore(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Store {
+		db, err := storage.Open(config.DB{
+			Driver:        storage.DriverMemory,
+			EncryptionKey: storagetest.EncryptionKey,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return db
+	})
+}
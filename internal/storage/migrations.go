@@ -0,0 +1,195 @@
+package storage
+
+// migration is a versioned change to the sql schema. Statements may use
+// {{id}}, {{blob}} and {{timestamp}} for column types which differ by dialect.
+type migration struct {
+	version    int
+	name       string
+	statements []string
+}
+
+// migrations are applied in order and must never be edited once released,
+// only appended to
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "create users",
+		statements: []string{
+			`CREATE TABLE users (
+				id {{id}},
+				twitch_id TEXT NOT NULL UNIQUE,
+				racetime_id TEXT NOT NULL DEFAULT '',
+				twitch_name TEXT NOT NULL DEFAULT '',
+				twitch_display_name TEXT NOT NULL DEFAULT '',
+				profile_image_url TEXT NOT NULL DEFAULT '',
+				active_in_channel BOOLEAN NOT NULL DEFAULT FALSE,
+				multistream_provider TEXT NOT NULL DEFAULT '',
+				multi_hide_finished BOOLEAN NOT NULL DEFAULT FALSE,
+				auto_title BOOLEAN NOT NULL DEFAULT FALSE,
+				title_template TEXT NOT NULL DEFAULT '',
+				predictions BOOLEAN NOT NULL DEFAULT FALSE,
+				prediction_top_n INTEGER NOT NULL DEFAULT 0,
+				prediction_target BIGINT NOT NULL DEFAULT 0,
+				auto_clip BOOLEAN NOT NULL DEFAULT FALSE,
+				clip_to_chat BOOLEAN NOT NULL DEFAULT FALSE,
+				clip_to_racetime BOOLEAN NOT NULL DEFAULT FALSE,
+				shoutouts BOOLEAN NOT NULL DEFAULT FALSE,
+				twitch_token {{blob}},
+				twitch_scopes TEXT NOT NULL DEFAULT '',
+				joined_at {{timestamp}} NOT NULL
+			)`,
+			`CREATE INDEX users_racetime_id ON users (racetime_id)`,
+		},
+	},
+	{
+		version: 2,
+		name:    "create channel states",
+		statements: []string{
+			`CREATE TABLE channel_states (
+				user_id BIGINT PRIMARY KEY,
+				twitch_id TEXT NOT NULL DEFAULT '',
+				live BOOLEAN NOT NULL DEFAULT FALSE,
+				joined BOOLEAN NOT NULL DEFAULT FALSE,
+				live_since {{timestamp}} NOT NULL,
+				offline_since {{timestamp}} NOT NULL,
+				title_race TEXT NOT NULL DEFAULT '',
+				original_title TEXT NOT NULL DEFAULT '',
+				original_game_id TEXT NOT NULL DEFAULT '',
+				updated_at {{timestamp}} NOT NULL
+			)`,
+		},
+	},
+	{
+		version: 3,
+		name:    "create predictions and clips",
+		statements: []string{
+			`CREATE TABLE predictions (
+				id TEXT PRIMARY KEY,
+				user_id BIGINT NOT NULL,
+				race_slug TEXT NOT NULL,
+				title TEXT NOT NULL DEFAULT '',
+				yes_outcome_id TEXT NOT NULL DEFAULT '',
+				no_outcome_id TEXT NOT NULL DEFAULT '',
+				status TEXT NOT NULL,
+				won BOOLEAN NOT NULL DEFAULT FALSE,
+				place INTEGER NOT NULL DEFAULT 0,
+				finish_time BIGINT NOT NULL DEFAULT 0,
+				created_at {{timestamp}} NOT NULL,
+				ended_at {{timestamp}} NOT NULL
+			)`,
+			`CREATE INDEX predictions_user_id ON predictions (user_id, race_slug)`,
+			`CREATE TABLE clips (
+				id TEXT PRIMARY KEY,
+				user_id BIGINT NOT NULL,
+				race_slug TEXT NOT NULL,
+				edit_url TEXT NOT NULL DEFAULT '',
+				url TEXT NOT NULL DEFAULT '',
+				status TEXT NOT NULL,
+				created_at {{timestamp}} NOT NULL
+			)`,
+			`CREATE INDEX clips_user_id ON clips (user_id)`,
+			`CREATE INDEX clips_race_slug ON clips (race_slug)`,
+		},
+	},
+	{
+		version: 4,
+		name:    "unique racetime accounts",
+		statements: []string{
+			`DROP INDEX users_racetime_id`,
+			`CREATE UNIQUE INDEX users_racetime_id ON users (racetime_id) WHERE racetime_id <> ''`,
+		},
+	},
+	{
+		version: 5,
+		name:    "create races",
+		statements: []string{
+			`CREATE TABLE races (
+				slug TEXT PRIMARY KEY,
+				category TEXT NOT NULL DEFAULT '',
+				status TEXT NOT NULL DEFAULT '',
+				goal TEXT NOT NULL DEFAULT '',
+				info TEXT NOT NULL DEFAULT '',
+				preset TEXT NOT NULL DEFAULT '',
+				permalink TEXT NOT NULL DEFAULT '',
+				seed_hash TEXT NOT NULL DEFAULT '',
+				opened_at {{timestamp}} NOT NULL,
+				started_at {{timestamp}} NOT NULL,
+				ended_at {{timestamp}} NOT NULL,
+				updated_at {{timestamp}} NOT NULL
+			)`,
+			`CREATE INDEX races_opened_at ON races (opened_at)`,
+			`CREATE TABLE race_entrants (
+				race_slug TEXT NOT NULL REFERENCES races (slug) ON DELETE CASCADE,
+				position INTEGER NOT NULL,
+				racetime_id TEXT NOT NULL,
+				name TEXT NOT NULL DEFAULT '',
+				twitch_name TEXT NOT NULL DEFAULT '',
+				status TEXT NOT NULL DEFAULT '',
+				place INTEGER NOT NULL DEFAULT 0,
+				finish_time BIGINT NOT NULL DEFAULT 0,
+				score_change INTEGER NOT NULL DEFAULT 0,
+				PRIMARY KEY (race_slug, racetime_id)
+			)`,
+			`CREATE INDEX race_entrants_racetime_id ON race_entrants (racetime_id)`,
+		},
+	},
+	{
+		version: 6,
+		name:    "create channel settings",
+		statements: []string{
+			`CREATE TABLE channel_settings (
+				user_id BIGINT PRIMARY KEY,
+				commands TEXT NOT NULL DEFAULT '',
+				prefix TEXT NOT NULL DEFAULT '',
+				locale TEXT NOT NULL DEFAULT '',
+				announce_start BOOLEAN NOT NULL DEFAULT FALSE,
+				announce_finish BOOLEAN NOT NULL DEFAULT FALSE,
+				announce_results BOOLEAN NOT NULL DEFAULT FALSE,
+				multistream_provider TEXT NOT NULL DEFAULT '',
+				multi_hide_finished BOOLEAN NOT NULL DEFAULT FALSE,
+				command_cooldown BIGINT NOT NULL DEFAULT 0,
+				marbles BOOLEAN NOT NULL DEFAULT TRUE,
+				updated_at {{timestamp}} NOT NULL
+			)`,
+		},
+	},
+	{
+		version: 7,
+		name:    "add channel command aliases",
+		statements: []string{
+			`ALTER TABLE channel_settings ADD COLUMN aliases TEXT NOT NULL DEFAULT ''`,
+		},
+	},
+	{
+		version: 8,
+		name:    "create command logs",
+		statements: []string{
+			`CREATE TABLE command_logs (
+				id {{id}},
+				user_id BIGINT NOT NULL,
+				channel TEXT NOT NULL DEFAULT '',
+				chatter TEXT NOT NULL DEFAULT '',
+				command TEXT NOT NULL DEFAULT '',
+				args TEXT NOT NULL DEFAULT '',
+				latency BIGINT NOT NULL DEFAULT 0,
+				outcome TEXT NOT NULL,
+				created_at {{timestamp}} NOT NULL
+			)`,
+			`CREATE INDEX command_logs_created_at ON command_logs (created_at)`,
+		},
+	},
+	{
+		version: 9,
+		name:    "move multistream settings to channel settings",
+		statements: []string{
+			// channels with settings already have multistream settings of their own,
+			// the rest keep those they chose with the default settings of the time
+			`INSERT INTO channel_settings (user_id, prefix, locale, multistream_provider, multi_hide_finished, marbles, updated_at)
+				SELECT id, '!twwr', 'en', multistream_provider, multi_hide_finished, TRUE, joined_at FROM users
+				WHERE (multistream_provider <> '' OR multi_hide_finished)
+				AND id NOT IN (SELECT user_id FROM channel_settings)`,
+			`ALTER TABLE users DROP COLUMN multistream_provider`,
+			`ALTER TABLE users DROP COLUMN multi_hide_finished`,
+		},
+	},
+}
@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/timshannon/badgerhold"
+)
+
+// Prediction status values
+const (
+	PredictionActive   = "active"
+	PredictionResolved = "resolved"
+	PredictionCanceled = "canceled"
+)
+
+// Prediction is a twitch channel prediction the bot opened for a streamer's race
+type Prediction struct {
+	ID           string `badgerhold:"key"`
+	UserID       uint64 `badgerhold:"index"`
+	RaceSlug     string
+	Title        string
+	YesOutcomeID string
+	NoOutcomeID  string
+	Status       string
+	// Won records whether the yes outcome won a resolved prediction
+	Won        bool
+	Place      int
+	FinishTime time.Duration
+	CreatedAt  time.Time
+	EndedAt    time.Time
+}
+
+// FindPredictions lists the predictions matching a query
+func (db *BadgerStore) FindPredictions(query *Query) ([]*Prediction, error) {
+	var predictions []*Prediction
+	err := db.find(predictionSchema, &predictions, query)
+	if err != nil {
+		return nil, fmt.Errorf("error while looking up predictions: %w", err)
+	}
+
+	return predictions, nil
+}
+
+// CountPredictions counts the predictions matching a query
+func (db *BadgerStore) CountPredictions(query *Query) (int, error) {
+	var predictions []*Prediction
+	n, err := db.count(predictionSchema, &predictions, query)
+	if err != nil {
+		return 0, fmt.Errorf("error while counting predictions: %w", err)
+	}
+
+	return n, nil
+}
+
+// FindActivePrediction looks up the prediction still open for a user's race
+func (db *BadgerStore) FindActivePrediction(userID uint64, raceSlug string) (*Prediction, error) {
+	var predictions []*Prediction
+	err := db.store.Find(&predictions, badgerhold.Where("UserID").Eq(userID).
+		And("RaceSlug").Eq(raceSlug).
+		And("Status").Eq(PredictionActive))
+	if err != nil {
+		return nil, fmt.Errorf("error while looking up active prediction for user %v: %w", userID, err)
+	}
+
+	if len(predictions) == 0 {
+		return nil, ErrNotFound
+	}
+
+	return predictions[0], nil
+}
+
+// SavePrediction inserts or replaces a prediction
+func (db *BadgerStore) SavePrediction(prediction Prediction) (*Prediction, error) {
+	err := db.store.Upsert(prediction.ID, &prediction)
+	if err != nil {
+		return nil, fmt.Errorf("error saving prediction %s: %w", prediction.ID, err)
+	}
+
+	return &prediction, nil
+}
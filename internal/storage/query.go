@@ -0,0 +1,429 @@
+package storage
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Field names a field of a record which queries filter and sort by
+type Field string
+
+const (
+	FieldID              Field = "ID"
+	FieldTwitchID        Field = "TwitchID"
+	FieldRacetimeID      Field = "RacetimeID"
+	FieldTwitchName      Field = "TwitchName"
+	FieldActiveInChannel Field = "ActiveInChannel"
+	FieldJoinedAt        Field = "JoinedAt"
+	FieldUserID          Field = "UserID"
+	FieldRaceSlug        Field = "RaceSlug"
+	FieldSlug            Field = "Slug"
+	FieldCategory        Field = "Category"
+	FieldGoal            Field = "Goal"
+	FieldStatus          Field = "Status"
+	FieldChannel         Field = "Channel"
+	FieldCommand         Field = "Command"
+	FieldOutcome         Field = "Outcome"
+	FieldCreatedAt       Field = "CreatedAt"
+	FieldOpenedAt        Field = "OpenedAt"
+	FieldEndedAt         Field = "EndedAt"
+)
+
+// operator compares a record's field to a criterion's value
+type operator int
+
+const (
+	opEq operator = iota
+	opNe
+	opGt
+	opGe
+	opLt
+	opLe
+)
+
+var operatorSQL = map[operator]string{
+	opEq: "=",
+	opNe: "<>",
+	opGt: ">",
+	opGe: ">=",
+	opLt: "<",
+	opLe: "<=",
+}
+
+type criterion struct {
+	field Field
+	op    operator
+	value interface{}
+}
+
+// Query narrows down, orders and pages the records a store finds. Every
+// condition must hold for a record to match. Records are ordered by their
+// key unless sorted otherwise, and a nil query matches every record.
+// Queries are never changed once built, each method returning a new one,
+// so a query can be shared and narrowed in different ways.
+//
+//	storage.Where(storage.FieldUserID).Eq(id).And(storage.FieldStatus).Eq(storage.ClipReady).
+//		SortBy(storage.FieldCreatedAt).Reverse().Limit(10)
+type Query struct {
+	criteria []criterion
+	sort     []Field
+	reverse  bool
+	limit    int
+	skip     int
+}
+
+// Criterion is a condition on a field of a query, waiting on what to compare it to
+type Criterion struct {
+	query *Query
+	field Field
+}
+
+// All starts a query matching every record, to be sorted or paged
+func All() *Query {
+	return &Query{}
+}
+
+// Where starts a query with a condition on a field
+func Where(field Field) *Criterion {
+	return All().And(field)
+}
+
+// And adds another condition on a field to the query
+func (q *Query) And(field Field) *Criterion {
+	return &Criterion{query: q, field: field}
+}
+
+// Eq matches records whose field equals value
+func (c *Criterion) Eq(value interface{}) *Query {
+	return c.add(opEq, value)
+}
+
+// Ne matches records whose field doesn't equal value
+func (c *Criterion) Ne(value interface{}) *Query {
+	return c.add(opNe, value)
+}
+
+// Gt matches records whose field is greater than value
+func (c *Criterion) Gt(value interface{}) *Query {
+	return c.add(opGt, value)
+}
+
+// Ge matches records whose field is greater than or equal to value
+func (c *Criterion) Ge(value interface{}) *Query {
+	return c.add(opGe, value)
+}
+
+// Lt matches records whose field is less than value
+func (c *Criterion) Lt(value interface{}) *Query {
+	return c.add(opLt, value)
+}
+
+// Le matches records whose field is less than or equal to value
+func (c *Criterion) Le(value interface{}) *Query {
+	return c.add(opLe, value)
+}
+
+func (c *Criterion) add(op operator, value interface{}) *Query {
+	q := c.query.clone()
+	q.criteria = append(q.criteria, criterion{field: c.field, op: op, value: value})
+	return q
+}
+
+// SortBy orders records by fields, the first deciding until two records are equal in it
+func (q *Query) SortBy(fields ...Field) *Query {
+	q = q.clone()
+	q.sort = append(q.sort, fields...)
+	return q
+}
+
+// Reverse orders records in descending order
+func (q *Query) Reverse() *Query {
+	q = q.clone()
+	q.reverse = true
+	return q
+}
+
+// Limit finds at most n records, all of them when n is 0
+func (q *Query) Limit(n int) *Query {
+	q = q.clone()
+	q.limit = n
+	return q
+}
+
+// Skip leaves out the first n records, such as to find the next page
+func (q *Query) Skip(n int) *Query {
+	q = q.clone()
+	q.skip = n
+	return q
+}
+
+// clone copies a query, so appending to its copy leaves it as it was
+func (q *Query) clone() *Query {
+	c := *q
+	c.criteria = append([]criterion(nil), q.criteria...)
+	c.sort = append([]Field(nil), q.sort...)
+
+	return &c
+}
+
+// ActiveChannels finds the users whose channels the bot follows, which
+// must have linked both their twitch and racetime accounts
+func ActiveChannels() *Query {
+	return Where(FieldActiveInChannel).Eq(true).
+		And(FieldTwitchID).Ne("").
+		And(FieldRacetimeID).Ne("")
+}
+
+// countable keeps only the conditions of a query, as counts ignore its order and paging
+func countable(q *Query) *Query {
+	if q == nil {
+		return nil
+	}
+
+	return &Query{criteria: q.criteria}
+}
+
+// schema lists the fields a kind of record can be queried by, along with
+// the columns SQLStore keeps them in and the fields BadgerStore indexes
+type schema struct {
+	name    string
+	table   string
+	key     Field
+	columns map[Field]string
+	indexes map[Field]bool
+}
+
+var userSchema = schema{
+	name:  "users",
+	table: "users",
+	key:   FieldID,
+	columns: map[Field]string{
+		FieldID:              "id",
+		FieldTwitchID:        "twitch_id",
+		FieldRacetimeID:      "racetime_id",
+		FieldTwitchName:      "twitch_name",
+		FieldActiveInChannel: "active_in_channel",
+		FieldJoinedAt:        "joined_at",
+	},
+}
+
+var predictionSchema = schema{
+	name:  "predictions",
+	table: "predictions",
+	key:   FieldID,
+	columns: map[Field]string{
+		FieldID:        "id",
+		FieldUserID:    "user_id",
+		FieldRaceSlug:  "race_slug",
+		FieldStatus:    "status",
+		FieldCreatedAt: "created_at",
+		FieldEndedAt:   "ended_at",
+	},
+	indexes: map[Field]bool{FieldUserID: true},
+}
+
+var clipSchema = schema{
+	name:  "clips",
+	table: "clips",
+	key:   FieldID,
+	columns: map[Field]string{
+		FieldID:        "id",
+		FieldUserID:    "user_id",
+		FieldRaceSlug:  "race_slug",
+		FieldStatus:    "status",
+		FieldCreatedAt: "created_at",
+	},
+	indexes: map[Field]bool{FieldUserID: true, FieldRaceSlug: true},
+}
+
+var raceSchema = schema{
+	name:  "races",
+	table: "races",
+	key:   FieldSlug,
+	columns: map[Field]string{
+		FieldSlug:     "slug",
+		FieldCategory: "category",
+		FieldGoal:     "goal",
+		FieldStatus:   "status",
+		FieldOpenedAt: "opened_at",
+		FieldEndedAt:  "ended_at",
+	},
+}
+
+var commandLogSchema = schema{
+	name:  "command logs",
+	table: "command_logs",
+	key:   FieldID,
+	columns: map[Field]string{
+		FieldID:        "id",
+		FieldUserID:    "user_id",
+		FieldChannel:   "channel",
+		FieldCommand:   "command",
+		FieldOutcome:   "outcome",
+		FieldCreatedAt: "created_at",
+	},
+	indexes: map[Field]bool{FieldCreatedAt: true},
+}
+
+// validate checks a query only uses the fields of a schema and pages sensibly
+func (q *Query) validate(s schema) error {
+	if q == nil {
+		return nil
+	}
+
+	for _, c := range q.criteria {
+		if _, ok := s.columns[c.field]; !ok {
+			return fmt.Errorf("%s cannot be queried by unknown field %s", s.name, c.field)
+		}
+		if c.value == nil {
+			return fmt.Errorf("%s cannot be compared with nil", c.field)
+		}
+	}
+	for _, f := range q.sort {
+		if _, ok := s.columns[f]; !ok {
+			return fmt.Errorf("%s cannot be sorted by unknown field %s", s.name, f)
+		}
+	}
+	if q.limit < 0 || q.skip < 0 {
+		return fmt.Errorf("limit and skip must not be negative, got %d and %d", q.limit, q.skip)
+	}
+
+	return nil
+}
+
+// matches reports whether a record meets every condition of the query
+func (q *Query) matches(record interface{}) (bool, error) {
+	if q == nil {
+		return true, nil
+	}
+
+	for _, c := range q.criteria {
+		cmp, err := compare(fieldValue(record, c.field), c.value)
+		if err != nil {
+			return false, err
+		}
+
+		var ok bool
+		switch c.op {
+		case opEq:
+			ok = cmp == 0
+		case opNe:
+			ok = cmp != 0
+		case opGt:
+			ok = cmp > 0
+		case opGe:
+			ok = cmp >= 0
+		case opLt:
+			ok = cmp < 0
+		case opLe:
+			ok = cmp <= 0
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// arrange sorts a slice of records, then returns the bounds of the page the query asks for
+func (q *Query) arrange(s schema, records interface{}) (from, to int, err error) {
+	slice := reflect.ValueOf(records)
+	n := slice.Len()
+	if q == nil {
+		q = All()
+	}
+
+	// records equal in every sorted field are ordered by their key, so pages never overlap
+	fields := append(append([]Field(nil), q.sort...), s.key)
+	sort.SliceStable(records, func(i, j int) bool {
+		for _, f := range fields {
+			cmp, cerr := compare(fieldValue(slice.Index(i).Interface(), f), fieldValue(slice.Index(j).Interface(), f))
+			if cerr != nil {
+				err = cerr
+				return false
+			}
+			if cmp != 0 {
+				return (cmp < 0) != q.reverse
+			}
+		}
+
+		return false
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	from = q.skip
+	if from > n {
+		from = n
+	}
+	to = n
+	if q.limit > 0 && from+q.limit < n {
+		to = from + q.limit
+	}
+
+	return from, to, nil
+}
+
+// fieldValue reads the field of a record, or of the record a pointer points to
+func fieldValue(record interface{}, field Field) interface{} {
+	return reflect.Indirect(reflect.ValueOf(record)).FieldByName(string(field)).Interface()
+}
+
+// compare orders two values of the same type, returning -1, 0 or 1
+func compare(value, other interface{}) (int, error) {
+	if reflect.TypeOf(value) != reflect.TypeOf(other) {
+		return 0, fmt.Errorf("%v (%T) cannot be compared with %v (%T)", value, value, other, other)
+	}
+
+	if t, ok := value.(time.Time); ok {
+		o := other.(time.Time)
+		switch {
+		case t.Before(o):
+			return -1, nil
+		case t.After(o):
+			return 1, nil
+		}
+
+		return 0, nil
+	}
+
+	v, o := reflect.ValueOf(value), reflect.ValueOf(other)
+	switch v.Kind() {
+	case reflect.String:
+		return strings.Compare(v.String(), o.String()), nil
+	case reflect.Bool:
+		switch {
+		case v.Bool() == o.Bool():
+			return 0, nil
+		case o.Bool():
+			return -1, nil
+		}
+
+		return 1, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		switch {
+		case v.Int() < o.Int():
+			return -1, nil
+		case v.Int() > o.Int():
+			return 1, nil
+		}
+
+		return 0, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		switch {
+		case v.Uint() < o.Uint():
+			return -1, nil
+		case v.Uint() > o.Uint():
+			return 1, nil
+		}
+
+		return 0, nil
+	}
+
+	return 0, fmt.Errorf("%T values cannot be compared", value)
+}
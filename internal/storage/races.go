@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/timshannon/badgerhold"
+)
+
+// Race is a racetime race the monitor has seen, kept after it
+// leaves racetime's list of current races
+type Race struct {
+	Slug      string `badgerhold:"key"`
+	Category  string
+	Status    string
+	Goal      string
+	Info      string
+	Preset    string
+	Permalink string
+	SeedHash  string
+	OpenedAt  time.Time
+	StartedAt time.Time
+	// EndedAt is when the race finished or was cancelled
+	EndedAt   time.Time
+	Entrants  []RaceEntrant
+	UpdatedAt time.Time
+}
+
+// RaceEntrant is a racer in a race, in the order racetime lists them
+type RaceEntrant struct {
+	RacetimeID  string
+	Name        string
+	TwitchName  string
+	Status      string
+	Place       int
+	FinishTime  time.Duration
+	ScoreChange int
+}
+
+// FindRace looks up the race with a slug
+func (db *BadgerStore) FindRace(slug string) (*Race, error) {
+	var race Race
+	err := db.store.Get(slug, &race)
+	if err != nil {
+		if err == badgerhold.ErrNotFound {
+			return nil, ErrNotFound
+		}
+
+		return nil, fmt.Errorf("error while looking up race %s: %w", slug, err)
+	}
+
+	return &race, nil
+}
+
+// FindRaces lists the races matching a query
+func (db *BadgerStore) FindRaces(query *Query) ([]*Race, error) {
+	var races []*Race
+	err := db.find(raceSchema, &races, query)
+	if err != nil {
+		return nil, fmt.Errorf("error while looking up races: %w", err)
+	}
+
+	return races, nil
+}
+
+// CountRaces counts the races matching a query
+func (db *BadgerStore) CountRaces(query *Query) (int, error) {
+	var races []*Race
+	n, err := db.count(raceSchema, &races, query)
+	if err != nil {
+		return 0, fmt.Errorf("error while counting races: %w", err)
+	}
+
+	return n, nil
+}
+
+// FindEntrantRaces lists the races a racetime user entered, most recently opened first
+func (db *BadgerStore) FindEntrantRaces(racetimeID string) ([]*Race, error) {
+	var races []*Race
+	err := db.store.Find(&races, badgerhold.Where("Entrants").MatchFunc(func(ra *badgerhold.RecordAccess) (bool, error) {
+		entrants, ok := ra.Field().([]RaceEntrant)
+		if !ok {
+			return false, fmt.Errorf("unexpected entrants type %T", ra.Field())
+		}
+
+		for _, e := range entrants {
+			if e.RacetimeID == racetimeID {
+				return true, nil
+			}
+		}
+
+		return false, nil
+	}).SortBy("OpenedAt").Reverse())
+	if err != nil {
+		return nil, fmt.Errorf("error while looking up races of %s: %w", racetimeID, err)
+	}
+
+	return races, nil
+}
+
+// SaveRace inserts or replaces a race and its entrants
+func (db *BadgerStore) SaveRace(race Race) (*Race, error) {
+	race.UpdatedAt = time.Now()
+
+	err := db.store.Upsert(race.Slug, &race)
+	if err != nil {
+		return nil, fmt.Errorf("error saving race %s: %w", race.Slug, err)
+	}
+
+	return &race, nil
+}
@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/timshannon/badgerhold"
+)
+
+// ChannelSettings is how the bot behaves in a streamer's channel.
+// Channels without saved settings use the defaults of the twitch package.
+type ChannelSettings struct {
+	UserID uint64 `badgerhold:"key"`
+	// Commands are the chat commands enabled in the channel, all of them when empty
+	Commands []string
+	// Prefix starts every chat command, such as !twwr
+	Prefix string
+	// Aliases map top-level commands, such as !perma, straight to the command they run
+	Aliases map[string]string
+	// Locale is the language the bot replies in
+	Locale string
+	// AnnounceStart, AnnounceFinish and AnnounceResults post in chat when the
+	// streamer's race starts, when they finish and once everyone has
+	AnnounceStart   bool
+	AnnounceFinish  bool
+	AnnounceResults bool
+	// MultistreamProvider is the site !twwr multi links to, leaving out
+	// finished racers when MultiHideFinished is set
+	MultistreamProvider string
+	MultiHideFinished   bool
+	// CommandCooldown is how long a command must wait before it is answered again
+	CommandCooldown time.Duration
+	// Marbles replies !play to the streamer's !play
+	Marbles   bool
+	UpdatedAt time.Time
+}
+
+// FindChannelSettings looks up the settings saved for a user's channel
+func (db *BadgerStore) FindChannelSettings(userID uint64) (*ChannelSettings, error) {
+	var settings ChannelSettings
+	err := db.store.Get(userID, &settings)
+	if err != nil {
+		if err == badgerhold.ErrNotFound {
+			return nil, ErrNotFound
+		}
+
+		return nil, fmt.Errorf("error while looking up channel settings for user %v: %w", userID, err)
+	}
+
+	return &settings, nil
+}
+
+// FindAllChannelSettings lists the settings saved for every channel
+func (db *BadgerStore) FindAllChannelSettings() ([]*ChannelSettings, error) {
+	var settings []*ChannelSettings
+	err := db.store.Find(&settings, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error while looking up channel settings: %w", err)
+	}
+
+	return settings, nil
+}
+
+// SaveChannelSettings inserts or replaces the settings of a user's channel
+func (db *BadgerStore) SaveChannelSettings(settings ChannelSettings) (*ChannelSettings, error) {
+	settings.UpdatedAt = time.Now()
+
+	err := db.store.Upsert(settings.UserID, &settings)
+	if err != nil {
+		return nil, fmt.Errorf("error saving channel settings for user %v: %w", settings.UserID, err)
+	}
+
+	return &settings, nil
+}
+
+// legacyUser is a user saved when channels kept their multistream
+// settings on the user, before channel settings existed. ID isn't tagged
+// as the key, as badgerhold finds keys by the name of the type rather than
+// its Type, but it is read from the user all the same.
+type legacyUser struct {
+	ID                  uint64
+	MultistreamProvider string
+	MultiHideFinished   bool
+}
+
+// Type reads legacy users from among users
+func (legacyUser) Type() string { return "User" }
+
+// Indexes are never used, as legacy users are only read
+func (legacyUser) Indexes() map[string]badgerhold.Index { return nil }
+
+// settings are the channel settings a legacy user's multistream settings move
+// to, with the default settings of the time, or false if there are none to move
+func (u legacyUser) settings() (ChannelSettings, bool) {
+	if u.MultistreamProvider == "" && !u.MultiHideFinished {
+		return ChannelSettings{}, false
+	}
+
+	return ChannelSettings{
+		UserID:              u.ID,
+		Prefix:              "!twwr",
+		Locale:              "en",
+		MultistreamProvider: u.MultistreamProvider,
+		MultiHideFinished:   u.MultiHideFinished,
+		Marbles:             true,
+	}, true
+}
+
+// migrateMultistreamSettings moves the multistream settings kept on users into
+// the settings of channels without any. Users drop them once they are saved again.
+func (db *BadgerStore) migrateMultistreamSettings() error {
+	var users []legacyUser
+	err := db.store.Find(&users, nil)
+	if err != nil {
+		return fmt.Errorf("error while looking up users: %w", err)
+	}
+
+	for _, u := range users {
+		settings, ok := u.settings()
+		if !ok {
+			continue
+		}
+
+		_, err = db.FindChannelSettings(u.ID)
+		if err != ErrNotFound {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		_, err = db.SaveChannelSettings(settings)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,294 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/config"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// dialect covers the differences between the sql databases SQLStore supports
+type dialect struct {
+	driver string
+	// types fills in the column types migrations leave as {{id}}, {{blob}} and {{timestamp}}
+	types *strings.Replacer
+	// numbered dialects use $1 style placeholders instead of ?
+	numbered bool
+	// resetSequence moves the users id sequence past users inserted with their own id
+	resetSequence string
+	// unlimited is the LIMIT of a query which only skips rows
+	unlimited string
+}
+
+var dialects = map[string]dialect{
+	DriverSQLite: {
+		driver: "sqlite3",
+		types: strings.NewReplacer(
+			"{{id}}", "INTEGER PRIMARY KEY AUTOINCREMENT",
+			"{{blob}}", "BLOB",
+			"{{timestamp}}", "TIMESTAMP",
+		),
+		unlimited: "-1",
+	},
+	DriverPostgres: {
+		driver: "postgres",
+		types: strings.NewReplacer(
+			"{{id}}", "BIGSERIAL PRIMARY KEY",
+			"{{blob}}", "BYTEA",
+			"{{timestamp}}", "TIMESTAMPTZ",
+		),
+		numbered:      true,
+		resetSequence: "SELECT setval(pg_get_serial_sequence('users', 'id'), (SELECT MAX(id) FROM users))",
+		unlimited:     "ALL",
+	},
+}
+
+// SQLStore keeps everything in a sqlite or postgres database
+type SQLStore struct {
+	secrets
+	db      *sql.DB
+	dialect dialect
+}
+
+// execer runs statements on either the database or a transaction
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// scanner is a row which can be scanned, from either QueryRow or Query
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// OpenSQL connects to the configured sqlite or postgres database,
+// migrating its schema to the latest version
+func OpenSQL(conf config.DB) (*SQLStore, error) {
+	d, ok := dialects[conf.Driver]
+	if !ok {
+		return nil, fmt.Errorf("unsupported sql database driver %q", conf.Driver)
+	}
+	if conf.DSN == "" {
+		return nil, fmt.Errorf("a DSN is required by the %s driver", conf.Driver)
+	}
+
+	keys, err := newSecrets(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open(d.driver, conf.DSN)
+	if err != nil {
+		return nil, err
+	}
+	// sqlite allows a single writer, so share one connection rather than
+	// fail with busy errors
+	if conf.Driver == DriverSQLite {
+		db.SetMaxOpenConns(1)
+	}
+
+	err = db.Ping()
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error connecting to %s database: %w", conf.Driver, err)
+	}
+
+	s := &SQLStore{
+		secrets: keys,
+		db:      db,
+		dialect: d,
+	}
+
+	err = s.migrate()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Close
+func (s *SQLStore) Close() error {
+	return s.db.Close()
+}
+
+// clear removes every record, leaving the schema as it is
+func (s *SQLStore) clear() error {
+	return s.transact(func(tx *sql.Tx) error {
+		for _, table := range []string{"command_logs", "race_entrants", "races", "clips", "predictions",
+			"channel_settings", "channel_states", "users"} {
+			_, err := tx.Exec("DELETE FROM " + table)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// migrate applies every migration newer than the schema's version,
+// each within its own transaction
+func (s *SQLStore) migrate() error {
+	_, err := s.db.Exec(s.dialect.types.Replace(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		applied_at {{timestamp}} NOT NULL
+	)`))
+	if err != nil {
+		return fmt.Errorf("error creating schema_migrations: %w", err)
+	}
+
+	var version int
+	err = s.db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+	if err != nil {
+		return fmt.Errorf("error reading schema version: %w", err)
+	}
+
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+
+		err = s.apply(m)
+		if err != nil {
+			return fmt.Errorf("error applying migration %d %s: %w", m.version, m.name, err)
+		}
+	}
+
+	return nil
+}
+
+func (s *SQLStore) apply(m migration) error {
+	return s.transact(func(tx *sql.Tx) error {
+		for _, statement := range m.statements {
+			_, err := tx.Exec(s.dialect.types.Replace(statement))
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err := tx.Exec(s.rebind("INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)"), m.version, time.Now())
+		return err
+	})
+}
+
+// transact runs fn within a transaction, committing it only if fn succeeds
+func (s *SQLStore) transact(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = fn(tx)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// rebind rewrites ? placeholders into the placeholders of the dialect
+func (s *SQLStore) rebind(query string) string {
+	if !s.dialect.numbered {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r != '?' {
+			b.WriteRune(r)
+			continue
+		}
+
+		n++
+		b.WriteString("$")
+		b.WriteString(strconv.Itoa(n))
+	}
+
+	return b.String()
+}
+
+// where turns the conditions of a query into a WHERE clause
+// and the arguments of its placeholders
+func where(sc schema, q *Query) (string, []interface{}, error) {
+	err := q.validate(sc)
+	if err != nil {
+		return "", nil, err
+	}
+	if q == nil || len(q.criteria) == 0 {
+		return "", nil, nil
+	}
+
+	conditions := make([]string, len(q.criteria))
+	args := make([]interface{}, len(q.criteria))
+	for i, c := range q.criteria {
+		conditions[i] = fmt.Sprintf("%s %s ?", sc.columns[c.field], operatorSQL[c.op])
+		args[i] = c.value
+	}
+
+	return "WHERE " + strings.Join(conditions, " AND "), args, nil
+}
+
+// clauses turns a query into the WHERE, ORDER BY, LIMIT and OFFSET clauses
+// of a select, ordering rows by their key once the query's sort is exhausted
+func (s *SQLStore) clauses(sc schema, q *Query) (string, []interface{}, error) {
+	clause, args, err := where(sc, q)
+	if err != nil {
+		return "", nil, err
+	}
+	if q == nil {
+		q = All()
+	}
+
+	direction := ""
+	if q.reverse {
+		direction = " DESC"
+	}
+	var order []string
+	for _, f := range append(append([]Field(nil), q.sort...), sc.key) {
+		order = append(order, sc.columns[f]+direction)
+	}
+	clause += " ORDER BY " + strings.Join(order, ", ")
+
+	if q.limit > 0 {
+		clause += fmt.Sprintf(" LIMIT %d", q.limit)
+	} else if q.skip > 0 {
+		clause += " LIMIT " + s.dialect.unlimited
+	}
+	if q.skip > 0 {
+		clause += fmt.Sprintf(" OFFSET %d", q.skip)
+	}
+
+	return clause, args, nil
+}
+
+// count counts the rows of a schema's table matching a query's conditions
+func (s *SQLStore) count(sc schema, q *Query) (int, error) {
+	clause, args, err := where(sc, q)
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	err = s.queryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s %s", sc.table, clause), args...).Scan(&n)
+	return n, err
+}
+
+func (s *SQLStore) exec(query string, args ...interface{}) (sql.Result, error) {
+	return s.db.Exec(s.rebind(query), args...)
+}
+
+func (s *SQLStore) query(query string, args ...interface{}) (*sql.Rows, error) {
+	return s.db.Query(s.rebind(query), args...)
+}
+
+func (s *SQLStore) queryRow(query string, args ...interface{}) *sql.Row {
+	return s.db.QueryRow(s.rebind(query), args...)
+}
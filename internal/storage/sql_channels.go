@@ -0,0 +1,180 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const channelStateColumns = `user_id, twitch_id, live, joined, live_since, offline_since,
+	title_race, original_title, original_game_id, updated_at`
+
+func scanChannelState(row scanner) (*ChannelState, error) {
+	var c ChannelState
+	err := row.Scan(&c.UserID, &c.TwitchID, &c.Live, &c.Joined, &c.LiveSince, &c.OfflineSince,
+		&c.TitleRace, &c.OriginalTitle, &c.OriginalGameID, &c.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+// FindChannelState looks up the state of a user's channel
+func (s *SQLStore) FindChannelState(userID uint64) (*ChannelState, error) {
+	row := s.queryRow(fmt.Sprintf("SELECT %s FROM channel_states WHERE user_id = ?", channelStateColumns), userID)
+	state, err := scanChannelState(row)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+
+		return nil, fmt.Errorf("error while looking up channel state for user %v: %w", userID, err)
+	}
+
+	return state, nil
+}
+
+// FindChannelStates lists the state of every channel
+func (s *SQLStore) FindChannelStates() ([]*ChannelState, error) {
+	rows, err := s.query(fmt.Sprintf("SELECT %s FROM channel_states ORDER BY user_id", channelStateColumns))
+	if err != nil {
+		return nil, fmt.Errorf("error while looking up channel states: %w", err)
+	}
+	defer rows.Close()
+
+	var states []*ChannelState
+	for rows.Next() {
+		state, err := scanChannelState(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error while reading channel states: %w", err)
+		}
+		states = append(states, state)
+	}
+
+	return states, rows.Err()
+}
+
+// SaveChannelState inserts or replaces the state of a user's channel
+func (s *SQLStore) SaveChannelState(state ChannelState) (*ChannelState, error) {
+	state.UpdatedAt = time.Now()
+
+	_, err := s.exec(fmt.Sprintf(`INSERT INTO channel_states (%s) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (user_id) DO UPDATE SET twitch_id = excluded.twitch_id, live = excluded.live,
+		joined = excluded.joined, live_since = excluded.live_since, offline_since = excluded.offline_since,
+		title_race = excluded.title_race, original_title = excluded.original_title,
+		original_game_id = excluded.original_game_id, updated_at = excluded.updated_at`, channelStateColumns),
+		state.UserID, state.TwitchID, state.Live, state.Joined, state.LiveSince, state.OfflineSince,
+		state.TitleRace, state.OriginalTitle, state.OriginalGameID, state.UpdatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("error saving channel state for user %v: %w", state.UserID, err)
+	}
+
+	return &state, nil
+}
+
+const channelSettingsColumns = `user_id, commands, prefix, aliases, locale, announce_start, announce_finish,
+	announce_results, multistream_provider, multi_hide_finished, command_cooldown, marbles, updated_at`
+
+func scanChannelSettings(row scanner) (*ChannelSettings, error) {
+	var c ChannelSettings
+	var commands, aliases string
+	var cooldown int64
+	err := row.Scan(&c.UserID, &commands, &c.Prefix, &aliases, &c.Locale, &c.AnnounceStart, &c.AnnounceFinish,
+		&c.AnnounceResults, &c.MultistreamProvider, &c.MultiHideFinished, &cooldown, &c.Marbles, &c.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	c.Commands = strings.Fields(commands)
+	c.Aliases = decodeAliases(aliases)
+	c.CommandCooldown = time.Duration(cooldown)
+
+	return &c, nil
+}
+
+// FindChannelSettings looks up the settings saved for a user's channel
+func (s *SQLStore) FindChannelSettings(userID uint64) (*ChannelSettings, error) {
+	row := s.queryRow(fmt.Sprintf("SELECT %s FROM channel_settings WHERE user_id = ?", channelSettingsColumns), userID)
+	settings, err := scanChannelSettings(row)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+
+		return nil, fmt.Errorf("error while looking up channel settings for user %v: %w", userID, err)
+	}
+
+	return settings, nil
+}
+
+// FindAllChannelSettings lists the settings saved for every channel
+func (s *SQLStore) FindAllChannelSettings() ([]*ChannelSettings, error) {
+	rows, err := s.query(fmt.Sprintf("SELECT %s FROM channel_settings ORDER BY user_id", channelSettingsColumns))
+	if err != nil {
+		return nil, fmt.Errorf("error while looking up channel settings: %w", err)
+	}
+	defer rows.Close()
+
+	var all []*ChannelSettings
+	for rows.Next() {
+		settings, err := scanChannelSettings(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error while reading channel settings: %w", err)
+		}
+		all = append(all, settings)
+	}
+
+	return all, rows.Err()
+}
+
+// SaveChannelSettings inserts or replaces the settings of a user's channel
+func (s *SQLStore) SaveChannelSettings(settings ChannelSettings) (*ChannelSettings, error) {
+	settings.UpdatedAt = time.Now()
+
+	_, err := s.exec(fmt.Sprintf(`INSERT INTO channel_settings (%s) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (user_id) DO UPDATE SET commands = excluded.commands, prefix = excluded.prefix,
+		aliases = excluded.aliases, locale = excluded.locale, announce_start = excluded.announce_start, announce_finish = excluded.announce_finish,
+		announce_results = excluded.announce_results, multistream_provider = excluded.multistream_provider,
+		multi_hide_finished = excluded.multi_hide_finished, command_cooldown = excluded.command_cooldown,
+		marbles = excluded.marbles, updated_at = excluded.updated_at`, channelSettingsColumns),
+		settings.UserID, strings.Join(settings.Commands, " "), settings.Prefix, encodeAliases(settings.Aliases), settings.Locale,
+		settings.AnnounceStart, settings.AnnounceFinish, settings.AnnounceResults,
+		settings.MultistreamProvider, settings.MultiHideFinished, int64(settings.CommandCooldown),
+		settings.Marbles, settings.UpdatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("error saving channel settings for user %v: %w", settings.UserID, err)
+	}
+
+	return &settings, nil
+}
+
+// encodeAliases stores aliases as space separated alias=command pairs
+func encodeAliases(aliases map[string]string) string {
+	var pairs []string
+	for alias, command := range aliases {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", alias, command))
+	}
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, " ")
+}
+
+func decodeAliases(encoded string) map[string]string {
+	pairs := strings.Fields(encoded)
+	if len(pairs) == 0 {
+		return nil
+	}
+
+	aliases := map[string]string{}
+	for _, pair := range pairs {
+		i := strings.Index(pair, "=")
+		if i == -1 {
+			continue
+		}
+		aliases[pair[:i]] = pair[i+1:]
+	}
+
+	return aliases
+}
@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+)
+
+const commandLogColumns = `user_id, channel, chatter, command, args, latency, outcome, created_at`
+
+// SaveCommandLog records a handled command
+func (s *SQLStore) SaveCommandLog(entry CommandLog) (*CommandLog, error) {
+	err := s.queryRow(fmt.Sprintf("INSERT INTO command_logs (%s) VALUES (?, ?, ?, ?, ?, ?, ?, ?) RETURNING id", commandLogColumns),
+		entry.UserID, entry.Channel, entry.Chatter, entry.Command, entry.Args, int64(entry.Latency), entry.Outcome, entry.CreatedAt).Scan(&entry.ID)
+	if err != nil {
+		return nil, fmt.Errorf("error saving command log: %w", err)
+	}
+
+	return &entry, nil
+}
+
+// FindCommandLogs lists the handled commands matching a query
+func (s *SQLStore) FindCommandLogs(query *Query) ([]*CommandLog, error) {
+	clauses, args, err := s.clauses(commandLogSchema, query)
+	if err != nil {
+		return nil, fmt.Errorf("error while looking up command logs: %w", err)
+	}
+
+	rows, err := s.query(fmt.Sprintf("SELECT id, %s FROM command_logs %s", commandLogColumns, clauses), args...)
+	if err != nil {
+		return nil, fmt.Errorf("error while looking up command logs: %w", err)
+	}
+	defer rows.Close()
+
+	var logs []*CommandLog
+	for rows.Next() {
+		var l CommandLog
+		var latency int64
+		err := rows.Scan(&l.ID, &l.UserID, &l.Channel, &l.Chatter, &l.Command, &l.Args, &latency, &l.Outcome, &l.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("error reading command log: %w", err)
+		}
+		l.Latency = time.Duration(latency)
+		logs = append(logs, &l)
+	}
+
+	return logs, rows.Err()
+}
+
+// CountCommandLogs counts the handled commands matching a query
+func (s *SQLStore) CountCommandLogs(query *Query) (int, error) {
+	n, err := s.count(commandLogSchema, query)
+	if err != nil {
+		return 0, fmt.Errorf("error while counting command logs: %w", err)
+	}
+
+	return n, nil
+}
+
+// DeleteCommandLogs deletes the commands handled before a time, returning how many were deleted
+func (s *SQLStore) DeleteCommandLogs(before time.Time) (int, error) {
+	res, err := s.exec("DELETE FROM command_logs WHERE created_at < ?", before)
+	if err != nil {
+		return 0, fmt.Errorf("error deleting command logs: %w", err)
+	}
+
+	n, err := res.RowsAffected()
+	return int(n), err
+}
@@ -0,0 +1,308 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+const predictionColumns = `id, user_id, race_slug, title, yes_outcome_id, no_outcome_id,
+	status, won, place, finish_time, created_at, ended_at`
+
+func scanPrediction(row scanner) (*Prediction, error) {
+	var p Prediction
+	var finishTime int64
+	err := row.Scan(&p.ID, &p.UserID, &p.RaceSlug, &p.Title, &p.YesOutcomeID, &p.NoOutcomeID,
+		&p.Status, &p.Won, &p.Place, &finishTime, &p.CreatedAt, &p.EndedAt)
+	if err != nil {
+		return nil, err
+	}
+	p.FinishTime = time.Duration(finishTime)
+
+	return &p, nil
+}
+
+func (s *SQLStore) findPredictions(query string, args ...interface{}) ([]*Prediction, error) {
+	rows, err := s.query(fmt.Sprintf("SELECT %s FROM predictions %s", predictionColumns, query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var predictions []*Prediction
+	for rows.Next() {
+		p, err := scanPrediction(rows)
+		if err != nil {
+			return nil, err
+		}
+		predictions = append(predictions, p)
+	}
+
+	return predictions, rows.Err()
+}
+
+// FindPredictions lists the predictions matching a query
+func (s *SQLStore) FindPredictions(query *Query) ([]*Prediction, error) {
+	clauses, args, err := s.clauses(predictionSchema, query)
+	if err != nil {
+		return nil, fmt.Errorf("error while looking up predictions: %w", err)
+	}
+
+	predictions, err := s.findPredictions(clauses, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error while looking up predictions: %w", err)
+	}
+
+	return predictions, nil
+}
+
+// CountPredictions counts the predictions matching a query
+func (s *SQLStore) CountPredictions(query *Query) (int, error) {
+	n, err := s.count(predictionSchema, query)
+	if err != nil {
+		return 0, fmt.Errorf("error while counting predictions: %w", err)
+	}
+
+	return n, nil
+}
+
+// FindActivePrediction looks up the prediction still open for a user's race
+func (s *SQLStore) FindActivePrediction(userID uint64, raceSlug string) (*Prediction, error) {
+	predictions, err := s.findPredictions("WHERE user_id = ? AND race_slug = ? AND status = ? LIMIT 1", userID, raceSlug, PredictionActive)
+	if err != nil {
+		return nil, fmt.Errorf("error while looking up active prediction for user %v: %w", userID, err)
+	}
+
+	if len(predictions) == 0 {
+		return nil, ErrNotFound
+	}
+
+	return predictions[0], nil
+}
+
+// SavePrediction inserts or replaces a prediction
+func (s *SQLStore) SavePrediction(p Prediction) (*Prediction, error) {
+	_, err := s.exec(fmt.Sprintf(`INSERT INTO predictions (%s) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET user_id = excluded.user_id, race_slug = excluded.race_slug,
+		title = excluded.title, yes_outcome_id = excluded.yes_outcome_id, no_outcome_id = excluded.no_outcome_id,
+		status = excluded.status, won = excluded.won, place = excluded.place, finish_time = excluded.finish_time,
+		created_at = excluded.created_at, ended_at = excluded.ended_at`, predictionColumns),
+		p.ID, p.UserID, p.RaceSlug, p.Title, p.YesOutcomeID, p.NoOutcomeID,
+		p.Status, p.Won, p.Place, int64(p.FinishTime), p.CreatedAt, p.EndedAt)
+	if err != nil {
+		return nil, fmt.Errorf("error saving prediction %s: %w", p.ID, err)
+	}
+
+	return &p, nil
+}
+
+const clipColumns = `id, user_id, race_slug, edit_url, url, status, created_at`
+
+func (s *SQLStore) findClips(query string, args ...interface{}) ([]*Clip, error) {
+	rows, err := s.query(fmt.Sprintf("SELECT %s FROM clips %s", clipColumns, query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var clips []*Clip
+	for rows.Next() {
+		var c Clip
+		err := rows.Scan(&c.ID, &c.UserID, &c.RaceSlug, &c.EditURL, &c.URL, &c.Status, &c.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		clips = append(clips, &c)
+	}
+
+	return clips, rows.Err()
+}
+
+// FindClips lists the clips matching a query
+func (s *SQLStore) FindClips(query *Query) ([]*Clip, error) {
+	clauses, args, err := s.clauses(clipSchema, query)
+	if err != nil {
+		return nil, fmt.Errorf("error while looking up clips: %w", err)
+	}
+
+	clips, err := s.findClips(clauses, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error while looking up clips: %w", err)
+	}
+
+	return clips, nil
+}
+
+// CountClips counts the clips matching a query
+func (s *SQLStore) CountClips(query *Query) (int, error) {
+	n, err := s.count(clipSchema, query)
+	if err != nil {
+		return 0, fmt.Errorf("error while counting clips: %w", err)
+	}
+
+	return n, nil
+}
+
+// SaveClip inserts or replaces a clip
+func (s *SQLStore) SaveClip(c Clip) (*Clip, error) {
+	_, err := s.exec(fmt.Sprintf(`INSERT INTO clips (%s) VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET user_id = excluded.user_id, race_slug = excluded.race_slug,
+		edit_url = excluded.edit_url, url = excluded.url, status = excluded.status,
+		created_at = excluded.created_at`, clipColumns),
+		c.ID, c.UserID, c.RaceSlug, c.EditURL, c.URL, c.Status, c.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("error saving clip %s: %w", c.ID, err)
+	}
+
+	return &c, nil
+}
+
+const raceColumns = `slug, category, status, goal, info, preset, permalink, seed_hash,
+	opened_at, started_at, ended_at, updated_at`
+
+const raceEntrantColumns = `race_slug, position, racetime_id, name, twitch_name, status,
+	place, finish_time, score_change`
+
+// findRaces looks up races along with their entrants
+func (s *SQLStore) findRaces(query string, args ...interface{}) ([]*Race, error) {
+	rows, err := s.query(fmt.Sprintf("SELECT %s FROM races %s", raceColumns, query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var races []*Race
+	bySlug := map[string]*Race{}
+	for rows.Next() {
+		var r Race
+		err := rows.Scan(&r.Slug, &r.Category, &r.Status, &r.Goal, &r.Info, &r.Preset, &r.Permalink, &r.SeedHash,
+			&r.OpenedAt, &r.StartedAt, &r.EndedAt, &r.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		races = append(races, &r)
+		bySlug[r.Slug] = &r
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	if len(races) == 0 {
+		return races, nil
+	}
+
+	entrants, err := s.query(fmt.Sprintf(`SELECT %s FROM race_entrants
+		WHERE race_slug IN (SELECT slug FROM races %s) ORDER BY race_slug, position`, raceEntrantColumns, query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer entrants.Close()
+
+	for entrants.Next() {
+		var slug string
+		var position int
+		var finishTime int64
+		var e RaceEntrant
+		err := entrants.Scan(&slug, &position, &e.RacetimeID, &e.Name, &e.TwitchName, &e.Status,
+			&e.Place, &finishTime, &e.ScoreChange)
+		if err != nil {
+			return nil, err
+		}
+		e.FinishTime = time.Duration(finishTime)
+
+		if r, ok := bySlug[slug]; ok {
+			r.Entrants = append(r.Entrants, e)
+		}
+	}
+
+	return races, entrants.Err()
+}
+
+// FindRace looks up the race with a slug
+func (s *SQLStore) FindRace(slug string) (*Race, error) {
+	races, err := s.findRaces("WHERE slug = ?", slug)
+	if err != nil {
+		return nil, fmt.Errorf("error while looking up race %s: %w", slug, err)
+	}
+
+	if len(races) == 0 {
+		return nil, ErrNotFound
+	}
+
+	return races[0], nil
+}
+
+// FindRaces lists the races matching a query
+func (s *SQLStore) FindRaces(query *Query) ([]*Race, error) {
+	clauses, args, err := s.clauses(raceSchema, query)
+	if err != nil {
+		return nil, fmt.Errorf("error while looking up races: %w", err)
+	}
+
+	races, err := s.findRaces(clauses, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error while looking up races: %w", err)
+	}
+
+	return races, nil
+}
+
+// CountRaces counts the races matching a query
+func (s *SQLStore) CountRaces(query *Query) (int, error) {
+	n, err := s.count(raceSchema, query)
+	if err != nil {
+		return 0, fmt.Errorf("error while counting races: %w", err)
+	}
+
+	return n, nil
+}
+
+// FindEntrantRaces lists the races a racetime user entered, most recently opened first
+func (s *SQLStore) FindEntrantRaces(racetimeID string) ([]*Race, error) {
+	races, err := s.findRaces(`WHERE slug IN (SELECT race_slug FROM race_entrants WHERE racetime_id = ?)
+		ORDER BY opened_at DESC`, racetimeID)
+	if err != nil {
+		return nil, fmt.Errorf("error while looking up races of %s: %w", racetimeID, err)
+	}
+
+	return races, nil
+}
+
+// SaveRace inserts or replaces a race and its entrants
+func (s *SQLStore) SaveRace(race Race) (*Race, error) {
+	race.UpdatedAt = time.Now()
+
+	err := s.transact(func(tx *sql.Tx) error {
+		_, err := tx.Exec(s.rebind(fmt.Sprintf(`INSERT INTO races (%s) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (slug) DO UPDATE SET category = excluded.category, status = excluded.status,
+			goal = excluded.goal, info = excluded.info, preset = excluded.preset, permalink = excluded.permalink,
+			seed_hash = excluded.seed_hash, opened_at = excluded.opened_at, started_at = excluded.started_at,
+			ended_at = excluded.ended_at, updated_at = excluded.updated_at`, raceColumns)),
+			race.Slug, race.Category, race.Status, race.Goal, race.Info, race.Preset, race.Permalink, race.SeedHash,
+			race.OpenedAt, race.StartedAt, race.EndedAt, race.UpdatedAt)
+		if err != nil {
+			return err
+		}
+
+		// entrants come and go before a race starts, so they are replaced as a whole
+		_, err = tx.Exec(s.rebind("DELETE FROM race_entrants WHERE race_slug = ?"), race.Slug)
+		if err != nil {
+			return err
+		}
+		for i, e := range race.Entrants {
+			_, err = tx.Exec(s.rebind(fmt.Sprintf("INSERT INTO race_entrants (%s) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)", raceEntrantColumns)),
+				race.Slug, i, e.RacetimeID, e.Name, e.TwitchName, e.Status,
+				e.Place, int64(e.FinishTime), e.ScoreChange)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error saving race %s: %w", race.Slug, err)
+	}
+
+	return &race, nil
+}
@@ -0,0 +1,143 @@
+package storage_test
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/config"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/storage"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/storage/storagetest"
+)
+
+func TestSQLiteStore(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Store {
+		db, err := storage.Open(config.DB{
+			Driver:        storage.DriverSQLite,
+			DSN:           filepath.Join(t.TempDir(), "twwr.db"),
+			EncryptionKey: storagetest.EncryptionKey,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return db
+	})
+
+	t.Run("should migrate an existing database once", func(t *testing.T) {
+		conf := config.DB{
+			Driver:        storage.DriverSQLite,
+			DSN:           filepath.Join(t.TempDir(), "twwr.db"),
+			EncryptionKey: storagetest.EncryptionKey,
+		}
+		db, err := storage.Open(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.CreateUser("1", "streamer", "Streamer", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+
+		db, err = storage.Open(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		users, err := db.FindUsers(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(users) != 1 {
+			t.Errorf("got %v users, want %v", len(users), 1)
+		}
+	})
+
+	t.Run("should move the multistream settings kept on users to their channel settings", func(t *testing.T) {
+		conf := config.DB{
+			Driver:        storage.DriverSQLite,
+			DSN:           filepath.Join(t.TempDir(), "twwr.db"),
+			EncryptionKey: storagetest.EncryptionKey,
+		}
+		db, err := storage.Open(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+
+		// roll the database back to before the settings moved
+		conn, err := sql.Open("sqlite3", conf.DSN)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, statement := range []string{
+			"DELETE FROM schema_migrations WHERE version = 9",
+			"ALTER TABLE users ADD COLUMN multistream_provider TEXT NOT NULL DEFAULT ''",
+			"ALTER TABLE users ADD COLUMN multi_hide_finished BOOLEAN NOT NULL DEFAULT FALSE",
+			"INSERT INTO users (id, twitch_id, multistream_provider, multi_hide_finished, joined_at) VALUES (1, '1', 'kadgar', TRUE, CURRENT_TIMESTAMP)",
+			"INSERT INTO users (id, twitch_id, multistream_provider, joined_at) VALUES (2, '2', 'kadgar', CURRENT_TIMESTAMP)",
+			"INSERT INTO channel_settings (user_id, prefix, multistream_provider, updated_at) VALUES (2, '!race', 'multitwitch', CURRENT_TIMESTAMP)",
+		} {
+			_, err = conn.Exec(statement)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		conn.Close()
+
+		db, err = storage.Open(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		settings, err := db.FindChannelSettings(1)
+		if err != nil || settings.MultistreamProvider != "kadgar" || !settings.MultiHideFinished || settings.Prefix != "!twwr" {
+			t.Errorf("got %+v (%v), want the user's multistream settings", settings, err)
+		}
+		settings, err = db.FindChannelSettings(2)
+		if err != nil || settings.MultistreamProvider != "multitwitch" || settings.Prefix != "!race" {
+			t.Errorf("got %+v (%v), want the channel's own settings", settings, err)
+		}
+		users, err := db.FindUsers(nil)
+		if err != nil || len(users) != 2 {
+			t.Errorf("got %v users (%v), want %v", len(users), err, 2)
+		}
+	})
+}
+
+// TestPostgresStore runs against the database in TEST_POSTGRES_DSN, which is
+// emptied before each test
+func TestPostgresStore(t *testing.T) {
+	dsn := os.Getenv("TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("TEST_POSTGRES_DSN is not set")
+	}
+
+	storagetest.Run(t, func(t *testing.T) storage.Store {
+		conn, err := sql.Open(storage.DriverPostgres, dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		// every table goes, so each test migrates from scratch however many migrations there are
+		_, err = conn.Exec("DROP SCHEMA public CASCADE; CREATE SCHEMA public")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		db, err := storage.Open(config.DB{
+			Driver:        storage.DriverPostgres,
+			DSN:           dsn,
+			EncryptionKey: storagetest.EncryptionKey,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return db
+	})
+}
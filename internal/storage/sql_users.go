@@ -0,0 +1,372 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const userColumns = `id, twitch_id, racetime_id, twitch_name, twitch_display_name, profile_image_url,
+	active_in_channel, auto_title, title_template,
+	predictions, prediction_top_n, prediction_target, auto_clip, clip_to_chat, clip_to_racetime,
+	shoutouts, twitch_token, twitch_scopes, joined_at`
+
+func scanUser(row scanner) (*User, error) {
+	var u User
+	var target int64
+	var scopes string
+	err := row.Scan(&u.ID, &u.TwitchID, &u.RacetimeID, &u.TwitchName, &u.TwitchDisplayName, &u.ProfileImageURL,
+		&u.ActiveInChannel, &u.AutoTitle, &u.TitleTemplate,
+		&u.Predictions, &u.PredictionTopN, &target, &u.AutoClip, &u.ClipToChat, &u.ClipToRacetime,
+		&u.Shoutouts, &u.TwitchToken, &scopes, &u.JoinedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	u.PredictionTarget = time.Duration(target)
+	u.TwitchScopes = strings.Fields(scopes)
+
+	return &u, nil
+}
+
+// FindUsers
+func (s *SQLStore) FindUsers(query *Query) ([]*User, error) {
+	clauses, args, err := s.clauses(userSchema, query)
+	if err != nil {
+		return nil, fmt.Errorf("error while looking up users: %w", err)
+	}
+
+	rows, err := s.query(fmt.Sprintf("SELECT %s FROM users %s", userColumns, clauses), args...)
+	if err != nil {
+		return nil, fmt.Errorf("error while looking up users: %w", err)
+	}
+	defer rows.Close()
+
+	var users []*User
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error while reading users: %w", err)
+		}
+		users = append(users, u)
+	}
+
+	return users, rows.Err()
+}
+
+// CountUsers
+func (s *SQLStore) CountUsers(query *Query) (int, error) {
+	n, err := s.count(userSchema, query)
+	if err != nil {
+		return 0, fmt.Errorf("error while counting users: %w", err)
+	}
+
+	return n, nil
+}
+
+func (s *SQLStore) FindUser(query *Query) (*User, error) {
+	users, err := s.FindUsers(query)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(users) == 0 {
+		return nil, ErrNotFound
+	}
+
+	return users[0], nil
+}
+
+// CreateUser inserts a new user into the database
+func (s *SQLStore) CreateUser(twitchID, twitchName, twitchDisplayName, profileImageURL string) (*User, error) {
+	user := User{
+		TwitchID:          twitchID,
+		TwitchName:        twitchName,
+		TwitchDisplayName: twitchDisplayName,
+		ProfileImageURL:   profileImageURL,
+		ActiveInChannel:   false,
+		JoinedAt:          time.Now(),
+	}
+	err := checkUnique(s.FindUsers, user, true)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.queryRow(`INSERT INTO users (twitch_id, twitch_name, twitch_display_name, profile_image_url, joined_at)
+		VALUES (?, ?, ?, ?, ?) RETURNING id`,
+		user.TwitchID, user.TwitchName, user.TwitchDisplayName, user.ProfileImageURL, user.JoinedAt).Scan(&user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("error while creating new user: %w", err)
+	}
+
+	return &user, nil
+}
+
+// UpdateUser
+func (s *SQLStore) UpdateUser(id uint64, user UserUpdate) (*User, error) {
+	u, err := s.FindUser(Where(FieldID).Eq(id))
+	if err != nil {
+		if err == ErrNotFound {
+			return nil, err
+		}
+
+		return nil, fmt.Errorf("error while updating user: %w", err)
+	}
+
+	user.apply(u)
+
+	err = checkUnique(s.FindUsers, *u, false)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.saveUser(s.db, u)
+	if err != nil {
+		return nil, fmt.Errorf("error updating user: %w", err)
+	}
+
+	return u, nil
+}
+
+// saveUser writes every column of an existing user
+func (s *SQLStore) saveUser(e execer, u *User) error {
+	_, err := e.Exec(s.rebind(`UPDATE users SET twitch_id = ?, racetime_id = ?, twitch_name = ?, twitch_display_name = ?,
+		profile_image_url = ?, active_in_channel = ?,
+		auto_title = ?, title_template = ?, predictions = ?, prediction_top_n = ?, prediction_target = ?,
+		auto_clip = ?, clip_to_chat = ?, clip_to_racetime = ?, shoutouts = ?, twitch_token = ?,
+		twitch_scopes = ?, joined_at = ?
+		WHERE id = ?`),
+		u.TwitchID, u.RacetimeID, u.TwitchName, u.TwitchDisplayName,
+		u.ProfileImageURL, u.ActiveInChannel,
+		u.AutoTitle, u.TitleTemplate, u.Predictions, u.PredictionTopN, int64(u.PredictionTarget),
+		u.AutoClip, u.ClipToChat, u.ClipToRacetime, u.Shoutouts, u.TwitchToken,
+		strings.Join(u.TwitchScopes, " "), u.JoinedAt,
+		u.ID)
+
+	return err
+}
+
+// RestoreUser inserts a user exactly as given, keeping its id
+func (s *SQLStore) RestoreUser(u User) error {
+	err := checkUnique(s.FindUsers, u, true)
+	if err != nil {
+		return err
+	}
+
+	err = s.transact(func(tx *sql.Tx) error {
+		_, err := tx.Exec(s.rebind(fmt.Sprintf(`INSERT INTO users (%s)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, userColumns)),
+			u.ID, u.TwitchID, u.RacetimeID, u.TwitchName, u.TwitchDisplayName, u.ProfileImageURL,
+			u.ActiveInChannel, u.AutoTitle, u.TitleTemplate,
+			u.Predictions, u.PredictionTopN, int64(u.PredictionTarget), u.AutoClip, u.ClipToChat, u.ClipToRacetime,
+			u.Shoutouts, u.TwitchToken, strings.Join(u.TwitchScopes, " "), u.JoinedAt)
+		if err != nil {
+			return err
+		}
+
+		// ids given explicitly don't advance the sequence new users take theirs from
+		if s.dialect.resetSequence != "" {
+			_, err = tx.Exec(s.dialect.resetSequence)
+		}
+
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("error restoring user %v: %w", u.ID, err)
+	}
+
+	return nil
+}
+
+// MergeUsers consolidates a duplicate user into the user kept, moving its
+// accounts, channel state and settings, predictions, clips and command logs before deleting it
+func (s *SQLStore) MergeUsers(keepID, duplicateID uint64) (*User, error) {
+	if keepID == duplicateID {
+		return nil, fmt.Errorf("cannot merge user %v into itself", keepID)
+	}
+
+	keep, err := s.FindUser(Where(FieldID).Eq(keepID))
+	if err != nil {
+		return nil, err
+	}
+	duplicate, err := s.FindUser(Where(FieldID).Eq(duplicateID))
+	if err != nil {
+		return nil, err
+	}
+
+	merged, err := s.mergeUser(*keep, *duplicate)
+	if err != nil {
+		return nil, err
+	}
+	err = s.transact(func(tx *sql.Tx) error {
+		statements := []string{
+			// the duplicate goes first so its accounts are free to move
+			"DELETE FROM users WHERE id = ?",
+			"UPDATE predictions SET user_id = ? WHERE user_id = ?",
+			"UPDATE clips SET user_id = ? WHERE user_id = ?",
+			"UPDATE command_logs SET user_id = ? WHERE user_id = ?",
+			// the duplicate's channel state and settings are only kept when the user kept has none
+			"DELETE FROM channel_states WHERE user_id = ? AND EXISTS (SELECT 1 FROM channel_states WHERE user_id = ?)",
+			"UPDATE channel_states SET user_id = ? WHERE user_id = ?",
+			"DELETE FROM channel_settings WHERE user_id = ? AND EXISTS (SELECT 1 FROM channel_settings WHERE user_id = ?)",
+			"UPDATE channel_settings SET user_id = ? WHERE user_id = ?",
+		}
+		args := [][]interface{}{
+			{duplicateID},
+			{keepID, duplicateID},
+			{keepID, duplicateID},
+			{keepID, duplicateID},
+			{duplicateID, keepID},
+			{keepID, duplicateID},
+			{duplicateID, keepID},
+			{keepID, duplicateID},
+		}
+		for i, statement := range statements {
+			_, err := tx.Exec(s.rebind(statement), args[i]...)
+			if err != nil {
+				return err
+			}
+		}
+
+		return s.saveUser(tx, &merged)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error merging user %v into %v: %w", duplicateID, keepID, err)
+	}
+
+	return &merged, nil
+}
+
+// DeleteUser
+func (s *SQLStore) DeleteUser(id uint64) error {
+	res, err := s.exec("DELETE FROM users WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("error deleting user with id %v: %w", id, err)
+	}
+
+	n, err := res.RowsAffected()
+	if err == nil && n == 0 {
+		return fmt.Errorf("error deleting user with id %v: %w", id, ErrNotFound)
+	}
+
+	return nil
+}
+
+// SaveTwitchToken encrypts a user's twitch token onto their user record
+func (s *SQLStore) SaveTwitchToken(id uint64, token OAuthToken) (*User, error) {
+	user, err := s.FindUser(Where(FieldID).Eq(id))
+	if err != nil {
+		return nil, err
+	}
+
+	user.TwitchToken, err = s.sealToken(id, token)
+	if err != nil {
+		return nil, fmt.Errorf("error encrypting twitch token for user %v: %w", id, err)
+	}
+	user.TwitchScopes = token.Scopes
+
+	err = s.saveUser(s.db, user)
+	if err != nil {
+		return nil, fmt.Errorf("error saving twitch token for user %v: %w", id, err)
+	}
+
+	return user, nil
+}
+
+// FindTwitchToken decrypts the twitch token a user has granted, if any
+func (s *SQLStore) FindTwitchToken(id uint64) (*OAuthToken, error) {
+	var ciphertext []byte
+	err := s.queryRow("SELECT twitch_token FROM users WHERE id = ?", id).Scan(&ciphertext)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+
+		return nil, fmt.Errorf("error while looking up twitch token for user %v: %w", id, err)
+	}
+	if len(ciphertext) == 0 {
+		return nil, ErrNotFound
+	}
+
+	token, err := s.openToken(id, ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting twitch token for user %v: %w", id, err)
+	}
+
+	return token, nil
+}
+
+// DeleteTwitchToken removes a user's twitch token and granted scopes
+func (s *SQLStore) DeleteTwitchToken(id uint64) error {
+	res, err := s.exec("UPDATE users SET twitch_token = NULL, twitch_scopes = '' WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("error deleting twitch token for user %v: %w", id, err)
+	}
+
+	n, err := res.RowsAffected()
+	if err == nil && n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// RotateEncryptionKey rewraps every user's twitch token with a new master key
+func (s *SQLStore) RotateEncryptionKey(key string) (int, error) {
+	rotated, err := s.rotate(key)
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	err = s.transact(func(tx *sql.Tx) error {
+		rows, err := tx.Query("SELECT id, twitch_token FROM users WHERE twitch_token IS NOT NULL")
+		if err != nil {
+			return err
+		}
+
+		// every token is read before any is written, as a transaction can't do both at once
+		tokens := map[uint64][]byte{}
+		for rows.Next() {
+			var id uint64
+			var ciphertext []byte
+			err = rows.Scan(&id, &ciphertext)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			if len(ciphertext) > 0 {
+				tokens[id] = ciphertext
+			}
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+
+		for id, ciphertext := range tokens {
+			token, changed, err := rotated.rewrap(ciphertext, tokenAAD(id))
+			if err != nil {
+				return fmt.Errorf("error rewrapping twitch token for user %v: %w", id, err)
+			}
+			if !changed {
+				continue
+			}
+
+			_, err = tx.Exec(s.rebind("UPDATE users SET twitch_token = ? WHERE id = ?"), token, id)
+			if err != nil {
+				return err
+			}
+			n++
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error rotating database encryption key: %w", err)
+	}
+	s.secrets = rotated
+
+	return n, nil
+}
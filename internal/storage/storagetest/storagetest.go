@@ -0,0 +1,1129 @@
+// Package storagetest is a conformance suite every storage.Store must pass
+package storagetest
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/storage"
+)
+
+// EncryptionKey is a valid DB_ENCRYPTION_KEY for stores opened by tests
+const EncryptionKey = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+
+// Run tests a store against the behaviour the bot expects of it.
+// open is called once per test and must return an empty store.
+func Run(t *testing.T, open func(t *testing.T) storage.Store) {
+	tests := map[string]func(t *testing.T, db storage.Store){
+		"users":            testUsers,
+		"user queries":     testUserQueries,
+		"twitch tokens":    testTwitchTokens,
+		"key rotation":     testKeyRotation,
+		"channel states":   testChannelStates,
+		"channel settings": testChannelSettings,
+		"predictions":      testPredictions,
+		"clips":            testClips,
+		"merging users":    testMergeUsers,
+		"races":            testRaces,
+		"command logs":     testCommandLogs,
+		"queries":          testQueries,
+	}
+
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			db := open(t)
+			t.Cleanup(func() {
+				db.Close()
+			})
+
+			test(t, db)
+		})
+	}
+}
+
+func testUsers(t *testing.T, db storage.Store) {
+	t.Run("should create users with unique twitch ids", func(t *testing.T) {
+		user, err := db.CreateUser("1", "streamer", "Streamer", "https://example.com/streamer.png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.CreateUser("1", "streamer", "Streamer", "")
+		if !errors.Is(err, storage.ErrExists) {
+			t.Errorf("got %v, want %v", err, storage.ErrExists)
+		}
+		var conflict *storage.ConflictError
+		if !errors.As(err, &conflict) || conflict.Field != storage.FieldTwitchID || conflict.UserID != user.ID {
+			t.Errorf("got %v, want a conflict on %v with user %v", err, storage.FieldTwitchID, user.ID)
+		}
+
+		other, err := db.CreateUser("2", "other", "Other", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if other.ID == user.ID {
+			t.Errorf("got id %v for both users, want distinct ids", other.ID)
+		}
+	})
+
+	t.Run("should find users by id", func(t *testing.T) {
+		created, err := db.CreateUser("3", "finder", "Finder", "https://example.com/finder.png")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		found, err := db.FindUser(storage.Where(storage.FieldID).Eq(created.ID))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found.TwitchID != "3" || found.TwitchName != "finder" || found.TwitchDisplayName != "Finder" ||
+			found.ProfileImageURL != "https://example.com/finder.png" {
+			t.Errorf("got %+v, want %+v", found, created)
+		}
+		if !sameTime(found.JoinedAt, created.JoinedAt) {
+			t.Errorf("got joined at %v, want %v", found.JoinedAt, created.JoinedAt)
+		}
+	})
+
+	t.Run("should update only the fields given", func(t *testing.T) {
+		created, err := db.CreateUser("4", "updater", "Updater", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		racetimeID := "racetime-4"
+		active := true
+		topN := 3
+		target := time.Hour + time.Minute*30
+		updated, err := db.UpdateUser(created.ID, storage.UserUpdate{
+			RacetimeID:       &racetimeID,
+			ActiveInChannel:  &active,
+			PredictionTopN:   &topN,
+			PredictionTarget: &target,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		found, err := db.FindUser(storage.Where(storage.FieldID).Eq(created.ID))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, u := range []*storage.User{updated, found} {
+			if u.RacetimeID != racetimeID || !u.ActiveInChannel || u.PredictionTopN != topN || u.PredictionTarget != target {
+				t.Errorf("got %+v, want the update applied", u)
+			}
+			if u.TwitchName != "updater" {
+				t.Errorf("got twitch name %v, want %v", u.TwitchName, "updater")
+			}
+		}
+	})
+
+	t.Run("should not link a racetime account to two users", func(t *testing.T) {
+		first, err := db.CreateUser("6", "first", "First", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		second, err := db.CreateUser("7", "second", "Second", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		racetimeID := "racetime-6"
+		_, err = db.UpdateUser(first.ID, storage.UserUpdate{RacetimeID: &racetimeID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// relinking the same account is not a conflict
+		_, err = db.UpdateUser(first.ID, storage.UserUpdate{RacetimeID: &racetimeID})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = db.UpdateUser(second.ID, storage.UserUpdate{RacetimeID: &racetimeID})
+		var conflict *storage.ConflictError
+		if !errors.As(err, &conflict) || conflict.Field != storage.FieldRacetimeID || conflict.UserID != first.ID {
+			t.Errorf("got %v, want a conflict on %v with user %v", err, storage.FieldRacetimeID, first.ID)
+		}
+
+		found, err := db.FindUser(storage.Where(storage.FieldID).Eq(second.ID))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found.RacetimeID != "" {
+			t.Errorf("got racetime id %v, want it left unlinked", found.RacetimeID)
+		}
+	})
+
+	t.Run("should not move a twitch account onto another user", func(t *testing.T) {
+		user, err := db.CreateUser("8", "mover", "Mover", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		twitchID := "1"
+		_, err = db.UpdateUser(user.ID, storage.UserUpdate{TwitchID: &twitchID})
+		var conflict *storage.ConflictError
+		if !errors.As(err, &conflict) || conflict.Field != storage.FieldTwitchID {
+			t.Errorf("got %v, want a conflict on %v", err, storage.FieldTwitchID)
+		}
+	})
+
+	t.Run("should not update missing users", func(t *testing.T) {
+		name := "missing"
+		_, err := db.UpdateUser(1000, storage.UserUpdate{TwitchName: &name})
+		if err != storage.ErrNotFound {
+			t.Errorf("got %v, want %v", err, storage.ErrNotFound)
+		}
+	})
+
+	t.Run("should delete users", func(t *testing.T) {
+		created, err := db.CreateUser("5", "deleted", "Deleted", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = db.DeleteUser(created.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = db.FindUser(storage.Where(storage.FieldID).Eq(created.ID))
+		if err != storage.ErrNotFound {
+			t.Errorf("got %v, want %v", err, storage.ErrNotFound)
+		}
+	})
+
+	t.Run("should not delete missing users", func(t *testing.T) {
+		err := db.DeleteUser(404)
+		if !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("got %v, want %v", err, storage.ErrNotFound)
+		}
+	})
+}
+
+func testUserQueries(t *testing.T, db storage.Store) {
+	linked, err := db.CreateUser("1", "linked", "Linked", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlinked, err := db.CreateUser("2", "unlinked", "Unlinked", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.CreateUser("3", "inactive", "Inactive", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	racetimeID := "racetime-1"
+	active := true
+	_, err = db.UpdateUser(linked.ID, storage.UserUpdate{RacetimeID: &racetimeID, ActiveInChannel: &active})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.UpdateUser(unlinked.ID, storage.UserUpdate{ActiveInChannel: &active})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("should find every user with a nil query", func(t *testing.T) {
+		users, err := db.FindUsers(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(users) != 3 {
+			t.Errorf("got %v users, want %v", len(users), 3)
+		}
+	})
+
+	t.Run("should find users by twitch and racetime id", func(t *testing.T) {
+		user, err := db.FindUser(storage.Where(storage.FieldTwitchID).Eq("2"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.ID != unlinked.ID {
+			t.Errorf("got %v, want %v", user.ID, unlinked.ID)
+		}
+
+		user, err = db.FindUser(storage.Where(storage.FieldRacetimeID).Eq(racetimeID))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.ID != linked.ID {
+			t.Errorf("got %v, want %v", user.ID, linked.ID)
+		}
+	})
+
+	t.Run("should only find active users who linked both accounts", func(t *testing.T) {
+		users, err := db.FindUsers(storage.ActiveChannels())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(users) != 1 || users[0].ID != linked.ID {
+			t.Errorf("got %+v, want only user %v", users, linked.ID)
+		}
+	})
+
+	t.Run("should not find unknown users", func(t *testing.T) {
+		_, err := db.FindUser(storage.Where(storage.FieldTwitchID).Eq("unknown"))
+		if err != storage.ErrNotFound {
+			t.Errorf("got %v, want %v", err, storage.ErrNotFound)
+		}
+	})
+}
+
+func testTwitchTokens(t *testing.T, db storage.Store) {
+	user, err := db.CreateUser("1", "streamer", "Streamer", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("should not find a token before one is saved", func(t *testing.T) {
+		_, err := db.FindTwitchToken(user.ID)
+		if err != storage.ErrNotFound {
+			t.Errorf("got %v, want %v", err, storage.ErrNotFound)
+		}
+	})
+
+	t.Run("should save encrypted tokens and their scopes", func(t *testing.T) {
+		token := storage.OAuthToken{
+			AccessToken:  "access",
+			RefreshToken: "refresh",
+			Scopes:       []string{"channel:manage:broadcast", "clips:edit"},
+			ExpiresAt:    time.Now().Add(time.Hour),
+		}
+		saved, err := db.SaveTwitchToken(user.ID, token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(saved.TwitchScopes) != 2 {
+			t.Errorf("got scopes %v, want %v", saved.TwitchScopes, token.Scopes)
+		}
+
+		found, err := db.FindTwitchToken(user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found.AccessToken != token.AccessToken || found.RefreshToken != token.RefreshToken || !sameTime(found.ExpiresAt, token.ExpiresAt) {
+			t.Errorf("got %+v, want %+v", found, token)
+		}
+
+		u, err := db.FindUser(storage.Where(storage.FieldID).Eq(user.ID))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(u.TwitchScopes) != 2 || u.TwitchScopes[0] != "channel:manage:broadcast" || u.TwitchScopes[1] != "clips:edit" {
+			t.Errorf("got scopes %v, want %v", u.TwitchScopes, token.Scopes)
+		}
+	})
+
+	t.Run("should delete tokens and their scopes", func(t *testing.T) {
+		err := db.DeleteTwitchToken(user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = db.FindTwitchToken(user.ID)
+		if err != storage.ErrNotFound {
+			t.Errorf("got %v, want %v", err, storage.ErrNotFound)
+		}
+
+		u, err := db.FindUser(storage.Where(storage.FieldID).Eq(user.ID))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(u.TwitchScopes) != 0 {
+			t.Errorf("got scopes %v, want none", u.TwitchScopes)
+		}
+	})
+}
+
+func testKeyRotation(t *testing.T, db storage.Store) {
+	user, err := db.CreateUser("1", "streamer", "Streamer", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := storage.OAuthToken{AccessToken: "access", RefreshToken: "refresh"}
+	_, err = db.SaveTwitchToken(user.ID, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("should not rotate to an invalid key", func(t *testing.T) {
+		_, err := db.RotateEncryptionKey("not a key")
+		if err == nil {
+			t.Error("got nil, want an error")
+		}
+	})
+
+	t.Run("should rewrap stored tokens with the new key", func(t *testing.T) {
+		key, err := storage.GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		n, err := db.RotateEncryptionKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 {
+			t.Errorf("got %v, want %v", n, 1)
+		}
+
+		found, err := db.FindTwitchToken(user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found.AccessToken != token.AccessToken || found.RefreshToken != token.RefreshToken {
+			t.Errorf("got %+v, want %+v", found, token)
+		}
+
+		n, err = db.RotateEncryptionKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 0 {
+			t.Errorf("got %v rewrapped again, want %v", n, 0)
+		}
+	})
+}
+
+func testChannelStates(t *testing.T, db storage.Store) {
+	t.Run("should not find a state before one is saved", func(t *testing.T) {
+		_, err := db.FindChannelState(1)
+		if err != storage.ErrNotFound {
+			t.Errorf("got %v, want %v", err, storage.ErrNotFound)
+		}
+	})
+
+	t.Run("should insert and replace states", func(t *testing.T) {
+		liveSince := time.Now().Add(-time.Hour)
+		_, err := db.SaveChannelState(storage.ChannelState{
+			UserID:    1,
+			TwitchID:  "1",
+			Live:      true,
+			Joined:    true,
+			LiveSince: liveSince,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.SaveChannelState(storage.ChannelState{UserID: 2, TwitchID: "2"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		state, err := db.FindChannelState(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !state.Live || !state.Joined || !sameTime(state.LiveSince, liveSince) {
+			t.Errorf("got %+v, want a live and joined state", state)
+		}
+
+		state.Joined = false
+		state.TitleRace = "twwr/clever-moblin-1234"
+		_, err = db.SaveChannelState(*state)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		state, err = db.FindChannelState(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state.Joined || state.TitleRace != "twwr/clever-moblin-1234" {
+			t.Errorf("got %+v, want the replaced state", state)
+		}
+
+		states, err := db.FindChannelStates()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(states) != 2 {
+			t.Errorf("got %v states, want %v", len(states), 2)
+		}
+	})
+}
+
+func testChannelSettings(t *testing.T, db storage.Store) {
+	t.Run("should not find settings before they are saved", func(t *testing.T) {
+		_, err := db.FindChannelSettings(1)
+		if err != storage.ErrNotFound {
+			t.Errorf("got %v, want %v", err, storage.ErrNotFound)
+		}
+	})
+
+	t.Run("should insert and replace settings", func(t *testing.T) {
+		_, err := db.SaveChannelSettings(storage.ChannelSettings{
+			UserID:          1,
+			Commands:        []string{"race", "multi"},
+			Prefix:          "!race",
+			Aliases:         map[string]string{"!perma": "perma", "!vs": "vs"},
+			Locale:          "es",
+			AnnounceFinish:  true,
+			CommandCooldown: 30 * time.Second,
+			Marbles:         true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.SaveChannelSettings(storage.ChannelSettings{UserID: 2, Prefix: "!twwr"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		settings, err := db.FindChannelSettings(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(settings.Commands, []string{"race", "multi"}) {
+			t.Errorf("got %v, want %v", settings.Commands, []string{"race", "multi"})
+		}
+		if !reflect.DeepEqual(settings.Aliases, map[string]string{"!perma": "perma", "!vs": "vs"}) {
+			t.Errorf("got %v, want %v", settings.Aliases, map[string]string{"!perma": "perma", "!vs": "vs"})
+		}
+		if settings.Prefix != "!race" || settings.Locale != "es" || !settings.AnnounceFinish ||
+			settings.CommandCooldown != 30*time.Second || !settings.Marbles {
+			t.Errorf("got %+v, want the saved settings", settings)
+		}
+
+		settings.Commands = nil
+		settings.Aliases = nil
+		settings.Marbles = false
+		_, err = db.SaveChannelSettings(*settings)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		settings, err = db.FindChannelSettings(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(settings.Commands) != 0 || len(settings.Aliases) != 0 || settings.Marbles {
+			t.Errorf("got %+v, want the replaced settings", settings)
+		}
+
+		all, err := db.FindAllChannelSettings()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(all) != 2 {
+			t.Errorf("got %v settings, want %v", len(all), 2)
+		}
+	})
+}
+
+func testPredictions(t *testing.T, db storage.Store) {
+	now := time.Now()
+	older := storage.Prediction{
+		ID:        "older",
+		UserID:    1,
+		RaceSlug:  "twwr/older-race-1234",
+		Status:    storage.PredictionResolved,
+		CreatedAt: now.Add(-time.Hour),
+	}
+	active := storage.Prediction{
+		ID:        "active",
+		UserID:    1,
+		RaceSlug:  "twwr/active-race-1234",
+		Title:     "Will Streamer finish top 3?",
+		Status:    storage.PredictionActive,
+		CreatedAt: now,
+	}
+	for _, p := range []storage.Prediction{older, active} {
+		_, err := db.SavePrediction(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("should list a user's predictions newest first", func(t *testing.T) {
+		predictions, err := db.FindPredictions(storage.Where(storage.FieldUserID).Eq(uint64(1)).SortBy(storage.FieldCreatedAt).Reverse())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(predictions) != 2 || predictions[0].ID != "active" || predictions[1].ID != "older" {
+			t.Errorf("got %+v, want active then older", predictions)
+		}
+	})
+
+	t.Run("should find the active prediction of a race", func(t *testing.T) {
+		p, err := db.FindActivePrediction(1, active.RaceSlug)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.ID != active.ID || p.Title != active.Title {
+			t.Errorf("got %+v, want %+v", p, active)
+		}
+
+		_, err = db.FindActivePrediction(1, older.RaceSlug)
+		if err != storage.ErrNotFound {
+			t.Errorf("got %v, want %v", err, storage.ErrNotFound)
+		}
+	})
+
+	t.Run("should replace saved predictions", func(t *testing.T) {
+		active.Status = storage.PredictionResolved
+		active.Won = true
+		active.Place = 2
+		active.FinishTime = time.Hour + time.Second*42
+		active.EndedAt = now.Add(time.Hour)
+		_, err := db.SavePrediction(active)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = db.FindActivePrediction(1, active.RaceSlug)
+		if err != storage.ErrNotFound {
+			t.Errorf("got %v, want %v", err, storage.ErrNotFound)
+		}
+
+		predictions, err := db.FindPredictions(storage.Where(storage.FieldUserID).Eq(uint64(1)).SortBy(storage.FieldCreatedAt).Reverse())
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := predictions[0]
+		if !p.Won || p.Place != 2 || p.FinishTime != active.FinishTime || !sameTime(p.EndedAt, active.EndedAt) {
+			t.Errorf("got %+v, want %+v", p, active)
+		}
+	})
+}
+
+func testClips(t *testing.T, db storage.Store) {
+	now := time.Now()
+	clips := []storage.Clip{
+		{ID: "first", UserID: 1, RaceSlug: "twwr/race-1234", Status: storage.ClipPending, CreatedAt: now.Add(-time.Minute)},
+		{ID: "second", UserID: 2, RaceSlug: "twwr/race-1234", Status: storage.ClipPending, CreatedAt: now},
+		{ID: "other", UserID: 1, RaceSlug: "twwr/other-1234", Status: storage.ClipPending, CreatedAt: now.Add(time.Minute)},
+	}
+	for _, c := range clips {
+		_, err := db.SaveClip(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("should list a user's clips newest first", func(t *testing.T) {
+		found, err := db.FindClips(storage.Where(storage.FieldUserID).Eq(uint64(1)).SortBy(storage.FieldCreatedAt).Reverse())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(found) != 2 || found[0].ID != "other" || found[1].ID != "first" {
+			t.Errorf("got %+v, want other then first", found)
+		}
+	})
+
+	t.Run("should list a race's clips oldest first", func(t *testing.T) {
+		found, err := db.FindClips(storage.Where(storage.FieldRaceSlug).Eq("twwr/race-1234").SortBy(storage.FieldCreatedAt))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(found) != 2 || found[0].ID != "first" || found[1].ID != "second" {
+			t.Errorf("got %+v, want first then second", found)
+		}
+	})
+
+	t.Run("should replace saved clips", func(t *testing.T) {
+		c := clips[0]
+		c.Status = storage.ClipReady
+		c.URL = "https://clips.twitch.tv/first"
+		_, err := db.SaveClip(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		found, err := db.FindClips(storage.Where(storage.FieldRaceSlug).Eq("twwr/race-1234").SortBy(storage.FieldCreatedAt))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found[0].Status != storage.ClipReady || found[0].URL != c.URL {
+			t.Errorf("got %+v, want %+v", found[0], c)
+		}
+	})
+}
+
+func testMergeUsers(t *testing.T, db storage.Store) {
+	keep, err := db.CreateUser("1", "streamer", "Streamer", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	duplicate, err := db.CreateUser("2", "streamer_alt", "Streamer_Alt", "https://example.com/alt.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	racetimeID := "racetime-1"
+	active := true
+	template := "{preset} vs {opponents}"
+	_, err = db.UpdateUser(duplicate.ID, storage.UserUpdate{
+		RacetimeID:      &racetimeID,
+		ActiveInChannel: &active,
+		AutoTitle:       &active,
+		TitleTemplate:   &template,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.SaveTwitchToken(duplicate.ID, storage.OAuthToken{AccessToken: "access", Scopes: []string{"clips:edit"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.SaveChannelState(storage.ChannelState{UserID: duplicate.ID, TwitchID: "2", Live: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.SaveChannelSettings(storage.ChannelSettings{UserID: duplicate.ID, Prefix: "!race"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.SavePrediction(storage.Prediction{ID: "prediction", UserID: duplicate.ID, RaceSlug: "twwr/race-1234", Status: storage.PredictionActive, CreatedAt: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.SaveClip(storage.Clip{ID: "clip", UserID: duplicate.ID, RaceSlug: "twwr/race-1234", Status: storage.ClipReady, CreatedAt: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("should not merge a user into itself", func(t *testing.T) {
+		_, err := db.MergeUsers(keep.ID, keep.ID)
+		if err == nil {
+			t.Errorf("got nil, want an error")
+		}
+	})
+
+	t.Run("should not merge missing users", func(t *testing.T) {
+		_, err := db.MergeUsers(keep.ID, 1000)
+		if err != storage.ErrNotFound {
+			t.Errorf("got %v, want %v", err, storage.ErrNotFound)
+		}
+	})
+
+	t.Run("should move everything of the duplicate onto the user kept", func(t *testing.T) {
+		merged, err := db.MergeUsers(keep.ID, duplicate.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if merged.ID != keep.ID || merged.TwitchID != "1" || merged.TwitchName != "streamer" {
+			t.Errorf("got %+v, want the accounts of user %v kept", merged, keep.ID)
+		}
+
+		_, err = db.FindUser(storage.Where(storage.FieldID).Eq(duplicate.ID))
+		if err != storage.ErrNotFound {
+			t.Errorf("got %v, want %v", err, storage.ErrNotFound)
+		}
+
+		user, err := db.FindUser(storage.Where(storage.FieldRacetimeID).Eq(racetimeID))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.ID != keep.ID || !user.ActiveInChannel || !user.AutoTitle || user.TitleTemplate != template ||
+			user.ProfileImageURL != "https://example.com/alt.png" {
+			t.Errorf("got %+v, want the duplicate's racetime account and settings", user)
+		}
+
+		token, err := db.FindTwitchToken(keep.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token.AccessToken != "access" {
+			t.Errorf("got %v, want %v", token.AccessToken, "access")
+		}
+
+		state, err := db.FindChannelState(keep.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !state.Live {
+			t.Errorf("got %+v, want the duplicate's channel state", state)
+		}
+		_, err = db.FindChannelState(duplicate.ID)
+		if err != storage.ErrNotFound {
+			t.Errorf("got %v, want %v", err, storage.ErrNotFound)
+		}
+
+		settings, err := db.FindChannelSettings(keep.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if settings.Prefix != "!race" {
+			t.Errorf("got %v, want %v", settings.Prefix, "!race")
+		}
+		_, err = db.FindChannelSettings(duplicate.ID)
+		if err != storage.ErrNotFound {
+			t.Errorf("got %v, want %v", err, storage.ErrNotFound)
+		}
+
+		predictions, err := db.FindPredictions(storage.Where(storage.FieldUserID).Eq(keep.ID))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.FindActivePrediction(keep.ID, "twwr/race-1234")
+		if len(predictions) != 1 || err != nil {
+			t.Errorf("got %v predictions (%v), want the duplicate's prediction", len(predictions), err)
+		}
+
+		clips, err := db.FindClips(storage.Where(storage.FieldUserID).Eq(keep.ID))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(clips) != 1 {
+			t.Errorf("got %v clips, want %v", len(clips), 1)
+		}
+	})
+}
+
+func testRaces(t *testing.T, db storage.Store) {
+	now := time.Now()
+	older := storage.Race{
+		Slug:     "older-race-1234",
+		Category: "twwr",
+		Status:   "finished",
+		OpenedAt: now.Add(-time.Hour * 24),
+		Entrants: []storage.RaceEntrant{
+			{RacetimeID: "a", Name: "A", Status: "done", Place: 1, FinishTime: time.Hour, ScoreChange: 12},
+		},
+	}
+	newer := storage.Race{
+		Slug:      "newer-race-1234",
+		Category:  "twwr",
+		Status:    "in_progress",
+		Goal:      "Standard",
+		Info:      "s4 | MS45LjAAQQAFCyIAD3DAAgAAAAAAAQAA | Seed Hash: Ganon Bokoblin Moblin",
+		Preset:    "s4",
+		Permalink: "MS45LjAAQQAFCyIAD3DAAgAAAAAAAQAA",
+		SeedHash:  "Ganon Bokoblin Moblin",
+		OpenedAt:  now.Add(-time.Hour),
+		StartedAt: now,
+		Entrants: []storage.RaceEntrant{
+			{RacetimeID: "b", Name: "B", TwitchName: "b_streams", Status: "in_progress"},
+			{RacetimeID: "a", Name: "A", Status: "in_progress"},
+		},
+	}
+	for _, r := range []storage.Race{older, newer} {
+		_, err := db.SaveRace(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("should not find races which were never saved", func(t *testing.T) {
+		_, err := db.FindRace("unknown-race-1234")
+		if err != storage.ErrNotFound {
+			t.Errorf("got %v, want %v", err, storage.ErrNotFound)
+		}
+	})
+
+	t.Run("should find races with their entrants in order", func(t *testing.T) {
+		got, err := db.FindRace(newer.Slug)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Preset != newer.Preset || got.Permalink != newer.Permalink || got.SeedHash != newer.SeedHash ||
+			got.Info != newer.Info || !sameTime(got.StartedAt, newer.StartedAt) {
+			t.Errorf("got %+v, want %+v", got, newer)
+		}
+		if len(got.Entrants) != 2 || got.Entrants[0].RacetimeID != "b" || got.Entrants[0].TwitchName != "b_streams" ||
+			got.Entrants[1].RacetimeID != "a" {
+			t.Errorf("got %+v, want b then a", got.Entrants)
+		}
+	})
+
+	t.Run("should list races most recently opened first", func(t *testing.T) {
+		got, err := db.FindRaces(storage.All().SortBy(storage.FieldOpenedAt).Reverse())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 2 || got[0].Slug != newer.Slug || got[1].Slug != older.Slug {
+			t.Errorf("got %+v, want newer then older", got)
+		}
+		if len(got[1].Entrants) != 1 || got[1].Entrants[0].FinishTime != time.Hour || got[1].Entrants[0].ScoreChange != 12 {
+			t.Errorf("got %+v, want the entrants of the older race", got[1].Entrants)
+		}
+	})
+
+	t.Run("should list the races of an entrant", func(t *testing.T) {
+		got, err := db.FindEntrantRaces("b")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 1 || got[0].Slug != newer.Slug {
+			t.Errorf("got %+v, want only the newer race", got)
+		}
+	})
+
+	t.Run("should replace races and their entrants as they progress", func(t *testing.T) {
+		newer.Status = "finished"
+		newer.EndedAt = now.Add(time.Hour)
+		newer.Entrants = []storage.RaceEntrant{
+			{RacetimeID: "a", Name: "A", Status: "done", Place: 1, FinishTime: time.Minute * 55, ScoreChange: 8},
+		}
+		_, err := db.SaveRace(newer)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := db.FindRace(newer.Slug)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Status != "finished" || !sameTime(got.EndedAt, newer.EndedAt) || len(got.Entrants) != 1 ||
+			got.Entrants[0].FinishTime != time.Minute*55 {
+			t.Errorf("got %+v, want %+v", got, newer)
+		}
+
+		races, err := db.FindEntrantRaces("b")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(races) != 0 {
+			t.Errorf("got %v races, want none once b left", len(races))
+		}
+	})
+}
+
+func testCommandLogs(t *testing.T, db storage.Store) {
+	now := time.Now()
+	for i, outcome := range []string{storage.CommandAnswered, storage.CommandCooldown, storage.CommandNotInRace} {
+		_, err := db.SaveCommandLog(storage.CommandLog{
+			UserID:    1,
+			Channel:   "streamer",
+			Chatter:   "viewer",
+			Command:   "race",
+			Latency:   time.Millisecond * 5,
+			Outcome:   outcome,
+			CreatedAt: now.Add(-time.Hour * time.Duration(2-i)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("should list logs since a time oldest first", func(t *testing.T) {
+		logs, err := db.FindCommandLogs(storage.Where(storage.FieldCreatedAt).Ge(now.Add(-time.Hour * 3)).SortBy(storage.FieldCreatedAt))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(logs) != 3 {
+			t.Fatalf("got %v logs, want %v", len(logs), 3)
+		}
+		if logs[0].Outcome != storage.CommandAnswered || logs[2].Outcome != storage.CommandNotInRace {
+			t.Errorf("got %v then %v, want the oldest log first", logs[0].Outcome, logs[2].Outcome)
+		}
+		if logs[0].Latency != time.Millisecond*5 || logs[0].Chatter != "viewer" {
+			t.Errorf("got %+v, want the saved log", logs[0])
+		}
+
+		logs, err = db.FindCommandLogs(storage.Where(storage.FieldCreatedAt).Ge(now.Add(-time.Minute * 90)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(logs) != 2 {
+			t.Errorf("got %v logs, want %v", len(logs), 2)
+		}
+	})
+
+	t.Run("should delete logs before a time", func(t *testing.T) {
+		n, err := db.DeleteCommandLogs(now.Add(-time.Minute * 30))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 2 {
+			t.Errorf("got %v deleted, want %v", n, 2)
+		}
+
+		logs, err := db.FindCommandLogs(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(logs) != 1 {
+			t.Errorf("got %v logs, want %v", len(logs), 1)
+		}
+	})
+}
+
+func testQueries(t *testing.T, db storage.Store) {
+	now := time.Now()
+	for i := 0; i < 6; i++ {
+		outcome := storage.CommandAnswered
+		if i%2 == 1 {
+			outcome = storage.CommandCooldown
+		}
+		channel := "streamer"
+		if i >= 4 {
+			channel = "other"
+		}
+
+		_, err := db.SaveCommandLog(storage.CommandLog{
+			UserID:    uint64(i / 4),
+			Channel:   channel,
+			Command:   "race",
+			Outcome:   outcome,
+			CreatedAt: now.Add(time.Minute * time.Duration(i)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	minutes := func(logs []*storage.CommandLog) []int {
+		var got []int
+		for _, l := range logs {
+			got = append(got, int(l.CreatedAt.Sub(now).Round(time.Minute)/time.Minute))
+		}
+
+		return got
+	}
+
+	t.Run("should match every condition of a query", func(t *testing.T) {
+		logs, err := db.FindCommandLogs(storage.Where(storage.FieldChannel).Eq("streamer").
+			And(storage.FieldOutcome).Eq(storage.CommandAnswered).
+			And(storage.FieldCreatedAt).Gt(now).
+			SortBy(storage.FieldCreatedAt))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := minutes(logs), []int{2}; !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+
+		logs, err = db.FindCommandLogs(storage.Where(storage.FieldUserID).Ne(uint64(0)).
+			And(storage.FieldCreatedAt).Le(now.Add(time.Minute * 4)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := minutes(logs), []int{4}; !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("should sort by each field in turn", func(t *testing.T) {
+		logs, err := db.FindCommandLogs(storage.All().SortBy(storage.FieldOutcome, storage.FieldCreatedAt).Reverse())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := minutes(logs), []int{5, 3, 1, 4, 2, 0}; !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("should page through sorted records", func(t *testing.T) {
+		var pages [][]int
+		for page := 0; page < 3; page++ {
+			logs, err := db.FindCommandLogs(storage.All().SortBy(storage.FieldCreatedAt).Reverse().Skip(page * 4).Limit(4))
+			if err != nil {
+				t.Fatal(err)
+			}
+			pages = append(pages, minutes(logs))
+		}
+		if want := [][]int{{5, 4, 3, 2}, {1, 0}, nil}; !reflect.DeepEqual(pages, want) {
+			t.Errorf("got %v, want %v", pages, want)
+		}
+
+		logs, err := db.FindCommandLogs(storage.All().SortBy(storage.FieldCreatedAt).Skip(4))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := minutes(logs), []int{4, 5}; !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("should count matches regardless of paging", func(t *testing.T) {
+		n, err := db.CountCommandLogs(storage.Where(storage.FieldChannel).Eq("streamer").Limit(1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 4 {
+			t.Errorf("got %v, want %v", n, 4)
+		}
+
+		n, err = db.CountCommandLogs(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 6 {
+			t.Errorf("got %v, want %v", n, 6)
+		}
+	})
+
+	t.Run("should leave a query unchanged when narrowing it", func(t *testing.T) {
+		base := storage.Where(storage.FieldChannel).Eq("streamer")
+		answered := base.And(storage.FieldOutcome).Eq(storage.CommandAnswered).SortBy(storage.FieldCreatedAt)
+		latest := base.SortBy(storage.FieldCreatedAt).Reverse().Limit(1)
+
+		for _, c := range []struct {
+			query *storage.Query
+			want  []int
+		}{
+			{answered, []int{0, 2}},
+			{latest, []int{3}},
+			{base, []int{0, 1, 2, 3}},
+		} {
+			logs, err := db.FindCommandLogs(c.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := minutes(logs); !reflect.DeepEqual(got, c.want) {
+				t.Errorf("got %v, want %v", got, c.want)
+			}
+		}
+	})
+
+	t.Run("should count users and races", func(t *testing.T) {
+		user, err := db.CreateUser("1", "streamer", "Streamer", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.CreateUser("2", "viewer", "Viewer", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		racetimeID := "racetime-1"
+		active := true
+		_, err = db.UpdateUser(user.ID, storage.UserUpdate{RacetimeID: &racetimeID, ActiveInChannel: &active})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.SaveRace(storage.Race{Slug: "race-1234", Category: "twwr", Status: "open", OpenedAt: now})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		n, err := db.CountUsers(storage.ActiveChannels())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 {
+			t.Errorf("got %v active channels, want %v", n, 1)
+		}
+
+		n, err = db.CountRaces(storage.Where(storage.FieldCategory).Eq("twwr").And(storage.FieldStatus).Eq("open"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 {
+			t.Errorf("got %v races, want %v", n, 1)
+		}
+	})
+
+	t.Run("should reject fields the records don't have", func(t *testing.T) {
+		_, err := db.FindUsers(storage.Where(storage.FieldOutcome).Eq(storage.CommandAnswered))
+		if err == nil {
+			t.Errorf("got %v, want an error", err)
+		}
+
+		_, err = db.CountClips(storage.All().SortBy(storage.FieldOpenedAt))
+		if err == nil {
+			t.Errorf("got %v, want an error", err)
+		}
+	})
+}
+
+// sameTime compares times to the microsecond, the precision postgres keeps
+func sameTime(a, b time.Time) bool {
+	return a.Truncate(time.Microsecond).Equal(b.Truncate(time.Microsecond))
+}
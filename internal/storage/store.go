@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/config"
+)
+
+// Database drivers a Store can be opened with
+const (
+	DriverBadger   = "badger"
+	DriverSQLite   = "sqlite"
+	DriverPostgres = "postgres"
+	DriverMemory   = "memory"
+)
+
+// Store persists users and everything the bot keeps about their channels
+type Store interface {
+	FindUsers(query *Query) ([]*User, error)
+	FindUser(query *Query) (*User, error)
+	CountUsers(query *Query) (int, error)
+	CreateUser(twitchID, twitchName, twitchDisplayName, profileImageURL string) (*User, error)
+	UpdateUser(id uint64, user UserUpdate) (*User, error)
+	DeleteUser(id uint64) error
+	MergeUsers(keepID, duplicateID uint64) (*User, error)
+	// RestoreUser inserts a user exactly as given, keeping its id
+	RestoreUser(user User) error
+
+	SaveTwitchToken(id uint64, token OAuthToken) (*User, error)
+	FindTwitchToken(id uint64) (*OAuthToken, error)
+	DeleteTwitchToken(id uint64) error
+	// RotateEncryptionKey rewraps every stored secret with a new base64 encoded
+	// master key, which the store seals secrets with from then on. It returns
+	// how many secrets were rewrapped.
+	RotateEncryptionKey(key string) (int, error)
+
+	FindChannelState(userID uint64) (*ChannelState, error)
+	FindChannelStates() ([]*ChannelState, error)
+	SaveChannelState(state ChannelState) (*ChannelState, error)
+
+	FindChannelSettings(userID uint64) (*ChannelSettings, error)
+	FindAllChannelSettings() ([]*ChannelSettings, error)
+	SaveChannelSettings(settings ChannelSettings) (*ChannelSettings, error)
+
+	SaveCommandLog(entry CommandLog) (*CommandLog, error)
+	FindCommandLogs(query *Query) ([]*CommandLog, error)
+	CountCommandLogs(query *Query) (int, error)
+	DeleteCommandLogs(before time.Time) (int, error)
+
+	FindPredictions(query *Query) ([]*Prediction, error)
+	CountPredictions(query *Query) (int, error)
+	FindActivePrediction(userID uint64, raceSlug string) (*Prediction, error)
+	SavePrediction(prediction Prediction) (*Prediction, error)
+
+	FindClips(query *Query) ([]*Clip, error)
+	CountClips(query *Query) (int, error)
+	SaveClip(clip Clip) (*Clip, error)
+
+	FindRace(slug string) (*Race, error)
+	FindRaces(query *Query) ([]*Race, error)
+	CountRaces(query *Query) (int, error)
+	FindEntrantRaces(racetimeID string) ([]*Race, error)
+	SaveRace(race Race) (*Race, error)
+
+	Close() error
+}
+
+// Open opens the store of the configured driver, badger when none is set
+func Open(conf config.DB) (Store, error) {
+	switch conf.Driver {
+	case "", DriverBadger:
+		return OpenBadger(conf)
+	case DriverSQLite, DriverPostgres:
+		return OpenSQL(conf)
+	case DriverMemory:
+		return OpenMemory(conf)
+	default:
+		return nil, fmt.Errorf("unsupported database driver %q", conf.Driver)
+	}
+}
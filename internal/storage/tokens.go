@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/dgraph-io/badger"
+)
+
+// OAuthToken is a token a user has granted the bot to act on their behalf
+type OAuthToken struct {
+	AccessToken  string
+	RefreshToken string
+	Scopes       []string
+	ExpiresAt    time.Time
+}
+
+// SaveTwitchToken encrypts a user's twitch token onto their user record
+func (db *BadgerStore) SaveTwitchToken(id uint64, token OAuthToken) (*User, error) {
+	user, err := db.FindUser(Where(FieldID).Eq(id))
+	if err != nil {
+		return nil, err
+	}
+
+	user.TwitchToken, err = db.sealToken(id, token)
+	if err != nil {
+		return nil, fmt.Errorf("error encrypting twitch token for user %v: %w", id, err)
+	}
+	user.TwitchScopes = token.Scopes
+
+	err = db.store.Update(id, user)
+	if err != nil {
+		return nil, fmt.Errorf("error saving twitch token for user %v: %w", id, err)
+	}
+
+	return user, nil
+}
+
+// FindTwitchToken decrypts the twitch token a user has granted, if any
+func (db *BadgerStore) FindTwitchToken(id uint64) (*OAuthToken, error) {
+	user, err := db.FindUser(Where(FieldID).Eq(id))
+	if err != nil {
+		return nil, err
+	}
+	if len(user.TwitchToken) == 0 {
+		return nil, ErrNotFound
+	}
+
+	token, err := db.openToken(id, user.TwitchToken)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting twitch token for user %v: %w", id, err)
+	}
+
+	return token, nil
+}
+
+// DeleteTwitchToken removes a user's twitch token and granted scopes
+func (db *BadgerStore) DeleteTwitchToken(id uint64) error {
+	user, err := db.FindUser(Where(FieldID).Eq(id))
+	if err != nil {
+		return err
+	}
+
+	user.TwitchToken = nil
+	user.TwitchScopes = nil
+	err = db.store.Update(id, user)
+	if err != nil {
+		return fmt.Errorf("error deleting twitch token for user %v: %w", id, err)
+	}
+
+	return nil
+}
+
+// RotateEncryptionKey rewraps every user's twitch token with a new master key
+func (db *BadgerStore) RotateEncryptionKey(key string) (int, error) {
+	rotated, err := db.rotate(key)
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	err = db.store.Badger().Update(func(tx *badger.Txn) error {
+		var users []User
+		err := db.store.TxFind(tx, &users, nil)
+		if err != nil {
+			return err
+		}
+
+		for _, u := range users {
+			if len(u.TwitchToken) == 0 {
+				continue
+			}
+
+			token, changed, err := rotated.rewrap(u.TwitchToken, tokenAAD(u.ID))
+			if err != nil {
+				return fmt.Errorf("error rewrapping twitch token for user %v: %w", u.ID, err)
+			}
+			if !changed {
+				continue
+			}
+
+			u.TwitchToken = token
+			err = db.store.TxUpdate(tx, u.ID, u)
+			if err != nil {
+				return err
+			}
+			n++
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error rotating database encryption key: %w", err)
+	}
+	db.secrets = rotated
+
+	return n, nil
+}
@@ -5,23 +5,32 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/dgraph-io/badger"
 	"github.com/timshannon/badgerhold"
 )
 
-type UserQueryField string
-
-const (
-	FieldID              UserQueryField = "ID"
-	FieldTwitchID        UserQueryField = "TwitchID"
-	FieldRacetimeID      UserQueryField = "RacetimeID"
-	FieldActiveInChannel UserQueryField = "ActiveInChannel"
-)
-
 var (
 	ErrNotFound = errors.New("no results match that query")
 	ErrExists   = errors.New("resource already exists")
 )
 
+// ConflictError is returned when a user would share a twitch or racetime
+// account with another user. It matches ErrExists with errors.Is.
+type ConflictError struct {
+	Field Field
+	Value string
+	// UserID is the user the account already belongs to
+	UserID uint64
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%s %s already belongs to user %d", e.Field, e.Value, e.UserID)
+}
+
+func (e *ConflictError) Is(target error) bool {
+	return target == ErrExists
+}
+
 // User
 type User struct {
 	ID                uint64 `badgerhold:"key"`
@@ -31,12 +40,26 @@ type User struct {
 	TwitchDisplayName string
 	ProfileImageURL   string
 	ActiveInChannel   bool
-	JoinedAt          time.Time
-}
-
-type UserQuery struct {
-	Field UserQueryField
-	Value interface{}
+	// AutoTitle opts the channel into stream titles set from TitleTemplate while racing
+	AutoTitle     bool
+	TitleTemplate string
+	// Predictions opts the channel into predictions on its races, asking whether
+	// the streamer beats PredictionTarget when set, or finishes top PredictionTopN
+	Predictions      bool
+	PredictionTopN   int
+	PredictionTarget time.Duration
+	// AutoClip clips the stream when the streamer finishes a race, posting
+	// the link in twitch chat and the racetime room when asked to
+	AutoClip       bool
+	ClipToChat     bool
+	ClipToRacetime bool
+	// Shoutouts shouts out live opponents once a race finishes
+	Shoutouts bool
+	// TwitchToken is the streamer's encrypted OAuthToken
+	TwitchToken []byte
+	// TwitchScopes are the scopes the streamer has granted the bot
+	TwitchScopes []string
+	JoinedAt     time.Time
 }
 
 type UserUpdate struct {
@@ -45,29 +68,165 @@ type UserUpdate struct {
 	TwitchName        *string
 	TwitchDisplayName *string
 	ActiveInChannel   *bool
+	AutoTitle         *bool
+	TitleTemplate     *string
+	Predictions       *bool
+	PredictionTopN    *int
+	PredictionTarget  *time.Duration
+	AutoClip          *bool
+	ClipToChat        *bool
+	ClipToRacetime    *bool
+	Shoutouts         *bool
+}
+
+// apply sets the fields of the update which are not nil on the user
+func (update UserUpdate) apply(u *User) {
+	if update.TwitchID != nil {
+		u.TwitchID = *update.TwitchID
+	}
+	if update.TwitchName != nil {
+		u.TwitchName = *update.TwitchName
+	}
+	if update.TwitchDisplayName != nil {
+		u.TwitchDisplayName = *update.TwitchDisplayName
+	}
+	if update.RacetimeID != nil {
+		u.RacetimeID = *update.RacetimeID
+	}
+	if update.ActiveInChannel != nil {
+		u.ActiveInChannel = *update.ActiveInChannel
+	}
+	if update.AutoTitle != nil {
+		u.AutoTitle = *update.AutoTitle
+	}
+	if update.TitleTemplate != nil {
+		u.TitleTemplate = *update.TitleTemplate
+	}
+	if update.Predictions != nil {
+		u.Predictions = *update.Predictions
+	}
+	if update.PredictionTopN != nil {
+		u.PredictionTopN = *update.PredictionTopN
+	}
+	if update.PredictionTarget != nil {
+		u.PredictionTarget = *update.PredictionTarget
+	}
+	if update.AutoClip != nil {
+		u.AutoClip = *update.AutoClip
+	}
+	if update.ClipToChat != nil {
+		u.ClipToChat = *update.ClipToChat
+	}
+	if update.ClipToRacetime != nil {
+		u.ClipToRacetime = *update.ClipToRacetime
+	}
+	if update.Shoutouts != nil {
+		u.Shoutouts = *update.Shoutouts
+	}
 }
 
-// FindUser
-func (db *DB) FindUsers(query UserQuery) ([]*User, error) {
-	var q *badgerhold.Query
-	if query.Field == FieldID {
-		q = badgerhold.Where(badgerhold.Key).Eq(query.Value).Limit(1)
-	} else if query.Field == FieldActiveInChannel {
-		q = badgerhold.Where(string(query.Field)).Eq(query.Value).And(string(FieldTwitchID)).Ne("").And(string(FieldRacetimeID)).Ne("")
-	} else {
-		q = badgerhold.Where(string(query.Field)).Eq(query.Value)
+// checkUnique returns a ConflictError when a user other than u already has
+// its twitch or racetime account. New users conflict with every match, as
+// they have no id of their own yet.
+func checkUnique(find func(*Query) ([]*User, error), u User, isNew bool) error {
+	accounts := []struct {
+		field Field
+		value string
+	}{
+		{FieldTwitchID, u.TwitchID},
+		{FieldRacetimeID, u.RacetimeID},
 	}
 
+	for _, a := range accounts {
+		if a.value == "" {
+			continue
+		}
+
+		users, err := find(Where(a.field).Eq(a.value))
+		if err != nil {
+			return err
+		}
+
+		for _, other := range users {
+			if isNew || other.ID != u.ID {
+				return &ConflictError{
+					Field:  a.field,
+					Value:  a.value,
+					UserID: other.ID,
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// mergeUser fills in whatever keep is missing from duplicate. Where both
+// have a value keep wins, while channel opt-ins are kept if either had them.
+// A twitch token taken from the duplicate is resealed for keep.
+func (s secrets) mergeUser(keep, duplicate User) (User, error) {
+	fill := func(s *string, from string) {
+		if *s == "" {
+			*s = from
+		}
+	}
+	fill(&keep.TwitchID, duplicate.TwitchID)
+	fill(&keep.RacetimeID, duplicate.RacetimeID)
+	fill(&keep.TwitchName, duplicate.TwitchName)
+	fill(&keep.TwitchDisplayName, duplicate.TwitchDisplayName)
+	fill(&keep.ProfileImageURL, duplicate.ProfileImageURL)
+	fill(&keep.TitleTemplate, duplicate.TitleTemplate)
+
+	keep.ActiveInChannel = keep.ActiveInChannel || duplicate.ActiveInChannel
+	keep.AutoTitle = keep.AutoTitle || duplicate.AutoTitle
+	keep.Predictions = keep.Predictions || duplicate.Predictions
+	keep.AutoClip = keep.AutoClip || duplicate.AutoClip
+	keep.ClipToChat = keep.ClipToChat || duplicate.ClipToChat
+	keep.ClipToRacetime = keep.ClipToRacetime || duplicate.ClipToRacetime
+	keep.Shoutouts = keep.Shoutouts || duplicate.Shoutouts
+
+	if keep.PredictionTopN == 0 && keep.PredictionTarget == 0 {
+		keep.PredictionTopN = duplicate.PredictionTopN
+		keep.PredictionTarget = duplicate.PredictionTarget
+	}
+	if len(keep.TwitchToken) == 0 && len(duplicate.TwitchToken) > 0 {
+		token, err := s.moveToken(duplicate.TwitchToken, duplicate.ID, keep.ID)
+		if err != nil {
+			return User{}, fmt.Errorf("error moving twitch token of user %v: %w", duplicate.ID, err)
+		}
+		keep.TwitchToken = token
+		keep.TwitchScopes = duplicate.TwitchScopes
+	}
+	if !duplicate.JoinedAt.IsZero() && duplicate.JoinedAt.Before(keep.JoinedAt) {
+		keep.JoinedAt = duplicate.JoinedAt
+	}
+
+	return keep, nil
+}
+
+// FindUsers
+func (db *BadgerStore) FindUsers(query *Query) ([]*User, error) {
 	var users []*User
-	err := db.store.Find(&users, q)
+	err := db.find(userSchema, &users, query)
 	if err != nil {
-		return nil, fmt.Errorf("error while looking up users %w with query %+v\n", err, query)
+		return nil, fmt.Errorf("error while looking up users: %w", err)
 	}
 
 	return users, nil
 }
 
-func (db *DB) FindUser(query UserQuery) (*User, error) {
+// CountUsers
+func (db *BadgerStore) CountUsers(query *Query) (int, error) {
+	var users []*User
+	n, err := db.count(userSchema, &users, query)
+	if err != nil {
+		return 0, fmt.Errorf("error while counting users: %w", err)
+	}
+
+	return n, nil
+}
+
+func (db *BadgerStore) FindUser(query *Query) (*User, error) {
 	users, err := db.FindUsers(query)
 	if err != nil {
 		return nil, err
@@ -81,19 +240,7 @@ func (db *DB) FindUser(query UserQuery) (*User, error) {
 }
 
 // CreateUser inserts a new user into the database
-func (db *DB) CreateUser(twitchID, twitchName, twitchDisplayName, profileImageURL string) (*User, error) {
-	users, err := db.FindUsers(UserQuery{
-		Field: FieldTwitchID,
-		Value: nil,
-	})
-	if err != nil {
-		return nil, fmt.Errorf("error while creating user: %w", err)
-	}
-
-	if users != nil && len(users) > 0 {
-		return nil, ErrExists
-	}
-
+func (db *BadgerStore) CreateUser(twitchID, twitchName, twitchDisplayName, profileImageURL string) (*User, error) {
 	user := User{
 		TwitchID:          twitchID,
 		TwitchName:        twitchName,
@@ -102,7 +249,16 @@ func (db *DB) CreateUser(twitchID, twitchName, twitchDisplayName, profileImageUR
 		ActiveInChannel:   false,
 		JoinedAt:          time.Now(),
 	}
+	err := checkUnique(db.FindUsers, user, true)
+	if err != nil {
+		return nil, err
+	}
+
+	// restored users keep their ids, which the sequence may hand out again
 	err = db.store.Insert(badgerhold.NextSequence(), &user)
+	for err == badgerhold.ErrKeyExists {
+		err = db.store.Insert(badgerhold.NextSequence(), &user)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("error while creating new user: %w", err)
 	}
@@ -111,11 +267,8 @@ func (db *DB) CreateUser(twitchID, twitchName, twitchDisplayName, profileImageUR
 }
 
 // UpdateUser
-func (db *DB) UpdateUser(id uint64, user UserUpdate) (*User, error) {
-	users, err := db.FindUsers(UserQuery{
-		Field: FieldID,
-		Value: id,
-	})
+func (db *BadgerStore) UpdateUser(id uint64, user UserUpdate) (*User, error) {
+	users, err := db.FindUsers(Where(FieldID).Eq(id))
 	if err != nil {
 		return nil, fmt.Errorf("error while updating user: %w", err)
 	}
@@ -124,35 +277,166 @@ func (db *DB) UpdateUser(id uint64, user UserUpdate) (*User, error) {
 	}
 
 	u := users[0]
-	if user.TwitchID != nil {
-		u.TwitchID = *user.TwitchID
+	user.apply(u)
+
+	err = checkUnique(db.FindUsers, *u, false)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.store.Update(id, u)
+	if err != nil {
+		return nil, fmt.Errorf("error updating user: %w", err)
+	}
+
+	return u, nil
+}
+
+// RestoreUser inserts a user exactly as given, keeping its id
+func (db *BadgerStore) RestoreUser(user User) error {
+	err := checkUnique(db.FindUsers, user, true)
+	if err != nil {
+		return err
 	}
-	if user.TwitchName != nil {
-		u.TwitchName = *user.TwitchName
+
+	err = db.store.Insert(user.ID, &user)
+	if err != nil {
+		if err == badgerhold.ErrKeyExists {
+			return &ConflictError{Field: FieldID, Value: fmt.Sprint(user.ID), UserID: user.ID}
+		}
+
+		return fmt.Errorf("error restoring user %v: %w", user.ID, err)
 	}
-	if user.TwitchDisplayName != nil {
-		u.TwitchDisplayName = *user.TwitchDisplayName
+
+	return nil
+}
+
+// MergeUsers consolidates a duplicate user into the user kept, moving its
+// accounts, channel state and settings, predictions, clips and command logs before deleting it
+func (db *BadgerStore) MergeUsers(keepID, duplicateID uint64) (*User, error) {
+	if keepID == duplicateID {
+		return nil, fmt.Errorf("cannot merge user %v into itself", keepID)
 	}
-	if user.RacetimeID != nil {
-		u.RacetimeID = *user.RacetimeID
+
+	keep, err := db.FindUser(Where(FieldID).Eq(keepID))
+	if err != nil {
+		return nil, err
 	}
-	if user.ActiveInChannel != nil {
-		u.ActiveInChannel = *user.ActiveInChannel
+	duplicate, err := db.FindUser(Where(FieldID).Eq(duplicateID))
+	if err != nil {
+		return nil, err
 	}
 
-	err = db.store.Update(id, u)
+	merged, err := db.mergeUser(*keep, *duplicate)
 	if err != nil {
-		return nil, fmt.Errorf("error updating user: %w", err)
+		return nil, err
 	}
+	err = db.store.Badger().Update(func(tx *badger.Txn) error {
+		// the duplicate goes first so its accounts are free to move
+		err := db.store.TxDelete(tx, duplicateID, &User{})
+		if err != nil {
+			return err
+		}
+		err = db.store.TxUpdate(tx, keepID, &merged)
+		if err != nil {
+			return err
+		}
 
-	return u, nil
+		var predictions []*Prediction
+		err = db.store.TxFind(tx, &predictions, badgerhold.Where("UserID").Eq(duplicateID))
+		if err != nil {
+			return err
+		}
+		for _, p := range predictions {
+			p.UserID = keepID
+			err = db.store.TxUpsert(tx, p.ID, p)
+			if err != nil {
+				return err
+			}
+		}
+
+		var clips []*Clip
+		err = db.store.TxFind(tx, &clips, badgerhold.Where("UserID").Eq(duplicateID))
+		if err != nil {
+			return err
+		}
+		for _, c := range clips {
+			c.UserID = keepID
+			err = db.store.TxUpsert(tx, c.ID, c)
+			if err != nil {
+				return err
+			}
+		}
+
+		var logs []*CommandLog
+		err = db.store.TxFind(tx, &logs, badgerhold.Where("UserID").Eq(duplicateID))
+		if err != nil {
+			return err
+		}
+		for _, l := range logs {
+			l.UserID = keepID
+			err = db.store.TxUpsert(tx, l.ID, l)
+			if err != nil {
+				return err
+			}
+		}
+
+		// the duplicate's channel state and settings are only kept when the user kept has none
+		var state ChannelState
+		err = db.store.TxGet(tx, duplicateID, &state)
+		if err != nil && err != badgerhold.ErrNotFound {
+			return err
+		}
+		if err == nil {
+			err = db.store.TxDelete(tx, duplicateID, &ChannelState{})
+			if err != nil {
+				return err
+			}
+			err = db.store.TxGet(tx, keepID, &ChannelState{})
+			if err == badgerhold.ErrNotFound {
+				state.UserID = keepID
+				err = db.store.TxInsert(tx, keepID, &state)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		var settings ChannelSettings
+		err = db.store.TxGet(tx, duplicateID, &settings)
+		if err == badgerhold.ErrNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		err = db.store.TxDelete(tx, duplicateID, &ChannelSettings{})
+		if err != nil {
+			return err
+		}
+		err = db.store.TxGet(tx, keepID, &ChannelSettings{})
+		if err != badgerhold.ErrNotFound {
+			return err
+		}
+		settings.UserID = keepID
+		return db.store.TxInsert(tx, keepID, &settings)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error merging user %v into %v: %w", duplicateID, keepID, err)
+	}
+
+	return &merged, nil
 }
 
 // DeleteUser
-func (db *DB) DeleteUser(id uint64) error {
+func (db *BadgerStore) DeleteUser(id uint64) error {
 	err := db.store.Delete(id, &User{})
 	if err != nil {
-		return fmt.Errorf("error deleting user with id %v", id)
+		if err == badgerhold.ErrNotFound {
+			err = ErrNotFound
+		}
+
+		return fmt.Errorf("error deleting user with id %v: %w", id, err)
 	}
 
 	return nil
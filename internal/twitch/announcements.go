@@ -0,0 +1,136 @@
+package twitch
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/races"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/racetime"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/storage"
+)
+
+// maxChatMessage is the longest message twitch chat accepts
+const maxChatMessage = 500
+
+// Announcements posts in the chat of followed streamers who opted in when
+// their race starts, when they finish and once the race ends
+type Announcements struct {
+	db          storage.Store
+	chat        Chat
+	racetimeURL string
+}
+
+// NewAnnouncements creates an announcer of race progress in chat
+func NewAnnouncements(db storage.Store, chat Chat, racetimeURL string) *Announcements {
+	return &Announcements{
+		db:          db,
+		chat:        chat,
+		racetimeURL: racetimeURL,
+	}
+}
+
+// Run announces the changes between race lists received from the listener until the context ends
+func (a *Announcements) Run(ctx context.Context, listener <-chan []racetime.RaceData) {
+	races.WatchChanges(ctx, listener, a.announce)
+}
+
+func (a *Announcements) announce(change races.Change) {
+	switch change.Type {
+	case races.RaceStarted, races.EntrantFinished:
+	case races.RaceEnded:
+		if change.Race.Status.Value == racetime.StatusCancelled {
+			return
+		}
+	default:
+		return
+	}
+
+	for _, user := range linkedStreamers(a.db, change) {
+		settings, err := ChannelSettingsFor(a.db, *user)
+		if err != nil {
+			log.Printf("announcements: settings of %s: %s", user.TwitchName, err)
+			continue
+		}
+
+		message, ok := Announcement(change, *user, settings, a.racetimeURL)
+		if !ok {
+			continue
+		}
+
+		a.chat.Say(user.TwitchName, message)
+	}
+}
+
+// Announcement describes a race change in a channel's locale,
+// if the channel announces changes of its type
+func Announcement(change races.Change, user storage.User, settings storage.ChannelSettings, racetimeURL string) (string, bool) {
+	switch change.Type {
+	case races.RaceStarted:
+		if !settings.AnnounceStart {
+			return "", false
+		}
+
+		link := fmt.Sprintf("%s/%s", racetimeURL, change.Race.Name)
+		return localize(settings.Locale, msgAnnounceStart, user.TwitchDisplayName, link), true
+	case races.EntrantFinished:
+		if !settings.AnnounceFinish || change.Entrant == nil {
+			return "", false
+		}
+
+		finishTime, err := racetime.ParseDuration(change.Entrant.FinishTime)
+		if err != nil {
+			log.Printf("announcements: %s", err)
+			return "", false
+		}
+
+		return localize(settings.Locale, msgAnnounceFinish, user.TwitchDisplayName, change.Entrant.PlaceOrdinal, formatDuration(finishTime)), true
+	case races.RaceEnded:
+		if !settings.AnnounceResults {
+			return "", false
+		}
+
+		message := localize(settings.Locale, msgAnnounceResults, change.Race.Slug, raceResults(change.Race))
+		if runes := []rune(message); len(runes) > maxChatMessage {
+			message = string(runes[:maxChatMessage-3]) + "..."
+		}
+
+		return message, true
+	}
+
+	return "", false
+}
+
+// raceResults lists the placed entrants of a race in order of place
+func raceResults(race racetime.RaceData) string {
+	var placed []racetime.Entrant
+	for _, e := range race.Entrants {
+		if e.Place > 0 {
+			placed = append(placed, e)
+		}
+	}
+	sort.SliceStable(placed, func(i, j int) bool {
+		return placed[i].Place < placed[j].Place
+	})
+
+	var results []string
+	for _, e := range placed {
+		name := e.User.Name
+		if e.User.TwitchDisplayName != "" {
+			name = e.User.TwitchDisplayName
+		}
+
+		result := fmt.Sprintf("%s %s", e.PlaceOrdinal, name)
+		if finishTime, err := racetime.ParseDuration(e.FinishTime); err == nil {
+			result = fmt.Sprintf("%s (%s)", result, formatDuration(finishTime))
+		}
+		results = append(results, result)
+	}
+	if len(results) == 0 {
+		return "-"
+	}
+
+	return strings.Join(results, ", ")
+}
@@ -1,12 +1,15 @@
 package twitch
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"net/url"
-	"strings"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/TBPixel/tww-rando-twitch-bot/internal/config"
@@ -16,6 +19,18 @@ const (
 	api         = "https://api.twitch.tv/helix"
 	auth        = "https://id.twitch.tv/oauth2/token"
 	clientGrant = "client_credentials"
+	// maxPerRequest is the most ids or logins twitch accepts in one lookup
+	maxPerRequest = 100
+	// maxTitle is the longest stream title twitch accepts
+	maxTitle = 140
+	// maxPredictionTitle is the longest prediction title twitch accepts
+	maxPredictionTitle = 45
+	// maxMarkerDescription is the longest stream marker description twitch accepts
+	maxMarkerDescription = 140
+	// maxFetchAttempts bounds how often a request is sent when twitch rejects it
+	maxFetchAttempts = 3
+	// tokenRefreshMargin renews the app token this long before it expires
+	tokenRefreshMargin = time.Minute * 5
 )
 
 type User struct {
@@ -26,120 +41,831 @@ type User struct {
 	CreatedAt       time.Time `json:"created_at"`
 }
 
+type Stream struct {
+	ID          string    `json:"id"`
+	UserID      string    `json:"user_id"`
+	UserLogin   string    `json:"user_login"`
+	UserName    string    `json:"user_name"`
+	GameID      string    `json:"game_id"`
+	GameName    string    `json:"game_name"`
+	Type        string    `json:"type"`
+	Title       string    `json:"title"`
+	ViewerCount int       `json:"viewer_count"`
+	StartedAt   time.Time `json:"started_at"`
+}
+
+type ChannelInformation struct {
+	BroadcasterID    string `json:"broadcaster_id"`
+	BroadcasterLogin string `json:"broadcaster_login"`
+	Title            string `json:"title"`
+	GameID           string `json:"game_id"`
+	GameName         string `json:"game_name"`
+}
+
+type Game struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type Prediction struct {
+	ID       string `json:"id"`
+	Title    string `json:"title"`
+	Status   string `json:"status"`
+	Outcomes []struct {
+		ID    string `json:"id"`
+		Title string `json:"title"`
+	} `json:"outcomes"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type Clip struct {
+	ID            string    `json:"id"`
+	URL           string    `json:"url"`
+	EmbedURL      string    `json:"embed_url"`
+	BroadcasterID string    `json:"broadcaster_id"`
+	Title         string    `json:"title"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// CreatedClip is a clip twitch has started processing
+type CreatedClip struct {
+	ID      string `json:"id"`
+	EditURL string `json:"edit_url"`
+}
+
+type StreamMarker struct {
+	ID              string    `json:"id"`
+	CreatedAt       time.Time `json:"created_at"`
+	Description     string    `json:"description"`
+	PositionSeconds int       `json:"position_seconds"`
+}
+
+// StatusError is returned when the helix api responds with an unsuccessful status
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("status code %v from twitch api", e.StatusCode)
+}
+
 type ApiClient struct {
-	config      config.Twitch
-	client      http.Client
-	accessToken string
+	config   config.Twitch
+	client   http.Client
+	apiURL   string
+	tokenURL string
+
+	tokenMut  sync.Mutex
+	token     string
+	expiresAt time.Time
+
+	limitMut  sync.Mutex
+	remaining int
+	resetAt   time.Time
 }
 
 func NewApiClient(config config.Twitch) (*ApiClient, error) {
-	client := http.Client{}
+	c := &ApiClient{
+		config:   config,
+		client:   http.Client{},
+		apiURL:   config.APIURL,
+		tokenURL: config.TokenURL,
+		// unknown until twitch reports it
+		remaining: -1,
+	}
+	if c.apiURL == "" {
+		c.apiURL = api
+	}
+	if c.tokenURL == "" {
+		c.tokenURL = auth
+	}
 
-	accessToken, err := newAccessToken(config)
+	err := c.refreshToken()
 	if err != nil {
 		return nil, err
 	}
 
-	return &ApiClient{
-		config,
-		client,
-		accessToken,
-	}, nil
+	return c, nil
 }
 
+// GetUsers looks up users by login, in batches of as many as twitch allows per request
 func (c *ApiClient) GetUsers(channels []string) ([]User, error) {
-	req, err := c.req("GET", "users")
+	var users []User
+	for _, batch := range chunk(channels, maxPerRequest) {
+		req, err := c.req("GET", "users")
+		if err != nil {
+			return nil, err
+		}
+
+		query := req.URL.Query()
+		for _, login := range batch {
+			query.Add("login", login)
+		}
+		req.URL.RawQuery = query.Encode()
+
+		body, err := c.fetch(req)
+		if err != nil {
+			return nil, err
+		}
+
+		type getUserResponse struct {
+			Data []User `json:"data"`
+		}
+		var payload getUserResponse
+		err = json.NewDecoder(body).Decode(&payload)
+		body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		users = append(users, payload.Data...)
+	}
+
+	return users, nil
+}
+
+func (c *ApiClient) GetUser(channel string) (*User, error) {
+	users, err := c.GetUsers([]string{channel})
 	if err != nil {
 		return nil, err
 	}
 
+	if len(users) == 0 {
+		return nil, fmt.Errorf("no channel with the login %s could be found", channel)
+	}
+
+	return &users[0], nil
+}
+
+// GetStreams returns the live streams of the given user ids.
+// Users who are offline are left out.
+func (c *ApiClient) GetStreams(userIDs []string) ([]Stream, error) {
+	return c.getStreams("user_id", userIDs)
+}
+
+// GetStreamsByLogin returns the live streams of the given user logins.
+// Users who are offline are left out.
+func (c *ApiClient) GetStreamsByLogin(logins []string) ([]Stream, error) {
+	return c.getStreams("user_login", logins)
+}
+
+func (c *ApiClient) getStreams(param string, values []string) ([]Stream, error) {
+	var streams []Stream
+	for _, batch := range chunk(values, maxPerRequest) {
+		req, err := c.req("GET", "streams")
+		if err != nil {
+			return nil, err
+		}
+
+		query := req.URL.Query()
+		for _, v := range batch {
+			query.Add(param, v)
+		}
+		query.Set("first", strconv.Itoa(maxPerRequest))
+		req.URL.RawQuery = query.Encode()
+
+		body, err := c.fetch(req)
+		if err != nil {
+			return nil, err
+		}
+
+		type getStreamsResponse struct {
+			Data []Stream `json:"data"`
+		}
+		var payload getStreamsResponse
+		err = json.NewDecoder(body).Decode(&payload)
+		body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		streams = append(streams, payload.Data...)
+	}
+
+	return streams, nil
+}
+
+// GetEventSubSubscriptions lists every eventsub subscription created by the app
+func (c *ApiClient) GetEventSubSubscriptions() ([]Subscription, error) {
+	var subscriptions []Subscription
+	var cursor string
+	for {
+		req, err := c.req("GET", "eventsub/subscriptions")
+		if err != nil {
+			return nil, err
+		}
+
+		if cursor != "" {
+			query := req.URL.Query()
+			query.Set("after", cursor)
+			req.URL.RawQuery = query.Encode()
+		}
+
+		body, err := c.fetch(req)
+		if err != nil {
+			return nil, err
+		}
+
+		type subscriptionsResponse struct {
+			Data       []Subscription `json:"data"`
+			Pagination struct {
+				Cursor string `json:"cursor"`
+			} `json:"pagination"`
+		}
+		var payload subscriptionsResponse
+		err = json.NewDecoder(body).Decode(&payload)
+		body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		subscriptions = append(subscriptions, payload.Data...)
+		cursor = payload.Pagination.Cursor
+		if cursor == "" {
+			return subscriptions, nil
+		}
+	}
+}
+
+// CreateEventSubSubscription subscribes a webhook callback to an event of a broadcaster
+func (c *ApiClient) CreateEventSubSubscription(subscriptionType, broadcasterID, callback, secret string) (*Subscription, error) {
+	type transport struct {
+		Method   string `json:"method"`
+		Callback string `json:"callback"`
+		Secret   string `json:"secret"`
+	}
+	type createSubscription struct {
+		Type      string            `json:"type"`
+		Version   string            `json:"version"`
+		Condition map[string]string `json:"condition"`
+		Transport transport         `json:"transport"`
+	}
+
+	req, err := c.reqJSON("POST", "eventsub/subscriptions", createSubscription{
+		Type:    subscriptionType,
+		Version: "1",
+		Condition: map[string]string{
+			"broadcaster_user_id": broadcasterID,
+		},
+		Transport: transport{
+			Method:   "webhook",
+			Callback: callback,
+			Secret:   secret,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := c.fetch(req)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	type subscriptionResponse struct {
+		Data []Subscription `json:"data"`
+	}
+	var payload subscriptionResponse
+	err = json.NewDecoder(body).Decode(&payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(payload.Data) == 0 {
+		return nil, fmt.Errorf("twitch api created no %s subscription for %s", subscriptionType, broadcasterID)
+	}
+
+	return &payload.Data[0], nil
+}
+
+// DeleteEventSubSubscription removes an eventsub subscription by id
+func (c *ApiClient) DeleteEventSubSubscription(id string) error {
+	req, err := c.req("DELETE", "eventsub/subscriptions")
+	if err != nil {
+		return err
+	}
+
 	query := req.URL.Query()
-	query.Set("login", strings.Join(channels, ","))
+	query.Set("id", id)
 	req.URL.RawQuery = query.Encode()
 
 	body, err := c.fetch(req)
+	if err != nil {
+		return err
+	}
+
+	return body.Close()
+}
+
+// SubscribeStreamEvents ensures the webhook callback is subscribed to the
+// online and offline events of every broadcaster, skipping existing subscriptions
+func (c *ApiClient) SubscribeStreamEvents(broadcasterIDs []string, callback, secret string) error {
+	existing, err := c.GetEventSubSubscriptions()
+	if err != nil {
+		return err
+	}
+
+	subscribed := map[string]bool{}
+	for _, s := range existing {
+		if s.Transport.Callback != callback || s.Status != "enabled" && s.Status != "webhook_callback_verification_pending" {
+			continue
+		}
+
+		subscribed[s.Type+s.Condition.BroadcasterUserID] = true
+	}
+
+	for _, id := range broadcasterIDs {
+		for _, t := range []string{SubscriptionStreamOnline, SubscriptionStreamOffline} {
+			if subscribed[t+id] {
+				continue
+			}
+
+			_, err := c.CreateEventSubSubscription(t, id, callback, secret)
+			if err != nil {
+				return fmt.Errorf("error subscribing to %s for %s: %w", t, id, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// CreateStreamMarker marks the current point of a live broadcast, acting with
+// a user token of the broadcaster or an editor granted channel:manage:broadcast
+func (c *ApiClient) CreateStreamMarker(userToken, broadcasterID, description string) (*StreamMarker, error) {
+	type createMarker struct {
+		UserID      string `json:"user_id"`
+		Description string `json:"description,omitempty"`
+	}
+
+	description = truncate(description, maxMarkerDescription)
+	req, err := c.reqJSON("POST", "streams/markers", createMarker{
+		UserID:      broadcasterID,
+		Description: description,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := c.fetchAs(req, userToken)
 	if err != nil {
 		return nil, err
 	}
 	defer body.Close()
 
-	type getUserResponse struct {
-		Data []User `json:"data"`
+	type markerResponse struct {
+		Data []StreamMarker `json:"data"`
 	}
-	var payload getUserResponse
+	var payload markerResponse
 	err = json.NewDecoder(body).Decode(&payload)
 	if err != nil {
 		return nil, err
 	}
 
-	return payload.Data, nil
+	if len(payload.Data) == 0 {
+		return nil, fmt.Errorf("twitch api created no stream marker for %s", broadcasterID)
+	}
+
+	return &payload.Data[0], nil
 }
 
-func (c *ApiClient) GetUser(channel string) (*User, error) {
-	users, err := c.GetUsers([]string{channel})
+// GetChannelInformation looks up the title and game of a broadcaster's channel
+func (c *ApiClient) GetChannelInformation(broadcasterID string) (*ChannelInformation, error) {
+	req, err := c.req("GET", "channels")
 	if err != nil {
 		return nil, err
 	}
 
-	if len(users) == 0 {
-		return nil, fmt.Errorf("no channel with the login %s could be found", channel)
+	query := req.URL.Query()
+	query.Set("broadcaster_id", broadcasterID)
+	req.URL.RawQuery = query.Encode()
+
+	body, err := c.fetch(req)
+	if err != nil {
+		return nil, err
 	}
+	defer body.Close()
 
-	return &users[0], nil
+	type channelsResponse struct {
+		Data []ChannelInformation `json:"data"`
+	}
+	var payload channelsResponse
+	err = json.NewDecoder(body).Decode(&payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(payload.Data) == 0 {
+		return nil, fmt.Errorf("no channel with the id %s could be found", broadcasterID)
+	}
+
+	return &payload.Data[0], nil
+}
+
+// ModifyChannelInformation sets the title and game of a broadcaster's channel,
+// acting with a user token of the broadcaster granted channel:manage:broadcast.
+// Empty values are left unchanged.
+func (c *ApiClient) ModifyChannelInformation(userToken, broadcasterID, title, gameID string) error {
+	type modifyChannel struct {
+		Title  string `json:"title,omitempty"`
+		GameID string `json:"game_id,omitempty"`
+	}
+
+	title = truncate(title, maxTitle)
+	req, err := c.reqJSON("PATCH", "channels", modifyChannel{
+		Title:  title,
+		GameID: gameID,
+	})
+	if err != nil {
+		return err
+	}
+
+	query := req.URL.Query()
+	query.Set("broadcaster_id", broadcasterID)
+	req.URL.RawQuery = query.Encode()
+
+	body, err := c.fetchAs(req, userToken)
+	if err != nil {
+		return err
+	}
+
+	return body.Close()
+}
+
+// GetGame looks up a game category by its exact name
+func (c *ApiClient) GetGame(name string) (*Game, error) {
+	req, err := c.req("GET", "games")
+	if err != nil {
+		return nil, err
+	}
+
+	query := req.URL.Query()
+	query.Set("name", name)
+	req.URL.RawQuery = query.Encode()
+
+	body, err := c.fetch(req)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	type gamesResponse struct {
+		Data []Game `json:"data"`
+	}
+	var payload gamesResponse
+	err = json.NewDecoder(body).Decode(&payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(payload.Data) == 0 {
+		return nil, fmt.Errorf("no game named %s could be found", name)
+	}
+
+	return &payload.Data[0], nil
+}
+
+// CreatePrediction opens a channel prediction which locks after the window,
+// acting with a user token of the broadcaster granted channel:manage:predictions
+func (c *ApiClient) CreatePrediction(userToken, broadcasterID, title string, outcomes []string, window time.Duration) (*Prediction, error) {
+	type outcome struct {
+		Title string `json:"title"`
+	}
+	type createPrediction struct {
+		BroadcasterID    string    `json:"broadcaster_id"`
+		Title            string    `json:"title"`
+		Outcomes         []outcome `json:"outcomes"`
+		PredictionWindow int       `json:"prediction_window"`
+	}
+
+	title = truncate(title, maxPredictionTitle)
+	p := createPrediction{
+		BroadcasterID:    broadcasterID,
+		Title:            title,
+		PredictionWindow: int(window.Seconds()),
+	}
+	for _, o := range outcomes {
+		p.Outcomes = append(p.Outcomes, outcome{o})
+	}
+
+	req, err := c.reqJSON("POST", "predictions", p)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.fetchPrediction(req, userToken)
+}
+
+// EndPrediction resolves a prediction with its winning outcome, or cancels
+// it and refunds every viewer when no winning outcome is given
+func (c *ApiClient) EndPrediction(userToken, broadcasterID, id, winningOutcomeID string) (*Prediction, error) {
+	type endPrediction struct {
+		BroadcasterID    string `json:"broadcaster_id"`
+		ID               string `json:"id"`
+		Status           string `json:"status"`
+		WinningOutcomeID string `json:"winning_outcome_id,omitempty"`
+	}
+
+	status := "RESOLVED"
+	if winningOutcomeID == "" {
+		status = "CANCELED"
+	}
+	req, err := c.reqJSON("PATCH", "predictions", endPrediction{
+		BroadcasterID:    broadcasterID,
+		ID:               id,
+		Status:           status,
+		WinningOutcomeID: winningOutcomeID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return c.fetchPrediction(req, userToken)
+}
+
+func (c *ApiClient) fetchPrediction(req *http.Request, userToken string) (*Prediction, error) {
+	body, err := c.fetchAs(req, userToken)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	type predictionResponse struct {
+		Data []Prediction `json:"data"`
+	}
+	var payload predictionResponse
+	err = json.NewDecoder(body).Decode(&payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(payload.Data) == 0 {
+		return nil, fmt.Errorf("twitch api returned no prediction")
+	}
+
+	return &payload.Data[0], nil
+}
+
+// CreateClip starts clipping a live broadcast, acting with a user token
+// granted clips:edit. The clip is processed asynchronously, see GetClips.
+func (c *ApiClient) CreateClip(userToken, broadcasterID string) (*CreatedClip, error) {
+	req, err := c.req("POST", "clips")
+	if err != nil {
+		return nil, err
+	}
+
+	query := req.URL.Query()
+	query.Set("broadcaster_id", broadcasterID)
+	req.URL.RawQuery = query.Encode()
+
+	body, err := c.fetchAs(req, userToken)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	type clipResponse struct {
+		Data []CreatedClip `json:"data"`
+	}
+	var payload clipResponse
+	err = json.NewDecoder(body).Decode(&payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(payload.Data) == 0 {
+		return nil, fmt.Errorf("twitch api created no clip for %s", broadcasterID)
+	}
+
+	return &payload.Data[0], nil
+}
+
+// GetClips looks up clips by id. Clips still being processed are left out.
+func (c *ApiClient) GetClips(ids []string) ([]Clip, error) {
+	var clips []Clip
+	for _, batch := range chunk(ids, maxPerRequest) {
+		req, err := c.req("GET", "clips")
+		if err != nil {
+			return nil, err
+		}
+
+		query := req.URL.Query()
+		for _, id := range batch {
+			query.Add("id", id)
+		}
+		req.URL.RawQuery = query.Encode()
+
+		body, err := c.fetch(req)
+		if err != nil {
+			return nil, err
+		}
+
+		type clipsResponse struct {
+			Data []Clip `json:"data"`
+		}
+		var payload clipsResponse
+		err = json.NewDecoder(body).Decode(&payload)
+		body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		clips = append(clips, payload.Data...)
+	}
+
+	return clips, nil
+}
+
+// SendShoutout shouts out another broadcaster in a channel's chat, acting with
+// a user token of the broadcaster granted moderator:manage:shoutouts
+func (c *ApiClient) SendShoutout(userToken, fromBroadcasterID, toBroadcasterID string) error {
+	req, err := c.req("POST", "chat/shoutouts")
+	if err != nil {
+		return err
+	}
+
+	query := req.URL.Query()
+	query.Set("from_broadcaster_id", fromBroadcasterID)
+	query.Set("to_broadcaster_id", toBroadcasterID)
+	query.Set("moderator_id", fromBroadcasterID)
+	req.URL.RawQuery = query.Encode()
+
+	body, err := c.fetchAs(req, userToken)
+	if err != nil {
+		return err
+	}
+
+	return body.Close()
 }
 
 func (c *ApiClient) req(method, path string) (*http.Request, error) {
-	uri := fmt.Sprintf("%s/%s", api, path)
+	return c.newRequest(method, path, nil)
+}
 
-	req, err := http.NewRequest(method, uri, nil)
+// reqJSON creates a request with the payload encoded as its json body
+func (c *ApiClient) reqJSON(method, path string, payload interface{}) (*http.Request, error) {
+	body, err := json.Marshal(payload)
 	if err != nil {
 		return nil, err
 	}
 
-	req.Header.Set("Client-Id", c.config.ClientID)
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.accessToken))
+	req, err := c.newRequest(method, path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
 
 	return req, nil
 }
 
-func (c *ApiClient) fetch(req *http.Request) (io.ReadCloser, error) {
-	res, err := c.client.Do(req)
+func (c *ApiClient) newRequest(method, path string, body io.Reader) (*http.Request, error) {
+	uri := fmt.Sprintf("%s/%s", c.apiURL, path)
+
+	req, err := http.NewRequest(method, uri, body)
 	if err != nil {
 		return nil, err
 	}
 
-	if res.StatusCode == http.StatusUnauthorized {
-		accessToken, err := newAccessToken(c.config)
+	req.Header.Set("Client-Id", c.config.ClientID)
+
+	return req, nil
+}
+
+// fetch sends a request to the helix api as the app, waiting out the rate limit
+// when it has been used up and retrying a bounded number of times when the app
+// token has been rejected or the rate limit was hit anyway
+func (c *ApiClient) fetch(req *http.Request) (io.ReadCloser, error) {
+	return c.do(req, c.accessToken, c.refreshToken)
+}
+
+// fetchAs sends a request to the helix api on behalf of a user. Their token is
+// not renewed when it is rejected, as it is owned by UserTokens.
+func (c *ApiClient) fetchAs(req *http.Request, userToken string) (io.ReadCloser, error) {
+	token := func() (string, error) {
+		return userToken, nil
+	}
+
+	return c.do(req, token, nil)
+}
+
+func (c *ApiClient) do(req *http.Request, token func() (string, error), renew func() error) (io.ReadCloser, error) {
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+
+		t, err := token()
 		if err != nil {
 			return nil, err
 		}
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", t))
+
+		c.waitForRateLimit()
+		res, err := c.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		c.updateRateLimit(res.Header)
+
+		retry := attempt < maxFetchAttempts
+		switch {
+		case res.StatusCode == http.StatusUnauthorized && retry && renew != nil:
+			res.Body.Close()
+			err = renew()
+			if err != nil {
+				return nil, err
+			}
+			continue
+		case res.StatusCode == http.StatusTooManyRequests && retry:
+			res.Body.Close()
+			continue
+		case res.StatusCode < 200 || res.StatusCode >= 300:
+			res.Body.Close()
+			return nil, &StatusError{StatusCode: res.StatusCode}
+		}
 
-		c.accessToken = accessToken
-		return c.fetch(req)
+		return res.Body, nil
 	}
+}
 
-	if res.StatusCode != http.StatusOK {
-		return res.Body, fmt.Errorf("status code %v from twitch api", res.StatusCode)
+// waitForRateLimit blocks until the rate limit resets when no requests remain
+func (c *ApiClient) waitForRateLimit() {
+	c.limitMut.Lock()
+	wait := time.Duration(0)
+	if c.remaining == 0 {
+		wait = time.Until(c.resetAt)
 	}
+	c.limitMut.Unlock()
 
-	return res.Body, nil
+	if wait > 0 {
+		log.Printf("twitch api rate limit reached, waiting %s", wait.Round(time.Second))
+		time.Sleep(wait)
+	}
 }
 
-func newAccessToken(config config.Twitch) (string, error) {
+// updateRateLimit records the rate limit twitch reports in response headers
+func (c *ApiClient) updateRateLimit(header http.Header) {
+	remaining, err := strconv.Atoi(header.Get("Ratelimit-Remaining"))
+	if err != nil {
+		return
+	}
+	reset, err := strconv.ParseInt(header.Get("Ratelimit-Reset"), 10, 64)
+	if err != nil {
+		return
+	}
+
+	c.limitMut.Lock()
+	defer c.limitMut.Unlock()
+	c.remaining = remaining
+	c.resetAt = time.Unix(reset, 0)
+}
+
+// accessToken returns the app token, renewing it first if it is about to expire
+func (c *ApiClient) accessToken() (string, error) {
+	c.tokenMut.Lock()
+	expired := time.Now().Add(tokenRefreshMargin).After(c.expiresAt)
+	c.tokenMut.Unlock()
+
+	if expired {
+		err := c.refreshToken()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	c.tokenMut.Lock()
+	defer c.tokenMut.Unlock()
+
+	return c.token, nil
+}
+
+func (c *ApiClient) refreshToken() error {
 	query := url.Values{
-		"client_id":     []string{config.ClientID},
-		"client_secret": []string{config.ClientSecret},
+		"client_id":     []string{c.config.ClientID},
+		"client_secret": []string{c.config.ClientSecret},
 		"grant_type":    []string{clientGrant},
 	}
-	u, _ := url.Parse(auth)
+	u, err := url.Parse(c.tokenURL)
+	if err != nil {
+		return err
+	}
 	u.RawQuery = query.Encode()
 
-	res, err := http.Post(u.String(), "", nil)
+	res, err := c.client.Post(u.String(), "", nil)
 	if err != nil {
-		return "", err
+		return err
 	}
 	defer res.Body.Close()
 
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("status code %v while requesting twitch app token", res.StatusCode)
+	}
+
 	type token struct {
 		AccessToken  string   `json:"access_token"`
 		RefreshToken string   `json:"refresh_token"`
@@ -150,8 +876,37 @@ func newAccessToken(config config.Twitch) (string, error) {
 	var t token
 	err = json.NewDecoder(res.Body).Decode(&t)
 	if err != nil {
-		return "", err
+		return fmt.Errorf("error decoding twitch app token: %w", err)
+	}
+
+	c.tokenMut.Lock()
+	defer c.tokenMut.Unlock()
+	c.token = t.AccessToken
+	c.expiresAt = time.Now().Add(time.Duration(t.ExpiresIn) * time.Second)
+
+	return nil
+}
+
+// chunk splits values into batches of at most size
+func chunk(values []string, size int) [][]string {
+	var batches [][]string
+	for len(values) > size {
+		batches = append(batches, values[:size])
+		values = values[size:]
+	}
+	if len(values) > 0 {
+		batches = append(batches, values)
+	}
+
+	return batches
+}
+
+// truncate shortens s to at most max characters, as twitch counts them
+// rather than bytes, without splitting a multibyte character
+func truncate(s string, max int) string {
+	if runes := []rune(s); len(runes) > max {
+		return string(runes[:max])
 	}
 
-	return t.AccessToken, nil
+	return s
 }
@@ -0,0 +1,189 @@
+package twitch_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/config"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/twitch"
+)
+
+// fakeHelix stands in for the token endpoint and the parts of helix the client uses
+type fakeHelix struct {
+	mut          sync.Mutex
+	tokens       int
+	userRequests int
+	// reject lists the status codes to answer the next requests with
+	reject        []int
+	subscriptions []string
+	// titles are the titles and descriptions sent to the endpoints which cap their length
+	titles map[string]string
+}
+
+func (f *fakeHelix) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	if r.URL.Path == "/token" {
+		f.tokens++
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": fmt.Sprintf("token-%d", f.tokens),
+			"expires_in":   3600,
+		})
+		return
+	}
+
+	if len(f.reject) > 0 {
+		status := f.reject[0]
+		f.reject = f.reject[1:]
+		w.Header().Set("Ratelimit-Remaining", "0")
+		w.Header().Set("Ratelimit-Reset", strconv.FormatInt(time.Now().Unix(), 10))
+		w.WriteHeader(status)
+		return
+	}
+
+	auth := r.Header.Get("Authorization")
+	if auth != fmt.Sprintf("Bearer token-%d", f.tokens) && auth != "Bearer user-token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/helix/users":
+		f.userRequests++
+		var users []twitch.User
+		for _, login := range r.URL.Query()["login"] {
+			users = append(users, twitch.User{Login: login})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": users})
+	case "/helix/eventsub/subscriptions":
+		var sub struct {
+			Type string `json:"type"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&sub)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.subscriptions = append(f.subscriptions, sub.Type)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": []twitch.Subscription{{Type: sub.Type}},
+		})
+	case "/helix/channels", "/helix/predictions", "/helix/streams/markers":
+		var body struct {
+			Title       string `json:"title"`
+			Description string `json:"description"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.titles[r.URL.Path] = body.Title + body.Description
+		switch r.URL.Path {
+		case "/helix/channels":
+			w.WriteHeader(http.StatusNoContent)
+		case "/helix/predictions":
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": []twitch.Prediction{{ID: "prediction"}}})
+		default:
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": []twitch.StreamMarker{{ID: "marker"}}})
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestApiClient(t *testing.T) {
+	fake := &fakeHelix{titles: map[string]string{}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	client, err := twitch.NewApiClient(config.Twitch{
+		APIURL:   srv.URL + "/helix",
+		TokenURL: srv.URL + "/token",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("should look up users in batches of 100", func(t *testing.T) {
+		var logins []string
+		for i := 0; i < 250; i++ {
+			logins = append(logins, fmt.Sprintf("racer%d", i))
+		}
+
+		users, err := client.GetUsers(logins)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(users) != 250 || fake.userRequests != 3 {
+			t.Errorf("got %v users in %v requests, want %v users in %v requests", len(users), fake.userRequests, 250, 3)
+		}
+	})
+
+	t.Run("should renew the app token and resend the body after a 401", func(t *testing.T) {
+		fake.reject = []int{http.StatusUnauthorized}
+		tokens := fake.tokens
+
+		_, err := client.CreateEventSubSubscription(twitch.SubscriptionStreamOnline, "1234", "https://example.com", "a-very-secret-secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fake.tokens != tokens+1 {
+			t.Errorf("got %v tokens, want %v", fake.tokens, tokens+1)
+		}
+		if len(fake.subscriptions) != 1 || fake.subscriptions[0] != twitch.SubscriptionStreamOnline {
+			t.Errorf("got %v, want [%v]", fake.subscriptions, twitch.SubscriptionStreamOnline)
+		}
+	})
+
+	t.Run("should retry once the rate limit resets", func(t *testing.T) {
+		fake.reject = []int{http.StatusTooManyRequests}
+
+		_, err := client.GetUser("tanjo3")
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("should shorten titles by character without splitting multibyte ones", func(t *testing.T) {
+		title := strings.Repeat("é", 200)
+
+		err := client.ModifyChannelInformation("user-token", "1234", title, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = client.CreatePrediction("user-token", "1234", title, []string{"yes", "no"}, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = client.CreateStreamMarker("user-token", "1234", title)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for path, want := range map[string]int{"/helix/channels": 140, "/helix/predictions": 45, "/helix/streams/markers": 140} {
+			got := fake.titles[path]
+			if !utf8.ValidString(got) || utf8.RuneCountInString(got) != want {
+				t.Errorf("got %q for %v, want %v characters", got, path, want)
+			}
+		}
+	})
+
+	t.Run("should give up after repeated rejections", func(t *testing.T) {
+		fake.reject = []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusUnauthorized}
+
+		_, err := client.GetUser("tanjo3")
+		if err == nil {
+			t.Errorf("got %v, want an error", err)
+		}
+	})
+}
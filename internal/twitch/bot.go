@@ -6,6 +6,7 @@ import (
 	"log"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/TBPixel/tww-rando-twitch-bot/internal/races"
 
@@ -27,23 +28,25 @@ var (
 
 const (
 	MultiTwitchURL = "https://multitwitch.tv"
-	SeedHashPrefix = "Seed Hash:"
-	Delimiter      = " | "
 )
 
 // Bot remains connected to twitch IRC, watches
 // chats and shares messages received through a channel
 type Bot struct {
 	racetimeURL string
-	db          *storage.DB
+	db          storage.Store
+	api         *ApiClient
 	client      *twitch.Client
 	msgChan     <-chan twitch.PrivateMessage
 	mut         sync.Mutex
 	races       []racetime.RaceData
+	// cooldowns holds when each command was last answered in each
+	// channel, and is only touched by the goroutine handling messages
+	cooldowns map[string]time.Time
 }
 
 // NewBot creates a client connected to the twitch Bot server
-func NewBot(conf config.Twitch, db *storage.DB, racetimeURL string) *Bot {
+func NewBot(conf config.Twitch, db storage.Store, api *ApiClient, racetimeURL string) *Bot {
 	client := twitch.NewClient(conf.Username, conf.IRCOAuth)
 	msgChan := make(chan twitch.PrivateMessage)
 
@@ -54,10 +57,12 @@ func NewBot(conf config.Twitch, db *storage.DB, racetimeURL string) *Bot {
 	return &Bot{
 		racetimeURL: racetimeURL,
 		db:          db,
+		api:         api,
 		client:      client,
 		msgChan:     msgChan,
 		mut:         sync.Mutex{},
 		races:       []racetime.RaceData{},
+		cooldowns:   map[string]time.Time{},
 	}
 }
 
@@ -66,6 +71,18 @@ func (b *Bot) Join(channels ...string) {
 	b.client.Join(channels...)
 }
 
+// Say sends a message to the chat of a twitch channel
+func (b *Bot) Say(channel, message string) {
+	b.client.Say(channel, message)
+}
+
+// Part leaves the chat of twitch channels
+func (b *Bot) Part(channels ...string) {
+	for _, c := range channels {
+		b.client.Depart(c)
+	}
+}
+
 // Listen connects to the IRC server and awaits messages,
 // handling any it sees as commands.
 func (b *Bot) Listen(ctx context.Context, listener chan []racetime.RaceData) {
@@ -98,6 +115,7 @@ func (b *Bot) Listen(ctx context.Context, listener chan []racetime.RaceData) {
 }
 
 func (b *Bot) handleMessage(message twitch.PrivateMessage) error {
+	start := time.Now()
 	idents, err := parseBotCommands(message.Message)
 	if err != nil {
 		if err == ErrNotEnoughArgs {
@@ -108,10 +126,7 @@ func (b *Bot) handleMessage(message twitch.PrivateMessage) error {
 		return nil
 	}
 
-	streamer, err := b.db.FindUser(storage.UserQuery{
-		Field: storage.FieldTwitchID,
-		Value: message.RoomID,
-	})
+	streamer, err := b.db.FindUser(storage.Where(storage.FieldTwitchID).Eq(message.RoomID))
 	if err != nil {
 		return err
 	}
@@ -119,27 +134,65 @@ func (b *Bot) handleMessage(message twitch.PrivateMessage) error {
 		return fmt.Errorf("unabled to find streamer with twitch id %s (name %s)", message.RoomID, message.Channel)
 	}
 
+	settings, err := ChannelSettingsFor(b.db, *streamer)
+	if err != nil {
+		return err
+	}
+
 	// ensure the bot can play marbles with Tanjo3 :widepeepoHappy:
 	if idents[0].Token == PLAY && message.User.ID == streamer.TwitchID {
-		b.client.Say(message.Channel, "!play")
+		if settings.Marbles {
+			b.client.Say(message.Channel, "!play")
+		}
 		return nil
 	}
 
-	// skip if not a !twwr nor a recognized command
-	if idents[0].Token != PREFIX {
+	// skip if neither the channel's prefix nor one of its aliases
+	words, ok := ParseCommand(settings, message.Message)
+	if !ok {
 		return nil
 	}
 
 	// TODO: Verify bot to allow whisper of help command
-	if len(idents) == 1 {
-		b.client.Say(message.Channel, handleHelpCommand())
+	if len(words) == 0 {
+		words = []string{"help"}
+		answered := b.say(message.Channel, settings, "help", handleHelpCommand(settings))
+		b.audit(start, *streamer, message, words, answeredOutcome(answered, storage.CommandAnswered))
+		return nil
+	}
+
+	idents, err = parseBotCommands(strings.Join(words, " "))
+	if err != nil {
+		log.Printf("error parsing bot command: %s", err)
+		return nil
+	}
+
+	if idents[0].Token == CONFIG {
+		if !isModerator(message.User) {
+			b.audit(start, *streamer, message, words, storage.CommandPermission)
+			return nil
+		}
+
+		reply, err := b.handleConfigCommand(*streamer, &settings, words[1:])
+		if err != nil {
+			return err
+		}
+		b.client.Say(message.Channel, reply)
+		b.audit(start, *streamer, message, words, storage.CommandAnswered)
+		return nil
+	}
+
+	command := strings.ToLower(idents[0].Lit)
+	if !CommandEnabled(settings, command) {
+		b.audit(start, *streamer, message, words, storage.CommandDisabled)
 		return nil
 	}
 
 	// Non-race commands
-	switch idents[1].Token {
+	switch idents[0].Token {
 	case HELP:
-		b.client.Say(message.Channel, handleHelpCommand())
+		answered := b.say(message.Channel, settings, command, handleHelpCommand(settings))
+		b.audit(start, *streamer, message, words, answeredOutcome(answered, storage.CommandAnswered))
 		return nil
 	case RESTREAM:
 		// TODO: Restream command will check if the user has linked to a restream for this race
@@ -152,33 +205,136 @@ func (b *Bot) handleMessage(message twitch.PrivateMessage) error {
 		return nil
 	}
 
+	var reply string
 	race := b.findRaceForUser(*streamer)
 	if race == nil {
-		b.client.Say(message.Channel, notCurrentlyInRace(*streamer))
+		reply = localize(settings.Locale, msgNotInRace, streamer.TwitchDisplayName)
+		answered := b.say(message.Channel, settings, command, reply)
+		b.audit(start, *streamer, message, words, answeredOutcome(answered, storage.CommandNotInRace))
 		return nil
 	}
 
 	// race only commands
-	switch idents[1].Token {
+	switch idents[0].Token {
 	case SETTINGS:
-		b.client.Say(message.Channel, handleSettingsCommand(*streamer, *race))
+		reply = handleSettingsCommand(*streamer, settings, *race)
 	case RACE:
-		b.client.Say(message.Channel, handleRaceCommand(*streamer, *race))
+		reply = handleRaceCommand(*streamer, settings, *race)
 	case VS:
-		b.client.Say(message.Channel, handleVsCommand(*streamer, *race))
+		reply = handleVsCommand(*streamer, settings, *race)
 	case LINK:
-		b.client.Say(message.Channel, fmt.Sprintf("%s/%s", b.racetimeURL, race.Name))
+		reply = fmt.Sprintf("%s/%s", b.racetimeURL, race.Name)
 	case ExamplePerma:
-		b.client.Say(message.Channel, handleExamplePermaCommand(*streamer, *race))
+		reply = handleExamplePermaCommand(*streamer, settings, *race)
 	case MULTI:
-		b.client.Say(message.Channel, handleMultiCommand(*streamer, *race))
+		reply = b.handleMultiCommand(*streamer, settings, *race)
 	case PERMA:
-		b.client.Say(message.Channel, handlePermaCommand(*streamer, *race))
+		reply = handlePermaCommand(*streamer, settings, *race)
+	default:
+		return nil
 	}
 
+	answered := b.say(message.Channel, settings, command, reply)
+	b.audit(start, *streamer, message, words, answeredOutcome(answered, storage.CommandAnswered))
+
 	return nil
 }
 
+// say replies to a command unless the channel's cooldown for it is running,
+// reporting whether it replied
+func (b *Bot) say(channel string, settings storage.ChannelSettings, command, reply string) bool {
+	key := fmt.Sprintf("%s/%s", channel, command)
+	if settings.CommandCooldown > 0 && time.Since(b.cooldowns[key]) < settings.CommandCooldown {
+		return false
+	}
+
+	b.cooldowns[key] = time.Now()
+	b.client.Say(channel, reply)
+
+	return true
+}
+
+// answeredOutcome is the outcome of a command, unless its cooldown kept it from being answered
+func answeredOutcome(answered bool, outcome string) string {
+	if !answered {
+		return storage.CommandCooldown
+	}
+
+	return outcome
+}
+
+// audit records a handled command with how long it took and how it turned out
+func (b *Bot) audit(start time.Time, streamer storage.User, message twitch.PrivateMessage, words []string, outcome string) {
+	_, err := b.db.SaveCommandLog(storage.CommandLog{
+		UserID:    streamer.ID,
+		Channel:   message.Channel,
+		Chatter:   message.User.Name,
+		Command:   strings.ToLower(words[0]),
+		Args:      strings.Join(words[1:], " "),
+		Latency:   time.Since(start),
+		Outcome:   outcome,
+		CreatedAt: start,
+	})
+	if err != nil {
+		log.Printf("error recording command: %s", err)
+	}
+}
+
+// isModerator reports whether a chatter may change the channel's settings
+func isModerator(user twitch.User) bool {
+	return user.Badges["broadcaster"] > 0 || user.Badges["moderator"] > 0
+}
+
+// handleConfigCommand gets or sets the channel's settings from the words after config
+func (b *Bot) handleConfigCommand(streamer storage.User, settings *storage.ChannelSettings, args []string) (string, error) {
+	usage := localize(settings.Locale, msgConfigUsage, settings.Prefix, settings.Prefix)
+	if len(args) == 0 {
+		return usage, nil
+	}
+
+	switch strings.ToLower(args[0]) {
+	case "get":
+		if len(args) == 1 {
+			var values []string
+			for _, s := range Settings {
+				values = append(values, fmt.Sprintf("%s=%s", s.Key, s.Get(*settings)))
+			}
+
+			return strings.Join(values, ", "), nil
+		}
+
+		setting, ok := FindSetting(args[1])
+		if !ok {
+			return localize(settings.Locale, msgConfigUnknown, args[1], strings.Join(SettingKeys(), ", ")), nil
+		}
+
+		return localize(settings.Locale, msgConfigValue, setting.Key, setting.Get(*settings)), nil
+	case "set":
+		if len(args) < 3 {
+			return usage, nil
+		}
+
+		setting, ok := FindSetting(args[1])
+		if !ok {
+			return localize(settings.Locale, msgConfigUnknown, args[1], strings.Join(SettingKeys(), ", ")), nil
+		}
+		err := setting.Set(settings, strings.Join(args[2:], " "))
+		if err != nil {
+			return localize(settings.Locale, msgConfigInvalid, setting.Key, err), nil
+		}
+
+		_, err = b.db.SaveChannelSettings(*settings)
+		if err != nil {
+			return "", err
+		}
+		log.Printf("settings: %s set to %s for channel %s", setting.Key, setting.Get(*settings), streamer.TwitchName)
+
+		return localize(settings.Locale, msgConfigSet, setting.Key, setting.Get(*settings)), nil
+	}
+
+	return usage, nil
+}
+
 func (b *Bot) findRaceForUser(user storage.User) (race *racetime.RaceData) {
 	b.mut.Lock()
 	defer b.mut.Unlock()
@@ -212,64 +368,50 @@ func parseBotCommands(input string) ([]lexer.Ident, error) {
 	return args, nil
 }
 
-func extractPreset(race racetime.RaceData) string {
-	for _, p := range races.Presets() {
-		if strings.Contains(strings.ToLower(race.Info), strings.ToLower(p)) {
-			return p
-		}
-	}
-
-	return ""
-}
-
-func notCurrentlyInRace(streamer storage.User) string {
-	return fmt.Sprintf("%s is not currently in a race", streamer.TwitchDisplayName)
+func customCategory(streamer storage.User, settings storage.ChannelSettings) string {
+	return localize(settings.Locale, msgCustomCategory, streamer.TwitchDisplayName)
 }
 
-func customCategory(streamer storage.User) string {
-	return fmt.Sprintf("%s is playing a custom race category", streamer.TwitchDisplayName)
-}
-
-func handleSettingsCommand(streamer storage.User, race racetime.RaceData) string {
+func handleSettingsCommand(streamer storage.User, settings storage.ChannelSettings, race racetime.RaceData) string {
 	if race.Goal.Name != races.Standard && race.Goal.Name != races.SpoilerLog {
-		return customCategory(streamer)
+		return customCategory(streamer, settings)
 	}
 
-	ex := races.ExamplePermaByPreset(extractPreset(race))
+	ex := races.ExamplePermaByPreset(races.ExtractPreset(race))
 	if ex == nil {
-		return customCategory(streamer)
+		return customCategory(streamer, settings)
 	}
 
 	return fmt.Sprintf("%s: %s", ex.Preset, ex.Description)
 }
 
-func handleRaceCommand(streamer storage.User, race racetime.RaceData) string {
+func handleRaceCommand(streamer storage.User, settings storage.ChannelSettings, race racetime.RaceData) string {
 	if race.Goal.Name != races.Standard && race.Goal.Name != races.SpoilerLog {
-		return customCategory(streamer)
+		return customCategory(streamer, settings)
 	}
 
-	ex := races.ExamplePermaByPreset(extractPreset(race))
+	ex := races.ExamplePermaByPreset(races.ExtractPreset(race))
 	if ex == nil {
-		return customCategory(streamer)
+		return customCategory(streamer, settings)
 	}
 
-	return fmt.Sprintf("%s is playing %s (!twwr settings)", streamer.TwitchDisplayName, ex.Preset)
+	return localize(settings.Locale, msgPlaying, streamer.TwitchDisplayName, ex.Preset, settings.Prefix)
 }
 
-func handleExamplePermaCommand(streamer storage.User, race racetime.RaceData) string {
+func handleExamplePermaCommand(streamer storage.User, settings storage.ChannelSettings, race racetime.RaceData) string {
 	if race.Goal.Name != races.Standard && race.Goal.Name != races.SpoilerLog {
-		return customCategory(streamer)
+		return customCategory(streamer, settings)
 	}
 
-	ex := races.ExamplePermaByPreset(extractPreset(race))
+	ex := races.ExamplePermaByPreset(races.ExtractPreset(race))
 	if ex == nil {
-		return customCategory(streamer)
+		return customCategory(streamer, settings)
 	}
 
-	return fmt.Sprintf("example permalink: %s", ex.Perma)
+	return localize(settings.Locale, msgExamplePerma, ex.Perma)
 }
 
-func handleVsCommand(streamer storage.User, race racetime.RaceData) string {
+func handleVsCommand(streamer storage.User, settings storage.ChannelSettings, race racetime.RaceData) string {
 	var entrants []string
 	for _, u := range race.Entrants {
 		// skip the streamer
@@ -285,61 +427,76 @@ func handleVsCommand(streamer storage.User, race racetime.RaceData) string {
 	}
 
 	if len(entrants) == 0 {
-		return fmt.Sprintf("There are currently no other entrants in race with %s", streamer.TwitchDisplayName)
+		return localize(settings.Locale, msgNoEntrants, streamer.TwitchDisplayName)
 	}
 
-	return fmt.Sprintf("%s is currently racing against: %s", streamer.TwitchDisplayName, strings.Join(entrants, ", "))
+	return localize(settings.Locale, msgRacingAgainst, streamer.TwitchDisplayName, strings.Join(entrants, ", "))
 }
 
-func handleMultiCommand(streamer storage.User, race racetime.RaceData) string {
-	var entrants []string
-	for _, u := range race.Entrants {
-		// skip users without a twitch account
-		if u.User.TwitchName == "" {
-			continue
-		}
+func (b *Bot) handleMultiCommand(streamer storage.User, settings storage.ChannelSettings, race racetime.RaceData) string {
+	opts := MultistreamOptions{
+		Provider:     settings.MultistreamProvider,
+		HideFinished: settings.MultiHideFinished,
+	}
 
-		entrants = append(entrants, u.User.TwitchName)
+	// fall back to racetime's view of who is live if twitch can't be reached
+	streams, err := liveStreams(b.api, race.Entrants)
+	if err != nil {
+		log.Printf("error looking up live racers: %s", err)
+	} else {
+		opts.Live = map[string]bool{}
+		for login := range streams {
+			opts.Live[login] = true
+		}
 	}
 
-	if len(entrants) == 0 {
-		return fmt.Sprintf("There are currently no other entrants in race with %s", streamer.TwitchDisplayName)
+	link, ok := MultistreamURL(race.Entrants, opts)
+	if !ok {
+		return localize(settings.Locale, msgNoLiveEntrants, streamer.TwitchDisplayName)
 	}
 
-	return fmt.Sprintf("%s/%s", MultiTwitchURL, strings.Join(entrants, "/"))
+	return link
 }
 
-func handlePermaCommand(streamer storage.User, race racetime.RaceData) string {
-	if race.Goal.Name != races.Standard && race.Goal.Name != races.SpoilerLog {
-		return customCategory(streamer)
+// liveStreams looks up the streams of entrants who are live on twitch,
+// keyed by their lowercased login
+func liveStreams(api *ApiClient, entrants []racetime.Entrant) (map[string]Stream, error) {
+	var logins []string
+	for _, e := range entrants {
+		if e.User.TwitchName != "" {
+			logins = append(logins, e.User.TwitchName)
+		}
 	}
 
-	hashStartIndex := strings.Index(race.Info, SeedHashPrefix)
-	if hashStartIndex == -1 {
-		return "Permalink has not yet been generated or cannot be found"
+	live := map[string]Stream{}
+	if len(logins) == 0 {
+		return live, nil
 	}
 
-	seedEndIndex := hashStartIndex - len(Delimiter)
-	seedStartIndex := strings.LastIndex(race.Info[:seedEndIndex], Delimiter) + len(Delimiter)
-	if seedStartIndex == -1 {
-		return "Permalink has not yet been generated or cannot be found"
+	streams, err := api.GetStreamsByLogin(logins)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range streams {
+		live[strings.ToLower(s.UserLogin)] = s
 	}
 
-	return race.Info[seedStartIndex:seedEndIndex]
+	return live, nil
 }
 
-func handleHelpCommand() string {
-	// list of active commands
-	commands := []string{
-		"settings",
-		"race",
-		"vs",
-		"link",
-		"exampleperma",
-		"perma",
-		"multi",
-		"help",
+func handlePermaCommand(streamer storage.User, settings storage.ChannelSettings, race racetime.RaceData) string {
+	if race.Goal.Name != races.Standard && race.Goal.Name != races.SpoilerLog {
+		return customCategory(streamer, settings)
+	}
+
+	info := races.ParseInfo(race.Info)
+	if info.SeedHash == "" || info.Permalink == "" {
+		return localize(settings.Locale, msgNoPerma)
 	}
 
-	return fmt.Sprintf("commands: %s", strings.Join(commands, ", "))
+	return info.Permalink
+}
+
+func handleHelpCommand(settings storage.ChannelSettings) string {
+	return localize(settings.Locale, msgCommands, strings.Join(EnabledCommands(settings), ", "))
 }
@@ -0,0 +1,153 @@
+package twitch
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/config"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/races"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/racetime"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/storage"
+)
+
+// ScopeEditClips lets the bot clip a streamer's broadcast
+const ScopeEditClips = "clips:edit"
+
+// RaceRooms finds the racetime room the bot is connected to for a race
+type RaceRooms interface {
+	Room(slug string) (*racetime.Room, bool)
+}
+
+// Clips clips the streams of opted in streamers when they finish a race
+type Clips struct {
+	api          *ApiClient
+	tokens       *UserTokens
+	db           storage.Store
+	bot          *Bot
+	rooms        RaceRooms
+	pollInterval time.Duration
+	timeout      time.Duration
+}
+
+// NewClips creates a clip tracker, which shares clip links in twitch chat
+// through the bot and in racetime rooms found through rooms when it isn't nil
+func NewClips(conf config.Twitch, api *ApiClient, tokens *UserTokens, db storage.Store, bot *Bot, rooms RaceRooms) *Clips {
+	return &Clips{
+		api:          api,
+		tokens:       tokens,
+		db:           db,
+		bot:          bot,
+		rooms:        rooms,
+		pollInterval: conf.ClipPollInterval,
+		timeout:      conf.ClipTimeout,
+	}
+}
+
+// Run clips the streams of racers who finished between the race lists
+// received from the listener until the context ends
+func (c *Clips) Run(ctx context.Context, listener <-chan []racetime.RaceData) {
+	races.WatchChanges(ctx, listener, func(change races.Change) {
+		if change.Type != races.EntrantFinished {
+			return
+		}
+
+		for _, user := range linkedStreamers(c.db, change) {
+			if !user.AutoClip || !c.tokens.HasScopes(*user, ScopeEditClips) {
+				continue
+			}
+
+			// processing takes a while, so don't hold up the race list
+			go c.clip(ctx, *user, change.Race)
+		}
+	})
+}
+
+func (c *Clips) clip(ctx context.Context, user storage.User, race racetime.RaceData) {
+	// twitch only clips live broadcasts
+	state, err := c.db.FindChannelState(user.ID)
+	if err != nil || !state.Live {
+		return
+	}
+
+	token, err := c.tokens.AccessToken(user.ID)
+	if err != nil {
+		log.Printf("clips: token for %s: %s", user.TwitchName, err)
+		return
+	}
+
+	created, err := c.api.CreateClip(token, user.TwitchID)
+	if err != nil {
+		log.Printf("clips: clipping stream of %s: %s", user.TwitchName, err)
+		return
+	}
+
+	clip, err := c.db.SaveClip(storage.Clip{
+		ID:        created.ID,
+		UserID:    user.ID,
+		RaceSlug:  race.Slug,
+		EditURL:   created.EditURL,
+		Status:    storage.ClipPending,
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		log.Printf("clips: %s", err)
+		return
+	}
+
+	url, err := c.await(ctx, clip.ID)
+	if err != nil {
+		log.Printf("clips: clip %s of %s: %s", clip.ID, user.TwitchName, err)
+		clip.Status = storage.ClipFailed
+	} else {
+		clip.Status = storage.ClipReady
+		clip.URL = url
+	}
+
+	_, err = c.db.SaveClip(*clip)
+	if err != nil {
+		log.Printf("clips: %s", err)
+	}
+	if clip.Status != storage.ClipReady {
+		return
+	}
+	log.Printf("clips: clipped %s finishing %s: %s", user.TwitchName, race.Slug, clip.URL)
+
+	message := fmt.Sprintf("%s finished %s! %s", user.TwitchDisplayName, race.Slug, clip.URL)
+	if user.ClipToChat {
+		c.bot.Say(user.TwitchName, message)
+	}
+	if user.ClipToRacetime && c.rooms != nil {
+		room, ok := c.rooms.Room(race.Slug)
+		if ok {
+			err = room.SendMessage(ctx, message, racetime.MessageOptions{})
+			if err != nil {
+				log.Printf("clips: %s", err)
+			}
+		}
+	}
+}
+
+// await polls for a clip until twitch has processed it, returning its url
+func (c *Clips) await(ctx context.Context, id string) (string, error) {
+	timeout := time.After(c.timeout)
+	for {
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-timeout:
+			return "", fmt.Errorf("not processed within %s", c.timeout)
+		case <-time.After(c.pollInterval):
+			clips, err := c.api.GetClips([]string{id})
+			if err != nil {
+				log.Printf("clips: %s", err)
+				continue
+			}
+
+			if len(clips) > 0 && clips[0].URL != "" {
+				return clips[0].URL, nil
+			}
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package twitch_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/config"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/racetime"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/storage"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/twitch"
+)
+
+func TestClips(t *testing.T) {
+	var mut sync.Mutex
+	var polls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mut.Lock()
+		defer mut.Unlock()
+
+		switch {
+		case r.URL.Path == "/token":
+			json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "app", "expires_in": 3600})
+		case r.URL.Path == "/helix/clips" && r.Method == "POST":
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"data": []twitch.CreatedClip{{ID: "AwkwardHelplessSalamanderSwiftRage"}},
+			})
+		case r.URL.Path == "/helix/clips":
+			// twitch leaves clips out until they have been processed
+			polls++
+			var clips []twitch.Clip
+			if polls > 2 {
+				clips = append(clips, twitch.Clip{ID: r.URL.Query().Get("id"), URL: "https://clips.twitch.tv/" + r.URL.Query().Get("id")})
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": clips})
+		}
+	}))
+	defer srv.Close()
+
+	conf := config.Twitch{
+		APIURL:           srv.URL + "/helix",
+		TokenURL:         srv.URL + "/token",
+		ClipPollInterval: time.Millisecond * 10,
+		ClipTimeout:      time.Second * 15,
+	}
+	api, err := twitch.NewApiClient(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := openDB(t)
+	user, err := db.CreateUser("1234", "tanjo3", "Tanjo3", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	racetimeID, enabled := "racer", true
+	_, err = db.UpdateUser(user.ID, storage.UserUpdate{RacetimeID: &racetimeID, ActiveInChannel: &enabled, AutoClip: &enabled})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.SaveTwitchToken(user.ID, storage.OAuthToken{AccessToken: "user", Scopes: []string{twitch.ScopeEditClips}, ExpiresAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.SaveChannelState(storage.ChannelState{UserID: user.ID, TwitchID: user.TwitchID, Live: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	listener := make(chan []racetime.RaceData)
+	clips := twitch.NewClips(conf, api, twitch.NewUserTokens(conf, db), db, nil, nil)
+	go clips.Run(ctx, listener)
+
+	racing := racetime.RaceData{Slug: "clever-link-1234"}
+	racing.Status.Value = racetime.StatusInProgress
+	var e racetime.Entrant
+	e.User.ID = racetimeID
+	e.Status.Value = racetime.EntrantInProgress
+	racing.Entrants = []racetime.Entrant{e}
+
+	finished := racing
+	e.Status.Value = racetime.EntrantDone
+	finished.Entrants = []racetime.Entrant{e}
+
+	listener <- []racetime.RaceData{racing}
+	listener <- []racetime.RaceData{finished}
+
+	t.Run("should store the clip url once twitch has processed it", func(t *testing.T) {
+		deadline := time.Now().Add(time.Second)
+		for time.Now().Before(deadline) {
+			got, err := db.FindClips(storage.Where(storage.FieldRaceSlug).Eq("clever-link-1234"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) == 1 && got[0].Status == storage.ClipReady {
+				if got[0].URL != "https://clips.twitch.tv/AwkwardHelplessSalamanderSwiftRage" {
+					t.Errorf("got %v, want the processed clip url", got[0].URL)
+				}
+				return
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+
+		t.Errorf("clip was not ready within a second")
+	})
+}
@@ -0,0 +1,76 @@
+package twitch
+
+import (
+	"context"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/storage"
+)
+
+// PruneCommandLogs deletes logs of commands older than the retention
+// every interval until the context ends
+func PruneCommandLogs(ctx context.Context, db storage.Store, retention, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		n, err := db.DeleteCommandLogs(time.Now().Add(-retention))
+		if err != nil {
+			log.Printf("command logs: %s", err)
+		} else if n > 0 {
+			log.Printf("command logs: deleted %d logs older than %s", n, retention)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// CommandUsage counts the uses of commands in one channel or of one command
+type CommandUsage struct {
+	Key   string
+	Total int
+	// Outcomes counts the uses by how they turned out
+	Outcomes map[string]int
+	// AverageLatency is how long the bot took to handle a use on average
+	AverageLatency time.Duration
+}
+
+// SummarizeCommands groups command logs by a key, such as their channel,
+// listing the most used first
+func SummarizeCommands(logs []*storage.CommandLog, key func(l *storage.CommandLog) string) []CommandUsage {
+	usage := map[string]*CommandUsage{}
+	latency := map[string]time.Duration{}
+	for _, l := range logs {
+		k := key(l)
+		u, ok := usage[k]
+		if !ok {
+			u = &CommandUsage{Key: k, Outcomes: map[string]int{}}
+			usage[k] = u
+		}
+
+		u.Total++
+		u.Outcomes[l.Outcome]++
+		latency[k] += l.Latency
+	}
+
+	var summary []CommandUsage
+	for k, u := range usage {
+		u.AverageLatency = latency[k] / time.Duration(u.Total)
+		summary = append(summary, *u)
+	}
+	sort.Slice(summary, func(i, j int) bool {
+		if summary[i].Total != summary[j].Total {
+			return summary[i].Total > summary[j].Total
+		}
+
+		return summary[i].Key < summary[j].Key
+	})
+
+	return summary
+}
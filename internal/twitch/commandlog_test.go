@@ -0,0 +1,32 @@
+package twitch_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/storage"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/twitch"
+)
+
+func TestSummarizeCommands(t *testing.T) {
+	logs := []*storage.CommandLog{
+		{Channel: "tanjo3", Command: "race", Outcome: storage.CommandAnswered, Latency: time.Millisecond * 10},
+		{Channel: "tanjo3", Command: "multi", Outcome: storage.CommandCooldown, Latency: time.Millisecond * 20},
+		{Channel: "other", Command: "race", Outcome: storage.CommandNotInRace, Latency: time.Millisecond * 30},
+	}
+
+	t.Run("should count uses by key, most used first", func(t *testing.T) {
+		usage := twitch.SummarizeCommands(logs, func(l *storage.CommandLog) string {
+			return l.Channel
+		})
+		if len(usage) != 2 {
+			t.Fatalf("got %v groups, want %v", len(usage), 2)
+		}
+		if usage[0].Key != "tanjo3" || usage[0].Total != 2 {
+			t.Errorf("got %v with %v uses, want %v with %v", usage[0].Key, usage[0].Total, "tanjo3", 2)
+		}
+		if usage[0].Outcomes[storage.CommandCooldown] != 1 || usage[0].AverageLatency != time.Millisecond*15 {
+			t.Errorf("got %+v, want one cooldown and 15ms average latency", usage[0])
+		}
+	})
+}
@@ -0,0 +1,285 @@
+package twitch
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// EventSub webhook headers and message types
+const (
+	EventSubMessageID        = "Twitch-Eventsub-Message-Id"
+	EventSubMessageTimestamp = "Twitch-Eventsub-Message-Timestamp"
+	EventSubMessageSignature = "Twitch-Eventsub-Message-Signature"
+	EventSubMessageType      = "Twitch-Eventsub-Message-Type"
+
+	EventSubNotification = "notification"
+	EventSubVerification = "webhook_callback_verification"
+	EventSubRevocation   = "revocation"
+
+	SubscriptionStreamOnline  = "stream.online"
+	SubscriptionStreamOffline = "stream.offline"
+)
+
+const (
+	// eventSubMaxAge rejects messages older than this, as Twitch recommends
+	eventSubMaxAge = time.Minute * 10
+	// eventSubMaxBody bounds the size of a webhook request body
+	eventSubMaxBody = 1 << 20
+	// eventSubQueue bounds how many events may wait on each listener
+	eventSubQueue = 100
+)
+
+var (
+	ErrInvalidSignature = errors.New("eventsub message signature does not match")
+	ErrExpiredMessage   = errors.New("eventsub message is too old")
+)
+
+// StreamEvent is a stream going online or offline
+type StreamEvent struct {
+	Type             string
+	BroadcasterID    string
+	BroadcasterLogin string
+	BroadcasterName  string
+	StartedAt        time.Time
+}
+
+// Online reports whether the event is a stream going live
+func (e StreamEvent) Online() bool {
+	return e.Type == SubscriptionStreamOnline
+}
+
+type Subscription struct {
+	ID        string `json:"id"`
+	Status    string `json:"status"`
+	Type      string `json:"type"`
+	Version   string `json:"version"`
+	Condition struct {
+		BroadcasterUserID string `json:"broadcaster_user_id"`
+	} `json:"condition"`
+	Transport struct {
+		Method   string `json:"method"`
+		Callback string `json:"callback"`
+	} `json:"transport"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type eventSubPayload struct {
+	Challenge    string          `json:"challenge"`
+	Subscription Subscription    `json:"subscription"`
+	Event        json.RawMessage `json:"event"`
+}
+
+type streamEventPayload struct {
+	BroadcasterUserID    string    `json:"broadcaster_user_id"`
+	BroadcasterUserLogin string    `json:"broadcaster_user_login"`
+	BroadcasterUserName  string    `json:"broadcaster_user_name"`
+	StartedAt            time.Time `json:"started_at"`
+}
+
+// EventSub receives Twitch EventSub webhooks, verifying each message and
+// sharing stream online and offline events with its listeners
+type EventSub struct {
+	secret        []byte
+	mut           sync.Mutex
+	seen          map[string]time.Time
+	listeners     []chan StreamEvent
+	listenerMutex sync.Mutex
+}
+
+// NewEventSub creates a webhook receiver for subscriptions created with secret
+func NewEventSub(secret string) (*EventSub, error) {
+	if len(secret) < 10 || len(secret) > 100 {
+		return nil, fmt.Errorf("eventsub secret must be between 10 and 100 characters")
+	}
+
+	return &EventSub{
+		secret:        []byte(secret),
+		mut:           sync.Mutex{},
+		seen:          map[string]time.Time{},
+		listeners:     []chan StreamEvent{},
+		listenerMutex: sync.Mutex{},
+	}, nil
+}
+
+// SignEventSub computes the signature Twitch sends with an EventSub message
+func SignEventSub(secret, messageID, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(messageID))
+	mac.Write([]byte(timestamp))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (es *EventSub) AddListener() chan StreamEvent {
+	es.listenerMutex.Lock()
+	defer es.listenerMutex.Unlock()
+
+	listener := make(chan StreamEvent, eventSubQueue)
+	es.listeners = append(es.listeners, listener)
+
+	return listener
+}
+
+func (es *EventSub) RemoveListener(listener chan StreamEvent) {
+	es.listenerMutex.Lock()
+	defer es.listenerMutex.Unlock()
+
+	for i, l := range es.listeners {
+		if l != listener {
+			continue
+		}
+
+		es.listeners = append(es.listeners[:i], es.listeners[i+1:]...)
+	}
+}
+
+func (es *EventSub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, eventSubMaxBody))
+	if err != nil {
+		http.Error(w, "unable to read body", http.StatusBadRequest)
+		return
+	}
+
+	messageID := r.Header.Get(EventSubMessageID)
+	err = es.verify(messageID, r.Header.Get(EventSubMessageTimestamp), r.Header.Get(EventSubMessageSignature), body)
+	if err != nil {
+		log.Printf("eventsub: rejected message %s: %s", messageID, err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	var payload eventSubPayload
+	err = json.Unmarshal(body, &payload)
+	if err != nil {
+		http.Error(w, "malformed payload", http.StatusBadRequest)
+		return
+	}
+
+	messageType := r.Header.Get(EventSubMessageType)
+	var event *StreamEvent
+	if messageType == EventSubNotification {
+		event, err = parseStreamEvent(payload)
+		if err != nil {
+			log.Printf("eventsub: %s", err)
+			http.Error(w, "malformed event", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// twitch retries messages it believes were not delivered, acknowledge without
+	// handling them twice. Messages are only seen once they have been parsed, so
+	// twitch retrying one which failed to parse still has it handled.
+	if !es.markSeen(messageID) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	switch messageType {
+	case EventSubVerification:
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, payload.Challenge)
+	case EventSubRevocation:
+		log.Printf("eventsub: subscription %s (%s) revoked: %s", payload.Subscription.ID, payload.Subscription.Type, payload.Subscription.Status)
+		w.WriteHeader(http.StatusNoContent)
+	case EventSubNotification:
+		if event != nil {
+			es.emit(*event)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (es *EventSub) verify(messageID, timestamp, signature string, body []byte) error {
+	expected := SignEventSub(string(es.secret), messageID, timestamp, body)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return ErrInvalidSignature
+	}
+
+	sentAt, err := time.Parse(time.RFC3339Nano, timestamp)
+	if err != nil {
+		return fmt.Errorf("malformed timestamp %s", timestamp)
+	}
+	if time.Since(sentAt) > eventSubMaxAge {
+		return ErrExpiredMessage
+	}
+
+	return nil
+}
+
+// markSeen records a message id, returning false if it was already seen
+func (es *EventSub) markSeen(messageID string) bool {
+	es.mut.Lock()
+	defer es.mut.Unlock()
+
+	now := time.Now()
+	for id, at := range es.seen {
+		if now.Sub(at) > eventSubMaxAge {
+			delete(es.seen, id)
+		}
+	}
+
+	if _, ok := es.seen[messageID]; ok {
+		return false
+	}
+	es.seen[messageID] = now
+
+	return true
+}
+
+// parseStreamEvent reads the stream event of a notification, which is nil
+// for the subscription types the bot doesn't act on
+func parseStreamEvent(payload eventSubPayload) (*StreamEvent, error) {
+	switch payload.Subscription.Type {
+	case SubscriptionStreamOnline, SubscriptionStreamOffline:
+	default:
+		return nil, nil
+	}
+
+	var e streamEventPayload
+	err := json.Unmarshal(payload.Event, &e)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding %s event: %w", payload.Subscription.Type, err)
+	}
+
+	return &StreamEvent{
+		Type:             payload.Subscription.Type,
+		BroadcasterID:    e.BroadcasterUserID,
+		BroadcasterLogin: e.BroadcasterUserLogin,
+		BroadcasterName:  e.BroadcasterUserName,
+		StartedAt:        e.StartedAt,
+	}, nil
+}
+
+// emit shares an event with every listener without waiting on them, as twitch
+// revokes subscriptions whose webhooks are slow to respond. Events are dropped
+// for listeners which have fallen a whole queue behind, which presence
+// catches up on by polling streams.
+func (es *EventSub) emit(event StreamEvent) {
+	es.listenerMutex.Lock()
+	defer es.listenerMutex.Unlock()
+
+	for _, l := range es.listeners {
+		select {
+		case l <- event:
+		default:
+			log.Printf("eventsub: listener is full, dropping %s event of %s", event.Type, event.BroadcasterLogin)
+		}
+	}
+}
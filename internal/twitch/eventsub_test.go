@@ -0,0 +1,167 @@
+package twitch_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/twitch"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/twitch/twitchtest"
+)
+
+const secret = "a-very-secret-secret"
+
+func TestEventSub(t *testing.T) {
+	es, err := twitch.NewEventSub(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := es.AddListener()
+
+	srv := httptest.NewServer(es)
+	defer srv.Close()
+
+	fake := twitchtest.NewEventSub(secret, srv.URL)
+
+	t.Run("should respond to verification with the challenge", func(t *testing.T) {
+		res, err := fake.Send(fake.Verification(twitch.SubscriptionStreamOnline, "1234", "pogchamp-kappa-360noscope"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+
+		got, _ := io.ReadAll(res.Body)
+		if res.StatusCode != http.StatusOK || string(got) != "pogchamp-kappa-360noscope" {
+			t.Errorf("got %v %q, want %v %q", res.StatusCode, got, http.StatusOK, "pogchamp-kappa-360noscope")
+		}
+	})
+
+	t.Run("should share stream online and offline events with listeners", func(t *testing.T) {
+		for _, m := range []twitchtest.Message{fake.StreamOnline("1234", "tanjo3"), fake.StreamOffline("1234", "tanjo3")} {
+			res, err := fake.Send(m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+		}
+
+		online, offline := <-listener, <-listener
+		if !online.Online() || online.BroadcasterLogin != "tanjo3" {
+			t.Errorf("got %+v, want tanjo3 online", online)
+		}
+		if offline.Online() || offline.BroadcasterID != "1234" {
+			t.Errorf("got %+v, want 1234 offline", offline)
+		}
+	})
+
+	t.Run("should reject messages with an invalid signature", func(t *testing.T) {
+		res, err := fake.SendSigned(fake.StreamOnline("1234", "tanjo3"), "not-the-right-secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if res.StatusCode != http.StatusForbidden {
+			t.Errorf("got %v, want %v", res.StatusCode, http.StatusForbidden)
+		}
+	})
+
+	t.Run("should reject messages older than ten minutes", func(t *testing.T) {
+		stale := twitchtest.NewEventSub(secret, srv.URL)
+		stale.Now = func() time.Time {
+			return time.Now().Add(-time.Minute * 11)
+		}
+
+		res, err := stale.Send(stale.StreamOnline("1234", "tanjo3"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if res.StatusCode != http.StatusForbidden {
+			t.Errorf("got %v, want %v", res.StatusCode, http.StatusForbidden)
+		}
+	})
+
+	t.Run("should acknowledge replayed messages without handling them again", func(t *testing.T) {
+		m := fake.StreamOnline("5678", "tbpixel")
+		for i := 0; i < 2; i++ {
+			res, err := fake.Send(m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+
+			if res.StatusCode != http.StatusNoContent {
+				t.Errorf("got %v, want %v", res.StatusCode, http.StatusNoContent)
+			}
+		}
+
+		<-listener
+		select {
+		case e := <-listener:
+			t.Errorf("got replayed event %+v", e)
+		case <-time.After(time.Millisecond * 50):
+		}
+	})
+
+	t.Run("should handle retries of messages which failed to parse", func(t *testing.T) {
+		m := fake.StreamOnline("9012", "linkus7")
+		malformed := m
+		malformed.Body = []byte(`{"subscription":{"type":"stream.online"},"event":"not an event"}`)
+
+		res, err := fake.Send(malformed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("got %v, want %v", res.StatusCode, http.StatusBadRequest)
+		}
+
+		res, err = fake.Send(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		select {
+		case e := <-listener:
+			if e.BroadcasterLogin != "linkus7" {
+				t.Errorf("got %+v, want linkus7 online", e)
+			}
+		case <-time.After(time.Second):
+			t.Error("got no event, want the retry handled")
+		}
+	})
+
+	t.Run("should acknowledge notifications while listeners are behind", func(t *testing.T) {
+		busy, err := twitch.NewEventSub(secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stalled := busy.AddListener()
+
+		busySrv := httptest.NewServer(busy)
+		defer busySrv.Close()
+		sender := twitchtest.NewEventSub(secret, busySrv.URL)
+		sender.Client = &http.Client{Timeout: time.Second}
+
+		for i := 0; i < cap(stalled)+1; i++ {
+			res, err := sender.Send(sender.StreamOnline("1234", "tanjo3"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+
+			if res.StatusCode != http.StatusNoContent {
+				t.Fatalf("got %v, want %v", res.StatusCode, http.StatusNoContent)
+			}
+		}
+		if len(stalled) != cap(stalled) {
+			t.Errorf("got %v queued events, want %v", len(stalled), cap(stalled))
+		}
+	})
+}
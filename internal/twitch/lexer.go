@@ -4,7 +4,6 @@ import "github.com/TBPixel/tww-rando-twitch-bot/internal/lexer"
 
 const (
 	PLAY = iota + lexer.Keyword
-	PREFIX
 	SETTINGS
 	RACE
 	VS
@@ -15,6 +14,7 @@ const (
 	RESTREAM
 	MULTI
 	HELP
+	CONFIG
 )
 
 var Keywords = []lexer.Ident{
@@ -22,10 +22,6 @@ var Keywords = []lexer.Ident{
 		Token: PLAY,
 		Lit:   "!play",
 	},
-	{
-		Token: PREFIX,
-		Lit:   "!twwr",
-	},
 	{
 		Token: SETTINGS,
 		Lit:   "settings",
@@ -66,4 +62,8 @@ var Keywords = []lexer.Ident{
 		Token: HELP,
 		Lit:   "help",
 	},
+	{
+		Token: CONFIG,
+		Lit:   "config",
+	},
 }
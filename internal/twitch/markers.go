@@ -0,0 +1,115 @@
+package twitch
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/races"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/racetime"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/storage"
+)
+
+// ScopeManageBroadcast lets the bot create stream markers for a streamer
+const ScopeManageBroadcast = "channel:manage:broadcast"
+
+// Markers creates stream markers on the broadcasts of live followed
+// streamers when their race starts, when they finish and when the race ends
+type Markers struct {
+	api    *ApiClient
+	tokens *UserTokens
+	db     storage.Store
+}
+
+// NewMarkers creates a stream marker tracker
+func NewMarkers(api *ApiClient, tokens *UserTokens, db storage.Store) *Markers {
+	return &Markers{
+		api:    api,
+		tokens: tokens,
+		db:     db,
+	}
+}
+
+// Run marks the streams of racers whose race changed between the race lists
+// received from the listener until the context ends
+func (m *Markers) Run(ctx context.Context, listener <-chan []racetime.RaceData) {
+	races.WatchChanges(ctx, listener, m.mark)
+}
+
+func (m *Markers) mark(change races.Change) {
+	switch change.Type {
+	case races.EntrantJoined, races.EntrantLeft, races.EntrantForfeited:
+		return
+	}
+
+	description := MarkerDescription(change)
+	for _, user := range linkedStreamers(m.db, change) {
+		if !m.tokens.HasScopes(*user, ScopeManageBroadcast) {
+			continue
+		}
+
+		// twitch only marks live broadcasts
+		state, err := m.db.FindChannelState(user.ID)
+		if err != nil || !state.Live {
+			continue
+		}
+
+		token, err := m.tokens.AccessToken(user.ID)
+		if err != nil {
+			log.Printf("markers: token for %s: %s", user.TwitchName, err)
+			continue
+		}
+
+		_, err = m.api.CreateStreamMarker(token, user.TwitchID, description)
+		if err != nil {
+			log.Printf("markers: marking stream of %s: %s", user.TwitchName, err)
+			continue
+		}
+
+		log.Printf("markers: marked stream of %s: %s", user.TwitchName, description)
+	}
+}
+
+// MarkerDescription describes a race change with the race slug and preset
+func MarkerDescription(change races.Change) string {
+	race := change.Race.Slug
+	if preset := races.ExtractPreset(change.Race); preset != "" {
+		race = fmt.Sprintf("%s (%s)", race, preset)
+	}
+
+	switch change.Type {
+	case races.RaceStarted:
+		return fmt.Sprintf("race started: %s", race)
+	case races.EntrantFinished:
+		return fmt.Sprintf("finished %s: %s", change.Entrant.PlaceOrdinal, race)
+	default:
+		return fmt.Sprintf("race ended: %s", race)
+	}
+}
+
+// linkedStreamers finds the followed streamers a race change is about:
+// the entrant it carries, or else every entrant of the race
+func linkedStreamers(db storage.Store, change races.Change) []*storage.User {
+	entrants := change.Race.Entrants
+	if change.Entrant != nil {
+		entrants = []racetime.Entrant{*change.Entrant}
+	}
+
+	var users []*storage.User
+	for _, e := range entrants {
+		user, err := db.FindUser(storage.Where(storage.FieldRacetimeID).Eq(e.User.ID))
+		if err != nil {
+			if err != storage.ErrNotFound {
+				log.Println(err)
+			}
+			continue
+		}
+		if !user.ActiveInChannel {
+			continue
+		}
+
+		users = append(users, user)
+	}
+
+	return users
+}
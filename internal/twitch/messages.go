@@ -0,0 +1,159 @@
+package twitch
+
+import (
+	"fmt"
+	"sort"
+)
+
+// DefaultLocale is the language of channels which haven't chosen one,
+// and of any message missing from a channel's locale
+const DefaultLocale = "en"
+
+// messageID names a reply the bot can make in chat
+type messageID int
+
+const (
+	msgNotInRace messageID = iota
+	msgCustomCategory
+	msgPlaying
+	msgExamplePerma
+	msgNoEntrants
+	msgRacingAgainst
+	msgNoLiveEntrants
+	msgNoPerma
+	msgCommands
+	msgConfigUsage
+	msgConfigUnknown
+	msgConfigValue
+	msgConfigSet
+	msgConfigInvalid
+	msgAnnounceStart
+	msgAnnounceFinish
+	msgAnnounceResults
+)
+
+// catalog holds the bot's replies in each supported locale
+var catalog = map[string]map[messageID]string{
+	"en": {
+		msgNotInRace:       "%s is not currently in a race",
+		msgCustomCategory:  "%s is playing a custom race category",
+		msgPlaying:         "%s is playing %s (%s settings)",
+		msgExamplePerma:    "example permalink: %s",
+		msgNoEntrants:      "There are currently no other entrants in race with %s",
+		msgRacingAgainst:   "%s is currently racing against: %s",
+		msgNoLiveEntrants:  "There are currently no other live entrants in race with %s",
+		msgNoPerma:         "Permalink has not yet been generated or cannot be found",
+		msgCommands:        "commands: %s",
+		msgConfigUsage:     "usage: %s config get [setting] or %s config set <setting> <value>",
+		msgConfigUnknown:   "unknown setting %s, settings are: %s",
+		msgConfigValue:     "%s: %s",
+		msgConfigSet:       "%s set to %s",
+		msgConfigInvalid:   "could not set %s: %s",
+		msgAnnounceStart:   "%s's race has started! %s",
+		msgAnnounceFinish:  "%s finished %s in %s!",
+		msgAnnounceResults: "results of %s: %s",
+	},
+	"es": {
+		msgNotInRace:       "%s no está en una carrera",
+		msgCustomCategory:  "%s está jugando una categoría de carrera personalizada",
+		msgPlaying:         "%s está jugando %s (%s settings)",
+		msgExamplePerma:    "permalink de ejemplo: %s",
+		msgNoEntrants:      "No hay otros participantes en la carrera con %s",
+		msgRacingAgainst:   "%s está compitiendo contra: %s",
+		msgNoLiveEntrants:  "No hay otros participantes en directo en la carrera con %s",
+		msgNoPerma:         "El permalink aún no se ha generado o no se encuentra",
+		msgCommands:        "comandos: %s",
+		msgConfigUsage:     "uso: %s config get [ajuste] o %s config set <ajuste> <valor>",
+		msgConfigUnknown:   "ajuste desconocido %s, los ajustes son: %s",
+		msgConfigValue:     "%s: %s",
+		msgConfigSet:       "%s cambiado a %s",
+		msgConfigInvalid:   "no se pudo cambiar %s: %s",
+		msgAnnounceStart:   "¡La carrera de %s ha empezado! %s",
+		msgAnnounceFinish:  "¡%s terminó en %s lugar con %s!",
+		msgAnnounceResults: "resultados de %s: %s",
+	},
+	"fr": {
+		msgNotInRace:       "%s n'est pas en course",
+		msgCustomCategory:  "%s joue une catégorie de course personnalisée",
+		msgPlaying:         "%s joue %s (%s settings)",
+		msgExamplePerma:    "permalink d'exemple : %s",
+		msgNoEntrants:      "Aucun autre participant dans la course avec %s",
+		msgRacingAgainst:   "%s est en course contre : %s",
+		msgNoLiveEntrants:  "Aucun autre participant en live dans la course avec %s",
+		msgNoPerma:         "Le permalink n'a pas encore été généré ou est introuvable",
+		msgCommands:        "commandes : %s",
+		msgConfigUsage:     "utilisation : %s config get [réglage] ou %s config set <réglage> <valeur>",
+		msgConfigUnknown:   "réglage inconnu %s, les réglages sont : %s",
+		msgConfigValue:     "%s : %s",
+		msgConfigSet:       "%s réglé sur %s",
+		msgConfigInvalid:   "impossible de régler %s : %s",
+		msgAnnounceStart:   "La course de %s a commencé ! %s",
+		msgAnnounceFinish:  "%s a terminé %s en %s !",
+		msgAnnounceResults: "résultats de %s : %s",
+	},
+	"de": {
+		msgNotInRace:       "%s ist gerade in keinem Rennen",
+		msgCustomCategory:  "%s spielt eine eigene Rennkategorie",
+		msgPlaying:         "%s spielt %s (%s settings)",
+		msgExamplePerma:    "Beispiel-Permalink: %s",
+		msgNoEntrants:      "Es gibt keine anderen Teilnehmer im Rennen mit %s",
+		msgRacingAgainst:   "%s tritt gerade an gegen: %s",
+		msgNoLiveEntrants:  "Es gibt keine anderen live Teilnehmer im Rennen mit %s",
+		msgNoPerma:         "Der Permalink wurde noch nicht erstellt oder kann nicht gefunden werden",
+		msgCommands:        "Befehle: %s",
+		msgConfigUsage:     "Verwendung: %s config get [Einstellung] oder %s config set <Einstellung> <Wert>",
+		msgConfigUnknown:   "unbekannte Einstellung %s, Einstellungen sind: %s",
+		msgConfigValue:     "%s: %s",
+		msgConfigSet:       "%s auf %s gesetzt",
+		msgConfigInvalid:   "%s konnte nicht gesetzt werden: %s",
+		msgAnnounceStart:   "Das Rennen von %s hat begonnen! %s",
+		msgAnnounceFinish:  "%s ist %s in %s ins Ziel gekommen!",
+		msgAnnounceResults: "Ergebnisse von %s: %s",
+	},
+	"pt": {
+		msgNotInRace:       "%s não está em uma corrida",
+		msgCustomCategory:  "%s está jogando uma categoria de corrida personalizada",
+		msgPlaying:         "%s está jogando %s (%s settings)",
+		msgExamplePerma:    "permalink de exemplo: %s",
+		msgNoEntrants:      "Não há outros participantes na corrida com %s",
+		msgRacingAgainst:   "%s está correndo contra: %s",
+		msgNoLiveEntrants:  "Não há outros participantes ao vivo na corrida com %s",
+		msgNoPerma:         "O permalink ainda não foi gerado ou não foi encontrado",
+		msgCommands:        "comandos: %s",
+		msgConfigUsage:     "uso: %s config get [ajuste] ou %s config set <ajuste> <valor>",
+		msgConfigUnknown:   "ajuste desconhecido %s, os ajustes são: %s",
+		msgConfigValue:     "%s: %s",
+		msgConfigSet:       "%s alterado para %s",
+		msgConfigInvalid:   "não foi possível alterar %s: %s",
+		msgAnnounceStart:   "A corrida de %s começou! %s",
+		msgAnnounceFinish:  "%s terminou em %s lugar com %s!",
+		msgAnnounceResults: "resultados de %s: %s",
+	},
+}
+
+// Locales lists the supported locales
+func Locales() []string {
+	var locales []string
+	for l := range catalog {
+		locales = append(locales, l)
+	}
+	sort.Strings(locales)
+
+	return locales
+}
+
+// ValidLocale reports whether the bot can reply in a locale
+func ValidLocale(locale string) bool {
+	_, ok := catalog[locale]
+	return ok
+}
+
+// localize formats a reply in a channel's locale
+func localize(locale string, id messageID, args ...interface{}) string {
+	format, ok := catalog[locale][id]
+	if !ok {
+		format = catalog[DefaultLocale][id]
+	}
+
+	return fmt.Sprintf(format, args...)
+}
@@ -0,0 +1,110 @@
+package twitch
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/racetime"
+)
+
+// Multistream providers a channel can choose for !twwr multi
+const (
+	MultiTwitch   = "multitwitch"
+	Kadgar        = "kadgar"
+	TwitchTheater = "twitchtheater"
+)
+
+// multistreamURLs maps each provider to the base of its links
+var multistreamURLs = map[string]string{
+	MultiTwitch:   MultiTwitchURL,
+	Kadgar:        "https://kadgar.net/live",
+	TwitchTheater: "https://twitchtheater.tv",
+}
+
+// MultistreamProviders lists the supported providers
+func MultistreamProviders() []string {
+	var providers []string
+	for p := range multistreamURLs {
+		providers = append(providers, p)
+	}
+	sort.Strings(providers)
+
+	return providers
+}
+
+// ValidMultistreamProvider reports whether a provider is supported
+func ValidMultistreamProvider(provider string) bool {
+	_, ok := multistreamURLs[provider]
+	return ok
+}
+
+// MultistreamOptions controls which racers a multistream link includes
+type MultistreamOptions struct {
+	Provider string
+	// Live holds the lowercased logins of racers twitch reports as live.
+	// When nil, racetime's stream_live flag is used instead.
+	Live map[string]bool
+	// HideFinished leaves out racers who have finished, forfeited or been disqualified
+	HideFinished bool
+}
+
+// MultistreamURL builds a link to watch the entrants' streams, ordered by place
+func MultistreamURL(entrants []racetime.Entrant, opts MultistreamOptions) (string, bool) {
+	var racers []racetime.Entrant
+	for _, e := range entrants {
+		// skip users without a twitch account or who are not streaming to it
+		if e.User.TwitchName == "" || e.StreamOverride {
+			continue
+		}
+
+		live := e.StreamLive
+		if opts.Live != nil {
+			live = opts.Live[strings.ToLower(e.User.TwitchName)]
+		}
+		if !live {
+			continue
+		}
+
+		if opts.HideFinished && finished(e) {
+			continue
+		}
+
+		racers = append(racers, e)
+	}
+
+	if len(racers) == 0 {
+		return "", false
+	}
+
+	// placed racers first in order of place, everyone else as racetime lists them
+	sort.SliceStable(racers, func(i, j int) bool {
+		a, b := racers[i].Place, racers[j].Place
+		if a == 0 || b == 0 {
+			return a != 0 && b == 0
+		}
+
+		return a < b
+	})
+
+	var names []string
+	for _, r := range racers {
+		names = append(names, r.User.TwitchName)
+	}
+
+	base, ok := multistreamURLs[opts.Provider]
+	if !ok {
+		base = MultiTwitchURL
+	}
+
+	return fmt.Sprintf("%s/%s", base, strings.Join(names, "/")), true
+}
+
+func finished(e racetime.Entrant) bool {
+	switch e.Status.Value {
+	case racetime.EntrantDone, racetime.EntrantForfeit, racetime.EntrantDisqualified:
+		return true
+	}
+
+	return false
+}
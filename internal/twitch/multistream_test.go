@@ -0,0 +1,65 @@
+package twitch_test
+
+import (
+	"testing"
+
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/racetime"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/twitch"
+)
+
+func entrant(name string, live bool, place int, status string) racetime.Entrant {
+	e := racetime.Entrant{
+		StreamLive: live,
+		Place:      place,
+	}
+	e.User.TwitchName = name
+	e.Status.Value = status
+
+	return e
+}
+
+func TestMultistreamURL(t *testing.T) {
+	entrants := []racetime.Entrant{
+		entrant("offline", false, 0, "in_progress"),
+		entrant("racing", true, 0, "in_progress"),
+		entrant("second", true, 2, "done"),
+		entrant("first", true, 1, "done"),
+		entrant("", true, 0, "in_progress"),
+	}
+
+	t.Run("should include only live racers ordered by place", func(t *testing.T) {
+		got, ok := twitch.MultistreamURL(entrants, twitch.MultistreamOptions{})
+		want := "https://multitwitch.tv/first/second/racing"
+		if !ok || got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("should prefer twitch's view of who is live", func(t *testing.T) {
+		got, _ := twitch.MultistreamURL(entrants, twitch.MultistreamOptions{
+			Live: map[string]bool{"offline": true, "racing": true},
+		})
+		want := "https://multitwitch.tv/offline/racing"
+		if got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("should leave out finished racers and link to the chosen provider", func(t *testing.T) {
+		got, _ := twitch.MultistreamURL(entrants, twitch.MultistreamOptions{
+			Provider:     twitch.Kadgar,
+			HideFinished: true,
+		})
+		want := "https://kadgar.net/live/racing"
+		if got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("should report when nobody is live", func(t *testing.T) {
+		_, ok := twitch.MultistreamURL(entrants[:1], twitch.MultistreamOptions{})
+		if ok {
+			t.Errorf("got %v, want %v", ok, false)
+		}
+	})
+}
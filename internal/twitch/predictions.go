@@ -0,0 +1,214 @@
+package twitch
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/config"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/races"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/racetime"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/storage"
+)
+
+const (
+	// ScopeManagePredictions lets the bot run predictions for a streamer
+	ScopeManagePredictions = "channel:manage:predictions"
+	// DefaultPredictionTopN is the place streamers are predicted to finish within
+	DefaultPredictionTopN = 3
+)
+
+// Predictions opens a channel prediction for opted in streamers when their race
+// starts, resolving it once they finish or cancelling it if they can't
+type Predictions struct {
+	api    *ApiClient
+	tokens *UserTokens
+	db     storage.Store
+	window time.Duration
+}
+
+// NewPredictions creates a prediction tracker
+func NewPredictions(conf config.Twitch, api *ApiClient, tokens *UserTokens, db storage.Store) *Predictions {
+	return &Predictions{
+		api:    api,
+		tokens: tokens,
+		db:     db,
+		window: conf.PredictionWindow,
+	}
+}
+
+// Run opens and ends predictions as races change between the race lists
+// received from the listener until the context ends
+func (p *Predictions) Run(ctx context.Context, listener <-chan []racetime.RaceData) {
+	races.WatchChanges(ctx, listener, p.handle)
+}
+
+func (p *Predictions) handle(change races.Change) {
+	switch change.Type {
+	case races.RaceStarted:
+		for _, user := range linkedStreamers(p.db, change) {
+			p.open(*user, change.Race)
+		}
+	case races.EntrantFinished:
+		for _, user := range linkedStreamers(p.db, change) {
+			p.resolve(*user, change.Race, *change.Entrant)
+		}
+	// whatever is still open when the race ends can no longer be decided
+	case races.EntrantForfeited, races.RaceEnded:
+		for _, user := range linkedStreamers(p.db, change) {
+			p.cancel(*user, change.Race)
+		}
+	}
+}
+
+func (p *Predictions) open(user storage.User, race racetime.RaceData) {
+	if !user.Predictions || !p.tokens.HasScopes(user, ScopeManagePredictions) {
+		return
+	}
+
+	token, err := p.tokens.AccessToken(user.ID)
+	if err != nil {
+		log.Printf("predictions: token for %s: %s", user.TwitchName, err)
+		return
+	}
+
+	title := PredictionTitle(user)
+	prediction, err := p.api.CreatePrediction(token, user.TwitchID, title, []string{"Yes", "No"}, p.window)
+	if err != nil {
+		log.Printf("predictions: opening prediction for %s: %s", user.TwitchName, err)
+		return
+	}
+	if len(prediction.Outcomes) != 2 {
+		log.Printf("predictions: prediction %s for %s has %d outcomes", prediction.ID, user.TwitchName, len(prediction.Outcomes))
+		return
+	}
+	log.Printf("predictions: opened %q for %s", title, user.TwitchName)
+
+	_, err = p.db.SavePrediction(storage.Prediction{
+		ID:           prediction.ID,
+		UserID:       user.ID,
+		RaceSlug:     race.Slug,
+		Title:        title,
+		YesOutcomeID: prediction.Outcomes[0].ID,
+		NoOutcomeID:  prediction.Outcomes[1].ID,
+		Status:       storage.PredictionActive,
+		CreatedAt:    time.Now(),
+	})
+	if err != nil {
+		log.Printf("predictions: %s", err)
+	}
+}
+
+func (p *Predictions) resolve(user storage.User, race racetime.RaceData, entrant racetime.Entrant) {
+	prediction, err := p.db.FindActivePrediction(user.ID, race.Slug)
+	if err != nil {
+		if err != storage.ErrNotFound {
+			log.Printf("predictions: %s", err)
+		}
+		return
+	}
+
+	finishTime, err := racetime.ParseDuration(entrant.FinishTime)
+	if err != nil && user.PredictionTarget > 0 {
+		log.Printf("predictions: finish time of %s: %s", user.TwitchName, err)
+		p.cancel(user, race)
+		return
+	}
+
+	won := PredictionWon(user, entrant.Place, finishTime)
+	winner := prediction.NoOutcomeID
+	if won {
+		winner = prediction.YesOutcomeID
+	}
+
+	token, err := p.tokens.AccessToken(user.ID)
+	if err != nil {
+		log.Printf("predictions: token for %s: %s", user.TwitchName, err)
+		return
+	}
+
+	_, err = p.api.EndPrediction(token, user.TwitchID, prediction.ID, winner)
+	if err != nil {
+		log.Printf("predictions: resolving prediction for %s: %s", user.TwitchName, err)
+		return
+	}
+	log.Printf("predictions: resolved %q for %s, won: %v", prediction.Title, user.TwitchName, won)
+
+	prediction.Status = storage.PredictionResolved
+	prediction.Won = won
+	prediction.Place = entrant.Place
+	prediction.FinishTime = finishTime
+	prediction.EndedAt = time.Now()
+	_, err = p.db.SavePrediction(*prediction)
+	if err != nil {
+		log.Printf("predictions: %s", err)
+	}
+}
+
+func (p *Predictions) cancel(user storage.User, race racetime.RaceData) {
+	prediction, err := p.db.FindActivePrediction(user.ID, race.Slug)
+	if err != nil {
+		if err != storage.ErrNotFound {
+			log.Printf("predictions: %s", err)
+		}
+		return
+	}
+
+	token, err := p.tokens.AccessToken(user.ID)
+	if err != nil {
+		log.Printf("predictions: token for %s: %s", user.TwitchName, err)
+		return
+	}
+
+	_, err = p.api.EndPrediction(token, user.TwitchID, prediction.ID, "")
+	if err != nil {
+		log.Printf("predictions: cancelling prediction for %s: %s", user.TwitchName, err)
+		return
+	}
+	log.Printf("predictions: cancelled %q for %s", prediction.Title, user.TwitchName)
+
+	prediction.Status = storage.PredictionCanceled
+	prediction.EndedAt = time.Now()
+	_, err = p.db.SavePrediction(*prediction)
+	if err != nil {
+		log.Printf("predictions: %s", err)
+	}
+}
+
+// PredictionTitle asks whether the streamer beats their target time when
+// they have one, or finishes in the top places otherwise
+func PredictionTitle(user storage.User) string {
+	if user.PredictionTarget > 0 {
+		return fmt.Sprintf("Will %s beat %s?", user.TwitchDisplayName, formatDuration(user.PredictionTarget))
+	}
+
+	return fmt.Sprintf("Will %s finish top %d?", user.TwitchDisplayName, predictionTopN(user))
+}
+
+// PredictionWon decides a prediction from where and when the streamer finished
+func PredictionWon(user storage.User, place int, finishTime time.Duration) bool {
+	if user.PredictionTarget > 0 {
+		return finishTime <= user.PredictionTarget
+	}
+
+	return place > 0 && place <= predictionTopN(user)
+}
+
+func predictionTopN(user storage.User) int {
+	if user.PredictionTopN <= 0 {
+		return DefaultPredictionTopN
+	}
+
+	return user.PredictionTopN
+}
+
+// formatDuration writes a duration the way racers read times, such as 1:23:45
+func formatDuration(d time.Duration) string {
+	d = d.Round(time.Second)
+	h := d / time.Hour
+	m := (d % time.Hour) / time.Minute
+	s := (d % time.Minute) / time.Second
+
+	return fmt.Sprintf("%d:%02d:%02d", h, m, s)
+}
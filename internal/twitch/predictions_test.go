@@ -0,0 +1,62 @@
+package twitch_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/storage"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/twitch"
+)
+
+func TestPredictions(t *testing.T) {
+	top := storage.User{TwitchDisplayName: "Tanjo3"}
+	timed := storage.User{TwitchDisplayName: "Tanjo3", PredictionTarget: time.Hour + time.Minute*30}
+
+	t.Run("should ask about the streamer's place or target time", func(t *testing.T) {
+		if got, want := twitch.PredictionTitle(top), "Will Tanjo3 finish top 3?"; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		if got, want := twitch.PredictionTitle(timed), "Will Tanjo3 beat 1:30:00?"; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("should decide from place or finish time", func(t *testing.T) {
+		cases := []struct {
+			user  storage.User
+			place int
+			time  time.Duration
+			want  bool
+		}{
+			{top, 3, time.Hour * 2, true},
+			{top, 4, time.Hour, false},
+			{timed, 9, time.Hour + time.Minute*29, true},
+			{timed, 1, time.Hour + time.Minute*31, false},
+		}
+
+		for _, c := range cases {
+			got := twitch.PredictionWon(c.user, c.place, c.time)
+			if got != c.want {
+				t.Errorf("got %v for place %v in %v, want %v", got, c.place, c.time, c.want)
+			}
+		}
+	})
+
+	t.Run("should find the active prediction of a race", func(t *testing.T) {
+		db := openDB(t)
+		for _, p := range []storage.Prediction{
+			{ID: "a", UserID: 1, RaceSlug: "clever-link-1234", Status: storage.PredictionCanceled},
+			{ID: "b", UserID: 1, RaceSlug: "clever-link-1234", Status: storage.PredictionActive},
+		} {
+			_, err := db.SavePrediction(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		got, err := db.FindActivePrediction(1, "clever-link-1234")
+		if err != nil || got.ID != "b" {
+			t.Errorf("got %+v %v, want prediction b", got, err)
+		}
+	})
+}
@@ -0,0 +1,264 @@
+package twitch
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/config"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/storage"
+)
+
+// Chats joins and parts twitch chats
+type Chats interface {
+	Join(channels ...string)
+	Part(channels ...string)
+}
+
+// Presence joins the chat of followed channels when they go live and
+// parts it once they have been offline for the grace period
+type Presence struct {
+	chats         Chats
+	client        *ApiClient
+	db            storage.Store
+	grace         time.Duration
+	pollInterval  time.Duration
+	checkInterval time.Duration
+}
+
+// NewPresence creates a presence tracker joining and parting chats, usually the bot's
+func NewPresence(conf config.Twitch, chats Chats, client *ApiClient, db storage.Store) *Presence {
+	return &Presence{
+		chats:         chats,
+		client:        client,
+		db:            db,
+		grace:         conf.LiveGracePeriod,
+		pollInterval:  conf.LivePollInterval,
+		checkInterval: conf.LiveCheckInterval,
+	}
+}
+
+// Run tracks the live state of followed channels until the context ends.
+// Streams are polled to learn the initial state, after which live state
+// comes from events when they are given. Polling carries on regardless, to
+// catch up on events which were dropped or never subscribed to.
+func (p *Presence) Run(ctx context.Context, events <-chan StreamEvent) {
+	err := p.reset()
+	if err != nil {
+		log.Println(err)
+	}
+	p.poll()
+
+	poll := time.NewTicker(p.pollInterval)
+	defer poll.Stop()
+
+	check := time.NewTicker(p.checkInterval)
+	defer check.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-events:
+			p.event(e)
+		case <-poll.C:
+			p.poll()
+		case <-check.C:
+			p.check()
+		}
+	}
+}
+
+// reset marks every channel as parted, as the bot starts outside of every chat
+func (p *Presence) reset() error {
+	states, err := p.db.FindChannelStates()
+	if err != nil {
+		return err
+	}
+
+	for _, s := range states {
+		s.Joined = false
+		_, err = p.db.SaveChannelState(*s)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *Presence) poll() {
+	users, err := p.db.FindUsers(storage.ActiveChannels())
+	if err != nil {
+		log.Printf("presence: %s", err)
+		return
+	}
+	if len(users) == 0 {
+		return
+	}
+
+	var ids []string
+	for _, u := range users {
+		ids = append(ids, u.TwitchID)
+	}
+
+	streams, err := p.client.GetStreams(ids)
+	if err != nil {
+		log.Printf("presence: %s", err)
+		return
+	}
+
+	live := map[string]Stream{}
+	for _, s := range streams {
+		live[s.UserID] = s
+	}
+
+	for _, u := range users {
+		s, ok := live[u.TwitchID]
+		p.update(*u, ok, s.StartedAt)
+	}
+
+	p.partUnfollowed(users)
+	p.partExpired()
+}
+
+// check parts channels no longer followed or offline past the grace period
+// more often than streams are polled
+func (p *Presence) check() {
+	users, err := p.db.FindUsers(storage.ActiveChannels())
+	if err != nil {
+		log.Printf("presence: %s", err)
+		return
+	}
+
+	p.partUnfollowed(users)
+	p.partExpired()
+}
+
+func (p *Presence) event(e StreamEvent) {
+	user, err := p.db.FindUser(storage.Where(storage.FieldTwitchID).Eq(e.BroadcasterID))
+	if err != nil {
+		if err != storage.ErrNotFound {
+			log.Printf("presence: %s", err)
+		}
+		return
+	}
+	if !user.ActiveInChannel {
+		return
+	}
+
+	startedAt := e.StartedAt
+	if startedAt.IsZero() {
+		startedAt = time.Now()
+	}
+	p.update(*user, e.Online(), startedAt)
+	p.partExpired()
+}
+
+// update records a channel's live state, joining its chat when it goes live
+func (p *Presence) update(user storage.User, live bool, startedAt time.Time) {
+	state, err := p.db.FindChannelState(user.ID)
+	if err != nil {
+		if err != storage.ErrNotFound {
+			log.Printf("presence: %s", err)
+			return
+		}
+
+		state = &storage.ChannelState{
+			UserID:   user.ID,
+			TwitchID: user.TwitchID,
+		}
+	}
+
+	if live == state.Live && (!live || state.Joined) {
+		return
+	}
+
+	if live {
+		if !state.Live {
+			state.LiveSince = startedAt
+			log.Printf("presence: %s went live", user.TwitchName)
+		}
+		if !state.Joined {
+			p.chats.Join(user.TwitchName)
+			state.Joined = true
+			log.Printf("presence: joined chat of %s", user.TwitchName)
+		}
+	} else {
+		state.OfflineSince = time.Now()
+		log.Printf("presence: %s went offline", user.TwitchName)
+	}
+	state.Live = live
+
+	_, err = p.db.SaveChannelState(*state)
+	if err != nil {
+		log.Printf("presence: %s", err)
+	}
+}
+
+// partExpired leaves the chat of channels offline for longer than the grace period
+func (p *Presence) partExpired() {
+	states, err := p.db.FindChannelStates()
+	if err != nil {
+		log.Printf("presence: %s", err)
+		return
+	}
+
+	for _, s := range states {
+		if !s.Joined || s.Live || time.Since(s.OfflineSince) < p.grace {
+			continue
+		}
+
+		p.part(*s)
+	}
+}
+
+// partUnfollowed leaves the chat of channels which are no longer followed
+func (p *Presence) partUnfollowed(followed []*storage.User) {
+	states, err := p.db.FindChannelStates()
+	if err != nil {
+		log.Printf("presence: %s", err)
+		return
+	}
+
+	active := map[uint64]bool{}
+	for _, u := range followed {
+		active[u.ID] = true
+	}
+
+	for _, s := range states {
+		if !s.Joined || active[s.UserID] {
+			continue
+		}
+
+		p.part(*s)
+	}
+}
+
+func (p *Presence) part(state storage.ChannelState) {
+	user, err := p.db.FindUser(storage.Where(storage.FieldID).Eq(state.UserID))
+	if err != nil {
+		if err != storage.ErrNotFound {
+			log.Printf("presence: %s", err)
+			return
+		}
+
+		// the user was deleted, so there is no chat left to part and the channel is forgotten
+		log.Printf("presence: forgetting channel of deleted user %d", state.UserID)
+		state.Joined = false
+		_, err = p.db.SaveChannelState(state)
+		if err != nil {
+			log.Printf("presence: %s", err)
+		}
+		return
+	}
+
+	p.chats.Part(user.TwitchName)
+	state.Joined = false
+	log.Printf("presence: parted chat of %s", user.TwitchName)
+
+	_, err = p.db.SaveChannelState(state)
+	if err != nil {
+		log.Printf("presence: %s", err)
+	}
+}
@@ -0,0 +1,175 @@
+package twitch_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/config"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/storage"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/twitch"
+)
+
+type fakeChats struct {
+	mut    sync.Mutex
+	joined []string
+	parted []string
+}
+
+func (c *fakeChats) Join(channels ...string) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.joined = append(c.joined, channels...)
+}
+
+func (c *fakeChats) Part(channels ...string) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.parted = append(c.parted, channels...)
+}
+
+// wait waits for the chats to have been joined and parted at least as often as given
+func (c *fakeChats) wait(joined, parted int) (int, int) {
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		c.mut.Lock()
+		j, p := len(c.joined), len(c.parted)
+		c.mut.Unlock()
+		if (j >= joined && p >= parted) || time.Now().After(deadline) {
+			return j, p
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+}
+
+func TestPresence(t *testing.T) {
+	tests := []struct {
+		name     string
+		live     bool
+		goesLive bool
+		event    string
+		unfollow bool
+		delete   bool
+		joined   int
+		parted   int
+	}{
+		{name: "should join channels live when it starts", live: true, joined: 1},
+		{name: "should join channels going live", event: twitch.SubscriptionStreamOnline, joined: 1},
+		{name: "should join channels going live without an event by polling", goesLive: true, joined: 1},
+		{name: "should part channels offline past the grace period", live: true, event: twitch.SubscriptionStreamOffline, joined: 1, parted: 1},
+		{name: "should part channels no longer followed", live: true, unfollow: true, joined: 1, parted: 1},
+		{name: "should forget channels of deleted users", live: true, delete: true, joined: 1},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			var mut sync.Mutex
+			live := tt.live
+			polled := make(chan struct{}, 100)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/token":
+					json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "app", "expires_in": 3600})
+				case "/helix/streams":
+					mut.Lock()
+					streams := []twitch.Stream{}
+					if live {
+						streams = append(streams, twitch.Stream{UserID: "1234", UserLogin: "tanjo3", StartedAt: time.Now()})
+					}
+					mut.Unlock()
+					json.NewEncoder(w).Encode(map[string]interface{}{"data": streams})
+
+					select {
+					case polled <- struct{}{}:
+					default:
+					}
+				}
+			}))
+			defer srv.Close()
+
+			conf := config.Twitch{
+				APIURL:            srv.URL + "/helix",
+				TokenURL:          srv.URL + "/token",
+				LiveGracePeriod:   time.Millisecond * 10,
+				LivePollInterval:  time.Hour,
+				LiveCheckInterval: time.Millisecond * 10,
+			}
+			if tt.goesLive {
+				conf.LivePollInterval = time.Millisecond * 10
+			}
+			api, err := twitch.NewApiClient(conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			db := openDB(t)
+			user, err := db.CreateUser("1234", "tanjo3", "Tanjo3", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			active := true
+			racetimeID := "racetime"
+			_, err = db.UpdateUser(user.ID, storage.UserUpdate{ActiveInChannel: &active, RacetimeID: &racetimeID})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			chats := &fakeChats{}
+			events := make(chan twitch.StreamEvent)
+			go twitch.NewPresence(conf, chats, api, db).Run(ctx, events)
+
+			if tt.live {
+				chats.wait(1, 0)
+			}
+			if tt.goesLive {
+				// the stream only goes live once it has been seen offline
+				<-polled
+				mut.Lock()
+				live = true
+				mut.Unlock()
+			}
+			if tt.event != "" {
+				events <- twitch.StreamEvent{Type: tt.event, BroadcasterID: "1234", BroadcasterLogin: "tanjo3"}
+			}
+			if tt.unfollow {
+				active = false
+				_, err = db.UpdateUser(user.ID, storage.UserUpdate{ActiveInChannel: &active})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.delete {
+				err = db.DeleteUser(user.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				deadline := time.Now().Add(time.Second * 5)
+				for {
+					state, err := db.FindChannelState(user.ID)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if !state.Joined {
+						break
+					}
+					if time.Now().After(deadline) {
+						t.Fatal("got the channel still joined, want it forgotten")
+					}
+					time.Sleep(time.Millisecond * 5)
+				}
+			}
+
+			joined, parted := chats.wait(tt.joined, tt.parted)
+			if joined != tt.joined || parted != tt.parted {
+				t.Errorf("got %v joins and %v parts, want %v and %v", joined, parted, tt.joined, tt.parted)
+			}
+		})
+	}
+}
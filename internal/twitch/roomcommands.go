@@ -0,0 +1,43 @@
+package twitch
+
+import (
+	"log"
+	"strings"
+
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/races"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/racetime"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/storage"
+)
+
+// RoomCommands resolves commands in race rooms with the prefixes and
+// aliases the followed entrants use in their twitch chat, along with the
+// default prefix. When entrants give the same alias to different commands,
+// the entrant racetime lists first wins.
+type RoomCommands struct {
+	db storage.Store
+}
+
+// NewRoomCommands creates a race room command resolver
+func NewRoomCommands(db storage.Store) *RoomCommands {
+	return &RoomCommands{
+		db: db,
+	}
+}
+
+// ResolveCommand finds the command a race room chat message runs
+func (c *RoomCommands) ResolveCommand(race racetime.RaceData, message string) (string, bool) {
+	for _, user := range linkedStreamers(c.db, races.Change{Race: race}) {
+		settings, err := ChannelSettingsFor(c.db, *user)
+		if err != nil {
+			log.Printf("room commands: settings of %s: %s", user.TwitchName, err)
+			continue
+		}
+
+		words, ok := ParseCommand(settings, message)
+		if ok && len(words) > 0 {
+			return strings.Join(words, " "), true
+		}
+	}
+
+	return racetime.DefaultCommand(message)
+}
@@ -0,0 +1,412 @@
+package twitch
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/racetime"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/storage"
+)
+
+// DefaultPrefix starts chat commands in channels which haven't chosen their own
+const DefaultPrefix = racetime.DefaultPrefix
+
+// reservedCommands are chat commands a prefix or alias must not take over
+var reservedCommands = map[string]bool{
+	"!play": true,
+}
+
+// MaxCommandCooldown bounds how long a channel can make its commands wait
+const MaxCommandCooldown = time.Minute * 10
+
+// Commands lists the chat commands a channel can enable. config is left out
+// as mods must always be able to change the channel's settings.
+var Commands = []string{
+	"settings",
+	"race",
+	"vs",
+	"link",
+	"exampleperma",
+	"perma",
+	"multi",
+	"help",
+}
+
+// DefaultChannelSettings are the settings of a channel which hasn't saved any
+func DefaultChannelSettings(user storage.User) storage.ChannelSettings {
+	return storage.ChannelSettings{
+		UserID:  user.ID,
+		Prefix:  DefaultPrefix,
+		Locale:  DefaultLocale,
+		Marbles: true,
+	}
+}
+
+// ChannelSettingsFor looks up the settings of a user's channel, falling back to the defaults
+func ChannelSettingsFor(db storage.Store, user storage.User) (storage.ChannelSettings, error) {
+	settings, err := db.FindChannelSettings(user.ID)
+	if err != nil {
+		if err == storage.ErrNotFound {
+			return DefaultChannelSettings(user), nil
+		}
+
+		return storage.ChannelSettings{}, err
+	}
+
+	return *settings, nil
+}
+
+// CommandEnabled reports whether a channel answers a chat command
+func CommandEnabled(settings storage.ChannelSettings, command string) bool {
+	if len(settings.Commands) == 0 {
+		return true
+	}
+
+	for _, c := range settings.Commands {
+		if c == command {
+			return true
+		}
+	}
+
+	return false
+}
+
+// EnabledCommands lists the chat commands a channel answers
+func EnabledCommands(settings storage.ChannelSettings) []string {
+	var commands []string
+	for _, c := range Commands {
+		if CommandEnabled(settings, c) {
+			commands = append(commands, c)
+		}
+	}
+
+	return commands
+}
+
+// Setting is a channel setting as mods see it in chat, validated whenever it is set
+type Setting struct {
+	Key         string
+	Description string
+	get         func(settings storage.ChannelSettings) string
+	set         func(settings *storage.ChannelSettings, value string) error
+}
+
+// Get formats the setting's value
+func (s Setting) Get(settings storage.ChannelSettings) string {
+	return s.get(settings)
+}
+
+// Set validates a value before setting it
+func (s Setting) Set(settings *storage.ChannelSettings, value string) error {
+	return s.set(settings, strings.TrimSpace(value))
+}
+
+// Settings is the schema of every channel setting
+var Settings = []Setting{
+	{
+		Key:         "commands",
+		Description: fmt.Sprintf("enabled commands, all or some of %s", strings.Join(Commands, ", ")),
+		get: func(settings storage.ChannelSettings) string {
+			if len(settings.Commands) == 0 {
+				return "all"
+			}
+
+			return strings.Join(settings.Commands, ",")
+		},
+		set: func(settings *storage.ChannelSettings, value string) error {
+			if strings.EqualFold(value, "all") {
+				settings.Commands = nil
+				return nil
+			}
+
+			commands, err := parseCommands(value)
+			if err != nil {
+				return err
+			}
+			settings.Commands = commands
+
+			return nil
+		},
+	},
+	{
+		Key:         "prefix",
+		Description: "what starts every command, such as !twwr",
+		get: func(settings storage.ChannelSettings) string {
+			return settings.Prefix
+		},
+		set: func(settings *storage.ChannelSettings, value string) error {
+			value = strings.ToLower(value)
+			err := validTrigger("prefix", value)
+			if err != nil {
+				return err
+			}
+			if command, ok := settings.Aliases[value]; ok {
+				return fmt.Errorf("prefix %s is already an alias of %s", value, command)
+			}
+			settings.Prefix = value
+
+			return nil
+		},
+	},
+	{
+		Key:         "aliases",
+		Description: "commands which run a command without the prefix, such as !perma=perma !race=race, or none",
+		get: func(settings storage.ChannelSettings) string {
+			if len(settings.Aliases) == 0 {
+				return "none"
+			}
+
+			var pairs []string
+			for alias, command := range settings.Aliases {
+				pairs = append(pairs, fmt.Sprintf("%s=%s", alias, command))
+			}
+			sort.Strings(pairs)
+
+			return strings.Join(pairs, " ")
+		},
+		set: func(settings *storage.ChannelSettings, value string) error {
+			if strings.EqualFold(value, "none") {
+				settings.Aliases = nil
+				return nil
+			}
+
+			aliases, err := parseAliases(settings.Prefix, value)
+			if err != nil {
+				return err
+			}
+			settings.Aliases = aliases
+
+			return nil
+		},
+	},
+	{
+		Key:         "locale",
+		Description: fmt.Sprintf("language of the bot's replies, one of %s", strings.Join(Locales(), ", ")),
+		get: func(settings storage.ChannelSettings) string {
+			return settings.Locale
+		},
+		set: func(settings *storage.ChannelSettings, value string) error {
+			value = strings.ToLower(value)
+			if !ValidLocale(value) {
+				return fmt.Errorf("locale must be one of %s", strings.Join(Locales(), ", "))
+			}
+			settings.Locale = value
+
+			return nil
+		},
+	},
+	boolSetting("announce.start", "announce in chat when the streamer's race starts", func(settings *storage.ChannelSettings) *bool {
+		return &settings.AnnounceStart
+	}),
+	boolSetting("announce.finish", "announce in chat when the streamer finishes", func(settings *storage.ChannelSettings) *bool {
+		return &settings.AnnounceFinish
+	}),
+	boolSetting("announce.results", "announce the results in chat once the race ends", func(settings *storage.ChannelSettings) *bool {
+		return &settings.AnnounceResults
+	}),
+	{
+		Key:         "multistream.provider",
+		Description: fmt.Sprintf("site multi links to, one of %s", strings.Join(MultistreamProviders(), ", ")),
+		get: func(settings storage.ChannelSettings) string {
+			if settings.MultistreamProvider == "" {
+				return MultiTwitch
+			}
+
+			return settings.MultistreamProvider
+		},
+		set: func(settings *storage.ChannelSettings, value string) error {
+			value = strings.ToLower(value)
+			if !ValidMultistreamProvider(value) {
+				return fmt.Errorf("provider must be one of %s", strings.Join(MultistreamProviders(), ", "))
+			}
+			settings.MultistreamProvider = value
+
+			return nil
+		},
+	},
+	boolSetting("multistream.hide_finished", "leave racers who have finished out of multi", func(settings *storage.ChannelSettings) *bool {
+		return &settings.MultiHideFinished
+	}),
+	{
+		Key:         "cooldown",
+		Description: "how long each command waits before it is answered again, such as 30s",
+		get: func(settings storage.ChannelSettings) string {
+			return settings.CommandCooldown.String()
+		},
+		set: func(settings *storage.ChannelSettings, value string) error {
+			if value == "0" {
+				settings.CommandCooldown = 0
+				return nil
+			}
+
+			cooldown, err := time.ParseDuration(value)
+			if err != nil || cooldown < 0 || cooldown > MaxCommandCooldown {
+				return fmt.Errorf("cooldown must be a duration between 0s and %s", MaxCommandCooldown)
+			}
+			settings.CommandCooldown = cooldown
+
+			return nil
+		},
+	},
+	boolSetting("marbles", "reply !play to the streamer's !play", func(settings *storage.ChannelSettings) *bool {
+		return &settings.Marbles
+	}),
+}
+
+// FindSetting looks up a setting of the schema by key
+func FindSetting(key string) (*Setting, bool) {
+	key = strings.ToLower(key)
+	for _, s := range Settings {
+		if s.Key == key {
+			return &s, true
+		}
+	}
+
+	return nil, false
+}
+
+// SettingKeys lists the key of every setting
+func SettingKeys() []string {
+	var keys []string
+	for _, s := range Settings {
+		keys = append(keys, s.Key)
+	}
+
+	return keys
+}
+
+func boolSetting(key, description string, field func(settings *storage.ChannelSettings) *bool) Setting {
+	return Setting{
+		Key:         key,
+		Description: fmt.Sprintf("%s, on or off", description),
+		get: func(settings storage.ChannelSettings) string {
+			if *field(&settings) {
+				return "on"
+			}
+
+			return "off"
+		},
+		set: func(settings *storage.ChannelSettings, value string) error {
+			switch strings.ToLower(value) {
+			case "on", "yes":
+				*field(settings) = true
+				return nil
+			case "off", "no":
+				*field(settings) = false
+				return nil
+			}
+
+			enabled, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("%s must be on or off", key)
+			}
+			*field(settings) = enabled
+
+			return nil
+		},
+	}
+}
+
+// validTrigger checks what starts a command, a prefix or an alias, can be typed in chat
+func validTrigger(kind, value string) error {
+	if !strings.HasPrefix(value, "!") || len(value) < 2 || len(value) > 20 || strings.ContainsAny(value, " \t=,") {
+		return fmt.Errorf("%s %s must start with ! and be 2 to 20 characters without spaces", kind, value)
+	}
+	if reservedCommands[value] {
+		return fmt.Errorf("%s %s is taken by another command", kind, value)
+	}
+
+	return nil
+}
+
+// parseAliases reads a list of alias=command pairs, rejecting aliases
+// which collide with the prefix or with each other
+func parseAliases(prefix, value string) (map[string]string, error) {
+	aliases := map[string]string{}
+	for _, pair := range strings.FieldsFunc(strings.ToLower(value), func(r rune) bool {
+		return r == ',' || r == ' '
+	}) {
+		i := strings.Index(pair, "=")
+		if i == -1 {
+			return nil, fmt.Errorf("alias %s must be written as alias=command, such as !perma=perma", pair)
+		}
+		alias, command := pair[:i], pair[i+1:]
+
+		err := validTrigger("alias", alias)
+		if err != nil {
+			return nil, err
+		}
+		if alias == prefix {
+			return nil, fmt.Errorf("alias %s collides with the prefix", alias)
+		}
+		if !knownCommand(command) {
+			return nil, fmt.Errorf("unknown command %s, commands are %s", command, strings.Join(Commands, ", "))
+		}
+		if other, ok := aliases[alias]; ok && other != command {
+			return nil, fmt.Errorf("alias %s is given to both %s and %s", alias, other, command)
+		}
+		aliases[alias] = command
+	}
+	if len(aliases) == 0 {
+		return nil, fmt.Errorf("give at least one alias=command, or none")
+	}
+
+	return aliases, nil
+}
+
+func knownCommand(command string) bool {
+	for _, c := range Commands {
+		if c == command {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ParseCommand finds the command a chat message runs in a channel, either
+// after the channel's prefix or through one of its aliases, returning the
+// command and its arguments. A prefix alone runs no command.
+func ParseCommand(settings storage.ChannelSettings, message string) ([]string, bool) {
+	fields := strings.Fields(message)
+	if len(fields) == 0 {
+		return nil, false
+	}
+
+	first := strings.ToLower(fields[0])
+	if first == settings.Prefix {
+		return fields[1:], true
+	}
+	if command, ok := settings.Aliases[first]; ok {
+		return append([]string{command}, fields[1:]...), true
+	}
+
+	return nil, false
+}
+
+// parseCommands reads a list of commands separated by commas or spaces
+func parseCommands(value string) ([]string, error) {
+	seen := map[string]bool{}
+	var commands []string
+	for _, c := range strings.FieldsFunc(strings.ToLower(value), func(r rune) bool {
+		return r == ',' || r == ' '
+	}) {
+		if !knownCommand(c) {
+			return nil, fmt.Errorf("unknown command %s, commands are %s", c, strings.Join(Commands, ", "))
+		}
+		if seen[c] {
+			continue
+		}
+		seen[c] = true
+		commands = append(commands, c)
+	}
+	if len(commands) == 0 {
+		return nil, fmt.Errorf("enable all commands or at least one of %s", strings.Join(Commands, ", "))
+	}
+	sort.Strings(commands)
+
+	return commands, nil
+}
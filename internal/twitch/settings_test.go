@@ -0,0 +1,231 @@
+package twitch_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/races"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/racetime"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/storage"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/twitch"
+)
+
+func TestSettings(t *testing.T) {
+	set := func(t *testing.T, settings *storage.ChannelSettings, key, value string) error {
+		setting, ok := twitch.FindSetting(key)
+		if !ok {
+			t.Fatalf("got no setting %v, want one", key)
+		}
+
+		return setting.Set(settings, value)
+	}
+
+	t.Run("should default to the bot's prefix and locale", func(t *testing.T) {
+		settings := twitch.DefaultChannelSettings(storage.User{ID: 1})
+		if settings.Prefix != twitch.DefaultPrefix || settings.Locale != twitch.DefaultLocale || !settings.Marbles {
+			t.Errorf("got %+v, want the default settings", settings)
+		}
+	})
+
+	t.Run("should set valid values", func(t *testing.T) {
+		settings := twitch.DefaultChannelSettings(storage.User{ID: 1})
+		values := map[string]string{
+			"commands":             "multi, race perma",
+			"prefix":               "!Race",
+			"locale":               "fr",
+			"announce.finish":      "on",
+			"multistream.provider": "kadgar",
+			"cooldown":             "30s",
+			"marbles":              "false",
+		}
+		for key, value := range values {
+			err := set(t, &settings, key, value)
+			if err != nil {
+				t.Errorf("got %v setting %v to %v, want nil", err, key, value)
+			}
+		}
+
+		want := storage.ChannelSettings{
+			UserID:              1,
+			Commands:            []string{"multi", "perma", "race"},
+			Prefix:              "!race",
+			Locale:              "fr",
+			AnnounceFinish:      true,
+			MultistreamProvider: twitch.Kadgar,
+			CommandCooldown:     30 * time.Second,
+		}
+		if !reflect.DeepEqual(settings, want) {
+			t.Errorf("got %+v, want %+v", settings, want)
+		}
+	})
+
+	t.Run("should reject invalid values", func(t *testing.T) {
+		cases := map[string][]string{
+			"commands":             {"dance", ","},
+			"prefix":               {"twwr", "!", "!two words", "!" + strings.Repeat("a", 20), "!play"},
+			"aliases":              {"!race", "!race=dance", "race=race", "!twwr=race", "!play=race", "!race=race !race=vs"},
+			"locale":               {"xx"},
+			"announce.start":       {"maybe"},
+			"multistream.provider": {"youtube"},
+			"cooldown":             {"-1s", "11m", "soon"},
+		}
+		for key, values := range cases {
+			for _, value := range values {
+				settings := twitch.DefaultChannelSettings(storage.User{ID: 1})
+				err := set(t, &settings, key, value)
+				if err == nil {
+					t.Errorf("got nil setting %v to %q, want an error", key, value)
+				}
+				if !reflect.DeepEqual(settings, twitch.DefaultChannelSettings(storage.User{ID: 1})) {
+					t.Errorf("got %+v after setting %v to %q, want the settings unchanged", settings, key, value)
+				}
+			}
+		}
+	})
+
+	t.Run("should enable every command until some are chosen", func(t *testing.T) {
+		settings := storage.ChannelSettings{}
+		if got := twitch.EnabledCommands(settings); !reflect.DeepEqual(got, twitch.Commands) {
+			t.Errorf("got %v, want %v", got, twitch.Commands)
+		}
+
+		settings.Commands = []string{"race"}
+		if twitch.CommandEnabled(settings, "multi") || !twitch.CommandEnabled(settings, "race") {
+			t.Errorf("got %v enabled, want only race", twitch.EnabledCommands(settings))
+		}
+	})
+}
+
+func TestParseCommand(t *testing.T) {
+	settings := twitch.DefaultChannelSettings(storage.User{ID: 1})
+	aliases, _ := twitch.FindSetting("aliases")
+	err := aliases.Set(&settings, "!Perma=perma, !race=race")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("should run commands after the prefix or through an alias", func(t *testing.T) {
+		cases := map[string][]string{
+			"!twwr vs":       {"vs"},
+			"!TWWR race now": {"race", "now"},
+			"!twwr":          {},
+			"!perma":         {"perma"},
+			"!race please":   {"race", "please"},
+		}
+		for message, want := range cases {
+			got, ok := twitch.ParseCommand(settings, message)
+			if !ok || len(got) != len(want) || (len(want) > 0 && !reflect.DeepEqual(got, want)) {
+				t.Errorf("got %v (%v) for %q, want %v", got, ok, message, want)
+			}
+		}
+	})
+
+	t.Run("should ignore other messages", func(t *testing.T) {
+		for _, message := range []string{"", "hello !twwr", "!twwrvs", "!multi"} {
+			if got, ok := twitch.ParseCommand(settings, message); ok {
+				t.Errorf("got %v for %q, want no command", got, message)
+			}
+		}
+	})
+
+	t.Run("should not take a prefix which is already an alias", func(t *testing.T) {
+		prefix, _ := twitch.FindSetting("prefix")
+		err := prefix.Set(&settings, "!perma")
+		if err == nil {
+			t.Errorf("got nil, want an error")
+		}
+	})
+}
+
+func TestRoomCommands(t *testing.T) {
+	db := openDB(t)
+	user, err := db.CreateUser("1", "streamer", "Streamer", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	racetimeID, active := "racer", true
+	_, err = db.UpdateUser(user.ID, storage.UserUpdate{RacetimeID: &racetimeID, ActiveInChannel: &active})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.SaveChannelSettings(storage.ChannelSettings{
+		UserID:  user.ID,
+		Prefix:  "!tww",
+		Aliases: map[string]string{"!perma": "perma"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	race := racetime.RaceData{Name: "twwr/clever-link-1234"}
+	var e racetime.Entrant
+	e.User.ID = racetimeID
+	race.Entrants = append(race.Entrants, e)
+	commands := twitch.NewRoomCommands(db)
+
+	t.Run("should use the prefixes and aliases of the race's entrants", func(t *testing.T) {
+		cases := map[string]string{
+			"!tww vs":      "vs",
+			"!perma":       "perma",
+			"!twwr link 1": "link 1",
+		}
+		for message, want := range cases {
+			got, ok := commands.ResolveCommand(race, message)
+			if !ok || got != want {
+				t.Errorf("got %v for %q, want %v", got, message, want)
+			}
+		}
+	})
+
+	t.Run("should only use the default prefix in other races", func(t *testing.T) {
+		if got, ok := commands.ResolveCommand(racetime.RaceData{}, "!perma"); ok {
+			t.Errorf("got %v, want no command", got)
+		}
+	})
+}
+
+func TestAnnouncement(t *testing.T) {
+	user := storage.User{TwitchDisplayName: "Tanjo3"}
+	race := racetime.RaceData{Name: "twwr/clever-link-1234", Slug: "clever-link-1234"}
+	for i, name := range []string{"Tanjo3", "Racer"} {
+		var e racetime.Entrant
+		e.User.Name = name
+		e.Place = 2 - i
+		e.PlaceOrdinal = []string{"2nd", "1st"}[i]
+		e.FinishTime = []string{"PT1H30M5S", "PT1H20M"}[i]
+		race.Entrants = append(race.Entrants, e)
+	}
+
+	t.Run("should only announce what the channel opted into", func(t *testing.T) {
+		_, ok := twitch.Announcement(races.Change{Type: races.RaceStarted, Race: race}, user, storage.ChannelSettings{}, "https://racetime.gg")
+		if ok {
+			t.Errorf("got an announcement, want none")
+		}
+	})
+
+	t.Run("should announce in the channel's locale", func(t *testing.T) {
+		settings := storage.ChannelSettings{AnnounceStart: true, AnnounceFinish: true, AnnounceResults: true, Locale: "en"}
+		cases := []struct {
+			change races.Change
+			want   string
+		}{
+			{races.Change{Type: races.RaceStarted, Race: race}, "Tanjo3's race has started! https://racetime.gg/twwr/clever-link-1234"},
+			{races.Change{Type: races.EntrantFinished, Race: race, Entrant: &race.Entrants[0]}, "Tanjo3 finished 2nd in 1:30:05!"},
+			{races.Change{Type: races.RaceEnded, Race: race}, "results of clever-link-1234: 1st Racer (1:20:00), 2nd Tanjo3 (1:30:05)"},
+		}
+		for _, c := range cases {
+			got, ok := twitch.Announcement(c.change, user, settings, "https://racetime.gg")
+			if !ok || got != c.want {
+				t.Errorf("got %v, want %v", got, c.want)
+			}
+		}
+
+		settings.Locale = "de"
+		got, _ := twitch.Announcement(races.Change{Type: races.RaceStarted, Race: race}, user, settings, "https://racetime.gg")
+		if want := "Das Rennen von Tanjo3 hat begonnen! https://racetime.gg/twwr/clever-link-1234"; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+}
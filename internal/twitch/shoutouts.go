@@ -0,0 +1,234 @@
+package twitch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/races"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/racetime"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/storage"
+)
+
+// ScopeManageShoutouts lets the bot shout out other broadcasters for a streamer
+const ScopeManageShoutouts = "moderator:manage:shoutouts"
+
+// maxShoutoutAttempts bounds how often a shoutout twitch rejected for
+// cooldown reasons is retried before falling back to chat
+const maxShoutoutAttempts = 3
+
+var (
+	// ShoutoutInterval is how long twitch makes a channel wait between shoutouts
+	ShoutoutInterval = time.Minute * 2
+	// ShoutoutTargetCooldown is how long twitch makes a channel wait before
+	// shouting out the same broadcaster again
+	ShoutoutTargetCooldown = time.Hour
+)
+
+// Chat sends messages to twitch chat
+type Chat interface {
+	Say(channel, message string)
+}
+
+// shoutout is an opponent queued to be shouted out in a streamer's channel
+type shoutout struct {
+	login       string
+	displayName string
+	id          string
+	attempts    int
+}
+
+// Shoutouts shouts out the live opponents of opted in streamers once their
+// race finishes, spacing shoutouts out to respect twitch's cooldowns
+type Shoutouts struct {
+	api    *ApiClient
+	tokens *UserTokens
+	db     storage.Store
+	chat   Chat
+	mut    sync.Mutex
+	queues map[uint64][]shoutout
+	// draining is the channels with a goroutine sending their queued shoutouts
+	draining map[uint64]bool
+	// last is when each channel last shouted out, and each channel and target pair
+	last       map[uint64]time.Time
+	lastTarget map[string]time.Time
+}
+
+// NewShoutouts creates a shoutout queue, which falls back to chat messages
+// when twitch does not permit a shoutout
+func NewShoutouts(api *ApiClient, tokens *UserTokens, db storage.Store, chat Chat) *Shoutouts {
+	return &Shoutouts{
+		api:        api,
+		tokens:     tokens,
+		db:         db,
+		chat:       chat,
+		queues:     map[uint64][]shoutout{},
+		draining:   map[uint64]bool{},
+		last:       map[uint64]time.Time{},
+		lastTarget: map[string]time.Time{},
+	}
+}
+
+// Run queues shoutouts for races which finished between the race lists
+// received from the listener until the context ends
+func (s *Shoutouts) Run(ctx context.Context, listener <-chan []racetime.RaceData) {
+	races.WatchChanges(ctx, listener, func(change races.Change) {
+		if change.Type != races.RaceEnded || change.Race.Status.Value == racetime.StatusCancelled {
+			return
+		}
+
+		var streamers []*storage.User
+		for _, user := range linkedStreamers(s.db, change) {
+			if user.Shoutouts {
+				streamers = append(streamers, user)
+			}
+		}
+		if len(streamers) == 0 {
+			return
+		}
+
+		live, err := liveStreams(s.api, change.Race.Entrants)
+		if err != nil {
+			log.Printf("shoutouts: looking up live opponents: %s", err)
+			return
+		}
+
+		for _, user := range streamers {
+			s.Enqueue(ctx, *user, Opponents(*user, change.Race, live))
+		}
+	})
+}
+
+// Opponents lists the live opponents of a streamer in a race
+func Opponents(streamer storage.User, race racetime.RaceData, live map[string]Stream) []Stream {
+	var opponents []Stream
+	for _, e := range race.Entrants {
+		// skip the streamer
+		if e.User.ID == streamer.RacetimeID || e.User.TwitchName == "" {
+			continue
+		}
+
+		stream, ok := live[strings.ToLower(e.User.TwitchName)]
+		if ok {
+			opponents = append(opponents, stream)
+		}
+	}
+
+	return opponents
+}
+
+// Enqueue queues shoutouts of the opponents in a streamer's channel, sending
+// them one at a time as the channel's cooldown allows
+func (s *Shoutouts) Enqueue(ctx context.Context, user storage.User, opponents []Stream) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	for _, o := range opponents {
+		s.queues[user.ID] = append(s.queues[user.ID], shoutout{
+			login:       o.UserLogin,
+			displayName: o.UserName,
+			id:          o.UserID,
+		})
+	}
+
+	if !s.draining[user.ID] && len(s.queues[user.ID]) > 0 {
+		s.draining[user.ID] = true
+		go s.drain(ctx, user)
+	}
+}
+
+// drain sends the shoutouts queued for a streamer until none are left. Only
+// one drain runs per channel, marked as draining by Enqueue until it returns.
+func (s *Shoutouts) drain(ctx context.Context, user storage.User) {
+	for {
+		s.mut.Lock()
+		queue := s.queues[user.ID]
+		if len(queue) == 0 {
+			delete(s.queues, user.ID)
+			delete(s.draining, user.ID)
+			s.mut.Unlock()
+			return
+		}
+		next := queue[0]
+		wait := time.Until(s.last[user.ID].Add(ShoutoutInterval))
+		recent := time.Since(s.lastTarget[targetKey(user.ID, next.id)]) < ShoutoutTargetCooldown
+		s.mut.Unlock()
+
+		done := true
+		if !recent {
+			select {
+			case <-ctx.Done():
+				s.mut.Lock()
+				delete(s.draining, user.ID)
+				s.mut.Unlock()
+				return
+			case <-time.After(wait):
+			}
+
+			done = s.send(user, next)
+		}
+
+		s.mut.Lock()
+		if done {
+			s.queues[user.ID] = s.queues[user.ID][1:]
+		} else {
+			s.queues[user.ID][0].attempts++
+		}
+		s.mut.Unlock()
+	}
+}
+
+// send shouts out the target, reporting false when twitch asked to wait
+// for a cooldown and the shoutout should be tried again
+func (s *Shoutouts) send(user storage.User, target shoutout) bool {
+	err := s.shoutout(user, target)
+
+	var status *StatusError
+	if errors.As(err, &status) && status.StatusCode == http.StatusTooManyRequests && target.attempts+1 < maxShoutoutAttempts {
+		log.Printf("shoutouts: %s is on cooldown, retrying shoutout of %s later", user.TwitchName, target.login)
+		s.mut.Lock()
+		s.last[user.ID] = time.Now()
+		s.mut.Unlock()
+
+		return false
+	}
+
+	if err != nil {
+		log.Printf("shoutouts: shouting out %s for %s, falling back to chat: %s", target.login, user.TwitchName, err)
+		s.chat.Say(user.TwitchName, fmt.Sprintf("GG! Go check out %s at %s/%s", target.displayName, URL, target.login))
+	} else {
+		log.Printf("shoutouts: shouted out %s for %s", target.login, user.TwitchName)
+	}
+
+	now := time.Now()
+	s.mut.Lock()
+	s.last[user.ID] = now
+	s.lastTarget[targetKey(user.ID, target.id)] = now
+	s.mut.Unlock()
+
+	return true
+}
+
+// shoutout sends a shoutout through the api, returning an error when it can't
+// be sent so the caller can fall back to chat
+func (s *Shoutouts) shoutout(user storage.User, target shoutout) error {
+	if !s.tokens.HasScopes(user, ScopeManageShoutouts) {
+		return fmt.Errorf("%s has not been granted", ScopeManageShoutouts)
+	}
+
+	token, err := s.tokens.AccessToken(user.ID)
+	if err != nil {
+		return err
+	}
+
+	return s.api.SendShoutout(token, user.TwitchID, target.id)
+}
+
+func targetKey(userID uint64, targetID string) string {
+	return fmt.Sprintf("%d:%s", userID, targetID)
+}
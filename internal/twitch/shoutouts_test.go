@@ -0,0 +1,118 @@
+package twitch_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/config"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/storage"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/twitch"
+)
+
+type fakeChat struct {
+	mut      sync.Mutex
+	messages []string
+}
+
+func (c *fakeChat) Say(channel, message string) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.messages = append(c.messages, channel+": "+message)
+}
+
+func TestShoutouts(t *testing.T) {
+	interval := twitch.ShoutoutInterval
+	twitch.ShoutoutInterval = time.Millisecond * 20
+	t.Cleanup(func() {
+		twitch.ShoutoutInterval = interval
+	})
+
+	var mut sync.Mutex
+	var sent []time.Time
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mut.Lock()
+		defer mut.Unlock()
+
+		switch r.URL.Path {
+		case "/token":
+			json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "app", "expires_in": 3600})
+		case "/helix/chat/shoutouts":
+			if r.URL.Query().Get("to_broadcaster_id") == "forbidden" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			sent = append(sent, time.Now())
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer srv.Close()
+
+	conf := config.Twitch{
+		APIURL:   srv.URL + "/helix",
+		TokenURL: srv.URL + "/token",
+	}
+	api, err := twitch.NewApiClient(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := openDB(t)
+	user, err := db.CreateUser("1234", "tanjo3", "Tanjo3", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.SaveTwitchToken(user.ID, storage.OAuthToken{AccessToken: "user", Scopes: []string{twitch.ScopeManageShoutouts}, ExpiresAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, _ = db.FindUser(storage.Where(storage.FieldID).Eq(user.ID))
+
+	chat := &fakeChat{}
+	shoutouts := twitch.NewShoutouts(api, twitch.NewUserTokens(conf, db), db, chat)
+	shoutouts.Enqueue(context.Background(), *user, []twitch.Stream{
+		{UserID: "1", UserLogin: "racer1", UserName: "Racer1"},
+		{UserID: "forbidden", UserLogin: "racer2", UserName: "Racer2"},
+		{UserID: "1", UserLogin: "racer1", UserName: "Racer1"},
+		{UserID: "3", UserLogin: "racer3", UserName: "Racer3"},
+	})
+
+	// the queue is drained once both shoutouts and the chat fallback are out
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		mut.Lock()
+		chat.mut.Lock()
+		done := len(sent) >= 2 && len(chat.messages) >= 1
+		chat.mut.Unlock()
+		mut.Unlock()
+		if done || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	mut.Lock()
+	defer mut.Unlock()
+	chat.mut.Lock()
+	defer chat.mut.Unlock()
+
+	t.Run("should space shoutouts out and skip targets on cooldown", func(t *testing.T) {
+		if len(sent) != 2 {
+			t.Fatalf("got %v shoutouts, want %v", len(sent), 2)
+		}
+		if gap := sent[1].Sub(sent[0]); gap < twitch.ShoutoutInterval*2 {
+			t.Errorf("got %v between shoutouts, want at least %v", gap, twitch.ShoutoutInterval*2)
+		}
+	})
+
+	t.Run("should fall back to chat when the shoutout is not permitted", func(t *testing.T) {
+		want := "tanjo3: GG! Go check out Racer2 at https://twitch.tv/racer2"
+		if len(chat.messages) != 1 || chat.messages[0] != want {
+			t.Errorf("got %v, want [%v]", chat.messages, want)
+		}
+	})
+}
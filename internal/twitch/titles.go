@@ -0,0 +1,196 @@
+package twitch
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/races"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/racetime"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/storage"
+)
+
+const (
+	// DefaultTitleTemplate is used by channels which opt in without a template of their own
+	DefaultTitleTemplate = "TWW Rando {preset} race vs {opponents} | !twwr"
+	// WindWakerGame is the category streams are set to while racing
+	WindWakerGame = "The Legend of Zelda: The Wind Waker"
+)
+
+// Titles sets the stream title and category of opted in streamers while they
+// race, restoring what they had before once they leave or the race ends
+type Titles struct {
+	api    *ApiClient
+	tokens *UserTokens
+	db     storage.Store
+	mut    sync.Mutex
+	gameID string
+}
+
+// NewTitles creates a stream title tracker
+func NewTitles(api *ApiClient, tokens *UserTokens, db storage.Store) *Titles {
+	return &Titles{
+		api:    api,
+		tokens: tokens,
+		db:     db,
+	}
+}
+
+// Run updates stream titles as streamers join, start and leave races between
+// the race lists received from the listener until the context ends
+func (t *Titles) Run(ctx context.Context, listener <-chan []racetime.RaceData) {
+	races.WatchChanges(ctx, listener, t.handle)
+}
+
+func (t *Titles) handle(change races.Change) {
+	switch change.Type {
+	// titles are set again once the race starts, as opponents may have joined since
+	case races.EntrantJoined, races.RaceStarted:
+		for _, user := range linkedStreamers(t.db, change) {
+			t.apply(*user, change.Race)
+		}
+	case races.EntrantLeft, races.RaceEnded:
+		for _, user := range linkedStreamers(t.db, change) {
+			t.restore(*user, change.Race)
+		}
+	}
+}
+
+func (t *Titles) apply(user storage.User, race racetime.RaceData) {
+	if !user.AutoTitle || !t.tokens.HasScopes(user, ScopeManageBroadcast) {
+		return
+	}
+
+	state, err := t.db.FindChannelState(user.ID)
+	if err != nil {
+		if err != storage.ErrNotFound {
+			log.Printf("titles: %s", err)
+			return
+		}
+
+		state = &storage.ChannelState{
+			UserID:   user.ID,
+			TwitchID: user.TwitchID,
+		}
+	}
+
+	// keep the title from before the first race, not one the bot set
+	if state.TitleRace == "" {
+		info, err := t.api.GetChannelInformation(user.TwitchID)
+		if err != nil {
+			log.Printf("titles: %s", err)
+			return
+		}
+
+		state.OriginalTitle = info.Title
+		state.OriginalGameID = info.GameID
+	}
+
+	gameID, err := t.game()
+	if err != nil {
+		log.Printf("titles: %s", err)
+	}
+
+	token, err := t.tokens.AccessToken(user.ID)
+	if err != nil {
+		log.Printf("titles: token for %s: %s", user.TwitchName, err)
+		return
+	}
+
+	title := RenderTitle(user.TitleTemplate, user, race)
+	err = t.api.ModifyChannelInformation(token, user.TwitchID, title, gameID)
+	if err != nil {
+		log.Printf("titles: setting title of %s: %s", user.TwitchName, err)
+		return
+	}
+	log.Printf("titles: set title of %s to %q", user.TwitchName, title)
+
+	state.TitleRace = race.Slug
+	_, err = t.db.SaveChannelState(*state)
+	if err != nil {
+		log.Printf("titles: %s", err)
+	}
+}
+
+func (t *Titles) restore(user storage.User, race racetime.RaceData) {
+	state, err := t.db.FindChannelState(user.ID)
+	if err != nil || state.TitleRace != race.Slug {
+		return
+	}
+
+	token, err := t.tokens.AccessToken(user.ID)
+	if err != nil {
+		log.Printf("titles: token for %s: %s", user.TwitchName, err)
+		return
+	}
+
+	err = t.api.ModifyChannelInformation(token, user.TwitchID, state.OriginalTitle, state.OriginalGameID)
+	if err != nil {
+		log.Printf("titles: restoring title of %s: %s", user.TwitchName, err)
+		return
+	}
+	log.Printf("titles: restored title of %s to %q", user.TwitchName, state.OriginalTitle)
+
+	state.TitleRace = ""
+	state.OriginalTitle = ""
+	state.OriginalGameID = ""
+	_, err = t.db.SaveChannelState(*state)
+	if err != nil {
+		log.Printf("titles: %s", err)
+	}
+}
+
+// game looks up the id of the wind waker category once
+func (t *Titles) game() (string, error) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	if t.gameID != "" {
+		return t.gameID, nil
+	}
+
+	game, err := t.api.GetGame(WindWakerGame)
+	if err != nil {
+		return "", err
+	}
+	t.gameID = game.ID
+
+	return t.gameID, nil
+}
+
+// RenderTitle fills a title template with the race a streamer is in. Templates
+// may use {preset}, {goal}, {race} for the race slug and {opponents}.
+func RenderTitle(template string, streamer storage.User, race racetime.RaceData) string {
+	if template == "" {
+		template = DefaultTitleTemplate
+	}
+
+	preset := races.ExtractPreset(race)
+	if preset == "" {
+		preset = race.Goal.Name
+	}
+
+	var opponents []string
+	for _, e := range race.Entrants {
+		if e.User.ID == streamer.RacetimeID {
+			continue
+		}
+
+		if e.User.TwitchDisplayName != "" {
+			opponents = append(opponents, e.User.TwitchDisplayName)
+		} else {
+			opponents = append(opponents, e.User.Name)
+		}
+	}
+	if len(opponents) == 0 {
+		opponents = []string{"TBD"}
+	}
+
+	return strings.NewReplacer(
+		"{preset}", preset,
+		"{goal}", race.Goal.Name,
+		"{race}", race.Slug,
+		"{opponents}", strings.Join(opponents, ", "),
+	).Replace(template)
+}
@@ -0,0 +1,38 @@
+package twitch_test
+
+import (
+	"testing"
+
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/racetime"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/storage"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/twitch"
+)
+
+func TestRenderTitle(t *testing.T) {
+	streamer := storage.User{RacetimeID: "streamer"}
+	race := racetime.RaceData{Slug: "clever-link-1234"}
+	race.Goal.Name = "Standard Race"
+	race.InfoUser = "s4"
+	for _, id := range []string{"streamer", "tanjo3"} {
+		var e racetime.Entrant
+		e.User.ID = id
+		e.User.TwitchDisplayName = id
+		race.Entrants = append(race.Entrants, e)
+	}
+
+	t.Run("should fill the default template", func(t *testing.T) {
+		got := twitch.RenderTitle("", streamer, race)
+		want := "TWW Rando s4 race vs tanjo3 | !twwr"
+		if got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("should fill a channel's own template", func(t *testing.T) {
+		got := twitch.RenderTitle("{goal} {race}", streamer, race)
+		want := "Standard Race clever-link-1234"
+		if got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+}
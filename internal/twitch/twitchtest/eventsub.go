@@ -0,0 +1,123 @@
+// Package twitchtest provides fakes of Twitch services for tests
+package twitchtest
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/twitch"
+	"github.com/google/uuid"
+)
+
+// EventSub sends EventSub webhook messages to a callback, signing
+// them with the subscription secret the same way Twitch does
+type EventSub struct {
+	Secret      string
+	CallbackURL string
+	Client      *http.Client
+	// Now stamps messages, defaulting to time.Now
+	Now func() time.Time
+}
+
+// Message is a single webhook delivery. Resending a message
+// reuses its id, as Twitch does when it retries a delivery.
+type Message struct {
+	ID   string
+	Type string
+	Body []byte
+}
+
+// NewEventSub creates a fake which delivers messages to callbackURL
+func NewEventSub(secret, callbackURL string) *EventSub {
+	return &EventSub{
+		Secret:      secret,
+		CallbackURL: callbackURL,
+		Client:      http.DefaultClient,
+		Now:         time.Now,
+	}
+}
+
+// Verification builds the challenge Twitch sends when a subscription is created
+func (f *EventSub) Verification(subscriptionType, broadcasterID, challenge string) Message {
+	return f.message(twitch.EventSubVerification, map[string]interface{}{
+		"challenge":    challenge,
+		"subscription": subscription(subscriptionType, broadcasterID, "webhook_callback_verification_pending"),
+	})
+}
+
+// StreamOnline builds a stream.online notification
+func (f *EventSub) StreamOnline(broadcasterID, login string) Message {
+	return f.message(twitch.EventSubNotification, map[string]interface{}{
+		"subscription": subscription(twitch.SubscriptionStreamOnline, broadcasterID, "enabled"),
+		"event": map[string]interface{}{
+			"id":                     uuid.New().String(),
+			"broadcaster_user_id":    broadcasterID,
+			"broadcaster_user_login": login,
+			"broadcaster_user_name":  login,
+			"type":                   "live",
+			"started_at":             f.Now().UTC().Format(time.RFC3339),
+		},
+	})
+}
+
+// StreamOffline builds a stream.offline notification
+func (f *EventSub) StreamOffline(broadcasterID, login string) Message {
+	return f.message(twitch.EventSubNotification, map[string]interface{}{
+		"subscription": subscription(twitch.SubscriptionStreamOffline, broadcasterID, "enabled"),
+		"event": map[string]interface{}{
+			"broadcaster_user_id":    broadcasterID,
+			"broadcaster_user_login": login,
+			"broadcaster_user_name":  login,
+		},
+	})
+}
+
+// Send delivers a message to the callback, signed with the fake's secret
+func (f *EventSub) Send(m Message) (*http.Response, error) {
+	return f.SendSigned(m, f.Secret)
+}
+
+// SendSigned delivers a message signed with an arbitrary secret
+func (f *EventSub) SendSigned(m Message, secret string) (*http.Response, error) {
+	timestamp := f.Now().UTC().Format(time.RFC3339Nano)
+
+	req, err := http.NewRequest("POST", f.CallbackURL, bytes.NewReader(m.Body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(twitch.EventSubMessageID, m.ID)
+	req.Header.Set(twitch.EventSubMessageTimestamp, timestamp)
+	req.Header.Set(twitch.EventSubMessageType, m.Type)
+	req.Header.Set(twitch.EventSubMessageSignature, twitch.SignEventSub(secret, m.ID, timestamp, m.Body))
+
+	return f.Client.Do(req)
+}
+
+func (f *EventSub) message(messageType string, payload interface{}) Message {
+	body, _ := json.Marshal(payload)
+
+	return Message{
+		ID:   uuid.New().String(),
+		Type: messageType,
+		Body: body,
+	}
+}
+
+func subscription(subscriptionType, broadcasterID, status string) map[string]interface{} {
+	return map[string]interface{}{
+		"id":      uuid.New().String(),
+		"status":  status,
+		"type":    subscriptionType,
+		"version": "1",
+		"condition": map[string]string{
+			"broadcaster_user_id": broadcasterID,
+		},
+		"transport": map[string]string{
+			"method": "webhook",
+		},
+		"created_at": time.Now().UTC().Format(time.RFC3339Nano),
+	}
+}
@@ -0,0 +1,173 @@
+package twitch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/config"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/storage"
+)
+
+// ErrTokenRevoked is returned when twitch no longer accepts a streamer's
+// refresh token, and the streamer must log in again
+var ErrTokenRevoked = errors.New("twitch token has been revoked, the streamer must log in again")
+
+// UserTokens hands out the tokens streamers have granted the bot,
+// refreshing them before they expire
+type UserTokens struct {
+	config config.Twitch
+	client http.Client
+	db     storage.Store
+	mut    sync.Mutex
+}
+
+// NewUserTokens creates a token store for streamer tokens
+func NewUserTokens(conf config.Twitch, db storage.Store) *UserTokens {
+	return &UserTokens{
+		config: conf,
+		db:     db,
+	}
+}
+
+// AccessToken returns a streamer's access token, renewing it first if it is
+// about to expire. storage.ErrNotFound is returned when none has been granted.
+func (t *UserTokens) AccessToken(userID uint64) (string, error) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	token, err := t.db.FindTwitchToken(userID)
+	if err != nil {
+		return "", err
+	}
+
+	if time.Now().Add(tokenRefreshMargin).Before(token.ExpiresAt) {
+		return token.AccessToken, nil
+	}
+
+	refreshed, err := t.refresh(*token)
+	if err != nil {
+		if err == ErrTokenRevoked {
+			_ = t.db.DeleteTwitchToken(userID)
+		}
+
+		return "", err
+	}
+
+	_, err = t.db.SaveTwitchToken(userID, *refreshed)
+	if err != nil {
+		return "", err
+	}
+
+	return refreshed.AccessToken, nil
+}
+
+// HasScopes reports whether a streamer has granted the bot every scope
+func (t *UserTokens) HasScopes(user storage.User, scopes ...string) bool {
+	granted := map[string]bool{}
+	for _, s := range user.TwitchScopes {
+		granted[s] = true
+	}
+
+	for _, s := range scopes {
+		if !granted[s] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Revoke invalidates a streamer's token with twitch and forgets it
+func (t *UserTokens) Revoke(userID uint64) error {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	token, err := t.db.FindTwitchToken(userID)
+	if err != nil {
+		return err
+	}
+
+	form := url.Values{
+		"client_id": []string{t.config.ClientID},
+		"token":     []string{token.AccessToken},
+	}
+	res, err := t.client.PostForm(t.config.RevokeURL, form)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	// a 400 means twitch had already invalidated the token
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusBadRequest {
+		return fmt.Errorf("status code %v while revoking twitch token", res.StatusCode)
+	}
+
+	return t.db.DeleteTwitchToken(userID)
+}
+
+func (t *UserTokens) refresh(token storage.OAuthToken) (*storage.OAuthToken, error) {
+	form := url.Values{
+		"client_id":     []string{t.config.ClientID},
+		"client_secret": []string{t.config.ClientSecret},
+		"grant_type":    []string{"refresh_token"},
+		"refresh_token": []string{token.RefreshToken},
+	}
+	res, err := t.client.PostForm(t.config.TokenURL, form)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusBadRequest || res.StatusCode == http.StatusUnauthorized {
+		return nil, ErrTokenRevoked
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return nil, fmt.Errorf("status code %v while refreshing twitch token", res.StatusCode)
+	}
+
+	var grant TokenGrant
+	err = json.NewDecoder(res.Body).Decode(&grant)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding refreshed twitch token: %w", err)
+	}
+
+	return grant.Token(), nil
+}
+
+// TokenGrant is the token response of the twitch oauth endpoints
+type TokenGrant struct {
+	AccessToken  string   `json:"access_token"`
+	RefreshToken string   `json:"refresh_token"`
+	ExpiresIn    int      `json:"expires_in"`
+	Scope        []string `json:"scope"`
+	IDToken      string   `json:"id_token"`
+}
+
+// Token converts the grant into a token for storage
+func (g TokenGrant) Token() *storage.OAuthToken {
+	return &storage.OAuthToken{
+		AccessToken:  g.AccessToken,
+		RefreshToken: g.RefreshToken,
+		Scopes:       g.Scope,
+		ExpiresAt:    time.Now().Add(time.Duration(g.ExpiresIn) * time.Second),
+	}
+}
+
+// LoginScopes are the scopes requested from streamers, always including openid
+// as the bot identifies streamers by their id token
+func LoginScopes(conf config.Twitch) []string {
+	scopes := []string{"openid"}
+	for _, s := range conf.Scopes {
+		if !strings.EqualFold(s, "openid") {
+			scopes = append(scopes, s)
+		}
+	}
+
+	return scopes
+}
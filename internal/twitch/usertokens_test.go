@@ -0,0 +1,154 @@
+package twitch_test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/config"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/storage"
+	"github.com/TBPixel/tww-rando-twitch-bot/internal/twitch"
+)
+
+func openDB(t *testing.T) storage.Store {
+	db, err := storage.Open(config.DB{
+		Driver:        storage.DriverMemory,
+		EncryptionKey: base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef")),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+	})
+
+	return db
+}
+
+func TestUserTokens(t *testing.T) {
+	var revoked []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		switch r.URL.Path {
+		case "/token":
+			if r.Form.Get("refresh_token") != "refresh-1" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			json.NewEncoder(w).Encode(twitch.TokenGrant{
+				AccessToken:  "access-2",
+				RefreshToken: "refresh-2",
+				ExpiresIn:    3600,
+				Scope:        []string{"openid", "channel:manage:broadcast"},
+			})
+		case "/revoke":
+			revoked = append(revoked, r.Form.Get("token"))
+		}
+	}))
+	defer srv.Close()
+
+	db := openDB(t)
+	user, err := db.CreateUser("1234", "tanjo3", "Tanjo3", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokens := twitch.NewUserTokens(config.Twitch{
+		TokenURL:  srv.URL + "/token",
+		RevokeURL: srv.URL + "/revoke",
+	}, db)
+
+	t.Run("should store tokens encrypted on the user", func(t *testing.T) {
+		_, err := db.SaveTwitchToken(user.ID, storage.OAuthToken{
+			AccessToken:  "access-1",
+			RefreshToken: "refresh-1",
+			Scopes:       []string{"openid"},
+			ExpiresAt:    time.Now().Add(time.Hour),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := db.FindUser(storage.Where(storage.FieldID).Eq(user.ID))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got.TwitchToken) == 0 || string(got.TwitchToken) == "access-1" {
+			t.Errorf("got %q, want an encrypted token", got.TwitchToken)
+		}
+
+		token, err := tokens.AccessToken(user.ID)
+		if err != nil || token != "access-1" {
+			t.Errorf("got %v %v, want %v", token, err, "access-1")
+		}
+	})
+
+	t.Run("should refresh tokens which are about to expire", func(t *testing.T) {
+		_, err := db.SaveTwitchToken(user.ID, storage.OAuthToken{
+			AccessToken:  "access-1",
+			RefreshToken: "refresh-1",
+			Scopes:       []string{"openid"},
+			ExpiresAt:    time.Now().Add(time.Minute),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		token, err := tokens.AccessToken(user.ID)
+		if err != nil || token != "access-2" {
+			t.Errorf("got %v %v, want %v", token, err, "access-2")
+		}
+
+		got, _ := db.FindUser(storage.Where(storage.FieldID).Eq(user.ID))
+		if !tokens.HasScopes(*got, "channel:manage:broadcast") {
+			t.Errorf("got scopes %v, want channel:manage:broadcast", got.TwitchScopes)
+		}
+	})
+
+	t.Run("should forget tokens twitch will no longer refresh", func(t *testing.T) {
+		_, err := db.SaveTwitchToken(user.ID, storage.OAuthToken{
+			AccessToken:  "access-2",
+			RefreshToken: "refresh-2",
+			ExpiresAt:    time.Now(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = tokens.AccessToken(user.ID)
+		if err != twitch.ErrTokenRevoked {
+			t.Errorf("got %v, want %v", err, twitch.ErrTokenRevoked)
+		}
+
+		_, err = db.FindTwitchToken(user.ID)
+		if err != storage.ErrNotFound {
+			t.Errorf("got %v, want %v", err, storage.ErrNotFound)
+		}
+	})
+
+	t.Run("should revoke tokens on unlink", func(t *testing.T) {
+		_, err := db.SaveTwitchToken(user.ID, storage.OAuthToken{
+			AccessToken: "access-3",
+			ExpiresAt:   time.Now().Add(time.Hour),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = tokens.Revoke(user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(revoked) != 1 || revoked[0] != "access-3" {
+			t.Errorf("got %v, want [access-3]", revoked)
+		}
+
+		_, err = db.FindTwitchToken(user.ID)
+		if err != storage.ErrNotFound {
+			t.Errorf("got %v, want %v", err, storage.ErrNotFound)
+		}
+	})
+}